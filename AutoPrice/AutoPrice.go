@@ -9,7 +9,14 @@ import (
 	"time"
 )
 
-func Start(C string) (float64, error) {
+// OKX OKX C2C 快捷交易卖出价
+type OKX struct{}
+
+func (OKX) Name() string {
+	return "okx"
+}
+
+func (OKX) Price(C string) (float64, error) {
 
 	client := http.Client{
 		Timeout: 10 * time.Second,
@@ -22,7 +29,7 @@ func Start(C string) (float64, error) {
 		}, */
 	}
 
-	url := fmt.Sprintf("https://www.okx.com/v4/c2c/express/price?crypto=%s&fiat=%s&side=sell", C, "CNY")
+	url := fmt.Sprintf("https://www.okx.com/v4/c2c/express/price?crypto=%s&fiat=%s&side=sell", C, Fiat)
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -45,8 +52,10 @@ func Start(C string) (float64, error) {
 	}
 
 	// 字符串转为float64
-
-	a, _ := strconv.ParseFloat(respData.Data.Price, 64)
+	a, err := strconv.ParseFloat(respData.Data.Price, 64)
+	if err != nil {
+		return 0, fmt.Errorf("okx 返回的价格无法解析: %q %s", respData.Data.Price, respData.Msg)
+	}
 	return a, nil
 
 }
@@ -0,0 +1,73 @@
+package Autoprice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Binance 币安 P2P 广告列表中的最优卖出价
+type Binance struct{}
+
+func (Binance) Name() string {
+	return "binance"
+}
+
+func (Binance) Price(C string) (float64, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"asset":     C,
+		"fiat":      Fiat,
+		"tradeType": "SELL",
+		"page":      1,
+		"rows":      5,
+		"payTypes":  []string{},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", "https://p2p.binance.com/bapi/c2c/v2/friendly/c2c/adv/search", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("binance 返回错误状态码: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	var respData binanceResponse
+	if err := json.Unmarshal(body, &respData); err != nil {
+		return 0, err
+	}
+	if len(respData.Data) == 0 {
+		return 0, fmt.Errorf("binance 没有返回 %s 的广告: %s", C, respData.Message)
+	}
+
+	return strconv.ParseFloat(respData.Data[0].Adv.Price, 64)
+}
+
+type binanceResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Data    []struct {
+		Adv struct {
+			Price string `json:"price"`
+		} `json:"adv"`
+	} `json:"data"`
+}
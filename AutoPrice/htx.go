@@ -0,0 +1,71 @@
+package Autoprice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTX 火币 OTC 广告列表中的最优卖出价
+type HTX struct{}
+
+// htxCoinIds HTX OTC 接口使用数字币种编号，目前只开放了 USDT
+var htxCoinIds = map[string]int{
+	"USDT": 2,
+}
+
+// htxCNY HTX OTC 接口中人民币的编号
+const htxCNY = 1
+
+func (HTX) Name() string {
+	return "htx"
+}
+
+func (HTX) Price(C string) (float64, error) {
+	coinId, ok := htxCoinIds[C]
+	if !ok {
+		return 0, fmt.Errorf("htx 不支持币种 %s", C)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+
+	url := fmt.Sprintf("https://www.htx.com/-/x/otc/v1/data/trade-market?coinId=%d&currency=%d&tradeType=sell&currPage=1&payMethod=0&acceptOrder=0&blockType=general&online=1&range=0&onlyTradable=false", coinId, htxCNY)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("htx 返回错误状态码: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	var respData htxResponse
+	if err := json.Unmarshal(body, &respData); err != nil {
+		return 0, err
+	}
+	if len(respData.Data) == 0 {
+		return 0, fmt.Errorf("htx 没有返回 %s 的广告: %s", C, respData.Message)
+	}
+
+	return strconv.ParseFloat(respData.Data[0].Price, 64)
+}
+
+type htxResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    []struct {
+		Price string `json:"price"`
+	} `json:"data"`
+}
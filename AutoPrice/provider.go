@@ -0,0 +1,234 @@
+package Autoprice
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Fiat 所有汇率都以人民币计价
+const Fiat = "CNY"
+
+// 默认的偏差保护阈值（百分比）
+const (
+	DefaultMaxDeviation = 3.0  // 单个数据源偏离中位数超过该比例时剔除
+	DefaultMaxChange    = 10.0 // 新汇率相对上一次有效汇率变化超过该比例时拒绝
+	// 变化过大的新汇率连续被拒绝该次数、并且每次都和上一次被拒绝的汇率一致时，认为行情确实发生了变化，接受新汇率
+	DefaultJumpConfirmations = 3
+)
+
+// DefaultProviders 默认启用的数据源
+var DefaultProviders = []string{"okx", "binance", "htx"}
+
+// RateProvider 汇率数据源，返回 1 个加密货币可以卖出的人民币价格
+type RateProvider interface {
+	Name() string
+	Price(C string) (float64, error)
+}
+
+// Quote 单个数据源的报价
+type Quote struct {
+	Provider string
+	Price    float64
+	Err      error
+}
+
+// Aggregator 从多个数据源取中位数，并做偏差保护
+type Aggregator struct {
+	Providers    []RateProvider
+	MaxDeviation float64 // 百分比，<=0 表示使用默认值
+	MaxChange    float64 // 百分比，<=0 表示使用默认值
+}
+
+// New 根据名称创建数据源，未知名称会被忽略；static 数据源需要传入固定汇率
+func New(names []string, static map[string]float64, maxDeviation, maxChange float64) *Aggregator {
+	a := &Aggregator{MaxDeviation: maxDeviation, MaxChange: maxChange}
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "okx":
+			a.Providers = append(a.Providers, OKX{})
+		case "binance":
+			a.Providers = append(a.Providers, Binance{})
+		case "htx":
+			a.Providers = append(a.Providers, HTX{})
+		case "static":
+			a.Providers = append(a.Providers, Static{Rates: static})
+		}
+	}
+	return a
+}
+
+// ErrNoHealthyProvider 所有数据源都不可用
+var ErrNoHealthyProvider = errors.New("没有可用的汇率数据源")
+
+// RateJump 新汇率相对上一次有效汇率变化过大，Rate 为通过偏差检查后的中位数
+type RateJump struct {
+	Rate      float64
+	Last      float64
+	MaxChange float64
+}
+
+func (e *RateJump) Error() string {
+	return fmt.Sprintf("新汇率 %.4f 相对上一次有效汇率 %.4f 变化超过 %.2f%%", e.Rate, e.Last, e.MaxChange)
+}
+
+// Quotes 依次查询所有数据源
+func (a *Aggregator) Quotes(C string) []Quote {
+	quotes := make([]Quote, 0, len(a.Providers))
+	for _, p := range a.Providers {
+		price, err := p.Price(C)
+		if err == nil && (price <= 0 || math.IsNaN(price) || math.IsInf(price, 0)) {
+			err = fmt.Errorf("无效的价格: %v", price)
+		}
+		quotes = append(quotes, Quote{Provider: p.Name(), Price: price, Err: err})
+	}
+	return quotes
+}
+
+// Rate 返回健康数据源的中位数汇率
+// last 为上一次有效的汇率（没有则传 0），新汇率相对 last 变化过大时返回错误，由调用方继续沿用 last
+func (a *Aggregator) Rate(C string, last float64) (float64, []Quote, error) {
+	return a.Aggregate(a.Quotes(C), last)
+}
+
+// Aggregate 对已经查询到的报价做聚合，多个币种共用同一组报价时避免重复请求数据源
+// 返回的报价是传入报价的副本，被剔除的报价会带上错误信息
+func (a *Aggregator) Aggregate(quotes []Quote, last float64) (float64, []Quote, error) {
+	quotes = append([]Quote(nil), quotes...)
+
+	var prices []float64
+	for _, q := range quotes {
+		if q.Err == nil {
+			prices = append(prices, q.Price)
+		}
+	}
+	if len(prices) == 0 {
+		return 0, quotes, ErrNoHealthyProvider
+	}
+
+	// 剔除偏离中位数过大的报价后重新取中位数
+	m := median(prices)
+	maxDeviation := a.maxDeviation()
+	var healthy []float64
+	for i, q := range quotes {
+		if q.Err != nil {
+			continue
+		}
+		if deviation(q.Price, m) > maxDeviation {
+			quotes[i].Err = fmt.Errorf("偏离中位数 %.4f 超过 %.2f%%", m, maxDeviation)
+			continue
+		}
+		healthy = append(healthy, q.Price)
+	}
+	if len(healthy) == 0 {
+		return 0, quotes, ErrNoHealthyProvider
+	}
+	rate := median(healthy)
+
+	maxChange := a.MaxChange
+	if maxChange <= 0 {
+		maxChange = DefaultMaxChange
+	}
+	if last > 0 && deviation(rate, last) > maxChange {
+		return 0, quotes, &RateJump{Rate: rate, Last: last, MaxChange: maxChange}
+	}
+
+	return rate, quotes, nil
+}
+
+// maxDeviation 生效的最大偏差
+func (a *Aggregator) maxDeviation() float64 {
+	if a.MaxDeviation <= 0 {
+		return DefaultMaxDeviation
+	}
+	return a.MaxDeviation
+}
+
+// JumpGuard 记录每个币种连续被拒绝的汇率
+// 最大变化保护和上一次有效汇率比较，行情确实大幅变化时上一次有效汇率不会再更新，自动汇率会一直停在旧值；
+// 同一个新汇率水平（相互偏差不超过最大偏差）连续被拒绝 Confirmations 次后接受新汇率
+type JumpGuard struct {
+	Confirmations int // <=0 表示使用默认值
+
+	mu      sync.Mutex
+	pending map[string]pendingJump
+}
+
+type pendingJump struct {
+	rate  float64
+	count int
+}
+
+// Aggregate 和 Aggregator.Aggregate 相同，key 为保存汇率的币种，例如 USDT-TRC20
+// 变化过大的新汇率连续被确认后返回新汇率和 confirmed=true，调用方应记录日志或告警
+func (g *JumpGuard) Aggregate(a *Aggregator, key string, quotes []Quote, last float64) (rate float64, confirmed bool, err error) {
+	rate, _, err = a.Aggregate(quotes, last)
+	var jump *RateJump
+	if !errors.As(err, &jump) {
+		// 汇率正常或者数据源不可用时重新计数
+		if err == nil {
+			g.reset(key)
+		}
+		return rate, false, err
+	}
+
+	confirmations := g.Confirmations
+	if confirmations <= 0 {
+		confirmations = DefaultJumpConfirmations
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending == nil {
+		g.pending = make(map[string]pendingJump)
+	}
+	p := g.pending[key]
+	if p.count > 0 && deviation(jump.Rate, p.rate) <= a.maxDeviation() {
+		p.count++
+	} else {
+		p.count = 1
+	}
+	p.rate = jump.Rate
+	if p.count >= confirmations {
+		delete(g.pending, key)
+		return jump.Rate, true, nil
+	}
+	g.pending[key] = p
+	return 0, false, err
+}
+
+func (g *JumpGuard) reset(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.pending, key)
+}
+
+// CryptoOf 根据钱包类型得到需要查询汇率的币种，例如 USDT-TRC20 -> USDT
+func CryptoOf(currency string) string {
+	switch {
+	case strings.Contains(currency, "USDT"):
+		return "USDT"
+	case strings.Contains(currency, "USDC"):
+		return "USDC"
+	case strings.Contains(currency, "TRX"):
+		return "TRX"
+	}
+	return ""
+}
+
+func median(values []float64) float64 {
+	s := append([]float64(nil), values...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+// deviation 返回 a 相对 b 的偏差百分比
+func deviation(a, b float64) float64 {
+	return math.Abs(a-b) / b * 100
+}
@@ -0,0 +1,144 @@
+package Autoprice
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	unavailable := errors.New("接口不可用")
+	cases := []struct {
+		name     string
+		quotes   []Quote
+		last     float64
+		rate     float64
+		rejected []string // 被剔除的数据源
+		err      error
+	}{
+		{
+			name:   "取中位数",
+			quotes: []Quote{{"a", 7.20, nil}, {"b", 7.22, nil}, {"c", 7.21, nil}},
+			rate:   7.21,
+		},
+		{
+			name:   "偶数个报价取中间两个的平均值",
+			quotes: []Quote{{"a", 7.20, nil}, {"b", 7.22, nil}},
+			last:   7.2,
+			rate:   7.21,
+		},
+		{
+			name:   "忽略不可用的数据源",
+			quotes: []Quote{{"a", 7.20, nil}, {"b", 0, unavailable}, {"c", 7.22, nil}},
+			rate:   7.21,
+		},
+		{
+			name:     "剔除偏离中位数过大的报价",
+			quotes:   []Quote{{"a", 7.20, nil}, {"b", 7.22, nil}, {"c", 7.21, nil}, {"d", 9.00, nil}},
+			rate:     7.21,
+			rejected: []string{"d"},
+		},
+		{
+			name:   "变化在最大变化以内",
+			quotes: []Quote{{"a", 7.5, nil}},
+			last:   7.2,
+			rate:   7.5,
+		},
+		{
+			name:   "变化超过最大变化",
+			quotes: []Quote{{"a", 8.5, nil}},
+			last:   7.2,
+			err:    &RateJump{},
+		},
+		{
+			name:   "没有报价",
+			quotes: nil,
+			err:    ErrNoHealthyProvider,
+		},
+		{
+			name:   "所有数据源都不可用",
+			quotes: []Quote{{"a", 0, unavailable}},
+			err:    ErrNoHealthyProvider,
+		},
+	}
+
+	a := &Aggregator{}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rate, quotes, err := a.Aggregate(c.quotes, c.last)
+			switch want := c.err.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("返回错误 %v", err)
+				}
+			case *RateJump:
+				var jump *RateJump
+				if !errors.As(err, &jump) {
+					t.Fatalf("返回错误 %v，期望 RateJump", err)
+				}
+				if jump.Last != c.last || jump.MaxChange != DefaultMaxChange {
+					t.Fatalf("RateJump %+v", jump)
+				}
+				return
+			default:
+				if !errors.Is(err, want) {
+					t.Fatalf("返回错误 %v，期望 %v", err, want)
+				}
+				return
+			}
+			if deviation(rate, c.rate) > 1e-9 {
+				t.Fatalf("汇率 %v，期望 %v", rate, c.rate)
+			}
+			var rejected []string
+			for i, q := range quotes {
+				if q.Err != nil && c.quotes[i].Err == nil {
+					rejected = append(rejected, q.Provider)
+				}
+			}
+			if len(rejected) != len(c.rejected) || (len(rejected) > 0 && rejected[0] != c.rejected[0]) {
+				t.Fatalf("剔除的数据源 %v，期望 %v", rejected, c.rejected)
+			}
+		})
+	}
+}
+
+// 同一个新汇率连续被拒绝后接受，新汇率不一致时重新计数
+func TestJumpGuard(t *testing.T) {
+	a := &Aggregator{}
+	g := &JumpGuard{Confirmations: 3}
+	quote := func(p float64) []Quote { return []Quote{{"a", p, nil}} }
+
+	steps := []struct {
+		price     float64
+		last      float64
+		rate      float64
+		confirmed bool
+	}{
+		{8.5, 7.2, 0, false},
+		{8.5, 7.2, 0, false},
+		// 和上一次被拒绝的汇率相差过大，重新计数
+		{9.5, 7.2, 0, false},
+		{9.5, 7.2, 0, false},
+		{9.52, 7.2, 9.52, true},
+		// 接受之后上一次有效汇率已经更新
+		{9.5, 9.52, 9.5, false},
+	}
+	for i, step := range steps {
+		rate, confirmed, err := g.Aggregate(a, "USDT-TRC20", quote(step.price), step.last)
+		if confirmed != step.confirmed || rate != step.rate {
+			t.Fatalf("第 %d 次: 汇率 %v confirmed=%v err=%v", i+1, rate, confirmed, err)
+		}
+		if step.rate == 0 && err == nil {
+			t.Fatalf("第 %d 次: 变化过大的汇率没有返回错误", i+1)
+		}
+	}
+
+	// 汇率恢复正常后重新计数
+	g.Aggregate(a, "USDT-BSC", quote(8.5), 7.2)
+	g.Aggregate(a, "USDT-BSC", quote(8.5), 7.2)
+	if _, _, err := g.Aggregate(a, "USDT-BSC", quote(7.3), 7.2); err != nil {
+		t.Fatal(err)
+	}
+	if _, confirmed, _ := g.Aggregate(a, "USDT-BSC", quote(8.5), 7.2); confirmed {
+		t.Fatal("汇率恢复正常后没有重新计数")
+	}
+}
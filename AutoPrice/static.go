@@ -0,0 +1,45 @@
+package Autoprice
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Static 手动维护的固定汇率，作为交易所接口之外的兜底数据源
+type Static struct {
+	Rates map[string]float64
+}
+
+func (Static) Name() string {
+	return "static"
+}
+
+func (s Static) Price(C string) (float64, error) {
+	rate, ok := s.Rates[C]
+	if !ok || rate <= 0 {
+		return 0, fmt.Errorf("没有配置 %s 的固定汇率", C)
+	}
+	return rate, nil
+}
+
+// ParseStaticRates 解析 "USDT=7.2,USDC=7.2,TRX=2.3" 格式的固定汇率配置
+func ParseStaticRates(s string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("固定汇率格式错误: %s", item)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("固定汇率必须是大于0的数字: %s", item)
+		}
+		rates[strings.ToUpper(strings.TrimSpace(kv[0]))] = rate
+	}
+	return rates, nil
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 	"upay_pro/db/sdb"
+	"upay_pro/metrics"
 	"upay_pro/mylog"
 
 	"go.uber.org/zap"
@@ -63,16 +64,19 @@ type APIConfig struct {
 	ProxyURL        string // 代理服务器地址
 }
 
+// Etherscan 接口地址
+const baseURL = "https://api.etherscan.io/v2/api"
+
 // NewDefaultConfig 创建默认配置
-func NewDefaultConfig() *APIConfig {
+func NewDefaultConfig(apiKey string) *APIConfig {
 	return &APIConfig{
-		BaseURL: "https://api.etherscan.io/v2/api",
+		BaseURL: baseURL,
 		ChainID: "56",
 		Module:  "account",
 		Action:  "tokentx",
 		// USDT合约地址:0x55d398326f99059ff775485246999027b3197955
 		ContractAddress: "0x55d398326f99059ff775485246999027b3197955",
-		APIKey:          sdb.GetApiKey().Etherscan,
+		APIKey:          apiKey,
 		Page:            "1",
 		Offset:          "1",
 		Sort:            "desc",
@@ -93,7 +97,8 @@ func fetchBSCUSDTransactions(config *APIConfig) (*APIResponse, error) {
 
 	// 创建HTTP客户端，设置超时和代理
 	client := &http.Client{
-		Timeout: 30 * time.Second,
+		Timeout:   30 * time.Second,
+		Transport: metrics.WatcherTransport,
 	}
 
 	// 如果配置了代理，则设置代理
@@ -102,9 +107,9 @@ func fetchBSCUSDTransactions(config *APIConfig) (*APIResponse, error) {
 		if err != nil {
 			return nil, fmt.Errorf("代理URL解析失败: %v", err)
 		}
-		client.Transport = &http.Transport{
+		client.Transport = metrics.Transport(&http.Transport{
 			Proxy: http.ProxyURL(proxyURL),
-		}
+		})
 		fmt.Printf("使用代理: %s\n", config.ProxyURL)
 	}
 
@@ -135,12 +140,27 @@ func fetchBSCUSDTransactions(config *APIConfig) (*APIResponse, error) {
 	return &apiResp, nil
 }
 
-func Start(order sdb.Orders) bool {
+// Watcher 通过 Etherscan 查询 BSC 上的 USDT 转账
+type Watcher struct {
+	store  *sdb.Store
+	apiKey func() string
+	// BaseURL 接口地址，默认为 Etherscan，测试时可以替换
+	BaseURL string
+}
+
+// New 创建监听器，apiKey 在每次查询时调用，后台修改的 API 密钥立即生效
+func New(store *sdb.Store, apiKey func() string) *Watcher {
+	return &Watcher{store: store, apiKey: apiKey, BaseURL: baseURL}
+}
+
+// Check 查询订单的转账，找到符合订单的转账时把订单设置为已支付并返回 true
+func (w *Watcher) Check(order sdb.Orders) bool {
 
 	mylog.Logger.Info("正在获取BSC-USD交易数据...")
 
 	// 创建配置
-	config := NewDefaultConfig()
+	config := NewDefaultConfig(w.apiKey())
+	config.BaseURL = w.BaseURL
 	config.Address = order.Token
 	// 可以根据需要自定义配置
 	// config.APIKey = "your_api_key_here"
@@ -154,6 +174,10 @@ func Start(order sdb.Orders) bool {
 		mylog.Logger.Error("查询BSC-USDT交易失败", zap.Error(err))
 		return false
 	}
+	// 返回结果有效（包括没有转账记录），记录查询成功
+	if metrics.EtherscanOK(data.Status, data.Message) {
+		metrics.RecordPoll(order.Type, order.Sandbox)
+	}
 
 	mylog.Logger.Info("BSC-USD 交易数据获取成功", zap.Any("data", data))
 
@@ -217,7 +241,7 @@ func Start(order sdb.Orders) bool {
 			order.BlockTransactionId = data.Result[0].Hash
 			order.Status = sdb.StatusPaySuccess
 			// 更新数据库订单记录
-			re := sdb.DB.Save(&order)
+			re := w.store.DB.Save(&order)
 			if re.Error == nil {
 				mylog.Logger.Info("USDT_BSC 订单入账成功")
 				return true
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 	"upay_pro/db/sdb"
+	"upay_pro/metrics"
 	"upay_pro/mylog"
 
 	"go.uber.org/zap"
@@ -79,23 +80,38 @@ func (config *EtherscanConfig) buildAPIURL() string {
 	return config.BaseURL + "?" + params.Encode()
 }
 
-func Start(order sdb.Orders) bool {
+// Watcher 通过 Etherscan 查询以太坊上的 USDT 转账
+type Watcher struct {
+	store  *sdb.Store
+	apiKey func() string
+	// BaseURL 接口地址，默认为 Etherscan，测试时可以替换
+	BaseURL string
+}
+
+// New 创建监听器，apiKey 在每次查询时调用，后台修改的 API 密钥立即生效
+func New(store *sdb.Store, apiKey func() string) *Watcher {
+	return &Watcher{store: store, apiKey: apiKey, BaseURL: "https://api.etherscan.io/v2/api"}
+}
+
+// Check 查询订单的转账，找到符合订单的转账时把订单设置为已支付并返回 true
+func (w *Watcher) Check(order sdb.Orders) bool {
 	// API配置 - 可以方便地修改各个参数
 	config := &EtherscanConfig{
-		BaseURL:         "https://api.etherscan.io/v2/api",
+		BaseURL:         w.BaseURL,
 		ChainID:         1,                                            // 以太坊主网
 		Module:          "account",                                    // 账户模块
 		Action:          "tokentx",                                    // 查询代币交易
 		Address:         order.Token,                                  // 查询的地址
 		ContractAddress: "0xdac17f958d2ee523a2206206994597c13d831ec7", // USDT合约地址
-		APIKey:          sdb.GetApiKey().Etherscan,
+		APIKey:          w.apiKey(),
 		Page:            1,      // 分页参数
 		Offset:          1,      // 返回记录数
 		Sort:            "desc", // 排序方式,desc 降序 最新的在最前面,asc 升序 最旧的在最前面
 	}
 
 	client := &http.Client{
-		Timeout: 30 * time.Second,
+		Timeout:   30 * time.Second,
+		Transport: metrics.WatcherTransport,
 	}
 
 	// 构建API URL
@@ -126,6 +142,10 @@ func Start(order sdb.Orders) bool {
 		mylog.Logger.Error("JSON解析错误", zap.Error(err))
 		return false
 	}
+	// 返回结果有效（包括没有转账记录），记录查询成功
+	if metrics.EtherscanOK(etherscanResp.Status, etherscanResp.Message) {
+		metrics.RecordPoll(order.Type, order.Sandbox)
+	}
 
 	if etherscanResp.Message != "OK" || len(etherscanResp.Result) == 0 {
 		mylog.Logger.Error("API返回消息错误", zap.String("message", etherscanResp.Message), zap.Int("结果切片", len(etherscanResp.Result)))
@@ -150,7 +170,7 @@ func Start(order sdb.Orders) bool {
 		order.BlockTransactionId = etherscanResp.Result[0].Hash
 		order.Status = sdb.StatusPaySuccess
 		// 更新数据库订单记录
-		re := sdb.DB.Save(&order)
+		re := w.store.DB.Save(&order)
 		if re.Error == nil {
 			mylog.Logger.Info("USDT_ERC20 订单入账成功")
 			return true
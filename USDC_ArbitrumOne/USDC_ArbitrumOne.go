@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 	"upay_pro/db/sdb"
+	"upay_pro/metrics"
 	"upay_pro/mylog"
 
 	"go.uber.org/zap"
@@ -49,7 +50,8 @@ type APIResponse struct {
 }
 
 var Client = &http.Client{
-	Timeout: time.Second * 30,
+	Timeout:   time.Second * 30,
+	Transport: metrics.WatcherTransport,
 	// 设置代理
 	/* 	Transport: &http.Transport{
 		Proxy: http.ProxyURL(&url.URL{
@@ -59,19 +61,33 @@ var Client = &http.Client{
 	}, */
 }
 
-func GETHTTP(order sdb.Orders) (APIResponse, error) {
+// Watcher 通过 Etherscan 查询Arbitrum One 上的 USDC 转账
+type Watcher struct {
+	store  *sdb.Store
+	apiKey func() string
+	// BaseURL 接口地址，默认为 Etherscan，测试时可以替换
+	BaseURL string
+}
+
+// New 创建监听器，apiKey 在每次查询时调用，后台修改的 API 密钥立即生效
+func New(store *sdb.Store, apiKey func() string) *Watcher {
+	return &Watcher{store: store, apiKey: apiKey, BaseURL: "https://api.etherscan.io/v2/api"}
+}
+
+// GETHTTP 查询订单钱包地址最新的一条转账
+func (w *Watcher) GETHTTP(order sdb.Orders) (APIResponse, error) {
 
 	var apiResponse APIResponse
 	// 构建请求参数
 
-	apiURL := "https://api.etherscan.io/v2/api"
+	apiURL := w.BaseURL
 	params := url.Values{}
 	params.Add("chainid", "42161")
 	params.Add("module", "account")
 	params.Add("page", "1")
 	params.Add("offset", "1")
 	params.Add("sort", "desc")
-	params.Add("apikey", sdb.GetApiKey().Etherscan)
+	params.Add("apikey", w.apiKey())
 	params.Add("action", "tokentx")
 	params.Add("address", order.Token)
 	// USDC合约地址0xaf88d065e77c8cc2239327c5edb3a432268e5831
@@ -107,12 +123,17 @@ func GETHTTP(order sdb.Orders) (APIResponse, error) {
 	return apiResponse, nil
 }
 
-func Start(order sdb.Orders) bool {
-	apiResponse, err := GETHTTP(order)
+// Check 查询订单的转账，找到符合订单的转账时把订单设置为已支付并返回 true
+func (w *Watcher) Check(order sdb.Orders) bool {
+	apiResponse, err := w.GETHTTP(order)
 	if err != nil {
 		mylog.Logger.Error("请求失败", zap.Error(err))
 		return false
 	}
+	// 返回结果有效（包括没有转账记录），记录查询成功
+	if metrics.EtherscanOK(apiResponse.Status, apiResponse.Message) {
+		metrics.RecordPoll(order.Type, order.Sandbox)
+	}
 
 	//
 
@@ -131,7 +152,7 @@ func Start(order sdb.Orders) bool {
 			order.BlockTransactionId = apiResponse.Result[0].Hash
 			order.Status = sdb.StatusPaySuccess
 			// 更新数据库订单记录
-			re := sdb.DB.Model(&order).Updates(order)
+			re := w.store.DB.Model(&order).Updates(order)
 			if re.Error == nil {
 				mylog.Logger.Info("数据库订单记录更新成功", zap.Any("订单号", order.TradeId))
 				return true
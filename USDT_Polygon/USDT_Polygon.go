@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 	"upay_pro/db/sdb"
+	"upay_pro/metrics"
 	"upay_pro/mylog"
 
 	"go.uber.org/zap"
@@ -23,13 +24,17 @@ type POLYGONClient struct {
 	httpClient *http.Client
 }
 
+// Etherscan 接口地址
+const baseURL = "https://api.etherscan.io/v2/api"
+
 // NewPOLYGONClient 创建新的Polygon客户端
 func NewPOLYGONClient(apiKey string) *POLYGONClient {
 	return &POLYGONClient{
 		apiKey:  apiKey,
-		baseURL: "https://api.etherscan.io/v2/api",
+		baseURL: baseURL,
 		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: metrics.WatcherTransport,
 		},
 	}
 }
@@ -37,7 +42,7 @@ func NewPOLYGONClient(apiKey string) *POLYGONClient {
 func (c *POLYGONClient) GetTransfers(contractAddress, walletAddress string) (*ApiResponse, error) {
 	url := fmt.Sprintf("%s?chainid=137&module=account&action=tokentx&page=1&sort=desc&contractaddress=%s&address=%s&offset=1&apikey=%s",
 		c.baseURL, contractAddress, walletAddress, c.apiKey)
-	resp, err := http.Get(url)
+	resp, err := c.httpClient.Get(url)
 	if err != nil {
 		return nil, fmt.Errorf("请求失败: %w", err)
 	}
@@ -53,26 +58,44 @@ func (c *POLYGONClient) GetTransfers(contractAddress, walletAddress string) (*Ap
 		return nil, fmt.Errorf("解析JSON失败: %w", err)
 	}
 
-	if apiResponse.Status != "1" {
+	// 没有转账记录时 status 也是 0，返回空的结果
+	if !metrics.EtherscanOK(apiResponse.Status, apiResponse.Message) {
 		return nil, fmt.Errorf("API返回错误: %s", apiResponse.Message)
 	}
 
 	return &apiResponse, nil
 }
 
-func Start(order sdb.Orders) bool {
-	apiKey := sdb.GetApiKey().Etherscan
+// Watcher 通过 Etherscan 查询Polygon 上的 USDT 转账
+type Watcher struct {
+	store  *sdb.Store
+	apiKey func() string
+	// BaseURL 接口地址，默认为 Etherscan，测试时可以替换
+	BaseURL string
+}
+
+// New 创建监听器，apiKey 在每次查询时调用，后台修改的 API 密钥立即生效
+func New(store *sdb.Store, apiKey func() string) *Watcher {
+	return &Watcher{store: store, apiKey: apiKey, BaseURL: baseURL}
+}
+
+// Check 查询订单的转账，找到符合订单的转账时把订单设置为已支付并返回 true
+func (w *Watcher) Check(order sdb.Orders) bool {
+	apiKey := w.apiKey()
 	// USDT的合约地址：0xc2132D05D31c914a87C6611C10748AEb04B58e8F
 	contractAddress := "0xc2132D05D31c914a87C6611C10748AEb04B58e8F"
 	walletAddress := order.Token // 使用订单中的钱包地址
 
 	polygonClient := NewPOLYGONClient(apiKey)
+	polygonClient.baseURL = w.BaseURL
 	txs, err := polygonClient.GetTransfers(contractAddress, walletAddress)
 	if err != nil {
 		// log.Printf("查询USDT交易失败: %v", err)
 		mylog.Logger.Error("查询USDT-Polygon交易失败", zap.Error(err))
 		return false
 	}
+	// 返回结果有效，记录查询成功
+	metrics.RecordPoll(order.Type, order.Sandbox)
 
 	if len(txs.Result) == 0 {
 		// 检查是否存在转账记录
@@ -112,7 +135,7 @@ func Start(order sdb.Orders) bool {
 		order.BlockTransactionId = latestTx.Hash
 		order.Status = sdb.StatusPaySuccess
 		// 更新数据库订单记录
-		re := sdb.DB.Save(&order)
+		re := w.store.DB.Save(&order)
 		if re.Error == nil {
 			mylog.Logger.Info("USDT_Polygon: 订单入账成功")
 			return true
@@ -0,0 +1,141 @@
+package chains
+
+// 各币种的链上信息，用于生成钱包支付链接（二维码）和支付页面图标
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"upay_pro/config"
+)
+
+// 链的类型
+const (
+	KindTron = "tron" // 波场
+	KindEVM  = "evm"  // 以太坊及兼容链
+)
+
+// Chain 币种在链上的信息
+type Chain struct {
+	Currency string // 币种，和钱包地址表的 Currency 一致，例如 USDT-TRC20
+	Network  string // 网络名称
+	Kind     string // tron 或 evm
+	ChainID  int    // EVM 链ID，波场为0
+	Contract string // 代币合约地址，原生币为空
+	Decimals int    // 代币精度
+	Logo     string // 本地图标路径
+}
+
+var registry = map[string]Chain{
+	"USDT-TRC20":       {Currency: "USDT-TRC20", Network: "TRON", Kind: KindTron, Contract: "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t", Decimals: 6, Logo: "/img/usdt.svg"},
+	"TRX":              {Currency: "TRX", Network: "TRON", Kind: KindTron, Decimals: 6, Logo: "/img/trx.svg"},
+	"USDT-Polygon":     {Currency: "USDT-Polygon", Network: "Polygon", Kind: KindEVM, ChainID: 137, Contract: "0xc2132D05D31c914a87C6611C10748AEb04B58e8F", Decimals: 6, Logo: "/img/usdt.svg"},
+	"USDT-BSC":         {Currency: "USDT-BSC", Network: "BSC", Kind: KindEVM, ChainID: 56, Contract: "0x55d398326f99059ff775485246999027b3197955", Decimals: 18, Logo: "/img/usdt.svg"},
+	"USDT-ERC20":       {Currency: "USDT-ERC20", Network: "Ethereum", Kind: KindEVM, ChainID: 1, Contract: "0xdac17f958d2ee523a2206206994597c13d831ec7", Decimals: 6, Logo: "/img/usdt.svg"},
+	"USDT-ArbitrumOne": {Currency: "USDT-ArbitrumOne", Network: "Arbitrum One", Kind: KindEVM, ChainID: 42161, Contract: "0xfd086bc7cd5c481dcc9c85ebe478a1c0b69fcbb9", Decimals: 6, Logo: "/img/usdt.svg"},
+	"USDC-ERC20":       {Currency: "USDC-ERC20", Network: "Ethereum", Kind: KindEVM, ChainID: 1, Contract: "0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48", Decimals: 6, Logo: "/img/usdc.svg"},
+	"USDC-Polygon":     {Currency: "USDC-Polygon", Network: "Polygon", Kind: KindEVM, ChainID: 137, Contract: "0x2791bca1f2de4661ed88a30c99a7a9449aa84174", Decimals: 6, Logo: "/img/usdc.svg"},
+	"USDC-BSC":         {Currency: "USDC-BSC", Network: "BSC", Kind: KindEVM, ChainID: 56, Contract: "0x8ac76a51cc950d9822d68b83fe1ad97b32cd580d", Decimals: 18, Logo: "/img/usdc.svg"},
+	"USDC-ArbitrumOne": {Currency: "USDC-ArbitrumOne", Network: "Arbitrum One", Kind: KindEVM, ChainID: 42161, Contract: "0xaf88d065e77c8cc2239327c5edb3a432268e5831", Decimals: 6, Logo: "/img/usdc.svg"},
+}
+
+// 沙盒订单使用的测试网，合约地址为测试网上常用的测试代币，没有常用测试代币的为空，需要在启动配置中设置
+// 测试网的代币精度可能和主网不同，例如 BSC 测试网的 USDT 为 18 位
+var testnets = map[string]Chain{
+	"USDT-ERC20":   {Currency: "USDT-ERC20", Network: "Sepolia", Kind: KindEVM, ChainID: 11155111, Contract: "0xaA8E23Fb1079EA71e0a56F48a2aA51851D8433D0", Decimals: 6, Logo: "/img/usdt.svg"},
+	"USDC-ERC20":   {Currency: "USDC-ERC20", Network: "Sepolia", Kind: KindEVM, ChainID: 11155111, Contract: "0x1c7D4B196Cb0C7B01d743Fbc6116a902379C7238", Decimals: 6, Logo: "/img/usdc.svg"},
+	"USDT-Polygon": {Currency: "USDT-Polygon", Network: "Amoy", Kind: KindEVM, ChainID: 80002, Decimals: 6, Logo: "/img/usdt.svg"},
+	"USDC-Polygon": {Currency: "USDC-Polygon", Network: "Amoy", Kind: KindEVM, ChainID: 80002, Contract: "0x41E94Eb019C0762f9Bfcf9Fb1E58725BfB0e7582", Decimals: 6, Logo: "/img/usdc.svg"},
+	"USDT-BSC":     {Currency: "USDT-BSC", Network: "BSC Testnet", Kind: KindEVM, ChainID: 97, Contract: "0x337610d27c682E347C9cD60BD4b3b107C9d34dDd", Decimals: 18, Logo: "/img/usdt.svg"},
+	"USDC-BSC":     {Currency: "USDC-BSC", Network: "BSC Testnet", Kind: KindEVM, ChainID: 97, Contract: "0x64544969ed7EBf5f083679233325356EbE738930", Decimals: 18, Logo: "/img/usdc.svg"},
+}
+
+// 波场测试网的名称和 USDT 合约
+var tronTestnets = map[string]struct{ name, usdt string }{
+	config.TronNile:   {"TRON Nile", "TXYZopYRdj2D9XRtbG411XZZ3kM5VkAeBf"},
+	config.TronShasta: {"TRON Shasta", "TG3XXyExBkPp9nzdajDZsozEu4BkaSJozs"},
+}
+
+// Testnet 获取沙盒订单使用的测试网信息，启动配置中的合约地址优先
+// 币种没有测试网或者代币没有合约地址时返回 false，这些币种的沙盒订单只能模拟支付
+func Testnet(currency string, sandbox config.Sandbox) (Chain, bool) {
+	var c Chain
+	switch currency {
+	case "USDT-TRC20", "TRX":
+		tron, ok := tronTestnets[sandbox.TronNetwork]
+		if !ok {
+			return Chain{}, false
+		}
+		c = registry[currency]
+		c.Network = tron.name
+		if c.Contract != "" {
+			c.Contract = tron.usdt
+		}
+	default:
+		var ok bool
+		if c, ok = testnets[currency]; !ok {
+			return Chain{}, false
+		}
+	}
+	if contract := sandbox.Contracts[currency]; contract != "" {
+		c.Contract = contract
+	}
+	// 原生币没有合约地址
+	if c.Contract == "" && currency != "TRX" {
+		return Chain{}, false
+	}
+	return c, true
+}
+
+// DefaultLogo 未知币种使用的图标
+const DefaultLogo = "/img/usdt.svg"
+
+// Get 获取币种的链上信息
+func Get(currency string) (Chain, bool) {
+	c, ok := registry[currency]
+	return c, ok
+}
+
+// LogoOf 获取币种的本地图标
+func LogoOf(currency string) string {
+	if c, ok := registry[currency]; ok {
+		return c.Logo
+	}
+	return DefaultLogo
+}
+
+// PaymentURI 生成钱包可以识别的支付链接，扫码后自动填写收款地址和金额
+// EVM 使用 EIP-681：ethereum:<合约>@<链ID>/transfer?address=<收款地址>&uint256=<最小单位金额>
+// 波场使用 tron:<收款地址>?amount=<金额>，TRC20 代币额外带上 token=<合约>
+func (c Chain) PaymentURI(address string, amount float64) string {
+	switch c.Kind {
+	case KindEVM:
+		return fmt.Sprintf("ethereum:%s@%d/transfer?address=%s&uint256=%s", c.Contract, c.ChainID, address, ToBaseUnits(amount, c.Decimals))
+	case KindTron:
+		q := url.Values{}
+		if c.Contract != "" {
+			q.Set("token", c.Contract)
+		}
+		q.Set("amount", strconv.FormatFloat(amount, 'f', -1, 64))
+		return fmt.Sprintf("tron:%s?%s", address, q.Encode())
+	}
+	return address
+}
+
+// ToBaseUnits 把金额转换为链上的最小单位，例如 12.34 USDT（6位精度）-> 12340000
+// 按十进制字符串处理，避免浮点数乘以 1e18 时丢失精度；超过精度的小数位舍去，不进位
+func ToBaseUnits(amount float64, decimals int) string {
+	s := strconv.FormatFloat(amount, 'f', -1, 64)
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if len(fracPart) > decimals {
+		fracPart = fracPart[:decimals]
+	}
+	fracPart += strings.Repeat("0", decimals-len(fracPart))
+
+	units := strings.TrimLeft(intPart+fracPart, "0")
+	if units == "" {
+		return "0"
+	}
+	return units
+}
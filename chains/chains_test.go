@@ -0,0 +1,83 @@
+package chains
+
+import "testing"
+
+func TestToBaseUnits(t *testing.T) {
+	cases := []struct {
+		name     string
+		amount   float64
+		decimals int
+		want     string
+	}{
+		{"6位精度", 12.34, 6, "12340000"},
+		{"18位精度", 12.34, 18, "12340000000000000000"},
+		{"整数", 10, 6, "10000000"},
+		{"18位精度的整数", 10, 18, "10000000000000000000"},
+		{"末尾的0不影响结果", 1.5000, 6, "1500000"},
+		{"小于1的金额去掉前导0", 0.01, 6, "10000"},
+		{"最小单位", 0.000001, 6, "1"},
+		{"0", 0, 18, "0"},
+		{"超过精度的小数位舍去", 1.23456789, 6, "1234567"},
+		{"浮点数误差不进位", 0.1 + 0.2, 6, "300000"},
+		{"18位精度不丢失精度", 14.2857, 18, "14285700000000000000"},
+		{"精度为0", 12.9, 0, "12"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ToBaseUnits(tc.amount, tc.decimals); got != tc.want {
+				t.Fatalf("ToBaseUnits(%v, %d) = %s，期望 %s", tc.amount, tc.decimals, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPaymentURI(t *testing.T) {
+	usdtBSC, _ := Get("USDT-BSC")
+	usdtERC20, _ := Get("USDT-ERC20")
+	usdtTRC20, _ := Get("USDT-TRC20")
+	trx, _ := Get("TRX")
+	cases := []struct {
+		name   string
+		chain  Chain
+		amount float64
+		want   string
+	}{
+		{
+			name:   "EVM 6位精度",
+			chain:  usdtERC20,
+			amount: 14.28,
+			want:   "ethereum:0xdac17f958d2ee523a2206206994597c13d831ec7@1/transfer?address=0xabc&uint256=14280000",
+		},
+		{
+			name:   "EVM 18位精度",
+			chain:  usdtBSC,
+			amount: 14.28,
+			want:   "ethereum:0x55d398326f99059ff775485246999027b3197955@56/transfer?address=0xabc&uint256=14280000000000000000",
+		},
+		{
+			name:   "TRC20 代币带合约地址",
+			chain:  usdtTRC20,
+			amount: 14.2,
+			want:   "tron:0xabc?amount=14.2&token=TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t",
+		},
+		{
+			name:   "TRX 金额不带末尾的0",
+			chain:  trx,
+			amount: 3.10,
+			want:   "tron:0xabc?amount=3.1",
+		},
+		{
+			name:   "未知类型只有收款地址",
+			chain:  Chain{},
+			amount: 1,
+			want:   "0xabc",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.chain.PaymentURI("0xabc", tc.amount); got != tc.want {
+				t.Fatalf("PaymentURI = %s，期望 %s", got, tc.want)
+			}
+		})
+	}
+}
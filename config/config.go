@@ -0,0 +1,408 @@
+package config
+
+// 启动配置：数据目录、日志、HTTP 端口、数据库、Redis、运行模式和沙盒订单使用的测试网
+// 这些配置在程序启动时读取，HTTP 端口和 Redis 修改后可以在后台重新加载，其余修改后需要重启；
+// 业务设置保存在数据库的设置表中，在后台修改
+//
+// 按以下顺序读取，后面的覆盖前面的：默认值 < 配置文件 < 环境变量 < 命令行参数
+//
+// 配置文件使用 TOML 格式，通过 -config 或 UPAY_CONFIG 指定，不指定时依次查找数据目录下的
+// upay.toml 和 DBS/upay.toml，都不存在时只使用默认值和环境变量
+//
+//	data_dir = "."
+//	log_path = "logs/upay.log"
+//	backend  = "redis"
+//
+//	[http]
+//	port = 8090
+//
+//	[database]
+//	driver = "sqlite"
+//	dsn    = "DBS/upay_pro.db"
+//
+//	[redis]
+//	host     = "127.0.0.1"
+//	port     = 6379
+//	password = ""
+//	db       = 0
+//
+//	[sandbox]
+//	tron_network = "nile"
+//	# 测试网的代币合约地址，覆盖内置的地址，没有内置地址的币种设置后才会查询测试网
+//	[sandbox.contracts]
+//	USDT-Polygon = "0x..."
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/BurntSushi/toml"
+)
+
+// 金额锁和订单过期任务的存储方式
+const (
+	BackendRedis = "redis" // 金额锁保存在 Redis，订单过期任务使用 asynq 队列
+	BackendLocal = "local" // 不依赖 Redis，金额锁保存在数据库，订单过期任务使用进程内定时器
+)
+
+// 沙盒订单可以使用的波场测试网
+const (
+	TronNile   = "nile"
+	TronShasta = "shasta"
+)
+
+// 支持的数据库类型
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+	DriverMySQL    = "mysql"
+)
+
+// FileName 配置文件的文件名
+const FileName = "upay.toml"
+
+type Config struct {
+	DataDir  string   `toml:"data_dir"` // 数据目录，SQLite 数据库、日志和模版覆盖目录都在这个目录下
+	LogPath  string   `toml:"log_path"` // 日志文件，为空时为数据目录下的 logs/upay.log
+	Backend  string   `toml:"backend"`  // 运行模式 redis 或 local
+	HTTP     HTTP     `toml:"http"`
+	Database Database `toml:"database"`
+	Redis    Redis    `toml:"redis"`
+	Sandbox  Sandbox  `toml:"sandbox"`
+}
+
+type HTTP struct {
+	Port int `toml:"port"`
+}
+
+type Database struct {
+	Driver string `toml:"driver"` // sqlite、postgres 或 mysql
+	DSN    string `toml:"dsn"`    // 连接参数，sqlite 为数据库文件路径，为空时为数据目录下的 DBS/upay_pro.db
+}
+
+type Redis struct {
+	Host     string `toml:"host"`
+	Port     int    `toml:"port"`
+	Password string `toml:"password"`
+	DB       int    `toml:"db"`
+}
+
+// Sandbox 沙盒订单使用的测试网，以太坊、Polygon 和 BSC 分别使用 Sepolia、Amoy 和 BSC 测试网
+type Sandbox struct {
+	TronNetwork string            `toml:"tron_network"` // 波场测试网 nile 或 shasta
+	Contracts   map[string]string `toml:"contracts"`    // 测试网的代币合约地址，key 为币种，例如 USDT-BSC
+}
+
+var (
+	// 当前的配置，程序启动时由 Load 读取，重新加载时整体替换，请求中通过 Get 读取
+	current atomic.Pointer[Config]
+	// 读取的配置文件，没有配置文件时为空
+	file atomic.Pointer[string]
+	// Args 命令行参数中去掉选项后剩下的参数，例如 migrate 子命令
+	Args []string
+	// 配置文件、环境变量或命令行参数中设置过的配置项
+	explicit = map[string]bool{}
+	// 启动时的命令行参数，重新加载配置时使用
+	loadArgs []string
+
+	reloadMu    sync.Mutex
+	subscribers []func(old, new Config) error
+)
+
+func init() {
+	Set(Default())
+	file.Store(new(string))
+}
+
+// Get 当前的配置
+func Get() Config {
+	return *current.Load()
+}
+
+// Set 替换当前的配置，用于迁移旧版本的设置和测试
+func Set(c Config) {
+	current.Store(&c)
+}
+
+// File 读取的配置文件，没有配置文件时为空
+func File() string {
+	return *file.Load()
+}
+
+// Default 默认配置
+func Default() Config {
+	return Config{
+		DataDir: ".",
+		Backend: BackendRedis,
+		HTTP:    HTTP{Port: 8090},
+		Database: Database{
+			Driver: DriverSQLite,
+		},
+		Redis:   Redis{Host: "127.0.0.1", Port: 6379},
+		Sandbox: Sandbox{TronNetwork: TronNile},
+	}
+}
+
+// Load 按默认值、配置文件、环境变量和命令行参数的顺序读取配置
+func Load(args []string) error {
+	c, path, rest, set, err := load(args)
+	if err != nil {
+		return err
+	}
+	Set(c)
+	file.Store(&path)
+	Args, explicit, loadArgs = rest, set, args
+	return nil
+}
+
+// load 读取配置，返回配置、配置文件、剩下的命令行参数和设置过的配置项
+func load(args []string) (Config, string, []string, map[string]bool, error) {
+	fset := flag.NewFlagSet("upay", flag.ContinueOnError)
+	configFile := fset.String("config", "", "配置文件，默认查找数据目录下的 upay.toml 和 DBS/upay.toml")
+	dataDir := fset.String("data-dir", "", "数据目录，默认为当前目录")
+	logPath := fset.String("log-path", "", "日志文件，默认为数据目录下的 logs/upay.log")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "用法: upay [选项] [migrate ...]")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return Config{}, "", nil, nil, err
+	}
+
+	c := Default()
+	set := map[string]bool{}
+
+	// 查找配置文件时需要先确定数据目录
+	dir := firstNonEmpty(*dataDir, os.Getenv("UPAY_DATA_DIR"), c.DataDir)
+	path := firstNonEmpty(*configFile, os.Getenv("UPAY_CONFIG"))
+	required := path != ""
+	if path == "" {
+		for _, p := range SearchPaths(dir) {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+	}
+	if path != "" {
+		meta, err := toml.DecodeFile(path, &c)
+		switch {
+		case err == nil:
+			for _, key := range meta.Keys() {
+				set[key.String()] = true
+			}
+			if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+				return Config{}, "", nil, nil, fmt.Errorf("配置文件 %s 中有未知的配置项 %v", path, undecoded)
+			}
+		case errors.Is(err, fs.ErrNotExist) && !required:
+			path = ""
+		default:
+			return Config{}, "", nil, nil, fmt.Errorf("配置文件 %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(&c, set); err != nil {
+		return Config{}, "", nil, nil, err
+	}
+	if *dataDir != "" {
+		c.DataDir = *dataDir
+		set["data_dir"] = true
+	}
+	if *logPath != "" {
+		c.LogPath = *logPath
+		set["log_path"] = true
+	}
+	if err := c.validate(); err != nil {
+		return Config{}, "", nil, nil, err
+	}
+	return c, path, fset.Args(), set, nil
+}
+
+// Reload 重新读取配置文件和环境变量，并通知订阅者
+// HTTP 端口和 Redis 连接可以在运行时修改；数据目录、日志、数据库、运行模式和测试网修改后需要重启，
+// 这些配置项保持原来的值，返回需要重启才能生效的配置项。
+// 订阅者应用配置失败时恢复原来的配置，已经应用的订阅者按相反的顺序恢复，返回订阅者的错误
+func Reload() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	old := Get()
+	next, path, _, _, err := load(loadArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	var restart []string
+	if next.DataDir != old.DataDir {
+		restart = append(restart, "data_dir")
+		next.DataDir = old.DataDir
+	}
+	if next.LogPath != old.LogPath {
+		restart = append(restart, "log_path")
+		next.LogPath = old.LogPath
+	}
+	if next.Backend != old.Backend {
+		restart = append(restart, "backend")
+		next.Backend = old.Backend
+	}
+	if next.Database != old.Database {
+		restart = append(restart, "database")
+		next.Database = old.Database
+	}
+	if !reflect.DeepEqual(next.Sandbox, old.Sandbox) {
+		restart = append(restart, "sandbox")
+		next.Sandbox = old.Sandbox
+	}
+	oldFile := File()
+	Set(next)
+	file.Store(&path)
+
+	for i, fn := range subscribers {
+		err := fn(old, next)
+		if err == nil {
+			continue
+		}
+		Set(old)
+		file.Store(&oldFile)
+		errs := []error{err}
+		for j := i - 1; j >= 0; j-- {
+			if err := subscribers[j](next, old); err != nil {
+				errs = append(errs, fmt.Errorf("恢复原来的配置失败: %w", err))
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+	return restart, nil
+}
+
+// OnChange 订阅重新加载配置，fn 在 Reload 中依次调用
+// fn 返回错误时不能留下修改，Reload 会恢复原来的配置
+func OnChange(fn func(old, new Config) error) {
+	reloadMu.Lock()
+	subscribers = append(subscribers, fn)
+	reloadMu.Unlock()
+}
+
+// applyEnv 使用环境变量覆盖配置
+func applyEnv(c *Config, set map[string]bool) error {
+	strs := []struct {
+		env, key string
+		dst      *string
+	}{
+		{"UPAY_DATA_DIR", "data_dir", &c.DataDir},
+		{"UPAY_LOG_PATH", "log_path", &c.LogPath},
+		{"UPAY_BACKEND", "backend", &c.Backend},
+		{"UPAY_DB_DRIVER", "database.driver", &c.Database.Driver},
+		{"UPAY_DB_DSN", "database.dsn", &c.Database.DSN},
+		{"UPAY_REDIS_HOST", "redis.host", &c.Redis.Host},
+		{"UPAY_REDIS_PASSWORD", "redis.password", &c.Redis.Password},
+		{"UPAY_SANDBOX_TRON_NETWORK", "sandbox.tron_network", &c.Sandbox.TronNetwork},
+	}
+	for _, s := range strs {
+		if v, ok := os.LookupEnv(s.env); ok {
+			*s.dst = v
+			set[s.key] = true
+		}
+	}
+
+	ints := []struct {
+		env, key string
+		dst      *int
+	}{
+		{"UPAY_HTTP_PORT", "http.port", &c.HTTP.Port},
+		{"UPAY_REDIS_PORT", "redis.port", &c.Redis.Port},
+		{"UPAY_REDIS_DB", "redis.db", &c.Redis.DB},
+	}
+	for _, s := range ints {
+		if v, ok := os.LookupEnv(s.env); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("环境变量 %s 必须是整数", s.env)
+			}
+			*s.dst = n
+			set[s.key] = true
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.Backend != BackendRedis && c.Backend != BackendLocal {
+		return fmt.Errorf("运行模式 backend 只能是 redis 或 local，当前为 %q", c.Backend)
+	}
+	switch c.Database.Driver {
+	case DriverSQLite, DriverPostgres, DriverMySQL:
+	case "sqlite3":
+		c.Database.Driver = DriverSQLite
+	case "postgresql", "pgx":
+		c.Database.Driver = DriverPostgres
+	default:
+		return fmt.Errorf("不支持的数据库类型 %q，可选 sqlite、postgres、mysql", c.Database.Driver)
+	}
+	if c.HTTP.Port < 1 || c.HTTP.Port > 65535 {
+		return fmt.Errorf("HTTP 端口必须在 1-65535 之间")
+	}
+	if c.Redis.Port < 1 || c.Redis.Port > 65535 {
+		return fmt.Errorf("Redis 端口必须在 1-65535 之间")
+	}
+	if c.Redis.DB < 0 || c.Redis.DB > 15 {
+		return fmt.Errorf("Redis 数据库编号必须在 0-15 之间")
+	}
+	if c.Sandbox.TronNetwork != TronNile && c.Sandbox.TronNetwork != TronShasta {
+		return fmt.Errorf("波场测试网 sandbox.tron_network 只能是 nile 或 shasta，当前为 %q", c.Sandbox.TronNetwork)
+	}
+	return nil
+}
+
+// SearchPaths 没有指定配置文件时依次查找的路径
+func SearchPaths(dataDir string) []string {
+	return []string{
+		filepath.Join(dataDir, FileName),
+		filepath.Join(dataDir, "DBS", FileName),
+	}
+}
+
+// IsSet 配置项是否在启动时的配置文件、环境变量或命令行参数中设置过，例如 redis.host
+func IsSet(key string) bool {
+	return explicit[key]
+}
+
+// UseRedis 是否使用 Redis
+func (c Config) UseRedis() bool {
+	return c.Backend != BackendLocal
+}
+
+// Path 数据目录下的路径
+func (c Config) Path(elem ...string) string {
+	return filepath.Join(append([]string{c.DataDir}, elem...)...)
+}
+
+// LogFile 日志文件
+func (c Config) LogFile() string {
+	if c.LogPath != "" {
+		return c.LogPath
+	}
+	return c.Path("logs", "upay.log")
+}
+
+// RedisAddr Redis 地址
+func (c Config) RedisAddr() string {
+	return fmt.Sprintf("%s:%d", c.Redis.Host, c.Redis.Port)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -13,23 +13,19 @@ import (
 	"net/http"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	Autoprice "upay_pro/AutoPrice"
-	"upay_pro/BSC_USD"
-	"upay_pro/ERC20_USDT"
-	"upay_pro/USDC_ArbitrumOne"
-	"upay_pro/USDC_BSC"
-	"upay_pro/USDC_ERC20"
-	"upay_pro/USDC_Polygon"
-	"upay_pro/USDT_ArbitrumOne"
-	"upay_pro/USDT_Polygon"
-	"upay_pro/db/rdb"
 	"upay_pro/db/sdb"
 	"upay_pro/dto"
+	"upay_pro/events"
+	"upay_pro/i18n"
+	"upay_pro/lock"
+	"upay_pro/metrics"
 	"upay_pro/mylog"
 	"upay_pro/notification"
-	"upay_pro/tron"
-	"upay_pro/trx"
+	"upay_pro/watcher"
 
 	"github.com/robfig/cron/v3"
 	"go.uber.org/zap"
@@ -45,9 +41,48 @@ var httpClient = &http.Client{
 	},
 }
 
-// 定义一个任务结构体 UsdtRateJob
-// 负责定期检查未支付订单的支付状态，并在支付成功后更新订单状态、发送通知和回调
-type UsdtCheckJob struct{}
+// Service 定时任务和异步回调
+// 负责定期检查未支付订单的支付状态，并在支付成功后更新订单状态、发送通知和回调；定期更新自动汇率
+type Service struct {
+	store    *sdb.Store
+	locker   lock.Locker
+	notifier notification.Notifier
+	watchers watcher.Set
+	// 沙盒订单的监听器
+	sandbox *watcher.Sandbox
+
+	// CallbackRetryDelay 异步回调失败后等待多久重试，默认 5 秒，测试时可以缩短
+	CallbackRetryDelay time.Duration
+
+	// 订单检查任务最近一次运行的时间（毫秒时间戳），用于健康检查
+	lastOrderCheck atomic.Int64
+	// 自动汇率连续被最大变化保护拒绝的记录，每次任务都会重新创建聚合器，所以保存在这里
+	jumps Autoprice.JumpGuard
+	// 定时任务调度器，Stop 时停止
+	scheduler *cron.Cron
+	// 正在执行的异步回调，Stop 时等待完成
+	callbacks sync.WaitGroup
+	// 程序停止时取消，异步回调不再等待重试
+	stopping context.Context
+	stop     context.CancelFunc
+}
+
+// New 创建定时任务，Start 后开始运行
+func New(store *sdb.Store, locker lock.Locker, notifier notification.Notifier, watchers watcher.Set, sandbox *watcher.Sandbox) *Service {
+	stopping, stop := context.WithCancel(context.Background())
+	return &Service{
+		store:    store,
+		locker:   locker,
+		notifier: notifier,
+		watchers: watchers,
+		sandbox:  sandbox,
+
+		CallbackRetryDelay: 5 * time.Second,
+
+		stopping: stopping,
+		stop:     stop,
+	}
+}
 
 // ExpiredOrdersJob 处理过期订单的任务结构体
 // 负责定期检查并处理已过期的未支付订单
@@ -100,13 +135,22 @@ func (j ExpiredOrdersJob) Run() {
 	Status             int     `json:"status"`
 } */
 
-// 实现 cron.Job 接口的 Run 方法
-func (j UsdtCheckJob) Run() {
+// LastOrderCheck 订单检查任务最近一次运行的时间，还没有运行过时为零值
+func (s *Service) LastOrderCheck() time.Time {
+	if ms := s.lastOrderCheck.Load(); ms > 0 {
+		return time.UnixMilli(ms)
+	}
+	return time.Time{}
+}
+
+// CheckOrders 检查未支付的订单，查到链上转账后发送异步回调
+func (s *Service) CheckOrders() {
+	s.lastOrderCheck.Store(time.Now().UnixMilli())
 	// 创建一个新的 Cron 调度器
 	fmt.Println("任务开启，检查未支付订单")
 	// 查询所有未支付状态的订单
 	var orders []sdb.Orders //因为可能未支付的订单数量较多所以用切片存储每条订单记录
-	if err := sdb.DB.Where("status = ?", sdb.StatusWaitPay).Find(&orders).Error; err != nil {
+	if err := s.store.DB.Where("status = ?", sdb.StatusWaitPay).Find(&orders).Error; err != nil {
 		mylog.Logger.Info("订单查询失败", zap.Any("err", err))
 		return
 	}
@@ -120,129 +164,155 @@ func (j UsdtCheckJob) Run() {
 	// 遍历每个未支付订单
 	for _, v := range orders {
 		fmt.Printf("订单ID: %s, 正在查询API\n", v.TradeId)
-		switch v.Type {
-		case "USDT-TRC20":
-			if tron.GetTransactions(v) {
-				go ProcessCallback(v)
-			} else if tron.GetTransactionsGrid(v) {
-				go ProcessCallback(v)
-			}
-		case "TRX":
-			if trx.Start(v) {
-				go ProcessCallback(v)
-			} else if trx.Start2(v) {
-				go ProcessCallback(v)
-			}
-		case "USDT-Polygon":
-			if USDT_Polygon.Start(v) {
-				go ProcessCallback(v)
-			}
-		case "USDT-BSC":
-			if BSC_USD.Start(v) {
-				go ProcessCallback(v)
-			}
-		case "USDT-ERC20":
-			if ERC20_USDT.Start(v) {
-				go ProcessCallback(v)
-			}
-		case "USDT-ArbitrumOne":
-			if USDT_ArbitrumOne.Start(v) {
-				go ProcessCallback(v)
-			}
-		case "USDC-ERC20":
-			if USDC_ERC20.Start(v) {
-				go ProcessCallback(v)
-			}
-		case "USDC-Polygon":
-			if USDC_Polygon.Start(v) {
-				go ProcessCallback(v)
-			}
-		case "USDC-BSC":
-			if USDC_BSC.Start(v) {
-				go ProcessCallback(v)
-			}
-		case "USDC-ArbitrumOne":
-			if USDC_ArbitrumOne.Start(v) {
-				go ProcessCallback(v)
-			}
-		default:
-			{
-
-				mylog.Logger.Info(fmt.Sprintf("当前订单号为%s的钱包类型%s没有配置对应的查询方法，请联系管理员进行新增", v.TradeId, v.Type))
-			}
+		if v.Type == "" {
+			// 买家还没有在支付页面选择网络，没有需要查询的钱包地址
+			continue
 		}
+		s.CheckOrder(v)
+	}
+
+}
 
+// CheckOrder 查询订单的转账，沙盒订单查询测试网和模拟的转账；查到转账时发送异步回调并返回 true
+func (s *Service) CheckOrder(order sdb.Orders) bool {
+	check := s.watchers.Check
+	if order.Sandbox {
+		check = s.sandbox.Check
+	}
+	paid, ok := check(order)
+	if !ok {
+		mylog.Logger.Info(fmt.Sprintf("当前订单号为%s的钱包类型%s没有配置对应的查询方法，请联系管理员进行新增", order.TradeId, order.Type))
+		return false
 	}
+	if paid {
+		// 只查询等待支付的订单，查到转账时订单刚变为支付成功
+		metrics.OrdersPaid.WithLabelValues(metrics.CurrencyLabel(order.Type)).Inc()
+		s.Paid(order.TradeId)
+	}
+	return paid
+}
 
+// Paid 订单保存为已支付之后调用，链上监听和手动补单共用：通知支付页面并发送异步回调
+func (s *Service) Paid(tradeId string) {
+	var order sdb.Orders
+	if err := s.store.DB.Where("trade_id = ?", tradeId).Limit(1).Find(&order).Error; err != nil || order.Status != sdb.StatusPaySuccess {
+		mylog.Logger.Error("查询已支付的订单失败", zap.String("order_id", tradeId), zap.Error(err))
+		return
+	}
+	events.Publish(events.Event{TradeId: order.TradeId, Type: events.Paid, TxHash: order.BlockTransactionId})
+	s.GoCallback(order)
 }
 
-// 自动汇率定时任务
+// SimulatePayment 为沙盒订单加入一笔模拟的转账，然后立即检查订单，转账和订单匹配时返回 true
+// amount 为转账金额，和订单的支付金额不一致时不会入账，可以用来测试金额错误的情况
+func (s *Service) SimulatePayment(order sdb.Orders, amount float64) bool {
+	s.sandbox.Simulator.Add(watcher.Transfer{
+		To:     order.Token,
+		Amount: amount,
+		TxID:   "sandbox-" + sdb.GenerateSecretKey(24),
+		Time:   time.Now(),
+	})
+	return s.CheckOrder(order)
+}
 
-type AutoRate struct{}
+// NewRateAggregator 按系统设置创建汇率聚合器
+func NewRateAggregator(setting sdb.Setting) *Autoprice.Aggregator {
 
-func (a AutoRate) Run() {
+	names := Autoprice.DefaultProviders
+	if strings.TrimSpace(setting.RateProviders) != "" {
+		names = strings.Split(setting.RateProviders, ",")
+	}
 
-	var wallets []sdb.WalletAddress
+	static, err := Autoprice.ParseStaticRates(setting.StaticRates)
+	if err != nil {
+		mylog.Logger.Error("固定汇率配置错误，已忽略", zap.Error(err))
+	}
+
+	return Autoprice.New(names, static, setting.RateMaxDeviation, setting.RateMaxChange)
+}
+
+// UpdateRates 自动汇率定时任务，更新开启了自动汇率的币种
+func (s *Service) UpdateRates() {
+
+	var currencies []sdb.Currency
+
+	s.store.DB.Where("auto_rate = ?", true).Find(&currencies)
+	mylog.Logger.Info("开始执行自动汇率任务", zap.Int("需要更新的币种数量", len(currencies)))
+
+	aggregator := NewRateAggregator(s.store.GetSetting())
+	// 同一次任务中同一个加密货币只请求一次数据源，例如 USDT-TRC20 和 USDT-BSC 共用 USDT 的报价
+	quotesOf := make(map[string][]Autoprice.Quote)
+	// 同一次任务中同一个加密货币只告警一次
+	alerted := make(map[string]bool)
 
-	sdb.DB.Where("AutoRate = ?", true).Find(&wallets)
-	mylog.Logger.Info("开始执行自动汇率任务", zap.Int("需要更新的地址数量", len(wallets)))
-	for _, wallet := range wallets {
+	for _, currency := range currencies {
 		// 币种
-		C := ""
-		// 如果order.Currency包含了"USDT"，那么C就等于"USDT"
-		switch {
-		case strings.Contains(wallet.Currency, "USDT"):
-			C = "USDT"
-		case strings.Contains(wallet.Currency, "USDC"):
-			C = "USDC"
-		case strings.Contains(wallet.Currency, "TRX"):
-			C = "TRX"
-		default:
-			mylog.Logger.Error("当前币种将自动设置默认汇率：10，请检查是否错误", zap.String("币种", wallet.Currency))
-			wallet.Rate = 10
-			sdb.DB.Save(&wallet)
-			continue // 跳过API调用，直接处理下一个钱包
+		C := Autoprice.CryptoOf(currency.Name)
+		if C == "" {
+			mylog.Logger.Error("当前币种不支持自动汇率，保留原汇率，请检查是否错误", zap.String("币种", currency.Name), zap.Float64("汇率", currency.Rate))
+			continue
+		}
+
+		quotes, ok := quotesOf[C]
+		if !ok {
+			quotes = aggregator.Quotes(C)
+			quotesOf[C] = quotes
+			for _, q := range quotes {
+				if q.Err != nil {
+					mylog.Logger.Warn("汇率数据源不可用", zap.String("数据源", q.Provider), zap.String("币种", C), zap.Error(q.Err))
+				}
+			}
+		}
+
+		// 用上一次的原始汇率做波动保护，没有历史记录时用币种当前汇率
+		last := s.store.LastMarketRate(currency.Name)
+		if last <= 0 {
+			last = currency.Rate
+		}
+		price, confirmed, err := s.jumps.Aggregate(aggregator, currency.Name, quotes, last)
+		if confirmed {
+			// 新汇率连续多次一致，认为行情确实发生了变化
+			mylog.Logger.Warn("汇率大幅变化已连续确认，接受新汇率", zap.String("币种", currency.Name), zap.Float64("上一次有效汇率", last), zap.Float64("新汇率", price))
+			lang := s.store.GetSetting().Language
+			go s.notifier.Alert(i18n.T(lang, "自动汇率大幅变化"), i18n.Tf(lang, "币种:%s\n上一次有效汇率:%v\n新汇率:%v", currency.Name, last, price))
 		}
-		price, err := Autoprice.Start(C)
 		if err != nil {
-			mylog.Logger.Error("获取自动汇率失败，将设置默认汇率，USDT:7,USDC:7,TRX:2.5", zap.Error(err))
-			//将设置默认汇率
-			// 优化后的switch语句
-			switch C {
-			case "USDT", "USDC":
-				wallet.Rate = 7
-			case "TRX":
-				wallet.Rate = 2.5
-			default:
-				wallet.Rate = 10
+			// 所有数据源失败或者汇率波动过大，沿用上一次有效汇率
+			mylog.Logger.Error("获取自动汇率失败，保留上一次有效汇率", zap.String("币种", currency.Name), zap.Float64("汇率", currency.Rate), zap.Error(err))
+			if !alerted[C] {
+				alerted[C] = true
+				lang := s.store.GetSetting().Language
+				go s.notifier.Alert(i18n.T(lang, "自动汇率更新失败"), i18n.Tf(lang, "币种:%s\n原因:%v\n当前沿用汇率:%v", C, err, currency.Rate))
 			}
-		} else {
-			wallet.Rate = price
+			continue
 		}
+		// 按币种的汇率策略调整后再保存
+		currency.Rate = currency.ApplyPolicy(price)
 
-		re := sdb.DB.Save(&wallet)
+		re := s.store.DB.Model(&currency).Update("rate", currency.Rate)
 		if re.Error != nil {
 			mylog.Logger.Error("自动汇率更新失败", zap.Error(re.Error))
+			continue
 		}
-		mylog.Logger.Info("自动汇率更新成功", zap.String("币种", wallet.Currency), zap.Float64("汇率", wallet.Rate))
+		s.store.RecordRate(currency.Name, currency.Rate, price, sdb.RateSourceAuto)
+		mylog.Logger.Info("自动汇率更新成功", zap.String("币种", currency.Name), zap.Float64("汇率", currency.Rate))
 	}
 
 }
 
 // Start 启动定时任务
 // 初始化并启动定时任务调度器，包括USDT支付检查和过期订单处理
-func Start() {
+func (s *Service) Start() error {
 
 	// 如果上一次任务还在运行，新的任务执行时间到了，则等待上一次任务完成后再执行
 	// c := cron.New(cron.WithChain(cron.DelayIfStillRunning(cron.DefaultLogger)))
 	// 如果上一次任务还在运行，新的任务执行时间到了，则跳过本次执行
 	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
 
-	// 每 2 秒执行一次 UsdtRateJob 任务
-	_, err := c.AddJob("@every 2s", UsdtCheckJob{})
+	// 每 2 秒检查一次未支付的订单
+	_, err := c.AddFunc("@every 2s", s.CheckOrders)
 	if err != nil {
-
-		mylog.Logger.Info("未支付订单检测任务添加失败")
+		return fmt.Errorf("未支付订单检测任务添加失败: %w", err)
 	}
 	// 每天凌晨3点执行过期订单清理任务
 	/* 	_, err = c.AddJob("0 5 * * *", ExpiredOrdersJob{})
@@ -252,15 +322,47 @@ func Start() {
 	// mylog.Logger.Info("订单清理任务已完成")
 	// 启动 Cron 调度器
 
-	_, err = c.AddJob("@every 10m", AutoRate{})
+	_, err = c.AddFunc("@every 10m", s.UpdateRates)
 	if err != nil {
-		mylog.Logger.Info("自动汇率任务添加失败")
+		return fmt.Errorf("自动汇率任务添加失败: %w", err)
 	}
 
+	// 汇率设置修改后立即按新的设置更新一次汇率，不用等下一次定时任务
+	s.store.OnSettingChange(func(old, new sdb.Setting) {
+		if old.RateProviders != new.RateProviders || old.StaticRates != new.StaticRates ||
+			old.RateMaxDeviation != new.RateMaxDeviation || old.RateMaxChange != new.RateMaxChange {
+			go s.UpdateRates()
+		}
+	})
+
 	c.Start()
+	s.scheduler = c
+	return nil
+}
 
-	// 保持主程序运行，确保任务执行
-	select {}
+// Stop 停止定时任务，等待正在执行的订单检查和异步回调完成
+// 异步回调不再等待重试，没有回调成功的订单可以在后台手动补单
+func (s *Service) Stop(ctx context.Context) error {
+	s.stop()
+	if s.scheduler != nil {
+		select {
+		case <-s.scheduler.Stop().Done():
+		case <-ctx.Done():
+			return fmt.Errorf("等待定时任务完成超时: %w", ctx.Err())
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.callbacks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("等待异步回调完成超时: %w", ctx.Err())
+	}
 }
 
 // 发起异步 POST 请求
@@ -285,8 +387,11 @@ func sendAsyncPost(url string, notification dto.PaymentNotification_request) (st
 	// 发送请求
 	// client := &http.Client{Timeout: 10 * time.Second}
 
+	start := time.Now()
 	resp, err := httpClient.Do(req)
+	metrics.CallbackDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		metrics.CallbackAttempts.WithLabelValues(metrics.CallbackNetworkError).Inc()
 		return "", err
 	}
 
@@ -301,10 +406,12 @@ func sendAsyncPost(url string, notification dto.PaymentNotification_request) (st
 
 		if buf.String() == "ok" || buf.String() == "success" {
 			fmt.Println("异步回调发送成功，服务器返回字符串 'ok' 或 'success")
+			metrics.CallbackAttempts.WithLabelValues(metrics.CallbackSuccess).Inc()
 			return "ok", nil
 
 		} else {
 			mylog.Logger.Info("异步回调，服务器返回字符串不是 'ok' 或 'success'", zap.String("body", buf.String()))
+			metrics.CallbackAttempts.WithLabelValues(metrics.CallbackRejected).Inc()
 			return "", errors.New("服务器返回字符串不是 'ok' 或 'success'")
 		}
 
@@ -312,6 +419,7 @@ func sendAsyncPost(url string, notification dto.PaymentNotification_request) (st
 		// 读取服务器响应
 		buf := new(bytes.Buffer)
 		_, _ = buf.ReadFrom(resp.Body)
+		metrics.CallbackAttempts.WithLabelValues(metrics.CallbackHTTPError).Inc()
 		mylog.Logger.Info("异步回调发送失败，服务器返回状态码：", zap.Any("resp.StatusCode", resp.StatusCode))
 		mylog.Logger.Info("异步回调发送失败，服务器返回内容：", zap.Any("buf.String()", buf.String()))
 		return "", fmt.Errorf("异步回调发送失败，服务器返回状态码：%d", resp.StatusCode)
@@ -324,8 +432,8 @@ func sendAsyncPost(url string, notification dto.PaymentNotification_request) (st
 
 }
 
-// 生成签名
-func generateSignature(data dto.PaymentNotification_request) string {
+// 生成签名，secretKey 为订单所属商户的密钥
+func generateSignature(data dto.PaymentNotification_request, secretKey string) string {
 	// 创建一个参数数组
 	params := []string{
 		fmt.Sprintf("trade_id=%s", data.TradeID),
@@ -336,6 +444,10 @@ func generateSignature(data dto.PaymentNotification_request) string {
 		fmt.Sprintf("block_transaction_id=%s", data.BlockTransactionID),
 		fmt.Sprintf("status=%d", data.Status),
 	}
+	// 沙盒订单才加入 sandbox，正式订单的签名和旧版本一致
+	if data.Sandbox {
+		params = append(params, "sandbox=true")
+	}
 
 	// 创建一个新的切片以保存非空字段
 	var filteredParams []string
@@ -352,7 +464,7 @@ func generateSignature(data dto.PaymentNotification_request) string {
 	sort.Strings(filteredParams)
 
 	// 使用 strings.Join 连接排序后的参数
-	signatureString := strings.Join(filteredParams, "&") + sdb.GetSetting().SecretKey
+	signatureString := strings.Join(filteredParams, "&") + secretKey
 
 	// 打印拼接的参数
 	mylog.Logger.Info("异步回调的拼接的参数", zap.Any("signatureString", signatureString))
@@ -363,36 +475,42 @@ func generateSignature(data dto.PaymentNotification_request) string {
 }
 
 // 解锁钱包地址和金额
-func unlockWalletAddressAndAmount(v sdb.Orders) {
+func (s *Service) unlockWalletAddressAndAmount(v sdb.Orders) {
 	// 解锁钱包地址和金额
-	address_amount := fmt.Sprintf("%s_%f", v.Token, v.ActualAmount)
-	cx := context.Background()
-	err := rdb.RDB.Del(cx, address_amount).Err()
+	err := s.locker.Unlock(context.Background(), lock.Key(v.Token, v.ActualAmount))
 	if err != nil {
 		mylog.Logger.Info("钱包地址和金额解锁失败", zap.Any("err", err))
 		// return err
 	}
 }
 
-// 异步回调
-func ProcessCallback(v sdb.Orders) {
+// GoCallback 在新的协程中发送异步回调，Stop 时等待回调完成
+func (s *Service) GoCallback(v sdb.Orders) {
+	s.callbacks.Add(1)
+	go func() {
+		defer s.callbacks.Done()
+		s.ProcessCallback(v)
+	}()
+}
+
+// ProcessCallback 异步回调
+func (s *Service) ProcessCallback(v sdb.Orders) {
 	// 先判断一下异步回调状态，如果已经回调了，则不处理
 	if v.CallBackConfirm == sdb.CallBackConfirmOk {
 		return
 	}
 
 	// 解锁钱包地址和金额|| 异步进程解锁钱包地址和金额
-	go unlockWalletAddressAndAmount(v)
+	go s.unlockWalletAddressAndAmount(v)
 
 	// 获取一下最新的订单记录
-	v1 := sdb.GetOrderByOrderId(v.OrderId)
+	v1 := s.store.GetOrderByOrderId(v.MerchantID, v.OrderId)
 
 	// 判断一下是否已经支付，没有支付，直接返回，不处理
 	if v1.Status != sdb.StatusPaySuccess {
 		mylog.Logger.Info("订单未支付，不需要异步回调", zap.Any("订单号：%s", v1.TradeId))
 		return
 	}
-
 	// 异步回调
 
 	paymentNotification := dto.PaymentNotification_request{
@@ -403,13 +521,14 @@ func ProcessCallback(v sdb.Orders) {
 		Token:              v1.Token,
 		BlockTransactionID: v1.BlockTransactionId,
 		Status:             v1.Status,
+		Sandbox:            v1.Sandbox,
 	}
 	// 这里要判断一下BlockTransactionID的值paymentNotification.BlockTransactionId是否为空，如果为空，就给赋值一个默认值0
 	if paymentNotification.BlockTransactionID == "" {
 		paymentNotification.BlockTransactionID = "0"
 	}
 	// 生成签名
-	signature := generateSignature(paymentNotification)
+	signature := generateSignature(paymentNotification, s.store.SecretKeyOf(v1.MerchantID))
 	paymentNotification.Signature = signature
 	// 异步回调最大次数5次
 	mylog.Logger.Info("异步回调的参数", zap.Any("参数", paymentNotification))
@@ -418,9 +537,10 @@ func ProcessCallback(v sdb.Orders) {
 	for i := 0; i < 5; i++ {
 		ok, err := sendAsyncPost(v1.NotifyUrl, paymentNotification)
 		if ok == "ok" && err == nil {
-			err = sdb.DB.Transaction(func(tx *gorm.DB) error {
+			// 只更新回调确认状态，不覆盖重试时累加的回调次数
+			err = s.store.DB.Transaction(func(tx *gorm.DB) error {
 				v1.CallBackConfirm = sdb.CallBackConfirmOk
-				return tx.Save(v1).Error
+				return tx.Model(&v1).Update("call_back_confirm", v1.CallBackConfirm).Error
 			})
 			if err != nil {
 				mylog.Logger.Info("更新回调确认状态失败", zap.Any("err", err))
@@ -428,8 +548,7 @@ func ProcessCallback(v sdb.Orders) {
 				mylog.Logger.Info("已经确认订单支付成功，并把回调CallBackConfirm设置为1")
 			}
 			// 异步回调成功后发送telegram、Bark通知|| 异步进程发送通知
-			go notification.Bark_Start(v1)
-			go notification.StartTelegram(v1)
+			go s.notifier.OrderPaid(v1)
 			break
 		}
 		if err != nil {
@@ -441,11 +560,16 @@ func ProcessCallback(v sdb.Orders) {
 			// if err := sdb.DB.Model(&v).UpdateColumn("callback_num", gorm.Expr("callback_num + ?", 1)).Error; err != nil {
 			// 	mylog.Logger.Info("更新回调失败次数失败", zap.Any("err", err))
 			// }
-			if err := sdb.DB.Model(v).UpdateColumn("callback_num", gorm.Expr("callback_num + ?", 1)).Error; err != nil {
+			if err := s.store.DB.Model(v).UpdateColumn("callback_num", gorm.Expr("callback_num + ?", 1)).Error; err != nil {
 				mylog.Logger.Info("更新回调失败次数失败", zap.Any("err", err))
 			}
-			// 延迟5秒
-			time.Sleep(5 * time.Second)
+			// 等待一段时间后重试，程序停止时不再重试
+			select {
+			case <-time.After(s.CallbackRetryDelay):
+			case <-s.stopping.Done():
+				mylog.Logger.Warn("程序停止，异步回调不再重试", zap.String("trade_id", v1.TradeId))
+				return
+			}
 
 			// 进入下次循环
 			// continue
@@ -2,24 +2,68 @@ package rdb
 
 import (
 	"context"
-	"fmt"
+	"sync/atomic"
 	"time"
-	"upay_pro/db/sdb"
+	"upay_pro/config"
 	"upay_pro/mylog"
 
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
-var RDB *redis.Client
+// Client Redis 客户端，重新加载配置时替换内部的连接
+type Client struct {
+	client atomic.Pointer[redis.Client]
+}
+
+// 重新连接后旧的客户端延迟关闭，让正在执行的命令完成
+const closeDelay = 10 * time.Second
+
+// New 按启动配置连接 Redis，只在 redis 模式下调用
+// Redis 连接失败时不返回错误，Redis 恢复后客户端会自动重连，期间 /readyz 返回不可用
+func New(cfg config.Config) *Client {
+	c := &Client{}
+	c.client.Store(connect(cfg))
+	return c
+}
+
+// Close 关闭 Redis 连接
+func (c *Client) Close() error {
+	if client := c.client.Swap(nil); client != nil {
+		return client.Close()
+	}
+	return nil
+}
 
-func init() {
+// Redis 返回当前的 Redis 连接
+func (c *Client) Redis() *redis.Client {
+	return c.client.Load()
+}
+
+// Reload 重新加载启动配置后调用，Redis 配置有变化时重新连接
+func (c *Client) Reload(old, new config.Config) error {
+	if new.UseRedis() && old.Redis != new.Redis {
+		c.Reconnect(new)
+	}
+	return nil
+}
+
+// Reconnect 按新的配置重新连接 Redis
+func (c *Client) Reconnect(cfg config.Config) {
+	old := c.client.Swap(connect(cfg))
+	if old != nil {
+		time.AfterFunc(closeDelay, func() { old.Close() })
+	}
+}
+
+// connect 按启动配置创建 Redis 客户端
+func connect(cfg config.Config) *redis.Client {
 	// 创建 Redis 客户端
 	rdb := redis.NewClient(&redis.Options{
 		// 基本连接配置
-		Addr:     fmt.Sprintf("%s:%d", sdb.GetSetting().Redishost, sdb.GetSetting().Redisport), // Redis 地址
-		Password: sdb.GetSetting().Redispasswd,                                                 // Redis 密码
-		DB:       sdb.GetSetting().Redisdb,                                                     // 数据库编号
+		Addr:     cfg.RedisAddr(),    // Redis 地址
+		Password: cfg.Redis.Password, // Redis 密码
+		DB:       cfg.Redis.DB,       // 数据库编号
 
 		// 连接超时设置
 		DialTimeout:  10 * time.Second, // 建立连接超时时间
@@ -40,25 +84,15 @@ func init() {
 		},
 	})
 	ctx := context.Background()
-	RDB = rdb
-	// defer rdb.Close()  在其他调用时最后关闭
 	// 测试连接
 	_, err := rdb.Ping(ctx).Result()
 	if err != nil {
-		// redis 连接失败写入日志
-		mylog.Logger.Panic("redis 链接失败", zap.Error(err))
-
+		// redis 连接失败时不退出程序，Redis 恢复后客户端会自动重连，期间 /readyz 返回不可用
+		mylog.Logger.Error("redis 链接失败", zap.String("addr", cfg.RedisAddr()), zap.Error(err))
+		return rdb
 	}
 
 	// 测试redis是否连接成功 写入日志
-	mylog.Logger.Info("redis 连接成功")
-
-	/* 	// 测试访问不存在的键
-	   	_, err = rdb.Get(ctx, "520").Result()
-	   	if err != nil {
-	   		log.Logger.Info("redis 访问不存在的键")
-	   	} */
-
+	mylog.Logger.Info("redis 连接成功", zap.String("addr", cfg.RedisAddr()))
+	return rdb
 }
-
-// Close 优雅关闭 Redis 连接
@@ -0,0 +1,604 @@
+package sdb
+
+// 数据库迁移
+// 每个迁移有一个递增的版本号，执行过的版本记录在 schema_migrations 表中，程序启动时自动执行还没有执行过的迁移
+// 修改表结构时在 migrations 末尾追加新的迁移，不要修改已经发布的迁移；
+// 迁移中使用迁移时的表结构（例如 schemaV1 中的结构体），不要直接使用会继续变化的模型
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"upay_pro/config"
+	"upay_pro/mylog"
+
+	"github.com/BurntSushi/toml"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Migration 一个数据库迁移
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error // 为 nil 时不能回滚
+}
+
+// SchemaMigration 已经执行过的迁移
+type SchemaMigration struct {
+	Version   int64 `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// MigrationState 迁移的执行状态
+type MigrationState struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// ErrIrreversible 迁移没有回滚步骤
+var ErrIrreversible = errors.New("迁移不能回滚")
+
+// migrations 所有迁移，按版本号从小到大排列
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "初始表结构",
+		// 旧版本用 AutoMigrate 创建的数据库执行后只会补充缺少的字段
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(schemaV1...)
+		},
+	},
+	{
+		Version: 2,
+		Name:    "钱包地址表中的汇率迁移到币种表",
+		Up: func(tx *gorm.DB) error {
+			return migrateWalletRates(tx)
+		},
+	},
+	{
+		Version: 3,
+		Name:    "订单号索引",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasIndex("orders", "idx_orders_trade_id") {
+				return nil
+			}
+			// MySQL 中字符串字段是 longtext，索引需要指定长度
+			column := "trade_id"
+			if tx.Dialector.Name() == config.DriverMySQL {
+				column = "trade_id(64)"
+			}
+			return tx.Exec("CREATE INDEX idx_orders_trade_id ON orders (" + column + ")").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasIndex("orders", "idx_orders_trade_id") {
+				return nil
+			}
+			return tx.Migrator().DropIndex("orders", "idx_orders_trade_id")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "Redis、HTTP 端口和运行模式移到启动配置",
+		Up:      moveInfraSettings,
+	},
+	{
+		Version: 5,
+		Name:    "商户和订单的沙盒标记",
+		Up: func(tx *gorm.DB) error {
+			for _, model := range []interface{}{&v5Merchant{}, &v5Orders{}} {
+				if tx.Migrator().HasColumn(model, "Sandbox") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(model, "Sandbox"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, model := range []interface{}{&v5Merchant{}, &v5Orders{}} {
+				if !tx.Migrator().HasColumn(model, "Sandbox") {
+					continue
+				}
+				if err := dropColumn(tx, model, "Sandbox"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 6,
+		Name:    "后台用户角色和审计日志",
+		Up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&v6User{}, "Role") {
+				if err := tx.Migrator().AddColumn(&v6User{}, "Role"); err != nil {
+					return err
+				}
+			}
+			// 已有的用户都是所有者，和升级前的权限一致
+			if err := tx.Exec("UPDATE users SET role = ? WHERE role IS NULL OR role = ''", "owner").Error; err != nil {
+				return err
+			}
+			return tx.AutoMigrate(&v6AuditLog{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&v6AuditLog{}); err != nil {
+				return err
+			}
+			if !tx.Migrator().HasColumn(&v6User{}, "Role") {
+				return nil
+			}
+			return dropColumn(tx, &v6User{}, "Role")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "监控接口公开访问开关",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&v7Setting{}, "MetricsPublic") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&v7Setting{}, "MetricsPublic")
+		},
+		Down: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&v7Setting{}, "MetricsPublic") {
+				return nil
+			}
+			return dropColumn(tx, &v7Setting{}, "MetricsPublic")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "后台用户的登录版本",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&v8User{}, "TokenVersion") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&v8User{}, "TokenVersion")
+		},
+		Down: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&v8User{}, "TokenVersion") {
+				return nil
+			}
+			return dropColumn(tx, &v8User{}, "TokenVersion")
+		},
+	},
+}
+
+// Migrations 返回所有迁移和执行状态
+func (s *Store) Migrations() ([]MigrationState, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		state := MigrationState{Migration: m}
+		if a, ok := applied[m.Version]; ok {
+			state.Applied = true
+			state.AppliedAt = a.AppliedAt
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// appliedMigrations 读取已经执行过的迁移，schema_migrations 表不存在时创建
+func (s *Store) appliedMigrations() (map[int64]SchemaMigration, error) {
+	if err := s.DB.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, fmt.Errorf("创建 schema_migrations 表失败: %w", err)
+	}
+	var rows []SchemaMigration
+	if err := s.DB.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]SchemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// Migrate 执行所有还没有执行过的迁移，返回本次执行的迁移数量
+func (s *Store) Migrate() (int, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		mylog.Logger.Info("执行数据库迁移", zap.Int64("version", m.Version), zap.String("name", m.Name))
+		err := s.DB.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			// 多个实例同时启动时，迁移可能已经被其他实例执行
+			if s.migrationApplied(m.Version) {
+				continue
+			}
+			return n, fmt.Errorf("迁移 %d（%s）失败: %w", m.Version, m.Name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Rollback 按版本号从大到小回滚最近执行的 steps 个迁移，返回回滚的迁移数量
+func (s *Store) Rollback(steps int) (int, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	versions := make([]int64, 0, len(applied))
+	for v := range applied {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+	n := 0
+	for _, v := range versions {
+		if n >= steps {
+			break
+		}
+		m, ok := findMigration(v)
+		if !ok {
+			return n, fmt.Errorf("迁移 %d 不存在，可能是新版本程序执行的迁移", v)
+		}
+		if m.Down == nil {
+			return n, fmt.Errorf("迁移 %d（%s）: %w", m.Version, m.Name, ErrIrreversible)
+		}
+		mylog.Logger.Info("回滚数据库迁移", zap.Int64("version", m.Version), zap.String("name", m.Name))
+		err := s.DB.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{Version: m.Version}).Error
+		})
+		if err != nil {
+			return n, fmt.Errorf("回滚迁移 %d（%s）失败: %w", m.Version, m.Name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// dropColumn 删除字段
+// SQLite 删除字段时会重建整张表，表上的索引（包括唯一索引）都会丢失，这里在删除后重新创建不包含该字段的索引
+func dropColumn(tx *gorm.DB, model interface{}, column string) error {
+	if tx.Dialector.Name() != config.DriverSQLite {
+		return tx.Migrator().DropColumn(model, column)
+	}
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	name := column
+	if field := stmt.Schema.LookUpField(column); field != nil {
+		name = field.DBName
+	}
+
+	var indexes []struct {
+		Name string
+		SQL  string `gorm:"column:sql"`
+	}
+	// 主键和唯一约束自动创建的索引 sql 为空，重建表时会一起创建
+	if err := tx.Raw("SELECT name, sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", stmt.Table).Scan(&indexes).Error; err != nil {
+		return err
+	}
+	if err := tx.Migrator().DropColumn(model, column); err != nil {
+		return err
+	}
+
+	uses := regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(name) + `\b`)
+	for _, index := range indexes {
+		_, columns, _ := strings.Cut(index.SQL, "(")
+		if uses.MatchString(columns) || tx.Migrator().HasIndex(stmt.Table, index.Name) {
+			continue
+		}
+		if err := tx.Exec(index.SQL).Error; err != nil {
+			return fmt.Errorf("重新创建索引 %s 失败: %w", index.Name, err)
+		}
+	}
+	return nil
+}
+
+// findMigration 按版本号查找迁移
+func findMigration(version int64) (Migration, bool) {
+	for _, m := range migrations {
+		if m.Version == version {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
+
+// migrationApplied 迁移是否已经执行过
+func (s *Store) migrationApplied(version int64) bool {
+	var count int64
+	s.DB.Model(&SchemaMigration{}).Where("version = ?", version).Count(&count)
+	return count > 0
+}
+
+// legacyInfraSettings 旧版本保存在设置表中的启动配置
+type legacyInfraSettings struct {
+	Httpport    int
+	Redishost   string
+	Redisport   int
+	Redispasswd string
+	Redisdb     int
+	Backend     string
+}
+
+// moveInfraSettings 把设置表中的 Redis、HTTP 端口和运行模式写入配置文件，然后删除这些字段
+// 配置文件、环境变量或命令行参数中已经设置的配置项不会被覆盖；已经有配置文件时不写入，只记录日志
+func moveInfraSettings(tx *gorm.DB) error {
+	columns := []string{"httpport", "redishost", "redisport", "redispasswd", "redisdb", "backend"}
+	var legacy legacyInfraSettings
+	re := tx.Table("settings").Select(columns).Where("deleted_at IS NULL").Order("id ASC").Limit(1).Scan(&legacy)
+	if re.Error != nil {
+		return fmt.Errorf("读取设置表中的启动配置失败: %w", re.Error)
+	}
+
+	if re.RowsAffected > 0 {
+		cfg := config.Get()
+		file := struct {
+			Backend string       `toml:"backend"`
+			HTTP    config.HTTP  `toml:"http"`
+			Redis   config.Redis `toml:"redis"`
+		}{cfg.Backend, cfg.HTTP, cfg.Redis}
+		apply := func(key string, ok bool, set func()) {
+			if ok && !config.IsSet(key) {
+				set()
+			}
+		}
+		apply("http.port", legacy.Httpport > 0, func() { file.HTTP.Port = legacy.Httpport })
+		apply("redis.host", legacy.Redishost != "", func() { file.Redis.Host = legacy.Redishost })
+		apply("redis.port", legacy.Redisport > 0, func() { file.Redis.Port = legacy.Redisport })
+		apply("redis.password", legacy.Redispasswd != "", func() { file.Redis.Password = legacy.Redispasswd })
+		apply("redis.db", true, func() { file.Redis.DB = legacy.Redisdb })
+		apply("backend", legacy.Backend == config.BackendLocal, func() { file.Backend = legacy.Backend })
+
+		if config.File() != "" {
+			mylog.Logger.Warn("设置表中的启动配置不再使用，已有配置文件，请确认配置文件中的设置",
+				zap.String("file", config.File()), zap.Int("httpport", legacy.Httpport),
+				zap.String("redis", fmt.Sprintf("%s:%d/%d", legacy.Redishost, legacy.Redisport, legacy.Redisdb)),
+				zap.String("backend", legacy.Backend))
+		} else {
+			path := cfg.Path("DBS", config.FileName)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			buf.WriteString("# 由旧版本设置表中的 Redis、HTTP 端口和运行模式生成，修改后需要重启程序\n\n")
+			if err := toml.NewEncoder(&buf).Encode(file); err != nil {
+				return err
+			}
+			// 文件中有 Redis 密码
+			if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+				return fmt.Errorf("写入配置文件 %s 失败: %w", path, err)
+			}
+			mylog.Logger.Info("设置表中的启动配置已写入配置文件", zap.String("file", path))
+			// 本次启动使用写入的配置
+			cfg.Backend, cfg.HTTP, cfg.Redis = file.Backend, file.HTTP, file.Redis
+			config.Set(cfg)
+		}
+	}
+
+	for _, column := range columns {
+		if !tx.Migrator().HasColumn(&v1Setting{}, column) {
+			continue
+		}
+		if err := dropColumn(tx, &v1Setting{}, column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 版本 1 的表结构
+var schemaV1 = []interface{}{
+	&v1User{}, &v1Orders{}, &v1WalletAddress{}, &v1Setting{}, &v1ApiKey{},
+	&v1TradeIdTaskID{}, &v1AmountLock{}, &v1RateHistory{}, &v1Currency{}, &v1Merchant{},
+}
+
+type v1User struct {
+	gorm.Model
+	UserName string `gorm:"column:UserName"`
+	PassWord string `gorm:"column:PassWord"`
+}
+
+func (v1User) TableName() string { return "users" }
+
+type v1Orders struct {
+	gorm.Model
+	TradeId            string
+	OrderId            string
+	BlockTransactionId string
+	Amount             float64
+	ActualAmount       float64
+	Type               string
+	AllowedTypes       string
+	Token              string
+	Status             int
+	Lang               string
+	Rate               float64
+	MerchantID         uint `gorm:"default:0"`
+	NotifyUrl          string
+	RedirectUrl        string
+	CallbackNum        int
+	CallBackConfirm    int
+	StartTime          int64
+	ExpirationTime     int64
+	PaidAt             int64 `gorm:"default:0"`
+}
+
+func (v1Orders) TableName() string { return "orders" }
+
+type v1WalletAddress struct {
+	gorm.Model
+	Currency string
+	Token    string
+	Status   int
+}
+
+func (v1WalletAddress) TableName() string { return "wallet_addresses" }
+
+type v1Branding struct {
+	BrandLogo    string
+	PrimaryColor string
+	FooterHtml   string
+	SupportLinks string
+}
+
+type v1Setting struct {
+	gorm.Model
+	AppUrl                 string
+	SecretKey              string
+	Httpport               int
+	Tgbotkey               string
+	Tgchatid               string
+	Barkkey                string
+	Redishost              string
+	Redisport              int
+	Redispasswd            string
+	Redisdb                int
+	ExpirationDate         time.Duration
+	AppName                string
+	CustomerServiceContact string
+	RateProviders          string  `gorm:"default:okx,binance,htx"`
+	RateMaxDeviation       float64 `gorm:"default:3"`
+	RateMaxChange          float64 `gorm:"default:10"`
+	StaticRates            string
+	Language               string `gorm:"default:zh-CN"`
+	LegacyApiErrors        bool
+	MetricsToken           string
+	Backend                string     `gorm:"default:redis"`
+	Branding               v1Branding `gorm:"embedded"`
+}
+
+func (v1Setting) TableName() string { return "settings" }
+
+type v1ApiKey struct {
+	gorm.Model
+	Tronscan  string
+	Trongrid  string
+	Etherscan string
+}
+
+func (v1ApiKey) TableName() string { return "api_keys" }
+
+type v1TradeIdTaskID struct {
+	gorm.Model
+	TradeId string `gorm:"column:TradeId"`
+	TaskID  string `gorm:"column:TaskID"`
+}
+
+func (v1TradeIdTaskID) TableName() string { return "trade_id_task_ids" }
+
+type v1AmountLock struct {
+	Key       string `gorm:"primaryKey"`
+	ExpiresAt int64  `gorm:"index"`
+}
+
+func (v1AmountLock) TableName() string { return "amount_locks" }
+
+type v1RateHistory struct {
+	gorm.Model
+	Currency   string `gorm:"index"`
+	Rate       float64
+	MarketRate float64
+	Source     string
+}
+
+func (v1RateHistory) TableName() string { return "rate_histories" }
+
+type v1Currency struct {
+	gorm.Model
+	Name             string `gorm:"uniqueIndex"`
+	Rate             float64
+	AutoRate         bool
+	MarkupPercent    float64
+	FixedOffset      float64
+	MinRate          float64
+	MaxRate          float64
+	Rounding         string
+	RoundingDecimals int
+}
+
+func (v1Currency) TableName() string { return "currencies" }
+
+type v1Merchant struct {
+	gorm.Model
+	Name                   string `gorm:"uniqueIndex"`
+	SecretKey              string
+	Status                 int
+	AppName                string
+	CustomerServiceContact string
+	Branding               v1Branding `gorm:"embedded"`
+}
+
+func (v1Merchant) TableName() string { return "merchants" }
+
+// 版本 5 增加的字段
+type v5Merchant struct {
+	Sandbox bool `gorm:"default:false"`
+}
+
+func (v5Merchant) TableName() string { return "merchants" }
+
+type v5Orders struct {
+	Sandbox bool `gorm:"default:false"`
+}
+
+func (v5Orders) TableName() string { return "orders" }
+
+// 版本 6 增加的字段和表
+type v6User struct {
+	Role string
+}
+
+func (v6User) TableName() string { return "users" }
+
+type v6AuditLog struct {
+	gorm.Model
+	UserID    uint `gorm:"index"`
+	UserName  string
+	Action    string `gorm:"index"`
+	Target    string
+	Detail    string
+	IP        string
+	RequestID string
+}
+
+func (v6AuditLog) TableName() string { return "audit_logs" }
+
+// 版本 7 增加的字段
+type v7Setting struct {
+	MetricsPublic bool `gorm:"default:false"`
+}
+
+func (v7Setting) TableName() string { return "settings" }
+
+// 版本 8 增加的字段
+type v8User struct {
+	TokenVersion int `gorm:"default:0"`
+}
+
+func (v8User) TableName() string { return "users" }
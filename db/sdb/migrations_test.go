@@ -0,0 +1,202 @@
+package sdb
+
+import (
+	"errors"
+	"testing"
+	"upay_pro/config"
+	"upay_pro/mylog"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// newTestStore 创建内存 SQLite 数据库，迁移 4 生成的配置文件写入临时目录
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	mylog.Logger = zap.NewNop()
+
+	cfg := config.Default()
+	cfg.DataDir = t.TempDir()
+	cfg.Database.DSN = ":memory:"
+	old := config.Get()
+	config.Set(cfg)
+	t.Cleanup(func() { config.Set(old) })
+
+	store, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 内存数据库只在一个连接中存在
+	db, err := store.DB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// 已经执行过的迁移不会重复执行
+func TestMigrateIdempotent(t *testing.T) {
+	store := newTestStore(t)
+
+	n, err := store.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(migrations) {
+		t.Fatalf("第一次执行了 %d 个迁移，期望 %d", n, len(migrations))
+	}
+	n, err = store.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("第二次执行了 %d 个迁移，期望 0", n)
+	}
+
+	states, err := store.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range states {
+		if !s.Applied {
+			t.Fatalf("迁移 %d 没有记录为已执行", s.Version)
+		}
+	}
+}
+
+// 旧版本 AutoMigrate 创建的钱包地址表中有汇率字段
+type legacyWalletAddress struct {
+	gorm.Model
+	Currency string
+	Token    string
+	Status   int
+	Rate     float64
+	AutoRate bool `gorm:"column:AutoRate"`
+}
+
+func (legacyWalletAddress) TableName() string { return "wallet_addresses" }
+
+// 旧版本的数据库升级时，钱包地址表中每个币种最新的汇率迁移到币种表
+func TestMigrateLegacyWalletRates(t *testing.T) {
+	store := newTestStore(t)
+
+	if err := store.DB.AutoMigrate(&legacyWalletAddress{}); err != nil {
+		t.Fatal(err)
+	}
+	wallets := []legacyWalletAddress{
+		{Currency: "USDT-TRC20", Token: "TOld", Rate: 7.1},
+		{Currency: "TRX", Token: "TTrx", Rate: 2.2, AutoRate: true},
+		{Currency: "USDT-TRC20", Token: "TNew", Rate: 7.3},
+	}
+	if err := store.DB.Create(&wallets).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]struct {
+		rate float64
+		auto bool
+	}{
+		"USDT-TRC20": {7.3, false},
+		"TRX":        {2.2, true},
+	}
+	for name, w := range want {
+		currency := store.GetCurrency(name)
+		if currency.Rate != w.rate || currency.AutoRate != w.auto {
+			t.Fatalf("%s 的汇率 %v 自动汇率 %v，期望 %v %v", name, currency.Rate, currency.AutoRate, w.rate, w.auto)
+		}
+	}
+	m := store.DB.Migrator()
+	for _, column := range []string{"rate", "AutoRate"} {
+		if m.HasColumn(&v1WalletAddress{}, column) {
+			t.Fatalf("钱包地址表中的 %s 字段没有删除", column)
+		}
+	}
+	if !m.HasIndex("wallet_addresses", "idx_wallet_addresses_deleted_at") {
+		t.Fatal("删除汇率字段后钱包地址表的索引丢失")
+	}
+	// 钱包地址保留
+	var count int64
+	store.DB.Model(&WalletAddress{}).Count(&count)
+	if count != int64(len(wallets)) {
+		t.Fatalf("钱包地址数量 %d，期望 %d", count, len(wallets))
+	}
+}
+
+// 按版本号从大到小回滚，没有回滚步骤的迁移返回 ErrIrreversible
+func TestRollback(t *testing.T) {
+	store := newTestStore(t)
+	if _, err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	m := store.DB.Migrator()
+
+	rollback := func(version int64) {
+		t.Helper()
+		n, err := store.Rollback(1)
+		if err != nil || n != 1 {
+			t.Fatalf("回滚迁移 %d: n=%d err=%v", version, n, err)
+		}
+		if store.migrationApplied(version) {
+			t.Fatalf("迁移 %d 回滚后仍然记录为已执行", version)
+		}
+	}
+
+	rollback(8)
+	if m.HasColumn(&v8User{}, "TokenVersion") {
+		t.Fatal("回滚迁移 8 后用户表仍有 token_version 字段")
+	}
+
+	rollback(7)
+	if m.HasColumn(&v7Setting{}, "MetricsPublic") {
+		t.Fatal("回滚迁移 7 后设置表仍有 metrics_public 字段")
+	}
+
+	rollback(6)
+	if m.HasColumn(&v6User{}, "Role") || m.HasTable(&v6AuditLog{}) {
+		t.Fatal("回滚迁移 6 后仍有用户角色字段或审计日志表")
+	}
+
+	rollback(5)
+	if m.HasColumn(&v5Merchant{}, "Sandbox") || m.HasColumn(&v5Orders{}, "Sandbox") {
+		t.Fatal("回滚迁移 5 后仍有沙盒字段")
+	}
+	// SQLite 删除字段会重建表，原有索引需要保留
+	if !m.HasIndex("merchants", "idx_merchants_name") || !m.HasIndex("orders", "idx_orders_trade_id") {
+		t.Fatal("删除沙盒字段后索引丢失")
+	}
+
+	// 回滚之后可以重新执行
+	if n, err := store.Migrate(); err != nil || n != 4 {
+		t.Fatalf("重新执行迁移: n=%d err=%v", n, err)
+	}
+	if !m.HasColumn(&v6User{}, "Role") || !m.HasColumn(&v5Merchant{}, "Sandbox") {
+		t.Fatal("重新执行迁移后缺少字段")
+	}
+	if n, err := store.Rollback(4); err != nil || n != 4 {
+		t.Fatalf("回滚迁移 8、7、6、5: n=%d err=%v", n, err)
+	}
+
+	// 迁移 4 没有回滚步骤
+	if n, err := store.Rollback(1); n != 0 || !errors.Is(err, ErrIrreversible) {
+		t.Fatalf("回滚迁移 4: n=%d err=%v，期望 ErrIrreversible", n, err)
+	}
+	if !store.migrationApplied(4) {
+		t.Fatal("不能回滚的迁移被删除了记录")
+	}
+
+	// 手动删除迁移 4 的记录后可以继续回滚迁移 3
+	store.DB.Delete(&SchemaMigration{Version: 4})
+	if !m.HasIndex("orders", "idx_orders_trade_id") {
+		t.Fatal("迁移 3 没有创建订单号索引")
+	}
+	rollback(3)
+	if m.HasIndex("orders", "idx_orders_trade_id") {
+		t.Fatal("回滚迁移 3 后仍有订单号索引")
+	}
+}
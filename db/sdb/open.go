@@ -0,0 +1,51 @@
+package sdb
+
+// 数据库类型和连接参数在启动配置中设置，见 config 包，多个实例部署时可以共用 PostgreSQL 或 MySQL 数据库
+//
+//	sqlite    dsn 为数据库文件路径，默认为数据目录下的 DBS/upay_pro.db
+//	postgres  例如 host=127.0.0.1 user=upay password=xxx dbname=upay port=5432 sslmode=disable
+//	mysql     例如 upay:xxx@tcp(127.0.0.1:3306)/upay?charset=utf8mb4
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"upay_pro/config"
+
+	"github.com/glebarez/sqlite"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// dialector 根据启动配置返回数据库驱动
+func dialector(cfg config.Config) (gorm.Dialector, error) {
+	dsn := cfg.Database.DSN
+	switch cfg.Database.Driver {
+	case config.DriverPostgres:
+		if dsn == "" {
+			return nil, fmt.Errorf("使用 postgres 时需要设置数据库连接参数 dsn")
+		}
+		return postgres.Open(dsn), nil
+	case config.DriverMySQL:
+		if dsn == "" {
+			return nil, fmt.Errorf("使用 mysql 时需要设置数据库连接参数 dsn")
+		}
+		// 时间字段需要解析为 time.Time
+		cfg, err := mysqldriver.ParseDSN(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("mysql 连接参数错误: %w", err)
+		}
+		cfg.ParseTime = true
+		return mysql.Open(cfg.FormatDSN()), nil
+	}
+	if dsn == "" {
+		dsn = cfg.Path("DBS", "upay_pro.db")
+	}
+	// 确保目录存在
+	if dir := filepath.Dir(dsn); dir != "." {
+		os.MkdirAll(dir, 0755)
+	}
+	return sqlite.Open(dsn), nil
+}
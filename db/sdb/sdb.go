@@ -3,38 +3,80 @@ package sdb
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"math/rand"
-	"os"
 	"time"
+	"upay_pro/config"
 	"upay_pro/mylog"
 
-	"github.com/glebarez/sqlite"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-var DB *gorm.DB
+// Store 数据库，由 main 按启动配置创建后传给需要访问数据库的服务
+type Store struct {
+	DB *gorm.DB
+	// 系统设置缓存，见 settings.go
+	settings settingCache
+}
+
+// New 按启动配置连接数据库
+func New(cfg config.Config) (*Store, error) {
+	d, err := dialector(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("数据库配置错误: %w", err)
+	}
+	db, err := gorm.Open(d, &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("连接数据库失败（%s）: %w", cfg.Database.Driver, err)
+	}
+	mylog.Logger.Info("数据库链接成功", zap.String("driver", cfg.Database.Driver))
+	return &Store{DB: db}, nil
+}
 
-func init() {
-	// 确保目录存在
-	// 创建目录
-	os.MkdirAll("DBS", 0755)
-	db, err := gorm.Open(sqlite.Open("DBS/upay_pro.db"), &gorm.Config{})
+// Close 关闭数据库连接
+func (s *Store) Close() error {
+	db, err := s.DB.DB()
 	if err != nil {
-		mylog.Logger.Error("open db error", zap.Error(err))
-		mylog.Logger.Sync()
+		return err
 	}
-	mylog.Logger.Info("数据库链接成功")
-	DB = db
-	Start()
+	return db.Close()
 }
 
+// IsMigrateCommand 程序是否以 migrate 子命令运行
+func IsMigrateCommand() bool {
+	return len(config.Args) > 0 && config.Args[0] == "migrate"
+}
+
+// 后台用户的角色
+const (
+	RoleOwner    = "owner"    // 所有者，可以管理后台用户、钱包地址、商户、系统设置和 API 密钥
+	RoleOperator = "operator" // 运营，可以查看订单、手动补单、模拟支付和修改币种汇率
+	RoleViewer   = "viewer"   // 只读，只能查看订单、统计、钱包地址和汇率
+)
+
 type User struct {
 	gorm.Model
 	UserName string `gorm:"column:UserName"`
-	PassWord string `gorm:"column:PassWord"`
+	PassWord string `gorm:"column:PassWord" json:"-"`
+	Role     string // 角色 owner/operator/viewer
+	// 登录版本，修改密码或角色时加1，之前签发的 token 失效
+	TokenVersion int `gorm:"default:0" json:"-"`
+}
+
+// AuditLog 后台操作的审计日志，记录谁在什么时候修改了什么
+type AuditLog struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"` // 操作的用户，登录失败时为0
+	UserName  string // 操作时的用户名，用户删除后仍然可以查看
+	Action    string `gorm:"index"` // 操作，例如 wallet.update
+	Target    string // 操作的对象，例如钱包地址ID、订单号
+	Detail    string // 修改的内容，JSON 格式，密钥类字段不记录明文
+	IP        string
+	RequestID string
 }
 
 // 订单状态
@@ -54,9 +96,14 @@ type Orders struct {
 	BlockTransactionId string  // 区块id
 	Amount             float64 // 订单金额，保留2位小数
 	ActualAmount       float64 // 订单实际需要支付的金额，保留4位小数
-	Type               string  //钱包类型
+	Type               string  //钱包类型，买家还没有选择网络时为空
+	AllowedTypes       string  // 买家可以选择的钱包类型，逗号分隔，下单时已经指定钱包类型时为空
 	Token              string  // 所属钱包地址
 	Status             int     // 1：等待支付，2：支付成功，3：已过期
+	Lang               string  // 支付页面的语言，为空时按浏览器语言显示
+	Rate               float64 // 下单时使用的汇率
+	MerchantID         uint    `gorm:"default:0"`     // 下单的商户，0 表示使用系统设置下单，旧订单迁移后为 0
+	Sandbox            bool    `gorm:"default:false"` // 沙盒订单，查询测试网上的转账，可以模拟支付
 
 	NotifyUrl       string // 异步回调地址
 	RedirectUrl     string // 同步回调地址
@@ -64,51 +111,162 @@ type Orders struct {
 	CallBackConfirm int    // 回调是否已确认 1是 2否
 	StartTime       int64  // 订单开始时间（时间戳）
 	ExpirationTime  int64  // 订单过期时间（时间戳）
+	PaidAt          int64  `gorm:"default:0"` // 支付成功时间（毫秒时间戳），未支付和旧版本的订单为 0
 
 }
 
+// BeforeSave 订单保存为支付成功时记录支付时间，各个网络确认到账和手动补单都会经过这里
+func (o *Orders) BeforeSave(tx *gorm.DB) error {
+	if o.Status == StatusPaySuccess && o.PaidAt == 0 {
+		tx.Statement.SetColumn("PaidAt", time.Now().UnixMilli())
+	}
+	return nil
+}
+
 // 钱包状态
 const (
 	TokenStatusEnable  = 1 // 钱包启用
 	TokenStatusDisable = 2 // 钱包禁用
 )
 
-// 钱包地址表
+// 钱包地址表，汇率由币种表统一维护
 type WalletAddress struct {
 	gorm.Model
-	Currency string  // 币种
-	Token    string  // 钱包token
-	Status   int     // 1:启用 2:禁用
-	Rate     float64 // 汇率
-	AutoRate bool    `gorm:"column:AutoRate;default:false"` // 汇率是否自动维护
+	Currency string // 币种
+	Token    string // 钱包token
+	Status   int    // 1:启用 2:禁用
+}
+
+// 汇率取整方向
+const (
+	RoundingNone    = ""        // 不取整
+	RoundingNearest = "nearest" // 四舍五入
+	RoundingUp      = "up"      // 向上取整
+	RoundingDown    = "down"    // 向下取整
+)
+
+// 币种表，保存每个币种的汇率和汇率策略，同一币种的所有钱包共用
+type Currency struct {
+	gorm.Model
+	Name             string  `gorm:"uniqueIndex"` // 币种，和钱包地址表的 Currency 一致，例如 USDT-TRC20
+	Rate             float64 // 汇率，自动汇率时为已经应用汇率策略后的汇率
+	AutoRate         bool    // 汇率是否自动维护
+	MarkupPercent    float64 // 在市场汇率上加价的百分比，可以为负数
+	FixedOffset      float64 // 在加价后的汇率上再加减的固定值
+	MinRate          float64 // 最低汇率，0 表示不限制
+	MaxRate          float64 // 最高汇率，0 表示不限制
+	Rounding         string  // 取整方向 nearest/up/down，空表示不取整
+	RoundingDecimals int     // 取整保留的小数位数
+}
+
+// ApplyPolicy 按币种的汇率策略调整汇率：加价、固定偏移、取整，最后限制在最低和最高汇率之间
+func (c Currency) ApplyPolicy(rate float64) float64 {
+	rate = rate*(1+c.MarkupPercent/100) + c.FixedOffset
+
+	pow := math.Pow(10, float64(c.RoundingDecimals))
+	switch c.Rounding {
+	case RoundingNearest:
+		rate = math.Round(rate*pow) / pow
+	case RoundingUp:
+		rate = math.Ceil(rate*pow) / pow
+	case RoundingDown:
+		rate = math.Floor(rate*pow) / pow
+	}
 
-	// - 0 ：表示 false ，即 禁用 自动汇率功能
-	// - 1 ：表示 true ，即 启用 自动汇率功能
+	if c.MinRate > 0 && rate < c.MinRate {
+		rate = c.MinRate
+	}
+	if c.MaxRate > 0 && rate > c.MaxRate {
+		rate = c.MaxRate
+	}
+	return rate
 }
 
-// 汇率维护表
-/* type AutoRate struct {
+// OrderRate 下单时使用的汇率，自动汇率在更新时已经应用了汇率策略，手动汇率在这里应用
+func (c Currency) OrderRate() float64 {
+	if c.AutoRate {
+		return c.Rate
+	}
+	return c.ApplyPolicy(c.Rate)
+}
+
+// GetCurrency 获取币种的汇率策略，不存在时返回不做任何调整的默认策略
+func (s *Store) GetCurrency(name string) Currency {
+	var currency Currency
+	s.DB.Where("name = ?", name).Limit(1).Find(&currency)
+	if currency.ID == 0 {
+		currency.Name = name
+	}
+	return currency
+}
+
+// 汇率来源
+const (
+	RateSourceAuto   = "auto"   // 自动汇率任务
+	RateSourceManual = "manual" // 后台手动设置
+)
+
+// 汇率历史表，每次汇率更新都记录一条
+type RateHistory struct {
 	gorm.Model
-	Currency string `gorm:"column:currency"`                // 币种
-	AutoRate bool   `gorm:"column:autoRate default:false" ` // 汇率是否自动维护
-} */
+	Currency   string  `gorm:"index"` // 币种
+	Rate       float64 // 汇率
+	MarketRate float64 // 数据源的原始汇率，手动设置时为0
+	Source     string  // 来源 auto/manual
+}
 
 type Setting struct {
 	gorm.Model
 	AppUrl                 string
 	SecretKey              string
-	Httpport               int
 	Tgbotkey               string
 	Tgchatid               string
 	Barkkey                string
-	Redishost              string
-	Redisport              int
-	Redispasswd            string
-	Redisdb                int
 	ExpirationDate         time.Duration
 	AppName                string //应用名称
 	CustomerServiceContact string //客户服务联系方式
 
+	// 自动汇率数据源，逗号分隔，可选 okx、binance、htx、static
+	RateProviders    string  `gorm:"default:okx,binance,htx"`
+	RateMaxDeviation float64 `gorm:"default:3"`  // 单个数据源偏离中位数的最大百分比，超过则剔除
+	RateMaxChange    float64 `gorm:"default:10"` // 新汇率相对上一次有效汇率的最大变化百分比，超过则沿用旧汇率
+	StaticRates      string  // 固定汇率，格式：USDT=7.2,USDC=7.2,TRX=2.3
+
+	Language string `gorm:"default:zh-CN"` // 通知消息的语言，zh-CN 或 en
+
+	LegacyApiErrors bool // 下单接口按旧版格式返回错误，兼容旧的对接插件
+
+	MetricsToken  string // Prometheus 采集 /metrics 时使用的令牌
+	MetricsPublic bool   // 开启后 /metrics 不需要认证；默认需要监控令牌或后台登录
+
+	Branding // 支付页面的默认品牌设置
+}
+
+// 支付页面的品牌设置，系统设置中为默认值，商户中填写的字段覆盖默认值
+type Branding struct {
+	BrandLogo    string // 品牌图标地址
+	PrimaryColor string // 主题色，例如 #28a745
+	FooterHtml   string // 页面底部的自定义 HTML
+	SupportLinks string // 帮助链接，每行一个，格式：名称|链接
+}
+
+// 商户状态
+const (
+	MerchantStatusEnable  = 1 // 商户启用
+	MerchantStatusDisable = 2 // 商户禁用
+)
+
+// 商户表，商户使用自己的密钥签名下单，支付页面使用商户的品牌设置
+type Merchant struct {
+	gorm.Model
+	Name                   string `gorm:"uniqueIndex"` // 商户标识，也是模版覆盖目录 merchants/<Name> 的名称
+	SecretKey              string // 商户的签名密钥
+	Status                 int    // 1:启用 2:禁用
+	AppName                string // 支付页面显示的收款方，为空时使用系统设置
+	CustomerServiceContact string // 客服联系方式，为空时使用系统设置
+	Sandbox                bool   `gorm:"default:false"` // 沙盒商户，下单后查询测试网上的转账，可以模拟支付
+
+	Branding
 }
 type ApiKey struct {
 	gorm.Model
@@ -126,14 +284,25 @@ type TradeIdTaskID struct {
 	TaskID  string `gorm:"column:TaskID"`
 }
 
-func Start() {
+// 金额锁，local 模式下代替 Redis 锁定钱包地址和支付金额
+type AmountLock struct {
+	Key       string `gorm:"primaryKey"` // 钱包地址_金额
+	ExpiresAt int64  `gorm:"index"`      // 过期时间，毫秒时间戳
+}
+
+// Init 执行数据库迁移，并在表为空时写入默认用户、默认设置和默认 API 密钥
+func (s *Store) Init() error {
 	mylog.Logger.Info("开始初始化数据库")
 	mylog.Logger.Info("开始迁移数据库")
-	// 迁移用户表
-	DB.AutoMigrate(&User{})
+	// 表结构的变化都通过版本迁移完成，见 migrations.go
+	n, err := s.Migrate()
+	if err != nil {
+		return fmt.Errorf("数据库迁移失败: %w", err)
+	}
+	mylog.Logger.Info("数据库迁移完成", zap.Int("执行的迁移数量", n))
 
 	// 初始化用户表
-	result := DB.First(&User{})
+	result := s.DB.First(&User{})
 	if result.Error != nil {
 		mylog.Logger.Info("获取用户表失败")
 	}
@@ -144,9 +313,10 @@ func Start() {
 		mylog.Logger.Info("初始用户名:", zap.String("username", defaultuserusername))
 		mylog.Logger.Info("初始密码:", zap.String("password", Defaultuserpassword))
 		// 创建用户
-		result := DB.Create(&User{
+		result := s.DB.Create(&User{
 			UserName: defaultuserusername,
 			PassWord: hashedPassword,
+			Role:     RoleOwner,
 		})
 		if result.Error != nil {
 			mylog.Logger.Info("创建用户失败")
@@ -156,34 +326,25 @@ func Start() {
 
 	}
 
-	// 迁移订单表
-	DB.AutoMigrate(&Orders{})
-	// 迁移钱包地址表
-	DB.AutoMigrate(&WalletAddress{})
-	// 迁移设置表
-	DB.AutoMigrate(&Setting{})
-	//迁移apikey表
-	DB.AutoMigrate(&ApiKey{})
 	// 检查设置表是否为空，如果为空则插入默认设置
 	var settingCount int64
-	DB.Model(&Setting{}).Count(&settingCount)
+	s.DB.Model(&Setting{}).Count(&settingCount)
 	// 给设置表设置默认值
 	if settingCount == 0 {
 		mylog.Logger.Info("设置表为空，创建默认设置")
-		result := DB.Create(&Setting{
+		result := s.DB.Create(&Setting{
 			AppUrl:                 "http://localhost",
 			SecretKey:              GenerateSecretKey(48),
-			Httpport:               8090,
 			Tgbotkey:               "",
 			Tgchatid:               "",
 			Barkkey:                "",
-			Redishost:              "127.0.0.1",
-			Redisport:              6379,
-			Redispasswd:            "",
-			Redisdb:                0,
 			ExpirationDate:         ExpirationDate,
 			AppName:                "",
 			CustomerServiceContact: "",
+			RateProviders:          "okx,binance,htx",
+			RateMaxDeviation:       3,
+			RateMaxChange:          10,
+			Language:               "zh-CN",
 		})
 		if result.Error != nil {
 			mylog.Logger.Error("创建默认设置失败", zap.Error(result.Error))
@@ -195,10 +356,10 @@ func Start() {
 	// 给APIKEY表设置默认值
 	var apikeyCount int64
 	// 检查APIKEY表是否为空，如果为空则插入默认值
-	DB.Model(&ApiKey{}).Count(&apikeyCount)
+	s.DB.Model(&ApiKey{}).Count(&apikeyCount)
 	if apikeyCount == 0 {
 		mylog.Logger.Info("APIKEY表为空，创建默认设置")
-		result := DB.Create(&ApiKey{
+		result := s.DB.Create(&ApiKey{
 			Tronscan:  "28b6e96a-4630-442e-8f2b-35f80c8b54d6",
 			Trongrid:  "0232af66-3f6f-42a3-bd90-f184b38fba27",
 			Etherscan: "UPCN5AHEA1383NW5DUYZ3REE8V38TSS94N",
@@ -209,11 +370,7 @@ func Start() {
 			mylog.Logger.Info("APIKEY表默认设置创建成功")
 		}
 	}
-	// 迁移订单号和队列ID表
-	DB.AutoMigrate(&TradeIdTaskID{})
-	// 迁移汇率维护表
-	// DB.AutoMigrate(&AutoRate{})
-
+	return nil
 }
 
 const (
@@ -237,39 +394,6 @@ func GenerateSecretKey(length int) string {
 	return key.String()
 }
 
-func GetSetting() Setting {
-	var setting Setting
-	DB.First(&setting)
-
-	/* if result.RowsAffected == 0 {
-		mylog.Logger.Info("系统设置不存在，创建默认设置")
-		// 创建默认设置
-		defaultSetting := Setting{
-			AppUrl:                 "",
-			SecretKey:              GenerateSecretKey(48),
-			Httpport:               8080,
-			Tgbotkey:               "",
-			Tgchatid:               "",
-			Barkkey:                "",
-			Redishost:              "127.0.0.1",
-			Redisport:              6379,
-			Redispasswd:            "",
-			Redisdb:                0,
-			ExpirationDate:         ExpirationDate,
-			AppName:                "",
-			CustomerServiceContact: "",
-		}
-		createResult := DB.Create(&defaultSetting)
-		if createResult.Error != nil {
-			mylog.Logger.Error("创建默认设置失败", zap.Error(createResult.Error))
-			return setting // 返回空设置
-		}
-		return defaultSetting
-	} */
-
-	return setting
-}
-
 func HashPassword(password string) (string, error) {
 	cost := 12 // 计算成本，值越大越安全但越耗时
 	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), cost)
@@ -286,36 +410,140 @@ func VerifyPassword(inputPassword, storedHash string) bool {
 }
 
 // 因为同样的钱包类型，可能有多个钱包地址，所以这里返回一个数组
-func GetWalletAddress(type_ string) []WalletAddress {
+func (s *Store) GetWalletAddress(type_ string) []WalletAddress {
 
 	var walletAddress []WalletAddress
 
-	DB.Where("currency = ? and status = ?", type_, TokenStatusEnable).Find(&walletAddress)
+	s.DB.Where("currency = ? and status = ?", type_, TokenStatusEnable).Find(&walletAddress)
 	return walletAddress
 }
 
+// GetEnabledCurrencies 获取有启用钱包地址的所有钱包类型
+func (s *Store) GetEnabledCurrencies() []string {
+	var currencies []string
+	s.DB.Model(&WalletAddress{}).Where("status = ?", TokenStatusEnable).Distinct().Order("currency").Pluck("currency", &currencies)
+	return currencies
+}
+
 func (n WalletAddress) String() string {
-	return fmt.Sprintf("%s:%v", n.Token, n.Rate)
+	return n.Token
 }
 
-func GetOrderByOrderId(orderId string) Orders {
+// GetMerchant 获取商户，商户不存在时返回 false
+func (s *Store) GetMerchant(id uint) (Merchant, bool) {
+	var merchant Merchant
+	re := s.DB.Where("id = ?", id).Limit(1).Find(&merchant)
+	return merchant, re.Error == nil && merchant.ID != 0
+}
+
+// GetOrderByOrderId 获取商户的订单，不同商户的订单号可以重复
+func (s *Store) GetOrderByOrderId(merchantID uint, orderId string) Orders {
 	var order Orders
-	DB.Where("order_id = ?", orderId).Last(&order)
+	s.DB.Where("merchant_id = ? AND order_id = ?", merchantID, orderId).Last(&order)
 	return order
 }
 
-func GetApiKey() ApiKey {
+// SecretKeyOf 获取签名使用的密钥，商户订单使用商户的密钥，其余使用系统设置的密钥
+func (s *Store) SecretKeyOf(merchantID uint) string {
+	if merchantID != 0 {
+		if merchant, ok := s.GetMerchant(merchantID); ok {
+			return merchant.SecretKey
+		}
+	}
+	return s.GetSetting().SecretKey
+}
+
+// RecordRate 记录一条汇率历史
+func (s *Store) RecordRate(currency string, rate, marketRate float64, source string) {
+	re := s.DB.Create(&RateHistory{Currency: currency, Rate: rate, MarketRate: marketRate, Source: source})
+	if re.Error != nil {
+		mylog.Logger.Error("记录汇率历史失败", zap.String("币种", currency), zap.Error(re.Error))
+	}
+}
+
+// LastMarketRate 获取币种最近一次自动汇率的原始汇率，没有记录时返回0
+func (s *Store) LastMarketRate(currency string) float64 {
+	var history RateHistory
+	s.DB.Where("currency = ? AND source = ? AND market_rate > 0", currency, RateSourceAuto).Order("id DESC").Limit(1).Find(&history)
+	return history.MarketRate
+}
+
+// migrateWalletRates 旧版本每个钱包地址单独保存汇率和自动汇率，这里按币种取最新的一条写入币种表，然后删除旧字段
+func migrateWalletRates(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn(&v1WalletAddress{}, "rate") {
+		return nil
+	}
+	mylog.Logger.Info("开始迁移钱包地址表中的汇率到币种表")
+
+	var rows []struct {
+		Currency string
+		Rate     float64
+		AutoRate bool `gorm:"column:AutoRate"`
+	}
+	// 字段名由 gorm 加引号，兼容不同的数据库
+	re := tx.Table("wallet_addresses").Select("currency, rate, ?", clause.Column{Name: "AutoRate"}).Where("deleted_at IS NULL").Order("id ASC").Scan(&rows)
+	if re.Error != nil {
+		return fmt.Errorf("读取钱包地址表中的汇率失败: %w", re.Error)
+	}
+
+	// 后面的记录覆盖前面的记录，保证使用每个币种最新的汇率
+	latest := make(map[string]int)
+	for i, row := range rows {
+		latest[row.Currency] = i
+	}
+	for name, i := range latest {
+		var currency v1Currency
+		tx.Where("name = ?", name).Limit(1).Find(&currency)
+		// 币种表已经有汇率时不覆盖
+		if currency.Rate > 0 {
+			continue
+		}
+		currency.Name = name
+		currency.Rate = rows[i].Rate
+		currency.AutoRate = rows[i].AutoRate
+		if err := tx.Save(&currency).Error; err != nil {
+			return err
+		}
+	}
+	if err := dropColumn(tx, &v1WalletAddress{}, "rate"); err != nil {
+		return err
+	}
+	if err := dropColumn(tx, &v1WalletAddress{}, "AutoRate"); err != nil {
+		return err
+	}
+	mylog.Logger.Info("钱包地址表中的汇率迁移完成", zap.Int("钱包数量", len(rows)))
+	return nil
+}
+
+func (s *Store) GetApiKey() ApiKey {
 	var apikey ApiKey
-	DB.First(&apikey)
+	s.DB.First(&apikey)
 	return apikey
 }
 
-func GetUserByUsername() string {
+// GetUser 按用户名查询后台用户
+func (s *Store) GetUser(name string) (User, bool) {
 	var user User
-	re := DB.First(&user)
+	// 字段名有大写字母，使用 map 条件由 gorm 给字段名加引号，兼容 PostgreSQL 和 MySQL
+	re := s.DB.Where(map[string]interface{}{"UserName": name}).Limit(1).Find(&user)
+	if re.Error != nil {
+		mylog.Logger.Error("查询用户失败", zap.String("username", name), zap.Error(re.Error))
+		return User{}, false
+	}
+	return user, user.ID != 0
+}
+
+// CountOwners 角色为所有者的用户数量，至少需要保留一个所有者
+func (s *Store) CountOwners() int64 {
+	var n int64
+	s.DB.Model(&User{}).Where("role = ?", RoleOwner).Count(&n)
+	return n
+}
+
+// RecordAudit 记录一条审计日志，失败时只记录错误日志，不影响操作本身
+func (s *Store) RecordAudit(log AuditLog) {
+	re := s.DB.Create(&log)
 	if re.Error != nil {
-		mylog.Logger.Error("查询用户失败", zap.Error(re.Error))
-		return ""
+		mylog.Logger.Error("记录审计日志失败", zap.String("action", log.Action), zap.String("target", log.Target), zap.Error(re.Error))
 	}
-	return user.UserName
 }
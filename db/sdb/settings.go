@@ -0,0 +1,81 @@
+package sdb
+
+// 系统设置缓存
+// 读取设置不再每次查询数据库；在后台保存设置时立即刷新缓存并通知订阅者。
+// 多个实例共用数据库时，其他实例保存的设置在 settingTTL 内生效
+
+import (
+	"sync"
+	"time"
+	"upay_pro/mylog"
+
+	"go.uber.org/zap"
+)
+
+// 缓存的有效时间，超过后下一次读取时重新查询数据库
+const settingTTL = 30 * time.Second
+
+// settingCache 系统设置缓存和订阅者
+type settingCache struct {
+	mu          sync.RWMutex
+	current     Setting
+	loadedAt    time.Time
+	subscribers []func(old, new Setting)
+}
+
+// GetSetting 获取系统设置，优先使用缓存；查询数据库失败时返回缓存中的设置
+func (s *Store) GetSetting() Setting {
+	s.settings.mu.RLock()
+	setting, fresh := s.settings.current, !s.settings.loadedAt.IsZero() && time.Since(s.settings.loadedAt) < settingTTL
+	s.settings.mu.RUnlock()
+	if fresh {
+		return setting
+	}
+
+	reloaded, err := s.ReloadSetting()
+	if err != nil {
+		mylog.Logger.Error("读取系统设置失败", zap.Error(err))
+		return setting
+	}
+	return reloaded
+}
+
+// ReloadSetting 从数据库重新读取系统设置，设置有变化时通知订阅者
+func (s *Store) ReloadSetting() (Setting, error) {
+	var setting Setting
+	if err := s.DB.First(&setting).Error; err != nil {
+		return Setting{}, err
+	}
+
+	s.settings.mu.Lock()
+	old, loaded := s.settings.current, !s.settings.loadedAt.IsZero()
+	s.settings.current = setting
+	s.settings.loadedAt = time.Now()
+	subscribers := append([]func(old, new Setting){}, s.settings.subscribers...)
+	s.settings.mu.Unlock()
+
+	// 第一次读取不算变化；保存设置时 UpdatedAt 会更新
+	if loaded && !setting.UpdatedAt.Equal(old.UpdatedAt) {
+		for _, fn := range subscribers {
+			fn(old, setting)
+		}
+	}
+	return setting, nil
+}
+
+// UpdateSetting 保存系统设置中的字段，然后刷新缓存，返回保存后的设置
+func (s *Store) UpdateSetting(id uint, updates map[string]interface{}) (Setting, error) {
+	// 先读取一次，保存后和保存前的设置比较
+	s.GetSetting()
+	if err := s.DB.Model(&Setting{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		return Setting{}, err
+	}
+	return s.ReloadSetting()
+}
+
+// OnSettingChange 订阅系统设置的变化，fn 在保存设置的协程中调用，不能阻塞
+func (s *Store) OnSettingChange(fn func(old, new Setting)) {
+	s.settings.mu.Lock()
+	s.settings.subscribers = append(s.settings.subscribers, fn)
+	s.settings.mu.Unlock()
+}
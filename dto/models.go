@@ -1,5 +1,7 @@
 package dto
 
+import "html/template"
+
 // 定义一个异步通知请求参数的结构体
 
 type PaymentNotification_request struct {
@@ -11,6 +13,7 @@ type PaymentNotification_request struct {
 	BlockTransactionID string  `json:"block_transaction_id"`
 	Signature          string  `json:"signature"`
 	Status             int     `json:"status"`
+	Sandbox            bool    `json:"sandbox,omitempty"` // 沙盒订单，只在为 true 时发送并参与签名
 }
 
 type Data struct {
@@ -21,6 +24,7 @@ type Data struct {
 	Token          string  `json:"token"`
 	ExpirationTime int64   `json:"expiration_time"`
 	PaymentURL     string  `json:"payment_url"`
+	Sandbox        bool    `json:"sandbox,omitempty"` // 沙盒订单，只在沙盒商户下单时返回
 }
 
 // 定义返回的结构体|创建订单后返回的数据
@@ -34,15 +38,38 @@ type Response struct {
 // 定义模版所需数据视图模型
 // 模版所需数据视图模型
 type PaymentViewModel struct {
-	Currency               string  `json:"currency"`
-	TradeId                string  `json:"tradeId"`
-	ActualAmount           float64 `json:"actualAmount"`
-	Token                  string  `json:"token"`
-	ExpirationTime         int64   `json:"expirationTime"`
-	RedirectUrl            string  `json:"redirectUrl"`            // 添加重定向URL
-	AppName                string  `json:"appName"`                //应用名称
-	CustomerServiceContact string  `json:"customerServiceContact"` //客户服务联系方式
-	Logo                   string  `json:"logo"`                   // 币种图标
+	Currency               string    `json:"currency"`
+	TradeId                string    `json:"tradeId"`
+	ActualAmount           float64   `json:"actualAmount"`
+	Token                  string    `json:"token"`
+	ExpirationTime         int64     `json:"expirationTime"`
+	RedirectUrl            string    `json:"redirectUrl"`            // 添加重定向URL
+	AppName                string    `json:"appName"`                //应用名称
+	CustomerServiceContact string    `json:"customerServiceContact"` //客户服务联系方式
+	Logo                   string    `json:"logo"`                   // 币种图标
+	Amount                 float64   `json:"amount"`                 // 订单金额（人民币）
+	Networks               []Network `json:"networks"`               // 买家可以选择的网络，已经选择网络时为空
+	Lang                   string    `json:"lang"`                   // 支付页面的语言
+	Sandbox                bool      `json:"sandbox"`                // 沙盒订单，支付页面提示使用测试网支付
+
+	// 品牌设置，商户的设置优先于系统设置
+	BrandLogo    string        `json:"brandLogo"`    // 品牌图标
+	PrimaryColor string        `json:"primaryColor"` // 主题色
+	FooterHtml   template.HTML `json:"footerHtml"`   // 页面底部的自定义 HTML，由管理员配置，不转义
+	SupportLinks []SupportLink `json:"supportLinks"` // 帮助链接
+}
+
+// SupportLink 支付页面底部的帮助链接
+type SupportLink struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+// Network 支付页面可以选择的网络
+type Network struct {
+	Currency string `json:"currency"` // 钱包类型，例如 USDT-BSC
+	Network  string `json:"network"`  // 网络名称
+	Logo     string `json:"logo"`     // 币种图标
 }
 
 // RequestParams 用于存储请求参数
@@ -53,4 +80,15 @@ type RequestParams struct {
 	NotifyURL   string  `json:"notify_url" validate:"required,url"`
 	RedirectURL string  `json:"redirect_url" validate:"required,url"`
 	Signature   string  `json:"signature" validate:"required"`
+	Lang        string  `json:"lang"`        // 支付页面和接口返回信息的语言，zh-CN 或 en，不参与签名
+	MerchantID  uint    `json:"merchant_id"` // 商户ID，传入时使用商户的密钥签名，不参与签名
+}
+
+// SimulateParams 沙盒订单模拟支付的请求参数，使用商户的密钥签名
+type SimulateParams struct {
+	MerchantID uint    `json:"merchant_id" validate:"required"` // 不参与签名
+	TradeID    string  `json:"trade_id" validate:"required"`
+	Amount     float64 `json:"amount" validate:"gte=0"` // 模拟的转账金额，为 0 时使用订单的支付金额
+	Signature  string  `json:"signature" validate:"required"`
+	Lang       string  `json:"lang"` // 接口返回信息的语言，不参与签名
 }
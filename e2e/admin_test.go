@@ -0,0 +1,374 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"strings"
+	"testing"
+	"upay_pro/config"
+	"upay_pro/db/sdb"
+)
+
+// adminResponse 后台接口的响应，成功时 code 为 0，失败时 code 为 1、error.code 为错误码
+type adminResponse struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Error   apiError        `json:"error"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// admin 登录后台的用户
+type admin struct {
+	h      *harness
+	client *http.Client
+}
+
+// addUser 添加后台用户
+func (h *harness) addUser(name, password, role string) sdb.User {
+	h.t.Helper()
+	hash, err := sdb.HashPassword(password)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	user := sdb.User{UserName: name, PassWord: hash, Role: role}
+	if err := h.store.DB.Create(&user).Error; err != nil {
+		h.t.Fatal(err)
+	}
+	return user
+}
+
+// login 登录后台，返回带登录 cookie 的客户端
+func (h *harness) login(name, password string) *admin {
+	h.t.Helper()
+	jar, _ := cookiejar.New(nil)
+	a := &admin{h: h, client: &http.Client{Jar: jar}}
+	if status, r := a.do(http.MethodPost, "/login", map[string]string{"username": name, "password": password}); status != http.StatusOK {
+		h.t.Fatalf("用户 %s 登录失败: %d %v %s", name, status, r.Error.Code, r.Message)
+	}
+	return a
+}
+
+// do 调用后台接口，返回 HTTP 状态码和响应
+func (a *admin) do(method, path string, body any) (int, adminResponse) {
+	a.h.t.Helper()
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, a.h.api.URL+path, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		a.h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r adminResponse
+	json.NewDecoder(resp.Body).Decode(&r)
+	return resp.StatusCode, r
+}
+
+// 各角色只能调用拥有权限的后台接口
+func TestAdminRolePermissions(t *testing.T) {
+	h := newHarness(t, config.BackendLocal)
+	h.addUser("owner1", "owner123", sdb.RoleOwner)
+	h.addUser("operator1", "operator123", sdb.RoleOperator)
+	h.addUser("viewer1", "viewer123", sdb.RoleViewer)
+	data := h.createOrder("rbac-1", "USDT-TRC20", 10)
+
+	owner := h.login("owner1", "owner123")
+	operator := h.login("operator1", "operator123")
+	viewer := h.login("viewer1", "viewer123")
+
+	wallet := map[string]any{"Currency": "USDT-TRC20", "Token": "TRbacWallet", "Status": sdb.TokenStatusEnable}
+	cases := []struct {
+		name   string
+		admin  *admin
+		method string
+		path   string
+		body   any
+		status int
+	}{
+		{"只读用户查看订单", viewer, http.MethodGet, "/admin/api/orders", nil, http.StatusOK},
+		{"只读用户查看钱包地址", viewer, http.MethodGet, "/admin/api/wallets", nil, http.StatusOK},
+		{"只读用户添加钱包地址", viewer, http.MethodPost, "/admin/api/wallets", wallet, http.StatusForbidden},
+		{"只读用户查看系统设置", viewer, http.MethodGet, "/admin/api/settings", nil, http.StatusForbidden},
+		{"只读用户手动补单", viewer, http.MethodPost, "/admin/api/manual-complete-order", map[string]string{"order_id": data.TradeID}, http.StatusForbidden},
+		{"运营查看 API 密钥", operator, http.MethodGet, "/admin/api/apikeys", nil, http.StatusForbidden},
+		{"运营添加钱包地址", operator, http.MethodPost, "/admin/api/wallets", wallet, http.StatusForbidden},
+		{"运营查看审计日志", operator, http.MethodGet, "/admin/api/audit-logs", nil, http.StatusForbidden},
+		{"运营手动补单", operator, http.MethodPost, "/admin/api/manual-complete-order", map[string]string{"order_id": data.TradeID}, http.StatusOK},
+		{"所有者查看 API 密钥", owner, http.MethodGet, "/admin/api/apikeys", nil, http.StatusOK},
+		{"所有者添加钱包地址", owner, http.MethodPost, "/admin/api/wallets", wallet, http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			status, r := c.admin.do(c.method, c.path, c.body)
+			if status != c.status {
+				t.Fatalf("返回 %d %v %s，期望 %d", status, r.Error.Code, r.Message, c.status)
+			}
+			if status == http.StatusForbidden && (r.Code != 1 || r.Error.Code != "FORBIDDEN") {
+				t.Fatalf("错误码 %v %v，期望 FORBIDDEN", r.Code, r.Error.Code)
+			}
+		})
+	}
+
+	// 只读用户只能修改自己的密码
+	if status, _ := viewer.do(http.MethodPost, "/admin/api/users/password", map[string]any{"userId": 1, "newPassword": "changed123"}); status != http.StatusForbidden {
+		t.Fatalf("只读用户修改其他用户的密码返回 %d", status)
+	}
+	me, _ := h.store.GetUser("viewer1")
+	if status, _ := viewer.do(http.MethodPost, "/admin/api/users/password", map[string]any{"userId": me.ID, "newPassword": "changed123"}); status != http.StatusOK {
+		t.Fatalf("只读用户修改自己的密码返回 %d", status)
+	}
+}
+
+// 所有者管理用户，修改角色、修改密码和删除用户后之前的登录立即失效，不能删除最后一个所有者
+func TestAdminUserManagement(t *testing.T) {
+	h := newHarness(t, config.BackendLocal)
+	ownerUser := h.addUser("owner1", "owner123", sdb.RoleOwner)
+	// 初始化数据库时创建的默认用户也是所有者，只保留一个所有者
+	h.store.DB.Where("id <> ?", ownerUser.ID).Delete(&sdb.User{})
+	owner := h.login("owner1", "owner123")
+
+	status, r := owner.do(http.MethodPost, "/admin/api/users", map[string]string{"username": "staff1", "password": "staff123", "role": sdb.RoleViewer})
+	if status != http.StatusOK {
+		t.Fatalf("添加用户返回 %d %v %s", status, r.Error.Code, r.Message)
+	}
+	var staff sdb.User
+	json.Unmarshal(r.Data, &staff)
+	if strings.Contains(string(r.Data), "PassWord") {
+		t.Fatal("用户信息中返回了密码")
+	}
+	staffPath := "/admin/api/users/" + strconv.Itoa(int(staff.ID))
+
+	// 修改角色后之前的登录失效，重新登录后使用新的角色
+	session := h.login("staff1", "staff123")
+	if status, _ := session.do(http.MethodGet, "/admin/api/currencies", nil); status != http.StatusOK {
+		t.Fatalf("只读用户查看币种返回 %d", status)
+	}
+	if status, _ := session.do(http.MethodPut, "/admin/api/currencies/USDT-TRC20", map[string]any{"Rate": 7.1}); status != http.StatusForbidden {
+		t.Fatalf("只读用户修改汇率返回 %d", status)
+	}
+	if status, _ := owner.do(http.MethodPut, staffPath, map[string]string{"role": sdb.RoleOperator}); status != http.StatusOK {
+		t.Fatalf("修改角色返回 %d", status)
+	}
+	if status, _ := session.do(http.MethodGet, "/admin/api/currencies", nil); status != http.StatusUnauthorized {
+		t.Fatalf("修改角色后之前的登录返回 %d", status)
+	}
+	session = h.login("staff1", "staff123")
+	if status, _ := session.do(http.MethodPut, "/admin/api/currencies/USDT-TRC20", map[string]any{"Rate": 7.1}); status != http.StatusOK {
+		t.Fatalf("改为运营后修改汇率返回 %d", status)
+	}
+
+	// 修改密码后之前的登录失效；修改自己的密码时当前会话重新签发，不需要重新登录
+	if status, _ := owner.do(http.MethodPost, "/admin/api/users/password", map[string]any{"userId": staff.ID, "newPassword": "staff456"}); status != http.StatusOK {
+		t.Fatalf("修改其他用户的密码返回 %d", status)
+	}
+	if status, _ := session.do(http.MethodGet, "/admin/api/currencies", nil); status != http.StatusUnauthorized {
+		t.Fatalf("修改密码后之前的登录返回 %d", status)
+	}
+	session = h.login("staff1", "staff456")
+	stale := h.login("owner1", "owner123")
+	if status, _ := owner.do(http.MethodPost, "/admin/api/users/password", map[string]any{"userId": ownerUser.ID, "newPassword": "owner456"}); status != http.StatusOK {
+		t.Fatalf("修改自己的密码返回 %d", status)
+	}
+	if status, _ := owner.do(http.MethodGet, "/admin/api/currencies", nil); status != http.StatusOK {
+		t.Fatalf("修改自己的密码后当前会话返回 %d", status)
+	}
+	if status, _ := stale.do(http.MethodGet, "/admin/api/currencies", nil); status != http.StatusUnauthorized {
+		t.Fatalf("修改密码后其他会话返回 %d", status)
+	}
+
+	// 最后一个所有者不能删除，也不能改为其他角色
+	ownerPath := "/admin/api/users/" + strconv.Itoa(int(ownerUser.ID))
+	if status, _ := owner.do(http.MethodPut, ownerPath, map[string]string{"role": sdb.RoleViewer}); status != http.StatusBadRequest {
+		t.Fatalf("修改最后一个所有者的角色返回 %d", status)
+	}
+	if status, _ := owner.do(http.MethodDelete, ownerPath, nil); status != http.StatusBadRequest {
+		t.Fatalf("删除当前登录的用户返回 %d", status)
+	}
+
+	if status, _ := owner.do(http.MethodDelete, staffPath, nil); status != http.StatusOK {
+		t.Fatalf("删除用户返回 %d", status)
+	}
+	if status, _ := session.do(http.MethodGet, "/admin/api/orders", nil); status != http.StatusUnauthorized {
+		t.Fatalf("删除的用户仍然可以访问后台: %d", status)
+	}
+}
+
+// 后台的修改操作记录审计日志，密钥不记录明文
+func TestAuditLog(t *testing.T) {
+	h := newHarness(t, config.BackendLocal)
+	h.addUser("owner1", "owner123", sdb.RoleOwner)
+	owner := h.login("owner1", "owner123")
+
+	if status, _ := owner.do(http.MethodPost, "/admin/api/settings", map[string]any{"secretkey": "new-secret-key", "tgchatid": "42"}); status != http.StatusOK {
+		t.Fatalf("保存设置返回 %d", status)
+	}
+	if status, _ := owner.do(http.MethodPost, "/admin/api/apikeys", map[string]any{"etherscan": "etherscan-key"}); status != http.StatusOK {
+		t.Fatalf("保存 API 密钥返回 %d", status)
+	}
+	if status, _ := owner.do(http.MethodPost, "/admin/api/wallets", map[string]any{"Currency": "USDT-TRC20", "Token": "TAuditWallet", "Status": sdb.TokenStatusEnable}); status != http.StatusOK {
+		t.Fatalf("添加钱包地址返回 %d", status)
+	}
+
+	status, r := owner.do(http.MethodGet, "/admin/api/audit-logs?user=owner1", nil)
+	if status != http.StatusOK {
+		t.Fatalf("查询审计日志返回 %d", status)
+	}
+	var page struct {
+		Logs  []sdb.AuditLog `json:"logs"`
+		Total int64          `json:"total"`
+	}
+	json.Unmarshal(r.Data, &page)
+
+	actions := map[string]sdb.AuditLog{}
+	for _, log := range page.Logs {
+		if log.UserName != "owner1" || log.RequestID == "" {
+			t.Fatalf("审计日志缺少用户或请求ID: %+v", log)
+		}
+		actions[log.Action] = log
+	}
+	for _, action := range []string{"user.login", "setting.update", "apikey.update", "wallet.create"} {
+		if _, ok := actions[action]; !ok {
+			t.Fatalf("没有记录 %s，记录的操作: %v", action, page.Logs)
+		}
+	}
+	if d := actions["setting.update"].Detail; strings.Contains(d, "new-secret-key") || !strings.Contains(d, `"Tgchatid":"42"`) {
+		t.Fatalf("系统设置的审计内容 %s", d)
+	}
+	if d := actions["apikey.update"].Detail; strings.Contains(d, "etherscan-key") {
+		t.Fatalf("API 密钥的审计内容 %s", d)
+	}
+	if !strings.Contains(actions["wallet.create"].Detail, "TAuditWallet") {
+		t.Fatalf("钱包地址的审计内容 %s", actions["wallet.create"].Detail)
+	}
+}
+
+// /metrics 默认需要监控令牌或后台登录，开启公开访问后不需要认证
+func TestMetricsAuth(t *testing.T) {
+	h := newHarness(t, config.BackendLocal)
+	h.addUser("viewer1", "viewer123", sdb.RoleViewer)
+	h.setting(map[string]any{"MetricsToken": "metrics-token"})
+
+	get := func(client *http.Client, token string) int {
+		req, _ := http.NewRequest(http.MethodGet, h.api.URL+"/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := get(http.DefaultClient, ""); status != http.StatusUnauthorized {
+		t.Fatalf("没有认证返回 %d", status)
+	}
+	if status := get(http.DefaultClient, "wrong-token"); status != http.StatusUnauthorized {
+		t.Fatalf("令牌错误返回 %d", status)
+	}
+	if status := get(http.DefaultClient, "metrics-token"); status != http.StatusOK {
+		t.Fatalf("令牌正确返回 %d", status)
+	}
+	if status := get(h.login("viewer1", "viewer123").client, ""); status != http.StatusOK {
+		t.Fatalf("已登录后台返回 %d", status)
+	}
+
+	// 没有配置令牌时同样需要认证
+	h.setting(map[string]any{"MetricsToken": ""})
+	if status := get(http.DefaultClient, ""); status != http.StatusUnauthorized {
+		t.Fatalf("没有配置令牌时返回 %d", status)
+	}
+	h.setting(map[string]any{"MetricsPublic": true})
+	if status := get(http.DefaultClient, ""); status != http.StatusOK {
+		t.Fatalf("公开访问返回 %d", status)
+	}
+}
+
+// 回调未确认的订单包括还没有回调的新订单，筛选结果和导出一致
+func TestOrderCallbackFilter(t *testing.T) {
+	h := newHarness(t, config.BackendLocal)
+	h.addUser("viewer1", "viewer123", sdb.RoleViewer)
+	viewer := h.login("viewer1", "viewer123")
+	pending := h.createOrder("callback-pending", "USDT-TRC20", 10)
+	confirmed := h.createOrder("callback-confirmed", "USDT-TRC20", 11)
+	if err := h.store.DB.Model(&sdb.Orders{}).Where("trade_id = ?", confirmed.TradeID).
+		Update("call_back_confirm", sdb.CallBackConfirmOk).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(callback int) []string {
+		t.Helper()
+		status, r := viewer.do(http.MethodGet, "/admin/api/orders?callback="+strconv.Itoa(callback), nil)
+		if status != http.StatusOK {
+			t.Fatalf("订单列表返回 %d %s", status, r.Message)
+		}
+		var data struct{ Orders []sdb.Orders }
+		if err := json.Unmarshal(r.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, o := range data.Orders {
+			ids = append(ids, o.TradeId)
+		}
+		return ids
+	}
+	if ids := list(sdb.CallBackConfirmNo); len(ids) != 1 || ids[0] != pending.TradeID {
+		t.Fatalf("回调未确认的订单 %v，期望 %s", ids, pending.TradeID)
+	}
+	if ids := list(sdb.CallBackConfirmOk); len(ids) != 1 || ids[0] != confirmed.TradeID {
+		t.Fatalf("回调已确认的订单 %v，期望 %s", ids, confirmed.TradeID)
+	}
+
+	resp, err := viewer.client.Get(h.api.URL + "/admin/api/orders/export?callback=" + strconv.Itoa(sdb.CallBackConfirmNo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), pending.TradeID) || strings.Contains(string(body), confirmed.TradeID) {
+		t.Fatalf("导出回调未确认的订单: %d\n%s", resp.StatusCode, body)
+	}
+}
+
+// 手动补单统计支付成功的订单，没有选择网络的订单 currency 为 auto，重复补单不重复统计
+func TestManualCompleteCountsPaidOnce(t *testing.T) {
+	h := newHarness(t, config.BackendLocal)
+	h.addUser("operator1", "operator123", sdb.RoleOperator)
+	operator := h.login("operator1", "operator123")
+	data := h.createOrder("manual-auto", "USDT-TRC20,USDT-ERC20", 10)
+
+	// 指标是进程内全局的，比较补单前后的差值
+	paid := func() float64 {
+		t.Helper()
+		resp, err := operator.client.Get(h.api.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		for _, line := range strings.Split(string(body), "\n") {
+			if v, ok := strings.CutPrefix(line, `upay_orders_paid_total{currency="auto"} `); ok {
+				n, _ := strconv.ParseFloat(v, 64)
+				return n
+			}
+		}
+		return 0
+	}
+	before := paid()
+	for i := 0; i < 2; i++ {
+		if status, r := operator.do(http.MethodPost, "/admin/api/manual-complete-order", map[string]string{"order_id": data.TradeID}); status != http.StatusOK {
+			t.Fatalf("手动补单返回 %d %s", status, r.Message)
+		}
+	}
+	if n := paid() - before; n != 1 {
+		t.Fatalf("支付成功的订单数增加了 %v，期望 1", n)
+	}
+}
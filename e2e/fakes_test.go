@@ -0,0 +1,302 @@
+package e2e
+
+// 模拟的外部服务：区块链浏览器接口、商户的回调地址和 Telegram/Bark 通知
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"upay_pro/db/sdb"
+	"upay_pro/dto"
+)
+
+// transfer 模拟的链上 USDT 转账
+type transfer struct {
+	To     string
+	Amount float64 // USDT 金额，接口中按 6 位小数返回
+	TxID   string
+	Time   time.Time
+	// 还没有确认，只有 Tronscan 返回确认状态
+	Unconfirmed bool
+}
+
+// quant 链上的转账数量
+func (tr transfer) quant() string {
+	return fmt.Sprintf("%d", int64(math.Round(tr.Amount*1e6)))
+}
+
+// explorer 模拟的区块链浏览器接口，按地址返回最近的一笔转账
+type explorer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	transfers []transfer
+	requests  int
+	// 不为 nil 时直接返回这个结果，模拟接口返回错误
+	override any
+}
+
+func newExplorer(t *testing.T, respond func(r *http.Request, latest func(address string) (transfer, bool)) any) *explorer {
+	e := &explorer{}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		e.requests++
+		override := e.override
+		e.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if override != nil {
+			json.NewEncoder(w).Encode(override)
+			return
+		}
+		json.NewEncoder(w).Encode(respond(r, e.latest))
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+// add 加入一笔转账
+func (e *explorer) add(tr transfer) {
+	if tr.Time.IsZero() {
+		tr.Time = time.Now()
+	}
+	e.mu.Lock()
+	e.transfers = append(e.transfers, tr)
+	e.mu.Unlock()
+}
+
+// confirm 确认交易 txID
+func (e *explorer) confirm(txID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i := range e.transfers {
+		if e.transfers[i].TxID == txID {
+			e.transfers[i].Unconfirmed = false
+		}
+	}
+}
+
+// latest 转入 address 的最近一笔转账
+func (e *explorer) latest(address string) (transfer, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i := len(e.transfers) - 1; i >= 0; i-- {
+		if strings.EqualFold(e.transfers[i].To, address) {
+			return e.transfers[i], true
+		}
+	}
+	return transfer{}, false
+}
+
+// respondWith 之后的请求都返回 body，nil 时恢复正常
+func (e *explorer) respondWith(body any) {
+	e.mu.Lock()
+	e.override = body
+	e.mu.Unlock()
+}
+
+// count 收到的请求数
+func (e *explorer) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.requests
+}
+
+// tronscanResponse Tronscan /api/token_trc20/transfers
+func tronscanResponse(r *http.Request, latest func(string) (transfer, bool)) any {
+	transfers := []map[string]any{}
+	if tr, ok := latest(r.URL.Query().Get("toAddress")); ok {
+		transfers = append(transfers, map[string]any{
+			"transaction_id": tr.TxID,
+			"block_ts":       tr.Time.UnixMilli(),
+			"to_address":     tr.To,
+			"quant":          tr.quant(),
+			"confirmed":      !tr.Unconfirmed,
+			"finalResult":    "SUCCESS",
+			"tokenInfo":      map[string]any{"tokenAbbr": "USDT", "tokenDecimal": 6},
+		})
+	}
+	return map[string]any{"total": len(transfers), "token_transfers": transfers}
+}
+
+// trongridResponse TronGrid /v1/accounts/{address}/transactions/trc20
+func trongridResponse(r *http.Request, latest func(string) (transfer, bool)) any {
+	data := []map[string]any{}
+	// 路径为 /v1/accounts/{address}/transactions/trc20
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 5 {
+		if tr, ok := latest(parts[2]); ok {
+			data = append(data, map[string]any{
+				"transaction_id":  tr.TxID,
+				"block_timestamp": tr.Time.UnixMilli(),
+				"to":              tr.To,
+				"type":            "Transfer",
+				"value":           tr.quant(),
+				"token_info":      map[string]any{"symbol": "USDT", "decimals": 6},
+			})
+		}
+	}
+	return map[string]any{"success": true, "data": data}
+}
+
+// etherscanResponse Etherscan module=account&action=tokentx
+func etherscanResponse(r *http.Request, latest func(string) (transfer, bool)) any {
+	tr, ok := latest(r.URL.Query().Get("address"))
+	if !ok {
+		return map[string]any{"status": "0", "message": "No transactions found", "result": []any{}}
+	}
+	return map[string]any{"status": "1", "message": "OK", "result": []map[string]any{{
+		"hash":          tr.TxID,
+		"timeStamp":     fmt.Sprintf("%d", tr.Time.Unix()),
+		"to":            tr.To,
+		"value":         tr.quant(),
+		"tokenSymbol":   "USDT",
+		"tokenDecimal":  "6",
+		"confirmations": "12",
+	}}}
+}
+
+// testnetSepolia Sepolia 的链ID，测试网接口只返回这条链上的转账
+const testnetSepolia = "11155111"
+
+// testnetResponse 测试网的 Etherscan V2 接口，按 chainid 和 contractaddress 返回转账
+func testnetResponse(r *http.Request, latest func(string) (transfer, bool)) any {
+	q := r.URL.Query()
+	tr, ok := latest(q.Get("address"))
+	if !ok || q.Get("chainid") != testnetSepolia {
+		return map[string]any{"status": "0", "message": "No transactions found", "result": []any{}}
+	}
+	return map[string]any{"status": "1", "message": "OK", "result": []map[string]any{{
+		"hash":            tr.TxID,
+		"timeStamp":       fmt.Sprintf("%d", tr.Time.Unix()),
+		"contractAddress": q.Get("contractaddress"),
+		"to":              tr.To,
+		"value":           tr.quant(),
+		"tokenSymbol":     "USDT",
+		"confirmations":   "3",
+	}}}
+}
+
+// callback 商户收到的异步回调
+type callback struct {
+	dto.PaymentNotification_request
+	// 按接口文档的规则验证签名是否正确
+	SignatureValid bool
+}
+
+// merchant 模拟的商户回调地址，前 failures 次回调返回错误，之后返回 ok
+type merchant struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	secretKey string
+	failures  int
+	callbacks []callback
+}
+
+func newMerchant(t *testing.T, secretKey string) *merchant {
+	m := &merchant{secretKey: secretKey}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.notify))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *merchant) notify(w http.ResponseWriter, r *http.Request) {
+	var n dto.PaymentNotification_request
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	secretKey := m.secretKey
+	m.mu.Unlock()
+	params := []string{
+		fmt.Sprintf("trade_id=%s", n.TradeID),
+		fmt.Sprintf("order_id=%s", n.OrderID),
+		fmt.Sprintf("amount=%g", n.Amount),
+		fmt.Sprintf("actual_amount=%g", n.ActualAmount),
+		fmt.Sprintf("token=%s", n.Token),
+		fmt.Sprintf("block_transaction_id=%s", n.BlockTransactionID),
+		fmt.Sprintf("status=%d", n.Status),
+	}
+	if n.Sandbox {
+		params = append(params, "sandbox=true")
+	}
+	valid := n.Signature == sign(params, secretKey)
+
+	m.mu.Lock()
+	m.callbacks = append(m.callbacks, callback{PaymentNotification_request: n, SignatureValid: valid})
+	fail := m.failures > 0
+	if fail {
+		m.failures--
+	}
+	m.mu.Unlock()
+
+	if fail {
+		http.Error(w, "fail", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// useKey 按商户的密钥验证回调签名
+func (m *merchant) useKey(secretKey string) {
+	m.mu.Lock()
+	m.secretKey = secretKey
+	m.mu.Unlock()
+}
+
+// failNext 接下来的 n 次回调返回错误
+func (m *merchant) failNext(n int) {
+	m.mu.Lock()
+	m.failures = n
+	m.mu.Unlock()
+}
+
+// received 收到的订单 tradeID 的回调
+func (m *merchant) received(tradeID string) []callback {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []callback
+	for _, c := range m.callbacks {
+		if c.TradeID == tradeID {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// notifier 记录支付成功通知和告警，代替 Telegram 和 Bark
+type notifier struct {
+	mu     sync.Mutex
+	paid   []string
+	alerts []string
+}
+
+func (n *notifier) OrderPaid(order sdb.Orders) {
+	n.mu.Lock()
+	n.paid = append(n.paid, order.TradeId)
+	n.mu.Unlock()
+}
+
+func (n *notifier) Alert(title, body string) {
+	n.mu.Lock()
+	n.alerts = append(n.alerts, title)
+	n.mu.Unlock()
+}
+
+// notified 订单 tradeID 是否发送了支付成功通知
+func (n *notifier) notified(tradeID string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, id := range n.paid {
+		if id == tradeID {
+			return true
+		}
+	}
+	return false
+}
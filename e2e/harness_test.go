@@ -0,0 +1,298 @@
+package e2e
+
+// 端到端测试
+// 使用内存 SQLite、miniredis 和 httptest 模拟的区块链浏览器接口、商户回调地址，按 main 的方式组装完整的服务，
+// 通过 HTTP 接口下单，在模拟的区块链浏览器中加入转账后运行订单检查任务，检查订单状态和商户收到的回调
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"upay_pro/ERC20_USDT"
+	"upay_pro/chains"
+	"upay_pro/config"
+	"upay_pro/cron"
+	"upay_pro/db/rdb"
+	"upay_pro/db/sdb"
+	"upay_pro/dto"
+	"upay_pro/lock"
+	"upay_pro/mq"
+	"upay_pro/mylog"
+	"upay_pro/testnet"
+	"upay_pro/tron"
+	"upay_pro/watcher"
+	"upay_pro/web"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 测试使用的钱包地址和汇率
+const (
+	walletTRC20 = "TTestWalletTRC20"
+	walletERC20 = "0x00000000000000000000000000000000000e2e01"
+	testRate    = 7
+)
+
+func TestMain(m *testing.M) {
+	// 模版和静态文件按相对路径加载，在项目根目录下运行
+	if err := os.Chdir(".."); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	gin.SetMode(gin.TestMode)
+	mylog.Logger = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// harness 一个完整的服务和它依赖的外部服务
+type harness struct {
+	t      *testing.T
+	cfg    config.Config
+	store  *sdb.Store
+	locker lock.Locker
+	jobs   *cron.Service
+	// redis 模式下的 Redis，local 模式下为 nil
+	redis *miniredis.Miniredis
+	// 服务的 HTTP 地址
+	api *httptest.Server
+
+	tronscan  *explorer
+	trongrid  *explorer
+	etherscan *explorer
+	// 沙盒订单查询的测试网 Etherscan 接口
+	testnet  *explorer
+	merchant *merchant
+	notifier *notifier
+}
+
+// newHarness 按运行模式启动服务，测试结束时按相反的顺序停止
+// 定时任务不启动调度器，测试中直接调用 CheckOrders，避免和测试同时检查订单
+func newHarness(t *testing.T, backend string) *harness {
+	t.Helper()
+	h := &harness{t: t, notifier: &notifier{}}
+
+	h.cfg = config.Default()
+	h.cfg.DataDir = t.TempDir()
+	h.cfg.Backend = backend
+	h.cfg.Database.DSN = ":memory:"
+	if backend == config.BackendRedis {
+		h.redis = miniredis.RunT(t)
+		h.cfg.Redis.Host = h.redis.Host()
+		h.cfg.Redis.Port, _ = strconv.Atoi(h.redis.Port())
+	}
+	// 模版覆盖目录和后台重新加载配置使用全局配置
+	old := config.Get()
+	config.Set(h.cfg)
+	t.Cleanup(func() { config.Set(old) })
+
+	store, err := sdb.New(h.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 内存数据库只在一个连接中存在
+	db, err := store.DB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { store.Close() })
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	h.store = store
+	h.seed()
+
+	var queue mq.Scheduler
+	if backend == config.BackendRedis {
+		client := rdb.New(h.cfg)
+		t.Cleanup(func() { client.Close() })
+		h.locker = lock.NewRedis(client)
+		queue = mq.NewAsynq(h.cfg, store)
+	} else {
+		h.locker = lock.NewDB(store)
+		queue = mq.NewLocal(store)
+	}
+	if err := queue.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stop(t, "订单过期任务", queue.Close) })
+
+	h.tronscan = newExplorer(t, tronscanResponse)
+	h.trongrid = newExplorer(t, trongridResponse)
+	h.etherscan = newExplorer(t, etherscanResponse)
+	h.testnet = newExplorer(t, testnetResponse)
+	h.merchant = newMerchant(t, store.GetSetting().SecretKey)
+
+	noKey := func() string { return "" }
+	tronscan := tron.NewTronscan(store, noKey)
+	tronscan.BaseURL = h.tronscan.URL
+	trongrid := tron.NewTronGrid(store, noKey)
+	trongrid.BaseURL = h.trongrid.URL
+	etherscan := ERC20_USDT.New(store, noKey)
+	etherscan.BaseURL = h.etherscan.URL
+	watchers := watcher.Set{
+		"USDT-TRC20": {tronscan, trongrid},
+		"USDT-ERC20": {etherscan},
+	}
+
+	// 沙盒订单只查询以太坊测试网 Sepolia
+	sepolia, _ := chains.Testnet("USDT-ERC20", h.cfg.Sandbox)
+	sepoliaWatcher := testnet.NewEtherscan(store, noKey, sepolia)
+	sepoliaWatcher.BaseURL = h.testnet.URL
+	sandbox := watcher.NewSandbox(store, watcher.Set{"USDT-ERC20": {sepoliaWatcher}})
+
+	h.jobs = cron.New(store, h.locker, h.notifier, watchers, sandbox)
+	h.jobs.CallbackRetryDelay = 50 * time.Millisecond
+	t.Cleanup(func() { stop(t, "定时任务", h.jobs.Stop) })
+
+	server := web.New(h.cfg, store, h.locker, queue, h.jobs)
+	h.api = httptest.NewServer(server.Handler())
+	t.Cleanup(func() {
+		h.api.Close()
+		stop(t, "HTTP 服务", server.Stop)
+	})
+	return h
+}
+
+// stop 停止组件，超时或出错时测试失败
+func stop(t *testing.T, name string, fn func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := fn(ctx); err != nil {
+		t.Errorf("停止%s失败: %v", name, err)
+	}
+}
+
+// seed 添加测试使用的币种和钱包地址
+func (h *harness) seed() {
+	h.t.Helper()
+	for _, row := range []any{
+		&sdb.Currency{Name: "USDT-TRC20", Rate: testRate},
+		&sdb.Currency{Name: "USDT-ERC20", Rate: testRate},
+		&sdb.WalletAddress{Currency: "USDT-TRC20", Token: walletTRC20, Status: sdb.TokenStatusEnable},
+		&sdb.WalletAddress{Currency: "USDT-ERC20", Token: walletERC20, Status: sdb.TokenStatusEnable},
+	} {
+		if err := h.store.DB.Create(row).Error; err != nil {
+			h.t.Fatal(err)
+		}
+	}
+}
+
+// setting 修改系统设置
+func (h *harness) setting(updates map[string]any) {
+	h.t.Helper()
+	if _, err := h.store.UpdateSetting(h.store.GetSetting().ID, updates); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// orderRequest 下单接口的请求参数
+func (h *harness) orderRequest(orderID, typ string, amount float64) dto.RequestParams {
+	p := dto.RequestParams{
+		Type:        typ,
+		OrderID:     orderID,
+		Amount:      amount,
+		NotifyURL:   h.merchant.URL + "/notify",
+		RedirectURL: "https://shop.example.com/return",
+	}
+	p.Signature = sign([]string{
+		"type=" + p.Type,
+		fmt.Sprintf("amount=%g", p.Amount),
+		"notify_url=" + p.NotifyURL,
+		"order_id=" + p.OrderID,
+		"redirect_url=" + p.RedirectURL,
+	}, h.store.GetSetting().SecretKey)
+	return p
+}
+
+// apiError 统一错误响应中的错误码
+type apiError struct {
+	Code string `json:"code"`
+}
+
+// orderResponse 下单接口的响应，成功时 data 有值，失败时 error.code 为错误码
+type orderResponse struct {
+	StatusCode int      `json:"status_code"`
+	Code       int      `json:"code"`
+	Message    string   `json:"message"`
+	Error      apiError `json:"error"`
+	Data       dto.Data `json:"data"`
+}
+
+// post 调用下单接口，返回 HTTP 状态码和响应
+func (h *harness) post(p dto.RequestParams) (int, orderResponse) {
+	h.t.Helper()
+	body, _ := json.Marshal(p)
+	resp, err := http.Post(h.api.URL+"/api/create_order", "application/json", bytes.NewReader(body))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r orderResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		h.t.Fatalf("解析下单响应失败: %v", err)
+	}
+	return resp.StatusCode, r
+}
+
+// createOrder 下单，失败时测试终止
+func (h *harness) createOrder(orderID, typ string, amount float64) dto.Data {
+	h.t.Helper()
+	status, r := h.post(h.orderRequest(orderID, typ, amount))
+	if status != http.StatusOK {
+		h.t.Fatalf("下单失败: %d %s %s", status, r.Error.Code, r.Message)
+	}
+	return r.Data
+}
+
+// order 查询订单
+func (h *harness) order(tradeID string) sdb.Orders {
+	h.t.Helper()
+	var order sdb.Orders
+	if err := h.store.DB.Where("trade_id = ?", tradeID).First(&order).Error; err != nil {
+		h.t.Fatalf("查询订单 %s 失败: %v", tradeID, err)
+	}
+	return order
+}
+
+// locked 钱包地址和金额是否被锁定
+func (h *harness) locked(token string, amount float64) bool {
+	h.t.Helper()
+	key := lock.Key(token, amount)
+	if h.redis != nil {
+		return h.redis.Exists(key)
+	}
+	var n int64
+	h.store.DB.Model(&sdb.AmountLock{}).Where(&sdb.AmountLock{Key: key}).Where("expires_at > ?", time.Now().UnixMilli()).Count(&n)
+	return n > 0
+}
+
+// eventually 在 timeout 内等待 cond 成立
+func eventually(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待%s超时", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// sign 按接口文档的规则签名：参数排序后用 & 连接，拼接密钥后计算 MD5
+func sign(params []string, secretKey string) string {
+	sort.Strings(params)
+	return fmt.Sprintf("%x", md5.Sum([]byte(strings.Join(params, "&")+secretKey)))
+}
@@ -0,0 +1,200 @@
+package e2e
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+	"upay_pro/config"
+	"upay_pro/db/sdb"
+	"upay_pro/dto"
+)
+
+// 同一个钱包同时有多个相同金额的订单时，每个订单的支付金额按 0.01 递增，不会重复
+func TestCreateOrderAllocatesUniqueAmounts(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+
+	for i, amount := range []float64{1.43, 1.44, 1.45} {
+		data := h.createOrder(fmt.Sprintf("unique-%d", i), "USDT-TRC20", 10)
+		if data.Token != walletTRC20 || data.ActualAmount != amount {
+			t.Fatalf("第 %d 个订单分配了 %s %v，期望 %s %v", i+1, data.Token, data.ActualAmount, walletTRC20, amount)
+		}
+		if !h.locked(walletTRC20, amount) {
+			t.Fatalf("金额 %v 没有锁定", amount)
+		}
+		order := h.order(data.TradeID)
+		if order.Status != sdb.StatusWaitPay || order.Rate != testRate {
+			t.Fatalf("订单状态 %d 汇率 %v", order.Status, order.Rate)
+		}
+	}
+}
+
+// 商户订单号重复并且订单仍在等待支付时返回原来的订单，并延长过期时间
+func TestDuplicateOrderID(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+
+	first := h.createOrder("dup-1", "USDT-TRC20", 10)
+	time.Sleep(10 * time.Millisecond)
+	second := h.createOrder("dup-1", "USDT-TRC20", 10)
+
+	if second.TradeID != first.TradeID || second.ActualAmount != first.ActualAmount || second.Token != first.Token {
+		t.Fatalf("重复下单返回了新的订单: %+v, 原订单 %+v", second, first)
+	}
+	if second.ExpirationTime <= first.ExpirationTime {
+		t.Fatalf("重复下单没有延长过期时间: %d <= %d", second.ExpirationTime, first.ExpirationTime)
+	}
+	var n int64
+	h.store.DB.Model(&sdb.Orders{}).Where("order_id = ?", "dup-1").Count(&n)
+	if n != 1 {
+		t.Fatalf("订单数 %d，期望 1", n)
+	}
+	// 重复下单不占用新的金额
+	if h.locked(walletTRC20, 1.44) {
+		t.Fatal("重复下单锁定了新的金额")
+	}
+}
+
+// 签名错误、参数被篡改和商户不存在时拒绝下单，不创建订单
+func TestCreateOrderSignature(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+
+	wrong := h.orderRequest("sig-1", "USDT-TRC20", 10)
+	wrong.Signature = "0123456789abcdef0123456789abcdef"
+
+	tampered := h.orderRequest("sig-2", "USDT-TRC20", 10)
+	tampered.Amount = 1
+
+	unknown := h.orderRequest("sig-3", "USDT-TRC20", 10)
+	unknown.MerchantID = 42
+
+	cases := []struct {
+		name string
+		req  dto.RequestParams
+		code string
+	}{
+		{"签名错误", wrong, "SIGNATURE_INVALID"},
+		{"金额被篡改", tampered, "SIGNATURE_INVALID"},
+		{"商户不存在", unknown, "MERCHANT_INVALID"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			status, r := h.post(c.req)
+			if status != http.StatusUnauthorized || r.Error.Code != c.code {
+				t.Fatalf("返回 %d %s，期望 401 %s", status, r.Error.Code, c.code)
+			}
+		})
+	}
+
+	var n int64
+	h.store.DB.Model(&sdb.Orders{}).Count(&n)
+	if n != 0 {
+		t.Fatalf("签名错误时创建了 %d 个订单", n)
+	}
+}
+
+// 商户使用自己的密钥签名下单，回调使用商户的密钥签名
+func TestMerchantSignature(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+
+	m := sdb.Merchant{Name: "shop", SecretKey: "merchant-secret", Status: sdb.MerchantStatusEnable}
+	if err := h.store.DB.Create(&m).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 使用系统设置的密钥签名的商户订单被拒绝
+	req := h.orderRequest("merchant-1", "USDT-TRC20", 10)
+	req.MerchantID = m.ID
+	if status, r := h.post(req); status != http.StatusUnauthorized || r.Error.Code != "SIGNATURE_INVALID" {
+		t.Fatalf("返回 %d %s，期望 401 SIGNATURE_INVALID", status, r.Error.Code)
+	}
+
+	req.Signature = sign([]string{
+		"type=" + req.Type,
+		fmt.Sprintf("amount=%g", req.Amount),
+		"notify_url=" + req.NotifyURL,
+		"order_id=" + req.OrderID,
+		"redirect_url=" + req.RedirectURL,
+	}, m.SecretKey)
+	status, r := h.post(req)
+	if status != http.StatusOK {
+		t.Fatalf("商户下单失败: %d %s %s", status, r.Error.Code, r.Message)
+	}
+
+	h.merchant.useKey(m.SecretKey)
+	h.tronscan.add(transfer{To: r.Data.Token, Amount: r.Data.ActualAmount, TxID: "tx-merchant"})
+	h.jobs.CheckOrders()
+	eventually(t, 5*time.Second, "商户收到回调", func() bool { return len(h.merchant.received(r.Data.TradeID)) > 0 })
+	if cb := h.merchant.received(r.Data.TradeID)[0]; !cb.SignatureValid {
+		t.Fatalf("回调没有使用商户的密钥签名: %+v", cb)
+	}
+}
+
+// 订单到期后设置为过期并释放金额，之后收到的转账不再入账
+func TestOrderExpiration(t *testing.T) {
+	for _, backend := range []string{config.BackendRedis, config.BackendLocal} {
+		t.Run(backend, func(t *testing.T) {
+			h := newHarness(t, backend)
+			h.setting(map[string]any{"expiration_date": time.Second})
+
+			data := h.createOrder("expire-1", "USDT-TRC20", 10)
+			// redis 模式下 asynq 每 5 秒检查一次到期的任务
+			eventually(t, 15*time.Second, "订单过期", func() bool {
+				return h.order(data.TradeID).Status == sdb.StatusExpired
+			})
+
+			// 过期订单收到转账后不再入账
+			h.tronscan.add(transfer{To: data.Token, Amount: data.ActualAmount, TxID: "tx-late"})
+			h.jobs.CheckOrders()
+			if order := h.order(data.TradeID); order.Status != sdb.StatusExpired {
+				t.Fatalf("过期订单状态变为 %d", order.Status)
+			}
+			if len(h.merchant.received(data.TradeID)) != 0 {
+				t.Fatal("过期订单发送了回调")
+			}
+
+			// 金额锁和订单同时到期，miniredis 的过期时间需要手动推进
+			if h.redis != nil {
+				h.redis.FastForward(time.Second)
+			}
+			if h.locked(data.Token, data.ActualAmount) {
+				t.Fatal("订单过期后金额仍被锁定")
+			}
+			next := h.createOrder("expire-2", "USDT-TRC20", 10)
+			if next.ActualAmount != data.ActualAmount {
+				t.Fatalf("过期订单的金额没有释放: %v != %v", next.ActualAmount, data.ActualAmount)
+			}
+		})
+	}
+}
+
+// 选择网络前的多网络订单没有收款地址，不能生成支付二维码
+func TestPaymentQRCode(t *testing.T) {
+	h := newHarness(t, config.BackendLocal)
+	get := func(tradeID string) (int, string, orderResponse) {
+		t.Helper()
+		resp, err := http.Get(h.api.URL + "/pay/qr/" + tradeID + ".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r orderResponse
+		if resp.Header.Get("Content-Type") != "image/png" {
+			json.NewDecoder(resp.Body).Decode(&r)
+		}
+		return resp.StatusCode, resp.Header.Get("Content-Type"), r
+	}
+
+	single := h.createOrder("qr-single", "USDT-TRC20", 10)
+	if status, contentType, _ := get(single.TradeID); status != http.StatusOK || contentType != "image/png" {
+		t.Fatalf("单网络订单的二维码返回 %d %s", status, contentType)
+	}
+
+	multi := h.createOrder("qr-multi", "USDT-TRC20,USDT-ERC20", 10)
+	if multi.Token != "" {
+		t.Fatalf("多网络订单下单时分配了收款地址 %s", multi.Token)
+	}
+	if status, _, r := get(multi.TradeID); status != http.StatusBadRequest || r.Error.Code != "VALIDATION_FAILED" {
+		t.Fatalf("没有选择网络的订单返回 %d %s，期望 400 VALIDATION_FAILED", status, r.Error.Code)
+	}
+}
@@ -0,0 +1,258 @@
+package e2e
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+	"upay_pro/config"
+	"upay_pro/db/sdb"
+	"upay_pro/events"
+)
+
+// 区块链浏览器中出现金额和地址都符合的转账后订单入账，商户收到签名正确的回调，金额锁释放
+func TestPaymentDetected(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+	data := h.createOrder("pay-1", "USDT-TRC20", 10)
+	ch, cancel := events.Subscribe(data.TradeID)
+	defer cancel()
+
+	// 金额不符合的转账不入账
+	h.tronscan.add(transfer{To: data.Token, Amount: data.ActualAmount + 0.01, TxID: "tx-wrong-amount"})
+	h.jobs.CheckOrders()
+	if order := h.order(data.TradeID); order.Status != sdb.StatusWaitPay {
+		t.Fatalf("金额不符合的转账入账了，订单状态 %d", order.Status)
+	}
+
+	h.tronscan.add(transfer{To: data.Token, Amount: data.ActualAmount, TxID: "tx-pay-1"})
+	h.jobs.CheckOrders()
+
+	order := h.order(data.TradeID)
+	if order.Status != sdb.StatusPaySuccess || order.BlockTransactionId != "tx-pay-1" || order.PaidAt == 0 {
+		t.Fatalf("订单没有入账: 状态 %d 交易 %q 支付时间 %d", order.Status, order.BlockTransactionId, order.PaidAt)
+	}
+	// 入账后支付页面只收到一次已支付事件
+	select {
+	case e := <-ch:
+		if e.Type != events.Paid || e.TxHash != "tx-pay-1" {
+			t.Fatalf("订单事件 %+v", e)
+		}
+	default:
+		t.Fatal("入账后没有发布已支付事件")
+	}
+
+	eventually(t, 5*time.Second, "回调确认", func() bool {
+		return h.order(data.TradeID).CallBackConfirm == sdb.CallBackConfirmOk
+	})
+	callbacks := h.merchant.received(data.TradeID)
+	if len(callbacks) != 1 {
+		t.Fatalf("商户收到 %d 次回调，期望 1 次", len(callbacks))
+	}
+	cb := callbacks[0]
+	if !cb.SignatureValid {
+		t.Fatalf("回调签名错误: %+v", cb)
+	}
+	if cb.OrderID != "pay-1" || cb.Amount != 10 || cb.ActualAmount != data.ActualAmount ||
+		cb.Token != data.Token || cb.BlockTransactionID != "tx-pay-1" || cb.Status != sdb.StatusPaySuccess || cb.Sandbox {
+		t.Fatalf("回调参数错误: %+v", cb)
+	}
+	eventually(t, 5*time.Second, "支付成功通知", func() bool { return h.notifier.notified(data.TradeID) })
+
+	// 入账后释放金额，新的订单可以使用同样的金额
+	eventually(t, 5*time.Second, "金额解锁", func() bool { return !h.locked(data.Token, data.ActualAmount) })
+	if next := h.createOrder("pay-2", "USDT-TRC20", 10); next.ActualAmount != data.ActualAmount {
+		t.Fatalf("入账后金额没有释放: %v != %v", next.ActualAmount, data.ActualAmount)
+	}
+
+	// 已入账的订单不再查询和回调
+	h.jobs.CheckOrders()
+	time.Sleep(100 * time.Millisecond)
+	if n := len(h.merchant.received(data.TradeID)); n != 1 {
+		t.Fatalf("已入账的订单重复回调了 %d 次", n)
+	}
+	if len(ch) != 0 {
+		t.Fatalf("订单事件重复发布: %+v", <-ch)
+	}
+}
+
+// 波场上还没有确认的转账不入账，支付页面先收到 detected 和 confirming，确认后收到 paid
+func TestPaymentConfirming(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+	data := h.createOrder("confirm-1", "USDT-TRC20", 10)
+	ch, cancel := events.Subscribe(data.TradeID)
+	defer cancel()
+
+	next := func() events.Event {
+		t.Helper()
+		select {
+		case e := <-ch:
+			return e
+		default:
+			t.Fatal("没有发布订单事件")
+			return events.Event{}
+		}
+	}
+
+	h.tronscan.add(transfer{To: data.Token, Amount: data.ActualAmount, TxID: "tx-confirm-1", Unconfirmed: true})
+	for _, want := range []string{events.Detected, events.Confirming} {
+		h.jobs.CheckOrders()
+		if order := h.order(data.TradeID); order.Status != sdb.StatusWaitPay {
+			t.Fatalf("没有确认的转账入账了，订单状态 %d", order.Status)
+		}
+		if e := next(); e.Type != want || e.TxHash != "tx-confirm-1" {
+			t.Fatalf("订单事件 %+v，期望 %s", e, want)
+		}
+	}
+
+	h.tronscan.confirm("tx-confirm-1")
+	h.jobs.CheckOrders()
+	if order := h.order(data.TradeID); order.Status != sdb.StatusPaySuccess || order.BlockTransactionId != "tx-confirm-1" {
+		t.Fatalf("确认后订单没有入账: 状态 %d 交易 %q", order.Status, order.BlockTransactionId)
+	}
+	if e := next(); e.Type != events.Paid {
+		t.Fatalf("订单事件 %+v，期望 paid", e)
+	}
+}
+
+// Tronscan 没有查到转账时使用 TronGrid
+func TestPaymentDetectedByTronGrid(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+	data := h.createOrder("grid-1", "USDT-TRC20", 10)
+
+	h.trongrid.add(transfer{To: data.Token, Amount: data.ActualAmount, TxID: "tx-grid-1"})
+	h.jobs.CheckOrders()
+
+	if h.tronscan.count() == 0 {
+		t.Fatal("没有先查询 Tronscan")
+	}
+	order := h.order(data.TradeID)
+	if order.Status != sdb.StatusPaySuccess || order.BlockTransactionId != "tx-grid-1" {
+		t.Fatalf("订单没有入账: 状态 %d 交易 %q", order.Status, order.BlockTransactionId)
+	}
+	eventually(t, 5*time.Second, "商户收到回调", func() bool { return len(h.merchant.received(data.TradeID)) == 1 })
+}
+
+// 以太坊订单通过 Etherscan 查询，转账时间需要在订单的有效期内
+func TestPaymentDetectedOnEtherscan(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+	data := h.createOrder("eth-1", "USDT-ERC20", 10)
+	if data.Token != walletERC20 {
+		t.Fatalf("分配了钱包 %s，期望 %s", data.Token, walletERC20)
+	}
+
+	// 下单之前的转账不入账
+	h.etherscan.add(transfer{To: data.Token, Amount: data.ActualAmount, TxID: "0xold", Time: time.Now().Add(-time.Hour)})
+	h.jobs.CheckOrders()
+	if order := h.order(data.TradeID); order.Status != sdb.StatusWaitPay {
+		t.Fatalf("下单之前的转账入账了，订单状态 %d", order.Status)
+	}
+
+	// Etherscan 的时间戳精确到秒，转账时间要晚于下单时间
+	h.etherscan.add(transfer{To: data.Token, Amount: data.ActualAmount, TxID: "0xpaid", Time: time.Now().Add(2 * time.Second)})
+	h.jobs.CheckOrders()
+	order := h.order(data.TradeID)
+	if order.Status != sdb.StatusPaySuccess || order.BlockTransactionId != "0xpaid" {
+		t.Fatalf("订单没有入账: 状态 %d 交易 %q", order.Status, order.BlockTransactionId)
+	}
+	eventually(t, 5*time.Second, "回调确认", func() bool {
+		return h.order(data.TradeID).CallBackConfirm == sdb.CallBackConfirmOk
+	})
+}
+
+// 商户回调失败时重试，成功后不再回调
+func TestCallbackRetries(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+	h.merchant.failNext(2)
+	data := h.createOrder("retry-1", "USDT-TRC20", 10)
+
+	h.tronscan.add(transfer{To: data.Token, Amount: data.ActualAmount, TxID: "tx-retry-1"})
+	h.jobs.CheckOrders()
+
+	eventually(t, 5*time.Second, "回调确认", func() bool {
+		return h.order(data.TradeID).CallBackConfirm == sdb.CallBackConfirmOk
+	})
+	if n := len(h.merchant.received(data.TradeID)); n != 3 {
+		t.Fatalf("商户收到 %d 次回调，期望 3 次", n)
+	}
+	if order := h.order(data.TradeID); order.CallbackNum != 2 {
+		t.Fatalf("回调失败次数 %d，期望 2", order.CallbackNum)
+	}
+	eventually(t, 5*time.Second, "支付成功通知", func() bool { return h.notifier.notified(data.TradeID) })
+}
+
+// 商户一直返回失败时最多回调 5 次，订单保持未确认，不发送支付成功通知
+func TestCallbackGivesUp(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+	h.merchant.failNext(100)
+	data := h.createOrder("retry-2", "USDT-TRC20", 10)
+
+	h.tronscan.add(transfer{To: data.Token, Amount: data.ActualAmount, TxID: "tx-retry-2"})
+	h.jobs.CheckOrders()
+
+	eventually(t, 5*time.Second, "回调重试结束", func() bool { return h.order(data.TradeID).CallbackNum == 5 })
+	time.Sleep(200 * time.Millisecond)
+	if n := len(h.merchant.received(data.TradeID)); n != 5 {
+		t.Fatalf("商户收到 %d 次回调，期望 5 次", n)
+	}
+	order := h.order(data.TradeID)
+	if order.Status != sdb.StatusPaySuccess || order.CallBackConfirm == sdb.CallBackConfirmOk {
+		t.Fatalf("订单状态 %d 回调确认 %d", order.Status, order.CallBackConfirm)
+	}
+	if h.notifier.notified(data.TradeID) {
+		t.Fatal("回调失败时发送了支付成功通知")
+	}
+}
+
+// 就绪检查按币种报告链上监听的状态，区块链浏览器返回 NOTOK 时不算查询成功
+func TestWatcherHealth(t *testing.T) {
+	h := newHarness(t, config.BackendLocal)
+	h.createOrder("health-1", "USDT-ERC20", 10)
+
+	currency := func() (w struct {
+		Currency     string `json:"currency"`
+		Status       string `json:"status"`
+		LastSuccess  int64  `json:"last_success"`
+		FailingSince int64  `json:"failing_since"`
+	}) {
+		resp, err := http.Get(h.api.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Watchers struct {
+				Currencies []json.RawMessage `json:"currencies"`
+			} `json:"watchers"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		for _, raw := range body.Watchers.Currencies {
+			json.Unmarshal(raw, &w)
+			if w.Currency == "USDT-ERC20" {
+				return w
+			}
+		}
+		t.Fatalf("就绪检查中没有 USDT-ERC20: %s", body.Watchers.Currencies)
+		return
+	}
+
+	// 没有转账记录也是有效的返回
+	h.jobs.CheckOrders()
+	ok := currency()
+	if ok.LastSuccess == 0 || ok.FailingSince != 0 || ok.Status != "ok" {
+		t.Fatalf("没有转账记录时的状态 %+v", ok)
+	}
+
+	// HTTP 状态码为 200，但接口返回 NOTOK
+	h.etherscan.respondWith(map[string]any{"status": "0", "message": "NOTOK", "result": []any{}})
+	h.jobs.CheckOrders()
+	failing := currency()
+	if failing.LastSuccess != ok.LastSuccess || failing.FailingSince == 0 {
+		t.Fatalf("接口返回 NOTOK 时的状态 %+v", failing)
+	}
+
+	h.etherscan.respondWith(nil)
+	h.jobs.CheckOrders()
+	if recovered := currency(); recovered.FailingSince != 0 || recovered.LastSuccess < failing.FailingSince {
+		t.Fatalf("接口恢复后的状态 %+v", recovered)
+	}
+}
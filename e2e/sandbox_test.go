@@ -0,0 +1,178 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"upay_pro/config"
+	"upay_pro/db/sdb"
+	"upay_pro/dto"
+)
+
+// addMerchant 添加商户，之后的回调使用商户的密钥验证签名
+func (h *harness) addMerchant(name string, sandbox bool) sdb.Merchant {
+	h.t.Helper()
+	m := sdb.Merchant{Name: name, SecretKey: name + "-secret", Status: sdb.MerchantStatusEnable, Sandbox: sandbox}
+	if err := h.store.DB.Create(&m).Error; err != nil {
+		h.t.Fatal(err)
+	}
+	h.merchant.useKey(m.SecretKey)
+	return m
+}
+
+// merchantOrder 商户使用自己的密钥签名下单
+func (h *harness) merchantOrder(m sdb.Merchant, orderID, typ string, amount float64) dto.Data {
+	h.t.Helper()
+	req := h.orderRequest(orderID, typ, amount)
+	req.MerchantID = m.ID
+	req.Signature = sign([]string{
+		"type=" + req.Type,
+		fmt.Sprintf("amount=%g", req.Amount),
+		"notify_url=" + req.NotifyURL,
+		"order_id=" + req.OrderID,
+		"redirect_url=" + req.RedirectURL,
+	}, m.SecretKey)
+	status, r := h.post(req)
+	if status != http.StatusOK {
+		h.t.Fatalf("商户下单失败: %d %s %s", status, r.Error.Code, r.Message)
+	}
+	return r.Data
+}
+
+// simulateResponse 模拟支付接口的响应
+type simulateResponse struct {
+	Code    int      `json:"code"`
+	Message string   `json:"message"`
+	Error   apiError `json:"error"`
+	Data    struct {
+		TradeID            string  `json:"trade_id"`
+		Paid               bool    `json:"paid"`
+		Status             int     `json:"status"`
+		Amount             float64 `json:"amount"`
+		BlockTransactionID string  `json:"block_transaction_id"`
+	} `json:"data"`
+}
+
+// simulate 调用模拟支付接口，secretKey 为签名使用的密钥
+func (h *harness) simulate(merchantID uint, tradeID string, amount float64, secretKey string) (int, simulateResponse) {
+	h.t.Helper()
+	p := dto.SimulateParams{MerchantID: merchantID, TradeID: tradeID, Amount: amount}
+	p.Signature = sign([]string{"trade_id=" + tradeID, fmt.Sprintf("amount=%g", amount)}, secretKey)
+	body, _ := json.Marshal(p)
+	resp, err := http.Post(h.api.URL+"/api/simulate_payment", "application/json", bytes.NewReader(body))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r simulateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		h.t.Fatalf("解析模拟支付响应失败: %v", err)
+	}
+	return resp.StatusCode, r
+}
+
+// 沙盒商户的订单可以模拟支付，金额不一致时不入账，入账后正常回调
+func TestSandboxSimulatePayment(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+	m := h.addMerchant("sandbox-shop", true)
+	data := h.merchantOrder(m, "sandbox-1", "USDT-TRC20", 10)
+	if !data.Sandbox {
+		t.Fatal("沙盒商户的订单没有标记为沙盒订单")
+	}
+
+	status, r := h.simulate(m.ID, data.TradeID, data.ActualAmount+0.01, m.SecretKey)
+	if status != http.StatusOK || r.Data.Paid || r.Data.Status != sdb.StatusWaitPay {
+		t.Fatalf("金额不一致的模拟转账入账了: %d %+v", status, r)
+	}
+
+	status, r = h.simulate(m.ID, data.TradeID, 0, m.SecretKey)
+	if status != http.StatusOK || !r.Data.Paid || r.Data.Status != sdb.StatusPaySuccess || r.Data.Amount != data.ActualAmount {
+		t.Fatalf("模拟支付没有入账: %d %+v", status, r)
+	}
+	if !strings.HasPrefix(r.Data.BlockTransactionID, "sandbox-") {
+		t.Fatalf("模拟的交易ID %q", r.Data.BlockTransactionID)
+	}
+	// 沙盒订单不查询主网
+	if h.tronscan.count() != 0 || h.trongrid.count() != 0 {
+		t.Fatal("沙盒订单查询了主网")
+	}
+
+	eventually(t, 5*time.Second, "回调确认", func() bool {
+		return h.order(data.TradeID).CallBackConfirm == sdb.CallBackConfirmOk
+	})
+	callbacks := h.merchant.received(data.TradeID)
+	if len(callbacks) != 1 || !callbacks[0].SignatureValid || !callbacks[0].Sandbox || callbacks[0].BlockTransactionID != r.Data.BlockTransactionID {
+		t.Fatalf("商户收到的回调: %+v", callbacks)
+	}
+
+	// 已支付的订单不能再模拟
+	if status, r := h.simulate(m.ID, data.TradeID, 0, m.SecretKey); status != http.StatusBadRequest || r.Error.Code != "ORDER_CLOSED" {
+		t.Fatalf("返回 %d %s，期望 400 ORDER_CLOSED", status, r.Error.Code)
+	}
+}
+
+// 不是沙盒商户的订单、其他商户的订单和签名错误时拒绝模拟支付
+func TestSimulatePaymentRejected(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+	live := h.addMerchant("live-shop", false)
+	sandbox := h.addMerchant("sandbox-shop", true)
+	liveOrder := h.merchantOrder(live, "live-1", "USDT-TRC20", 10)
+	sandboxOrder := h.merchantOrder(sandbox, "sandbox-1", "USDT-TRC20", 10)
+
+	cases := []struct {
+		name       string
+		merchantID uint
+		tradeID    string
+		secretKey  string
+		status     int
+		code       string
+	}{
+		{"正式订单", live.ID, liveOrder.TradeID, live.SecretKey, http.StatusForbidden, "NOT_SANDBOX"},
+		{"其他商户的订单", live.ID, sandboxOrder.TradeID, live.SecretKey, http.StatusNotFound, "ORDER_NOT_FOUND"},
+		{"签名错误", sandbox.ID, sandboxOrder.TradeID, live.SecretKey, http.StatusUnauthorized, "SIGNATURE_INVALID"},
+		{"商户不存在", 42, sandboxOrder.TradeID, sandbox.SecretKey, http.StatusUnauthorized, "MERCHANT_INVALID"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			status, r := h.simulate(c.merchantID, c.tradeID, 0, c.secretKey)
+			if status != c.status || r.Error.Code != c.code {
+				t.Fatalf("返回 %d %s，期望 %d %s", status, r.Error.Code, c.status, c.code)
+			}
+		})
+	}
+
+	for _, tradeID := range []string{liveOrder.TradeID, sandboxOrder.TradeID} {
+		if order := h.order(tradeID); order.Status != sdb.StatusWaitPay {
+			t.Fatalf("订单 %s 状态变为 %d", tradeID, order.Status)
+		}
+	}
+}
+
+// 沙盒订单查询测试网上的转账，主网上的转账不入账
+func TestSandboxOrderUsesTestnet(t *testing.T) {
+	h := newHarness(t, config.BackendRedis)
+	m := h.addMerchant("sandbox-shop", true)
+	data := h.merchantOrder(m, "sepolia-1", "USDT-ERC20", 10)
+
+	paidAt := time.Now().Add(2 * time.Second)
+	h.etherscan.add(transfer{To: data.Token, Amount: data.ActualAmount, TxID: "0xmainnet", Time: paidAt})
+	h.jobs.CheckOrders()
+	if order := h.order(data.TradeID); order.Status != sdb.StatusWaitPay {
+		t.Fatalf("沙盒订单使用了主网的转账，订单状态 %d", order.Status)
+	}
+
+	h.testnet.add(transfer{To: data.Token, Amount: data.ActualAmount, TxID: "0xsepolia", Time: paidAt})
+	h.jobs.CheckOrders()
+	order := h.order(data.TradeID)
+	if order.Status != sdb.StatusPaySuccess || order.BlockTransactionId != "0xsepolia" {
+		t.Fatalf("沙盒订单没有入账: 状态 %d 交易 %q", order.Status, order.BlockTransactionId)
+	}
+	if h.etherscan.count() != 0 {
+		t.Fatal("沙盒订单查询了主网")
+	}
+	eventually(t, 5*time.Second, "商户收到回调", func() bool { return len(h.merchant.received(data.TradeID)) == 1 })
+}
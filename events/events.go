@@ -0,0 +1,102 @@
+package events
+
+// 进程内的订单事件总线，支付页面通过 SSE 订阅
+// 链上监听查到还没有确认的转账时发布 detected 和 confirming，订单状态保存成功后发布 paid 和 expired
+
+import (
+	"sync"
+	"time"
+)
+
+// 订单事件类型
+const (
+	Detected   = "detected"   // 查到符合订单的转账，还没有确认
+	Confirming = "confirming" // 转账等待区块确认，每次查询仍未确认时发布
+	Paid       = "paid"       // 支付成功
+	Expired    = "expired"    // 订单已过期
+)
+
+// Event 订单状态变化事件
+type Event struct {
+	TradeId string `json:"trade_id"`
+	Type    string `json:"type"`
+	TxHash  string `json:"tx_hash,omitempty"`
+	Time    int64  `json:"time"` // 毫秒时间戳
+}
+
+// 每个订阅者的缓冲区大小，订阅者处理不过来时丢弃事件，不阻塞发布者
+const bufferSize = 8
+
+var (
+	mu          sync.RWMutex
+	subscribers = make(map[string]map[chan Event]struct{})
+	// 已经发布过 detected 的订单和交易，订单结束时删除
+	detected = make(map[string]string)
+)
+
+// Subscribe 订阅某个订单的事件，返回事件通道和取消订阅的函数
+func Subscribe(tradeId string) (<-chan Event, func()) {
+	ch := make(chan Event, bufferSize)
+
+	mu.Lock()
+	if subscribers[tradeId] == nil {
+		subscribers[tradeId] = make(map[chan Event]struct{})
+	}
+	subscribers[tradeId][ch] = struct{}{}
+	mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			mu.Lock()
+			delete(subscribers[tradeId], ch)
+			if len(subscribers[tradeId]) == 0 {
+				delete(subscribers, tradeId)
+			}
+			mu.Unlock()
+		})
+	}
+	return ch, cancel
+}
+
+// Publish 向订阅了该订单的所有订阅者发布事件
+func Publish(e Event) {
+	if e.Time == 0 {
+		e.Time = time.Now().UnixMilli()
+	}
+
+	mu.RLock()
+	for ch := range subscribers[e.TradeId] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	mu.RUnlock()
+
+	if Terminal(e.Type) {
+		mu.Lock()
+		delete(detected, e.TradeId)
+		mu.Unlock()
+	}
+}
+
+// Pending 链上监听查到符合订单、还没有确认的转账时调用
+// 第一次查到这笔转账时发布 detected，之后每次查询仍未确认时发布 confirming
+func Pending(tradeId, txHash string) {
+	mu.Lock()
+	first := detected[tradeId] != txHash
+	detected[tradeId] = txHash
+	mu.Unlock()
+
+	eventType := Confirming
+	if first {
+		eventType = Detected
+	}
+	Publish(Event{TradeId: tradeId, Type: eventType, TxHash: txHash})
+}
+
+// Terminal 事件是否为订单的最终状态
+func Terminal(eventType string) bool {
+	return eventType == Paid || eventType == Expired
+}
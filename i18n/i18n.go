@@ -0,0 +1,102 @@
+package i18n
+
+// 多语言支持，以中文原文作为翻译的键，没有翻译的文本原样返回中文
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 支持的语言
+const (
+	ZhCN = "zh-CN" // 简体中文
+	En   = "en"    // 英文
+)
+
+// Default 默认语言
+const Default = ZhCN
+
+// Supported 所有支持的语言
+var Supported = []string{ZhCN, En}
+
+// T 把中文原文翻译为指定语言
+func T(lang, msg string) string {
+	if m, ok := messages[Normalize(lang)]; ok {
+		if translated, ok := m[msg]; ok {
+			return translated
+		}
+	}
+	return msg
+}
+
+// Tf 翻译格式化字符串后再格式化
+func Tf(lang, format string, args ...any) string {
+	return fmt.Sprintf(T(lang, format), args...)
+}
+
+// Normalize 把语言标签规范为支持的语言，例如 en-US -> en、zh-Hans -> zh-CN，不支持的语言返回空字符串
+func Normalize(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	switch {
+	case lang == "":
+		return ""
+	case lang == "en" || strings.HasPrefix(lang, "en-") || strings.HasPrefix(lang, "en_"):
+		return En
+	case lang == "zh" || strings.HasPrefix(lang, "zh-") || strings.HasPrefix(lang, "zh_"):
+		return ZhCN
+	}
+	return ""
+}
+
+// FromAcceptLanguage 按 Accept-Language 请求头的权重选择支持的语言，都不支持时返回空字符串
+func FromAcceptLanguage(header string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if lang := Normalize(tag); lang != "" && q > 0 {
+			candidates = append(candidates, candidate{lang, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
+
+// Error 可以翻译的错误，Error() 返回中文，Localize 按语言翻译
+type Error struct {
+	Format string
+	Args   []any
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf(e.Format, e.Args...)
+}
+
+// Errorf 创建可以翻译的错误，format 为中文原文
+func Errorf(format string, args ...any) error {
+	return &Error{Format: format, Args: args}
+}
+
+// Localize 按语言翻译错误信息，不是 Errorf 创建的错误时翻译整条错误信息
+func Localize(lang string, err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return Tf(lang, e.Format, e.Args...)
+	}
+	return T(lang, err.Error())
+}
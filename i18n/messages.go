@@ -0,0 +1,74 @@
+package i18n
+
+// 翻译表，键为中文原文
+
+var messages = map[string]map[string]string{
+	En: {
+		// 下单接口
+		"读取请求体失败":               "Failed to read request body",
+		"签名验证失败":                "Signature verification failed",
+		"商户不存在或已禁用":             "Merchant not found or disabled",
+		"参数错误":                  "Invalid parameters",
+		"请求参数格式错误：%s":           "Malformed request: %s",
+		"请求参数校验失败：%s":           "Validation failed: %s",
+		"服务器内部错误":               "Internal server error",
+		"服务正在停止，请稍后重试":          "The service is shutting down, please try again later",
+		"未登录":                   "Not logged in",
+		"没有权限执行该操作":             "You do not have permission to perform this action",
+		"请先添加钱包地址":              "No wallet address is configured",
+		"币种汇率配置错误,小于等于0":        "Invalid exchange rate for this currency, must be greater than 0",
+		"换算后的支付金额低于最小支付金额0.01":  "The converted payment amount is below the minimum of 0.01",
+		"递增金额次数超过最大次数,请稍后再创建订单": "No unique payment amount available, please try again later",
+		"钱包类型%s没有可用的钱包地址":       "No wallet address is available for %s",
+		"钱包类型不能为空":              "Wallet type is required",
+		"创建订单失败1":               "Failed to create order",
+		"订单不存在":                 "Order not found",
+		"获取订单信息失败":              "Failed to load order",
+		"请选择网络":                 "Please choose a network",
+		"订单已支付或已过期":             "The order has been paid or has expired",
+		"订单已经选择了网络":             "A network has already been chosen for this order",
+		"订单不支持该网络":              "This network is not available for the order",
+		"订单已过期":                 "The order has expired",
+		"保存订单失败":                "Failed to save order",
+		"生成二维码失败":               "Failed to generate QR code",
+		"1-待支付，2-支付成功，3-支付过期":   "1 - waiting for payment, 2 - paid, 3 - expired",
+		"只能模拟沙盒订单的支付":           "Payments can only be simulated for sandbox orders",
+		"订单还没有选择网络":             "No network has been chosen for this order yet",
+
+		// 支付页面
+		"支付页面":    "Checkout",
+		"选择支付网络":  "Choose a payment network",
+		"剩余支付时间：": "Time remaining: ",
+		"点击复制地址":  "Click to copy the address",
+		"支付二维码":   "Payment QR code",
+		"请确保支付金额与显示金额一致，否则无法到账！": "Make sure you send exactly the amount shown, otherwise the payment cannot be matched!",
+		"订单详情":          "Order details",
+		"订单号":           "Order No.",
+		"收款方":           "Payee",
+		"遇到问题？联系客服":     "Need help? Contact support",
+		"支付成功":          "Payment successful",
+		"正在跳转到商户页面...":  "Redirecting to the merchant...",
+		"地址已复制":         "Address copied",
+		"复制失败，请手动复制":    "Copy failed, please copy it manually",
+		"无效的过期时间":       "Invalid expiration time",
+		"支付已超时":         "Payment timed out",
+		"已查到转账，等待区块确认":  "Payment detected, waiting for block confirmation",
+		"转账确认中，请不要关闭页面": "Confirming the payment, please keep this page open",
+		"选择网络失败，请重试":    "Failed to choose the network, please try again",
+		"测试订单：请使用测试网支付，不要转入真实资产": "Test order: pay on the testnet, do not send real funds",
+
+		// 通知
+		"UPAY_PRO 订单通知": "UPAY_PRO order notification",
+		"订单号:%s\n币种:%s\n支付金额%.2f\n支付状态:%s\n区块ID:%s\n回调状态：%s\n":                                                                                                    "Order No.: %s\nCurrency: %s\nAmount: %.2f\nStatus: %s\nTransaction: %s\nCallback: %s\n",
+		"<b>🔔 UPAY_PRO 订单通知</b>\n\n<b>订单号:</b> <code>%s</code>\n<b>币种:</b> %s\n<b>支付金额:</b> %.2f\n<b>支付状态:</b> %s\n<b>区块ID:</b> <code>%s</code>\n<b>回调状态:</b> %s": "<b>🔔 UPAY_PRO order notification</b>\n\n<b>Order No.:</b> <code>%s</code>\n<b>Currency:</b> %s\n<b>Amount:</b> %.2f\n<b>Status:</b> %s\n<b>Transaction:</b> <code>%s</code>\n<b>Callback:</b> %s",
+		"待支付":      "Waiting for payment",
+		"已过期":      "Expired",
+		"未知状态":     "Unknown",
+		"已回调":      "Delivered",
+		"未回调":      "Not delivered",
+		"自动汇率更新失败": "Automatic exchange rate update failed",
+		"币种:%s\n原因:%v\n当前沿用汇率:%v":   "Currency: %s\nReason: %v\nKeeping current rate: %v",
+		"自动汇率大幅变化":                  "Automatic exchange rate moved sharply",
+		"币种:%s\n上一次有效汇率:%v\n新汇率:%v": "Currency: %s\nPrevious rate: %v\nNew rate: %v",
+	},
+}
@@ -0,0 +1,86 @@
+package lifecycle
+
+// 组件的启动和停止
+// 组件按添加的顺序启动，后面的组件可以依赖前面的组件；启动失败时停止已经启动的组件并返回错误。
+// 收到 SIGINT 或 SIGTERM 后按相反的顺序停止：先停止接收新的请求，再等待后台任务完成，最后关闭数据库和日志
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"upay_pro/mylog"
+
+	"go.uber.org/zap"
+)
+
+// Component 一个组件，Start 和 Stop 都可以为空
+type Component struct {
+	Name  string
+	Start func() error
+	Stop  func(ctx context.Context) error
+}
+
+// Manager 按依赖顺序管理组件
+type Manager struct {
+	components []Component
+	// 已经启动的组件数量
+	started int
+}
+
+// Add 添加组件，组件按添加的顺序启动
+func (m *Manager) Add(name string, start func() error, stop func(ctx context.Context) error) {
+	m.components = append(m.components, Component{Name: name, Start: start, Stop: stop})
+}
+
+// Start 依次启动所有组件，遇到错误时返回，已经启动的组件需要调用 Stop 停止
+func (m *Manager) Start() error {
+	for _, c := range m.components[m.started:] {
+		if c.Start != nil {
+			if err := c.Start(); err != nil {
+				return fmt.Errorf("启动%s失败: %w", c.Name, err)
+			}
+		}
+		m.started++
+		mylog.Logger.Info("已启动", zap.String("component", c.Name))
+	}
+	return nil
+}
+
+// Stop 按相反的顺序停止已经启动的组件，某个组件停止失败时继续停止其他组件，返回所有错误
+func (m *Manager) Stop(ctx context.Context) error {
+	var errs []error
+	for ; m.started > 0; m.started-- {
+		c := m.components[m.started-1]
+		if c.Stop == nil {
+			continue
+		}
+		if err := c.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("停止%s失败: %w", c.Name, err))
+			mylog.Logger.Error("组件停止失败", zap.String("component", c.Name), zap.Error(err))
+			continue
+		}
+		mylog.Logger.Info("已停止", zap.String("component", c.Name))
+	}
+	return errors.Join(errs...)
+}
+
+// Run 启动所有组件，然后等待 SIGINT 或 SIGTERM，在 timeout 内停止所有组件
+func (m *Manager) Run(timeout time.Duration) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	err := m.Start()
+	if err == nil {
+		sig := <-sigs
+		mylog.Logger.Info("收到退出信号，开始停止", zap.String("signal", sig.String()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return errors.Join(err, m.Stop(ctx))
+}
@@ -0,0 +1,59 @@
+package lock
+
+import (
+	"context"
+	"time"
+	"upay_pro/db/sdb"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// dbLocker 使用数据库的金额锁表保存金额锁，锁定时删除已经过期的锁
+type dbLocker struct {
+	store *sdb.Store
+}
+
+// NewDB 创建保存在数据库中的金额锁
+func NewDB(store *sdb.Store) Locker {
+	return dbLocker{store: store}
+}
+
+func (l dbLocker) Lock(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	locked := false
+	err := l.store.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("expires_at <= ?", now.UnixMilli()).Delete(&sdb.AmountLock{}).Error; err != nil {
+			return err
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&sdb.AmountLock{
+			Key:       key,
+			ExpiresAt: now.Add(ttl).UnixMilli(),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		locked = result.RowsAffected == 1
+		return nil
+	})
+	return locked, err
+}
+
+func (l dbLocker) Refresh(ctx context.Context, key string, ttl time.Duration) error {
+	return l.store.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"expires_at"}),
+	}).Create(&sdb.AmountLock{Key: key, ExpiresAt: time.Now().Add(ttl).UnixMilli()}).Error
+}
+
+func (l dbLocker) Unlock(ctx context.Context, key string) error {
+	return l.store.DB.WithContext(ctx).Delete(&sdb.AmountLock{Key: key}).Error
+}
+
+func (l dbLocker) Ping(ctx context.Context) error {
+	db, err := l.store.DB.DB()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
+}
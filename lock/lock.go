@@ -0,0 +1,28 @@
+package lock
+
+// 钱包地址和支付金额的锁
+// 下单时为订单分配的“钱包地址 + 金额”在订单过期前不能分配给其他订单，否则链上转账无法区分属于哪个订单
+// redis 模式下锁保存在 Redis，local 模式下保存在数据库，程序重启后锁仍然有效
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Locker 金额锁
+type Locker interface {
+	// Lock 锁定金额，锁定时间为 ttl，金额已被其他订单占用时返回 false
+	Lock(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Refresh 重新设置锁定时间，锁不存在时重新锁定
+	Refresh(ctx context.Context, key string, ttl time.Duration) error
+	// Unlock 解锁金额
+	Unlock(ctx context.Context, key string) error
+	// Ping 检查存储是否可用
+	Ping(ctx context.Context) error
+}
+
+// Key 钱包地址和金额对应的锁
+func Key(token string, amount float64) string {
+	return fmt.Sprintf("%s_%f", token, amount)
+}
@@ -0,0 +1,34 @@
+package lock
+
+import (
+	"context"
+	"time"
+	"upay_pro/db/rdb"
+)
+
+// redisLocker 使用 Redis 的键保存金额锁，过期由 Redis 自动删除
+type redisLocker struct {
+	client *rdb.Client
+}
+
+// NewRedis 创建保存在 Redis 中的金额锁
+func NewRedis(client *rdb.Client) Locker {
+	return redisLocker{client: client}
+}
+
+func (l redisLocker) Lock(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	// SetNX 在键不存在时才写入，检查和锁定是一个原子操作
+	return l.client.Redis().SetNX(ctx, key, 1, ttl).Result()
+}
+
+func (l redisLocker) Refresh(ctx context.Context, key string, ttl time.Duration) error {
+	return l.client.Redis().Set(ctx, key, 1, ttl).Err()
+}
+
+func (l redisLocker) Unlock(ctx context.Context, key string) error {
+	return l.client.Redis().Del(ctx, key).Err()
+}
+
+func (l redisLocker) Ping(ctx context.Context) error {
+	return l.client.Redis().Ping(ctx).Err()
+}
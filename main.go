@@ -1,26 +1,111 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+	"upay_pro/config"
 	"upay_pro/cron"
+	"upay_pro/db/rdb"
+	"upay_pro/db/sdb"
+	"upay_pro/lifecycle"
+	"upay_pro/lock"
+	"upay_pro/mq"
 	"upay_pro/mylog"
+	"upay_pro/notification"
+	"upay_pro/watcher"
 	"upay_pro/web"
 
 	"go.uber.org/zap"
 )
 
+// 收到退出信号后等待组件停止的时间
+const shutdownTimeout = 30 * time.Second
+
 func main() {
+	if err := config.Load(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "读取配置失败:", err)
+		os.Exit(2)
+	}
+	mylog.Init()
+
+	// upay [选项] migrate [up|down [n]|status]
+	if sdb.IsMigrateCommand() {
+		code := runMigrate(config.Args[1:])
+		mylog.Close()
+		os.Exit(code)
+	}
 
 	defer func() {
 		if err := recover(); err != nil {
 			mylog.Logger.Error("程序发生恐慌导致崩溃", zap.Any("error", err))
+			mylog.Close()
+			os.Exit(1)
 		}
 
 	}()
 
-	{
-		go cron.Start()
-		web.Start()
-
+	// 按依赖顺序启动，停止时按相反的顺序：
+	// 先拒绝新的订单并等待 HTTP 请求完成，再等待订单检查和异步回调完成，然后停止异步队列，最后关闭 Redis、数据库和日志
+	// 组件在启动时创建，后面的组件使用前面组件创建的对象
+	var (
+		store  *sdb.Store
+		locker lock.Locker
+		queue  mq.Scheduler
+		jobs   *cron.Service
+		server *web.Server
+	)
+	m := &lifecycle.Manager{}
+	m.Add("日志", nil, func(ctx context.Context) error { return mylog.Close() })
+	m.Add("数据库", func() (err error) {
+		store, err = sdb.New(config.Get())
+		return err
+	}, func(ctx context.Context) error { return store.Close() })
+	m.Add("数据库迁移", func() error { return store.Init() }, nil)
+	// redis 模式下金额锁和订单过期任务使用 Redis，local 模式下使用数据库和进程内定时器
+	if config.Get().UseRedis() {
+		var redis *rdb.Client
+		var asynq *mq.AsynqScheduler
+		m.Add("Redis", func() error {
+			redis = rdb.New(config.Get())
+			config.OnChange(redis.Reload)
+			return nil
+		}, func(ctx context.Context) error { return redis.Close() })
+		m.Add("金额锁", func() error {
+			locker = lock.NewRedis(redis)
+			return nil
+		}, nil)
+		m.Add("订单过期任务", func() error {
+			asynq = mq.NewAsynq(config.Get(), store)
+			queue = asynq
+			config.OnChange(asynq.Reload)
+			return asynq.Start()
+		}, func(ctx context.Context) error { return asynq.Close(ctx) })
+	} else {
+		m.Add("金额锁", func() error {
+			locker = lock.NewDB(store)
+			return nil
+		}, nil)
+		m.Add("订单过期任务", func() error {
+			queue = mq.NewLocal(store)
+			return queue.Start()
+		}, func(ctx context.Context) error { return queue.Close(ctx) })
 	}
+	m.Add("定时任务", func() error {
+		sandbox := watcher.NewSandbox(store, watcher.Testnets(store, config.Get().Sandbox))
+		jobs = cron.New(store, locker, notification.New(store), watcher.New(store), sandbox)
+		return jobs.Start()
+	}, func(ctx context.Context) error { return jobs.Stop(ctx) })
+	m.Add("HTTP 服务", func() error {
+		server = web.New(config.Get(), store, locker, queue, jobs)
+		config.OnChange(server.Reload)
+		return server.Start()
+	}, func(ctx context.Context) error { return server.Stop(ctx) })
 
+	if err := m.Run(shutdownTimeout); err != nil {
+		// 日志已经关闭，错误输出到标准错误
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
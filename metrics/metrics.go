@@ -0,0 +1,83 @@
+package metrics
+
+// Prometheus 监控指标，通过 /metrics 暴露
+// 本包不依赖项目中的其他包，订单、队列和汇率等需要查询数据库的指标由 web 包在采集时读取
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// 指标名称的前缀
+const namespace = "upay"
+
+// 订单
+var (
+	OrdersCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_created_total",
+		Help:      "创建的订单数，买家还没有选择网络的订单 currency 为 auto",
+	}, []string{"currency"})
+
+	OrdersPaid = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_paid_total",
+		Help:      "支付成功的订单数，包括手动补单",
+	}, []string{"currency"})
+
+	OrdersExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_expired_total",
+		Help:      "过期的订单数",
+	}, []string{"currency"})
+
+	// AmountLockCollisions 分配支付金额时金额已被其他订单占用的次数，持续升高说明需要增加钱包地址
+	AmountLockCollisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "amount_lock_collisions_total",
+		Help:      "下单分配支付金额时金额已被其他订单占用的次数",
+	}, []string{"currency"})
+)
+
+// CurrencyLabel 订单指标的 currency 标签，买家还没有选择网络的订单为 auto
+func CurrencyLabel(walletType string) string {
+	if walletType == "" {
+		return "auto"
+	}
+	return walletType
+}
+
+// 异步回调的结果
+const (
+	CallbackSuccess      = "success"       // 商户返回 ok 或 success
+	CallbackRejected     = "rejected"      // 商户返回 200，但内容不是 ok 或 success
+	CallbackHTTPError    = "http_error"    // 商户返回的状态码不是 200
+	CallbackNetworkError = "network_error" // 请求失败
+)
+
+// 异步回调
+var (
+	CallbackAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "callback_attempts_total",
+		Help:      "异步回调次数，按结果统计",
+	}, []string{"outcome"})
+
+	CallbackDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "callback_duration_seconds",
+		Help:      "异步回调请求耗时",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+// Handler 返回 /metrics 的处理函数，collectors 为采集时查询的指标，和全局指标一起输出
+func Handler(collectors ...prometheus.Collector) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors...)
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, reg}, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,184 @@
+package metrics
+
+// 链上监听请求区块链浏览器接口的统计，同时记录每个接口最近一次成功和失败的时间，
+// 以及每个币种的监听器最近一次成功查询的时间，供健康检查使用
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 链上监听请求区块链浏览器接口，provider 为接口域名
+var (
+	watcherRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watcher_requests_total",
+		Help:      "链上监听请求区块链浏览器接口的次数，result 为 ok、http_error 或 error",
+	}, []string{"provider", "result"})
+
+	watcherDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "watcher_request_duration_seconds",
+		Help:      "链上监听请求区块链浏览器接口的耗时",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"provider"})
+
+	watcherLastPoll = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "watcher_last_success_timestamp_seconds",
+		Help:      "各币种的链上监听最近一次成功查询的时间，区块链浏览器返回的结果解析并校验通过才算成功",
+	}, []string{"currency"})
+)
+
+// instrumentedTransport 记录请求次数、错误和耗时的 RoundTripper
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	provider := req.URL.Hostname()
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	watcherDuration.WithLabelValues(provider).Observe(time.Since(start).Seconds())
+
+	switch {
+	case err != nil:
+		watcherRequests.WithLabelValues(provider, "error").Inc()
+		recordProvider(provider, err.Error())
+	case resp.StatusCode >= http.StatusBadRequest:
+		watcherRequests.WithLabelValues(provider, "http_error").Inc()
+		recordProvider(provider, resp.Status)
+	default:
+		watcherRequests.WithLabelValues(provider, "ok").Inc()
+		recordProvider(provider, "")
+	}
+	return resp, err
+}
+
+// Transport 包装链上监听使用的 RoundTripper，base 为 nil 时使用 http.DefaultTransport
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return instrumentedTransport{base: base}
+}
+
+// WatcherTransport 链上监听默认使用的 RoundTripper
+var WatcherTransport = Transport(nil)
+
+// ProviderStatus 区块链浏览器接口最近一次请求的情况，时间为毫秒时间戳，0 表示还没有发生过
+type ProviderStatus struct {
+	Provider    string `json:"provider"`
+	LastSuccess int64  `json:"last_success"`
+	LastError   int64  `json:"last_error"`
+	Error       string `json:"error,omitempty"` // 最近一次失败的原因
+}
+
+var (
+	providersMu sync.Mutex
+	providers   = make(map[string]*ProviderStatus)
+)
+
+// recordProvider 记录接口请求结果，errMsg 为空表示请求成功
+func recordProvider(provider, errMsg string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	p, ok := providers[provider]
+	if !ok {
+		p = &ProviderStatus{Provider: provider}
+		providers[provider] = p
+	}
+	now := time.Now().UnixMilli()
+	if errMsg == "" {
+		p.LastSuccess = now
+		return
+	}
+	p.LastError = now
+	p.Error = errMsg
+}
+
+// Providers 返回所有请求过的接口的状态，按域名排序
+func Providers() []ProviderStatus {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	list := make([]ProviderStatus, 0, len(providers))
+	for _, p := range providers {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Provider < list[j].Provider })
+	return list
+}
+
+// WatcherStatus 币种的链上监听最近一次查询的情况，时间为毫秒时间戳，0 表示还没有发生过
+type WatcherStatus struct {
+	Currency    string `json:"currency"`
+	LastCheck   int64  `json:"last_check"`   // 最近一次开始查询
+	LastSuccess int64  `json:"last_success"` // 最近一次查询成功
+	// 从这个时间开始查询一直没有成功，0 表示最近一次查询成功
+	FailingSince int64 `json:"failing_since,omitempty"`
+}
+
+var (
+	watchersMu sync.Mutex
+	watchers   = make(map[string]*WatcherStatus)
+)
+
+func watcherStatus(currency string) *WatcherStatus {
+	w, ok := watchers[currency]
+	if !ok {
+		w = &WatcherStatus{Currency: currency}
+		watchers[currency] = w
+	}
+	return w
+}
+
+// RecordCheck 开始查询订单的转账时调用，currency 为订单的币种
+// 沙盒订单查询的是测试网，不计入币种的状态
+func RecordCheck(currency string, sandbox bool) {
+	if sandbox {
+		return
+	}
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	w := watcherStatus(currency)
+	w.LastCheck = time.Now().UnixMilli()
+	if w.FailingSince == 0 {
+		w.FailingSince = w.LastCheck
+	}
+}
+
+// RecordPoll 链上监听解析并校验了区块链浏览器返回的结果后调用，没有查到转账也算查询成功
+func RecordPoll(currency string, sandbox bool) {
+	if sandbox {
+		return
+	}
+	watcherLastPoll.WithLabelValues(currency).SetToCurrentTime()
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	w := watcherStatus(currency)
+	w.LastSuccess = time.Now().UnixMilli()
+	w.FailingSince = 0
+}
+
+// Watchers 返回所有查询过的币种的状态，按币种排序
+func Watchers() []WatcherStatus {
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	list := make([]WatcherStatus, 0, len(watchers))
+	for _, w := range watchers {
+		list = append(list, *w)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Currency < list[j].Currency })
+	return list
+}
+
+// EtherscanOK Etherscan 接口的返回结果是否有效：status 为 1，或者没有转账记录；
+// 其他 status 为 0 的返回（message 为 NOTOK）是请求出错，例如 API 密钥错误、超过频率限制
+func EtherscanOK(status, message string) bool {
+	return status == "1" || message == "No transactions found"
+}
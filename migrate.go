@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"upay_pro/config"
+	"upay_pro/db/sdb"
+)
+
+const migrateUsage = `用法: upay migrate [up|down [n]|status]
+  up        执行所有还没有执行过的迁移（默认）
+  down [n]  回滚最近执行的 n 个迁移，默认 1 个
+  status    显示所有迁移和执行状态`
+
+// runMigrate 执行 migrate 子命令，返回进程的退出码
+func runMigrate(args []string) int {
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "up", "down", "status":
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	store, err := sdb.New(config.Get())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.Close()
+
+	switch cmd {
+	case "up":
+		n, err := store.Migrate()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("执行了 %d 个迁移\n", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			v, err := strconv.Atoi(args[1])
+			if err != nil || v < 1 {
+				fmt.Fprintln(os.Stderr, "回滚数量必须是正整数")
+				return 2
+			}
+			steps = v
+		}
+		n, err := store.Rollback(steps)
+		fmt.Printf("回滚了 %d 个迁移\n", n)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "status":
+		states, err := store.Migrations()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, s := range states {
+			applied := "未执行"
+			if s.Applied {
+				applied = "已执行 " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,203 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"upay_pro/config"
+	"upay_pro/db/sdb"
+	"upay_pro/mylog"
+
+	"github.com/hibiken/asynq"
+	"go.uber.org/zap"
+)
+
+// AsynqScheduler 使用 asynq 队列的调度器，任务保存在 Redis 中
+// 订单号和任务ID保存在 TradeIdTaskID 表中，用于取消任务
+type AsynqScheduler struct {
+	cfg   config.Config
+	store *sdb.Store
+	mux   *asynq.ServeMux
+	// 客户端、任务管理器、异步任务服务器和服务器启动失败或停止的原因，重新连接 Redis 时替换
+	mu        sync.Mutex
+	client    *asynq.Client
+	inspector *asynq.Inspector
+	server    *asynq.Server
+	serverErr error
+}
+
+// NewAsynq 创建使用 asynq 队列的调度器，Start 时连接 Redis
+func NewAsynq(cfg config.Config, store *sdb.Store) *AsynqScheduler {
+	s := &AsynqScheduler{cfg: cfg, store: store, mux: asynq.NewServeMux()}
+	// 注册处理函数，根据任务名称，调用不同的处理函数
+	s.mux.HandleFunc(QueueOrderExpiration, s.handleCheckStatusCodeTask)
+	return s
+}
+
+// Start 连接 Redis 并启动异步任务服务器
+func (s *AsynqScheduler) Start() error {
+	s.connect(s.cfg)
+	return nil
+}
+
+// Reload 重新加载启动配置后调用，Redis 配置有变化时重新连接
+// 已经加入队列的任务保存在原来的 Redis 中，不会迁移
+func (s *AsynqScheduler) Reload(old, new config.Config) error {
+	if old.Redis != new.Redis {
+		s.connect(new)
+	}
+	return nil
+}
+
+// connect 按启动配置创建客户端和任务管理器并启动异步任务服务器，已有的服务器会被关闭
+func (s *AsynqScheduler) connect(cfg config.Config) {
+	// 获取redis地址
+	opt := asynq.RedisClientOpt{
+		Addr:     cfg.RedisAddr(),
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	}
+	srv := asynq.NewServer(opt, asynq.Config{Concurrency: 10})
+
+	s.mu.Lock()
+	client, inspector, server := s.client, s.inspector, s.server
+	s.client = asynq.NewClient(opt)
+	s.inspector = asynq.NewInspector(opt)
+	s.server, s.serverErr = srv, nil
+	s.mu.Unlock()
+
+	// 启动异步任务服务器，停止由 Close 负责，不使用 asynq 自己的信号处理
+	if err := srv.Start(s.mux); err != nil {
+		mylog.Logger.Error("异步任务服务器启动失败", zap.Error(err))
+		s.mu.Lock()
+		if s.server == srv {
+			s.serverErr = err
+		}
+		s.mu.Unlock()
+	}
+
+	if server != nil {
+		server.Shutdown()
+		client.Close()
+		inspector.Close()
+	}
+}
+
+// clients 返回当前的客户端和任务管理器
+func (s *AsynqScheduler) clients() (*asynq.Client, *asynq.Inspector) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client, s.inspector
+}
+
+func (s *AsynqScheduler) Schedule(tradeId string, delay time.Duration) error {
+	if err := s.Cancel(tradeId); err != nil {
+		mylog.Logger.Error("删除旧的过期任务失败", zap.String("trade_id", tradeId), zap.Error(err))
+	}
+	client, _ := s.clients()
+	task := asynq.NewTask(QueueOrderExpiration, []byte(tradeId)) // 转换为字节切片
+	// 将任务加入队列
+	info, err := client.Enqueue(task, asynq.ProcessIn(delay))
+	if err != nil {
+		return err
+	}
+	mylog.Logger.Info("任务已加入队列:", zap.Any("info", info))
+
+	// 把订单号和任务ID存在数据库中，方便使用
+	return s.store.DB.Create(&sdb.TradeIdTaskID{TradeId: tradeId, TaskID: info.ID}).Error
+}
+
+func (s *AsynqScheduler) Cancel(tradeId string) error {
+	var tasks []sdb.TradeIdTaskID
+	// 字段名有大写字母，使用 map 条件由 gorm 给字段名加引号，兼容 PostgreSQL 和 MySQL
+	if err := s.store.DB.Where(map[string]interface{}{"TradeId": tradeId}).Find(&tasks).Error; err != nil {
+		return err
+	}
+	_, inspector := s.clients()
+	for _, task := range tasks {
+		// 任务已经执行过时队列中没有这个任务
+		err := inspector.DeleteTask("default", task.TaskID)
+		if err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+			return err
+		}
+		if err := s.store.DB.Delete(&task).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 停止异步任务服务器，等待正在执行的任务完成，然后关闭客户端
+func (s *AsynqScheduler) Close(ctx context.Context) error {
+	s.mu.Lock()
+	client, inspector, server := s.client, s.inspector, s.server
+	s.serverErr = errors.New("异步任务服务器已停止")
+	s.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+
+	// Shutdown 最多等待 asynq 的 ShutdownTimeout，默认 8 秒
+	server.Shutdown()
+	return errors.Join(client.Close(), inspector.Close())
+}
+
+// Ping 检查异步任务服务器是否在运行，并且能连接到 Redis
+func (s *AsynqScheduler) Ping() error {
+	s.mu.Lock()
+	srv, err := s.server, s.serverErr
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if srv == nil {
+		return errors.New("异步任务服务器还没有启动")
+	}
+	return srv.Ping()
+}
+
+func (s *AsynqScheduler) Tasks() (map[string]map[string]int, error) {
+	_, inspector := s.clients()
+	queues, err := inspector.Queues()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]int, len(queues))
+	for _, queue := range queues {
+		info, err := inspector.GetQueueInfo(queue)
+		if err != nil {
+			return nil, err
+		}
+		result[queue] = map[string]int{
+			"pending":   info.Pending,
+			"active":    info.Active,
+			"scheduled": info.Scheduled,
+			"retry":     info.Retry,
+			"archived":  info.Archived,
+		}
+	}
+	return result, nil
+}
+
+// 处理过期任务
+func (s *AsynqScheduler) handleCheckStatusCodeTask(ctx context.Context, t *asynq.Task) error {
+	// 提取任务载荷传入的交易ID，根据ID去查一下订单记录里面的支付状态是否是待支付，如果是待支付，改为已过期
+	// 钱包地址和金额的锁与订单同时过期，不需要在这里解锁
+	payload := string(t.Payload())
+	if err := expireOrder(s.store, payload); err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("%w: %v", asynq.SkipRetry, err)
+		}
+		return err
+	}
+
+	// 根据订单号查到记录，删除记录
+	re := s.store.DB.Where(map[string]interface{}{"TradeId": payload}).Delete(&sdb.TradeIdTaskID{})
+	if re.Error != nil {
+		mylog.Logger.Info("删除数据库TradeIdTaskID中的任务记录失败", zap.Error(re.Error))
+		return re.Error
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"upay_pro/db/sdb"
+	"upay_pro/mylog"
+
+	"go.uber.org/zap"
+)
+
+// 过期任务执行失败后的重试间隔
+const localRetryDelay = time.Minute
+
+// localScheduler 使用进程内定时器的调度器，不依赖 Redis
+// 定时器不会持久化，程序启动时根据等待支付订单的过期时间重新创建
+type localScheduler struct {
+	store  *sdb.Store
+	mu     sync.Mutex
+	tasks  map[string]*localTask
+	closed bool
+	// 正在执行的过期任务，停止时等待完成
+	running sync.WaitGroup
+}
+
+// localTask 一个订单的过期任务
+type localTask struct {
+	timer *time.Timer
+}
+
+// NewLocal 创建使用进程内定时器的调度器
+func NewLocal(store *sdb.Store) Scheduler {
+	return &localScheduler{store: store, tasks: make(map[string]*localTask)}
+}
+
+// Start 为等待支付的订单创建定时器，已经过期的订单立即处理
+func (s *localScheduler) Start() error {
+	var orders []sdb.Orders
+	if err := s.store.DB.Where("status = ?", sdb.StatusWaitPay).Find(&orders).Error; err != nil {
+		return fmt.Errorf("恢复订单过期任务失败: %w", err)
+	}
+	for _, order := range orders {
+		s.Schedule(order.TradeId, time.Until(time.UnixMilli(order.ExpirationTime)))
+	}
+	mylog.Logger.Info("已恢复订单过期任务", zap.Int("count", len(orders)))
+	return nil
+}
+
+func (s *localScheduler) Schedule(tradeId string, delay time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("订单过期调度器已停止")
+	}
+	if old := s.tasks[tradeId]; old != nil {
+		old.timer.Stop()
+	}
+	task := &localTask{}
+	task.timer = time.AfterFunc(delay, func() { s.fire(tradeId, task) })
+	s.tasks[tradeId] = task
+	return nil
+}
+
+// fire 定时器到期时把订单设置为过期，失败时稍后重试
+func (s *localScheduler) fire(tradeId string, task *localTask) {
+	s.mu.Lock()
+	// 任务已经被替换或取消
+	if s.tasks[tradeId] != task {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.tasks, tradeId)
+	s.running.Add(1)
+	s.mu.Unlock()
+	defer s.running.Done()
+
+	if err := expireOrder(s.store, tradeId); err != nil && !isNotFound(err) {
+		mylog.Logger.Error("订单过期任务执行失败，稍后重试", zap.String("trade_id", tradeId), zap.Error(err))
+		s.Schedule(tradeId, localRetryDelay)
+	}
+}
+
+func (s *localScheduler) Cancel(tradeId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if task := s.tasks[tradeId]; task != nil {
+		task.timer.Stop()
+		delete(s.tasks, tradeId)
+	}
+	return nil
+}
+
+// Close 停止所有定时器，等待正在执行的过期任务完成；等待支付的订单在下次启动时重新创建定时器
+func (s *localScheduler) Close(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for tradeId, task := range s.tasks {
+		task.timer.Stop()
+		delete(s.tasks, tradeId)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *localScheduler) Ping() error {
+	return nil
+}
+
+func (s *localScheduler) Tasks() (map[string]map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]map[string]int{
+		QueueOrderExpiration: {"scheduled": len(s.tasks)},
+	}, nil
+}
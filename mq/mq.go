@@ -1,125 +1,65 @@
 package mq
 
+// 订单过期任务
+// redis 模式下使用 asynq 队列，local 模式下使用进程内定时器，程序启动时根据数据库中等待支付的订单恢复定时器
+
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 	"upay_pro/db/sdb"
+	"upay_pro/events"
+	"upay_pro/metrics"
 	"upay_pro/mylog"
 
-	"github.com/hibiken/asynq"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
-// 客户端
-var Client *asynq.Client
-
-// 服务端
-var Mux *asynq.ServeMux
-
-// 任务管理器
-var Inspector *asynq.Inspector
-
-func init() {
-	// 获取redis地址
-	addr := fmt.Sprintf("%s:%d", sdb.GetSetting().Redishost, sdb.GetSetting().Redisport)
-	// 初始客户端
-	client := asynq.NewClient(asynq.RedisClientOpt{
-		Addr:     addr,
-		Password: sdb.GetSetting().Redispasswd,
-		DB:       sdb.GetSetting().Redisdb,
-	})
-	Client = client
-	// 初始化任务管理器
-	Inspector = asynq.NewInspector(asynq.RedisClientOpt{
-		Addr:     addr,
-		Password: sdb.GetSetting().Redispasswd,
-		DB:       sdb.GetSetting().Redisdb,
-	})
-	// 启动异步任务服务器
-	go async_server_run()
-
-}
-
 // QueueOrderExpiration 订单过期任务的队列名称
 const QueueOrderExpiration = "order:expiration"
 
-// TaskOrderExpiration 创建任务和任务加入对列
-func TaskOrderExpiration(payload string, expirationDuration time.Duration) {
-	task := asynq.NewTask(QueueOrderExpiration, []byte(payload)) // 转换为字节切片
-	// 将任务加入队列
-	info, err := Client.Enqueue(task, asynq.ProcessIn(expirationDuration))
-	if err != nil {
-		mylog.Logger.Info("任务加入失败:" + err.Error())
-	}
-	mylog.Logger.Info("任务已加入队列:", zap.Any("info", info))
-
-	// 把订单号和任务ID存在数据库中，方便使用
-	var tradeIdTaskID sdb.TradeIdTaskID
-	tradeIdTaskID.TradeId = payload
-	tradeIdTaskID.TaskID = info.ID
-	// 不存在就创建，存在就更新现有的记录
-	sdb.DB.Create(&tradeIdTaskID)
-
+// Scheduler 订单过期任务的调度器
+type Scheduler interface {
+	// Start 启动调度器
+	Start() error
+	// Schedule 在 delay 之后把订单设置为过期，订单已有过期任务时替换原来的任务
+	Schedule(tradeId string, delay time.Duration) error
+	// Cancel 取消订单的过期任务
+	Cancel(tradeId string) error
+	// Ping 检查调度器是否在运行
+	Ping() error
+	// Tasks 按队列和状态统计任务数
+	Tasks() (map[string]map[string]int, error)
+	// Close 停止调度器，等待正在执行的任务完成
+	Close(ctx context.Context) error
 }
 
-// 队列服务端
-func async_server_run() {
-	Mux = asynq.NewServeMux()
-	// 注册处理函数，根据任务名称，调用不同的处理函数
-	Mux.HandleFunc(QueueOrderExpiration, handleCheckStatusCodeTask)
-	// 获取redis地址
-	addr := fmt.Sprintf("%s:%d", sdb.GetSetting().Redishost, sdb.GetSetting().Redisport)
-	server := asynq.NewServer(asynq.RedisClientOpt{
-		Addr:     addr,
-		Password: sdb.GetSetting().Redispasswd,
-		DB:       sdb.GetSetting().Redisdb,
-	}, asynq.Config{Concurrency: 10})
-	if err := server.Run(Mux); err != nil {
-		mylog.Logger.Info("Error starting server:", zap.Any("err", err))
-	}
-}
-
-// 处理过期任务
-func handleCheckStatusCodeTask(ctx context.Context, t *asynq.Task) error {
-
-	// 提取任务载荷传入的交易ID，根据ID去查一下订单记录里面的支付状态是否是待支付，如果是待支付，改为已过期
-	// 订单过期后，需要解锁钱包地址和金额【从Redis里删除】
-	payload := string(t.Payload())
-
+// expireOrder 订单仍在等待支付时设置为过期
+// 过期时间被重复下单延长后，旧的任务不再生效
+func expireOrder(store *sdb.Store, tradeId string) error {
 	var order sdb.Orders
-
-	err := sdb.DB.First(&order, "trade_id = ?", payload).Error
+	err := store.DB.First(&order, "trade_id = ?", tradeId).Error
 	if err != nil {
-		mylog.Logger.Info("订单查询失败")
+		mylog.Logger.Info("订单查询失败", zap.String("trade_id", tradeId), zap.Error(err))
 		return err
 	}
 
-	if order.Status == sdb.StatusWaitPay {
+	if order.Status == sdb.StatusWaitPay && time.Now().Add(time.Second).UnixMilli() >= order.ExpirationTime {
 		order.Status = sdb.StatusExpired
-		sdb.DB.Save(&order)
+		if err := store.DB.Save(&order).Error; err != nil {
+			return err
+		}
+		metrics.OrdersExpired.WithLabelValues(metrics.CurrencyLabel(order.Type)).Inc()
 		mylog.Logger.Info(fmt.Sprintf("订单%v已设置为过期", order.TradeId))
+		// 通知支付页面订单已过期
+		events.Publish(events.Event{TradeId: order.TradeId, Type: events.Expired})
 	}
-
-	// 根据订单号查到记录，删除记录
-	var task sdb.TradeIdTaskID
-
-	re := sdb.DB.Where("TradeId = ?", payload).Delete(&task)
-	if re.Error != nil {
-		mylog.Logger.Info("删除数据库TradeIdTaskID中的任务记录失败", zap.Error(re.Error))
-		return re.Error
-	}
-
 	return nil
 }
 
-// 终止任务
-func StopTask(taskID string) error {
-	// 从队列中删除任务
-	err := Inspector.DeleteTask("default", taskID)
-	if err != nil {
-		mylog.Logger.Info("删除任务失败")
-		return err
-	}
-	return nil
+// isNotFound 订单已被删除，不需要重试
+func isNotFound(err error) bool {
+	return errors.Is(err, gorm.ErrRecordNotFound)
 }
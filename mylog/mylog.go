@@ -2,50 +2,71 @@ package mylog
 
 import (
 	"os"
+	"upay_pro/config"
 
 	"github.com/natefinch/lumberjack"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var Logger *zap.Logger
+// Logger 全局日志，Init 之前只输出到标准输出
+var Logger = zap.New(consoleCore(), zap.AddCaller())
 
-func init() {
-	// 创建一个 Console 编码器，输出更易读的文本格式
+// 日志文件，Close 时关闭
+var file *lumberjack.Logger
+
+// 创建一个 Console 编码器，输出更易读的文本格式
+func encoder() zapcore.Encoder {
 	encoderConfig := zap.NewDevelopmentEncoderConfig()
 	encoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 	// 添加以下配置来显示调用者信息
 	encoderConfig.EncodeCaller = zapcore.ShortCallerEncoder // 显示调用者信息
 	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder   // 时间格式
-	encoder := zapcore.NewConsoleEncoder(encoderConfig)
+	return zapcore.NewConsoleEncoder(encoderConfig)
+}
 
-	// 创建一个日志核心，输出到文件
-	fileCore := zapcore.NewCore(
-		encoder,
-		zapcore.AddSync(&lumberjack.Logger{
-			Filename:   "logs/upay.log",
-			MaxSize:    30, // MB
-			MaxBackups: 3,
-			MaxAge:     7, // days
-		}),
+// 输出到标准输出的日志核心
+func consoleCore() zapcore.Core {
+	return zapcore.NewCore(
+		encoder(),
+		zapcore.AddSync(os.Stdout),
 		zap.InfoLevel,
 	)
+}
 
-	// 创建另一个日志核心，输出到标准输出
-	consoleCore := zapcore.NewCore(
-		encoder,
-		zapcore.AddSync(os.Stdout),
+// Init 按启动配置创建日志，同时输出到日志文件和标准输出
+func Init() {
+	file = &lumberjack.Logger{
+		Filename:   config.Get().LogFile(),
+		MaxSize:    30, // MB
+		MaxBackups: 3,
+		MaxAge:     7, // days
+	}
+	// 创建一个日志核心，输出到文件
+	fileCore := zapcore.NewCore(
+		encoder(),
+		zapcore.AddSync(file),
 		zap.InfoLevel,
 	)
 
 	// 使用 zapcore.NewTee 将两个核心组合起来
-	log_zap := zap.New(zapcore.NewTee(fileCore, consoleCore),
+	log_zap := zap.New(zapcore.NewTee(fileCore, consoleCore()),
 		zap.AddCaller(),      // 添加调用者信息
 		zap.AddCallerSkip(0), // 调整调用栈跳过的帧数
 	)
 
 	// 将 logger 设置为全局变量
 	Logger = log_zap
-	// 确保 logger 在退出时进行同步
+}
 
+// Close 把缓冲中的日志写入文件并关闭日志文件，程序退出前调用
+func Close() error {
+	// 标准输出不支持 Sync，忽略这个错误
+	_ = Logger.Sync()
+	// 关闭后的日志只输出到标准输出，不会重新打开日志文件
+	Logger = zap.New(consoleCore(), zap.AddCaller())
+	if file != nil {
+		return file.Close()
+	}
+	return nil
 }
@@ -0,0 +1,30 @@
+package notification
+
+// 这里是系统告警，复用 telegram 和 bark 的通知渠道
+
+import (
+	"fmt"
+	"upay_pro/mylog"
+
+	"go.uber.org/zap"
+)
+
+// Alert 向管理员发送系统告警，没有配置通知渠道时只写日志
+func (s *Sender) Alert(title, body string) {
+	mylog.Logger.Warn("系统告警", zap.String("title", title), zap.String("body", body))
+
+	setting := s.store.GetSetting()
+
+	if setting.Tgbotkey != "" && setting.Tgchatid != "" {
+		message := fmt.Sprintf("<b>⚠️ UPAY_PRO %s</b>\n\n%s", title, body)
+		if err := s.sendTelegram(setting.Tgbotkey, setting.Tgchatid, message); err != nil {
+			mylog.Logger.Error("发送电报告警失败", zap.Error(err))
+		}
+	}
+
+	if setting.Barkkey != "" {
+		if err := s.sendBark(setting.Barkkey, "UPAY_PRO "+title, body); err != nil {
+			mylog.Logger.Error("发送Bark告警失败", zap.Error(err))
+		}
+	}
+}
@@ -8,10 +8,12 @@ import (
 	"fmt"
 	"net/http"
 	"upay_pro/db/sdb"
+	"upay_pro/i18n"
 	"upay_pro/mylog"
 )
 
-func sendBarkNotification(barkURL, title, body string) error {
+// sendBark 发送 Bark 通知，key 为 Bark 的设备密钥
+func (s *Sender) sendBark(key, title, body string) error {
 	// 创建通知内容
 	notification := map[string]string{
 		"title": title,
@@ -25,7 +27,7 @@ func sendBarkNotification(barkURL, title, body string) error {
 	}
 
 	// 发送 POST 请求
-	resp, err := http.Post(barkURL, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := http.Post(s.BarkAPI+"/"+key, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
@@ -39,41 +41,42 @@ func sendBarkNotification(barkURL, title, body string) error {
 	return nil
 }
 
-func Bark_Start(order sdb.Orders) {
+// barkOrder 发送 Bark 订单通知
+func (s *Sender) barkOrder(setting sdb.Setting, order sdb.Orders) {
 
-	if sdb.GetSetting().Barkkey == "" {
+	if setting.Barkkey == "" {
 		mylog.Logger.Info("Barkkey为空，不能发送通知")
 		return
 	}
 
-	// 替换为你的 Bark URL
-	barkURL := "https://api.day.app/" + sdb.GetSetting().Barkkey // 你的 Bark 服务器 URL
-	title := "UPAY_PRO 订单通知"
+	// 通知消息的语言
+	lang := setting.Language
+	title := i18n.T(lang, "UPAY_PRO 订单通知")
 	// 将数据库中的数字翻译会自然语言
 	var Status string
 	switch order.Status {
 	case 1:
-		Status = "待支付"
+		Status = i18n.T(lang, "待支付")
 	case 2:
-		Status = "支付成功"
+		Status = i18n.T(lang, "支付成功")
 	case 3:
-		Status = "已过期"
+		Status = i18n.T(lang, "已过期")
 	default:
-		Status = "未知状态"
+		Status = i18n.T(lang, "未知状态")
 	}
 
 	var CallBackConfirm string
 	if order.CallBackConfirm == sdb.CallBackConfirmOk {
-		CallBackConfirm = "已回调"
+		CallBackConfirm = i18n.T(lang, "已回调")
 	} else {
-		CallBackConfirm = "未回调"
+		CallBackConfirm = i18n.T(lang, "未回调")
 	}
 
-	body := fmt.Sprintf("订单号:%s\n币种:%s\n支付金额%.2f\n支付状态:%s\n区块ID:%s\n回调状态：%s\n", order.TradeId, order.Type, order.ActualAmount, Status, order.BlockTransactionId, CallBackConfirm)
+	body := i18n.Tf(lang, "订单号:%s\n币种:%s\n支付金额%.2f\n支付状态:%s\n区块ID:%s\n回调状态：%s\n", order.TradeId, order.Type, order.ActualAmount, Status, order.BlockTransactionId, CallBackConfirm)
 	// body := "您的订单已成功创建！\n感谢您的购买！\n请查看您的订单详情。"
 
 	// 发送通知
-	err := sendBarkNotification(barkURL, title, body)
+	err := s.sendBark(setting.Barkkey, title, body)
 	if err != nil {
 		fmt.Println("发送通知失败:", err)
 	} else {
@@ -0,0 +1,39 @@
+package notification
+
+// 订单通知和系统告警，按系统设置发送到电报和 Bark
+
+import (
+	"upay_pro/db/sdb"
+)
+
+// Notifier 通知管理员，没有配置通知渠道时不发送
+type Notifier interface {
+	// OrderPaid 订单支付成功并且异步回调成功后通知
+	OrderPaid(order sdb.Orders)
+	// Alert 系统告警
+	Alert(title, body string)
+}
+
+// Sender 按系统设置把通知发送到电报和 Bark
+type Sender struct {
+	store *sdb.Store
+	// 电报和 Bark 接口的地址，测试时可以替换
+	TelegramAPI string
+	BarkAPI     string
+}
+
+// New 创建通知，通知渠道在每次发送时从系统设置读取，后台修改后立即生效
+func New(store *sdb.Store) *Sender {
+	return &Sender{
+		store:       store,
+		TelegramAPI: "https://api.telegram.org",
+		BarkAPI:     "https://api.day.app",
+	}
+}
+
+// OrderPaid 发送 Bark 和电报订单通知
+func (s *Sender) OrderPaid(order sdb.Orders) {
+	setting := s.store.GetSetting()
+	s.barkOrder(setting, order)
+	s.telegramOrder(setting, order)
+}
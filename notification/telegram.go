@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	"upay_pro/db/sdb"
+	"upay_pro/i18n"
 	"upay_pro/mylog"
 )
 
@@ -18,10 +19,10 @@ type TelegramMessage struct {
 	ParseMode string `json:"parse_mode,omitempty"`
 }
 
-// sendTelegramNotification 发送电报通知
-func sendTelegramNotification(botToken, chatID, message string) error {
+// sendTelegram 发送电报通知
+func (s *Sender) sendTelegram(botToken, chatID, message string) error {
 	// 构建电报API URL
-	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", botToken)
+	apiURL := fmt.Sprintf("%s/bot%s/sendMessage", s.TelegramAPI, botToken)
 
 	// 创建消息内容
 	telegramMsg := TelegramMessage{
@@ -51,10 +52,8 @@ func sendTelegramNotification(botToken, chatID, message string) error {
 	return nil
 }
 
-// StartTelegram 启动电报通知服务
-func StartTelegram(order sdb.Orders) {
-	setting := sdb.GetSetting()
-
+// telegramOrder 发送电报订单通知
+func (s *Sender) telegramOrder(setting sdb.Setting, order sdb.Orders) {
 	// 检查电报机器人配置
 	if setting.Tgbotkey == "" {
 		mylog.Logger.Info("Tgbotkey为空，不能发送电报通知")
@@ -66,28 +65,31 @@ func StartTelegram(order sdb.Orders) {
 		return
 	}
 
+	// 通知消息的语言
+	lang := setting.Language
+
 	// 将数据库中的数字翻译为自然语言
 	var status string
 	switch order.Status {
 	case 1:
-		status = "待支付"
+		status = i18n.T(lang, "待支付")
 	case 2:
-		status = "支付成功"
+		status = i18n.T(lang, "支付成功")
 	case 3:
-		status = "已过期"
+		status = i18n.T(lang, "已过期")
 	default:
-		status = "未知状态"
+		status = i18n.T(lang, "未知状态")
 	}
 
 	var callBackConfirm string
 	if order.CallBackConfirm == sdb.CallBackConfirmOk {
-		callBackConfirm = "已回调"
+		callBackConfirm = i18n.T(lang, "已回调")
 	} else {
-		callBackConfirm = "未回调"
+		callBackConfirm = i18n.T(lang, "未回调")
 	}
 
 	// 构建电报消息内容（使用HTML格式）
-	message := fmt.Sprintf(
+	message := i18n.Tf(lang,
 		"<b>🔔 UPAY_PRO 订单通知</b>\n\n"+
 			"<b>订单号:</b> <code>%s</code>\n"+
 			"<b>币种:</b> %s\n"+
@@ -104,7 +106,7 @@ func StartTelegram(order sdb.Orders) {
 	)
 
 	// 发送电报通知
-	err := sendTelegramNotification(setting.Tgbotkey, setting.Tgchatid, message)
+	err := s.sendTelegram(setting.Tgbotkey, setting.Tgchatid, message)
 	if err != nil {
 		mylog.Logger.Error(fmt.Sprintf("发送电报通知失败: %v", err))
 	} else {
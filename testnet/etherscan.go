@@ -0,0 +1,124 @@
+package testnet
+
+// 沙盒订单在 EVM 测试网上的监听器
+// 测试网上的测试代币和主网的代币符号、精度不同，这里按链的信息查询，只按合约地址区分代币，不检查代币符号
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"upay_pro/chains"
+	"upay_pro/db/sdb"
+	"upay_pro/metrics"
+	"upay_pro/mylog"
+
+	"go.uber.org/zap"
+)
+
+// tokentxResponse Etherscan module=account&action=tokentx 的响应
+type tokentxResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Result  []struct {
+		TimeStamp       string `json:"timeStamp"`
+		Hash            string `json:"hash"`
+		ContractAddress string `json:"contractAddress"`
+		To              string `json:"to"`
+		Value           string `json:"value"`
+		Confirmations   string `json:"confirmations"`
+	} `json:"result"`
+}
+
+// Etherscan 通过 Etherscan V2 接口按链ID查询测试网上的代币转账
+type Etherscan struct {
+	store  *sdb.Store
+	apiKey func() string
+	chain  chains.Chain
+	// BaseURL 接口地址，默认为 Etherscan，测试时可以替换
+	BaseURL string
+}
+
+// NewEtherscan 创建 chain 所在测试网的监听器，apiKey 在每次查询时调用
+func NewEtherscan(store *sdb.Store, apiKey func() string, chain chains.Chain) *Etherscan {
+	return &Etherscan{store: store, apiKey: apiKey, chain: chain, BaseURL: "https://api.etherscan.io/v2/api"}
+}
+
+// Check 查询订单的转账，找到符合订单的转账时把订单设置为已支付并返回 true
+func (w *Etherscan) Check(order sdb.Orders) bool {
+	params := url.Values{}
+	params.Add("chainid", strconv.Itoa(w.chain.ChainID))
+	params.Add("module", "account")
+	params.Add("action", "tokentx")
+	params.Add("address", order.Token)
+	params.Add("contractaddress", w.chain.Contract)
+	params.Add("apikey", w.apiKey())
+	params.Add("page", "1")
+	params.Add("offset", "1")
+	params.Add("sort", "desc")
+
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: metrics.WatcherTransport,
+	}
+	resp, err := client.Get(w.BaseURL + "?" + params.Encode())
+	if err != nil {
+		mylog.Logger.Error("测试网请求失败", zap.String("网络", w.chain.Network), zap.Error(err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		mylog.Logger.Error("测试网读取响应失败", zap.String("网络", w.chain.Network), zap.Error(err))
+		return false
+	}
+	var response tokentxResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		mylog.Logger.Error("测试网解析响应失败", zap.String("网络", w.chain.Network), zap.Error(err))
+		return false
+	}
+	if response.Message != "OK" || len(response.Result) == 0 {
+		mylog.Logger.Info("测试网没有查询到转账记录", zap.String("网络", w.chain.Network), zap.String("message", response.Message))
+		return false
+	}
+
+	tx := response.Result[0]
+	timeStamp, err := strconv.ParseInt(tx.TimeStamp, 10, 64)
+	if err != nil {
+		mylog.Logger.Error("测试网时间戳转换失败", zap.Error(err))
+		return false
+	}
+	timeStampMs := timeStamp * 1000
+	amount := w.formatAmount(tx.Value)
+
+	if strings.EqualFold(tx.To, order.Token) && strings.EqualFold(tx.ContractAddress, w.chain.Contract) &&
+		timeStampMs > order.StartTime && timeStampMs < order.ExpirationTime && amount == order.ActualAmount && tx.Hash != "" {
+		order.BlockTransactionId = tx.Hash
+		order.Status = sdb.StatusPaySuccess
+		re := w.store.DB.Save(&order)
+		if re.Error == nil {
+			mylog.Logger.Info("沙盒订单入账成功", zap.String("网络", w.chain.Network), zap.String("order_id", order.TradeId))
+			return true
+		}
+		mylog.Logger.Error("沙盒订单入账失败", zap.String("网络", w.chain.Network), zap.Error(re.Error))
+		return false
+	}
+	mylog.Logger.Info("测试网找到的记录不满足要求", zap.String("网络", w.chain.Network), zap.String("hash", tx.Hash), zap.Float64("金额", amount))
+	return false
+}
+
+// formatAmount 按代币精度把最小单位转换为金额，保留2位小数
+func (w *Etherscan) formatAmount(value string) float64 {
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		mylog.Logger.Error("Error parsing amount", zap.Any("error", err))
+		return 0
+	}
+	amount = amount / math.Pow10(w.chain.Decimals)
+	return math.Round(amount*100) / 100
+}
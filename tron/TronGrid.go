@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 	"upay_pro/db/sdb"
+	"upay_pro/metrics"
 	"upay_pro/mylog"
 
 	"go.uber.org/zap"
@@ -55,23 +56,38 @@ type ApiResponseGrid struct {
 
 // --- 结束 JSON 结构体定义 ---
 
-// 传入钱包地址
-// 注意：startTime 和 endTime 参数当前未在此函数实现中使用
-func GetTransactionsGrid(order sdb.Orders) bool {
+// TronGrid 通过 TronGrid 查询 TRC20 USDT 转账，Tronscan 没有查到时使用
+type TronGrid struct {
+	store  *sdb.Store
+	apiKey func() string
+	// BaseURL 接口地址，默认为 TronGrid，测试时可以替换
+	BaseURL string
+	// Contract USDT 合约地址，默认为主网，查询测试网时替换
+	Contract string
+}
+
+// NewTronGrid 创建监听器，apiKey 在每次查询时调用，后台修改的 API 密钥立即生效
+func NewTronGrid(store *sdb.Store, apiKey func() string) *TronGrid {
+	return &TronGrid{store: store, apiKey: apiKey, BaseURL: "https://api.trongrid.io", Contract: USDTContract}
+}
+
+// Check 查询订单的转账，找到符合订单的转账时把订单设置为已支付并返回 true
+func (w *TronGrid) Check(order sdb.Orders) bool {
 
 	// 1. 构造请求 URL
-	// 注意：这里硬编码了合约地址和 limit=1，根据需要可以将其作为参数传入
-	contractAddress := "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t" // USDT TRC20 合约地址
+	// 注意：这里硬编码了 limit=1，根据需要可以将其作为参数传入
+	contractAddress := w.Contract // USDT TRC20 合约地址
 	limit := 1
 	min_timestamp := order.StartTime
 	max_timestamp := order.ExpirationTime
 
-	apiURL := fmt.Sprintf("https://api.trongrid.io/v1/accounts/%s/transactions/trc20?contract_address=%s&limit=%d&only_confirmed=true&min_block_timestamp=%v&max_block_timestamp=%v",
-		order.Token, contractAddress, limit, min_timestamp, max_timestamp)
+	apiURL := fmt.Sprintf("%s/v1/accounts/%s/transactions/trc20?contract_address=%s&limit=%d&only_confirmed=true&min_block_timestamp=%v&max_block_timestamp=%v",
+		w.BaseURL, order.Token, contractAddress, limit, min_timestamp, max_timestamp)
 
 	// 创建HTTP客户端
 	client := &http.Client{
-		Timeout: 30 * time.Second,
+		Timeout:   30 * time.Second,
+		Transport: metrics.WatcherTransport,
 	}
 	// 创建请求并设置请求头
 	req, err := http.NewRequest("GET", apiURL, nil)
@@ -80,7 +96,7 @@ func GetTransactionsGrid(order sdb.Orders) bool {
 		return false
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("TRON-PRO-API-KEY", sdb.GetApiKey().Trongrid)
+	req.Header.Set("TRON-PRO-API-KEY", w.apiKey())
 
 	// 2. 发送 HTTP GET 请求
 	resp, err := client.Do(req)
@@ -110,6 +126,12 @@ func GetTransactionsGrid(order sdb.Orders) bool {
 		mylog.Logger.Error("USDT_TronGrid解析 JSON 失败", zap.Error(err))
 		return false
 	}
+	if !apiResponse.Success {
+		mylog.Logger.Error("USDT_TronGrid 返回 success=false")
+		return false
+	}
+	// 返回结果有效，记录查询成功
+	metrics.RecordPoll(order.Type, order.Sandbox)
 	if len(apiResponse.Data) > 0 {
 		// 已经查到数据
 		// 金额转换
@@ -120,7 +142,7 @@ func GetTransactionsGrid(order sdb.Orders) bool {
 			// 符合要求就保存到数据库
 			order.BlockTransactionId = apiResponse.Data[0].TransactionID
 			order.Status = sdb.StatusPaySuccess
-			re := sdb.DB.Save(&order)
+			re := w.store.DB.Save(&order)
 			if re.Error == nil {
 				mylog.Logger.Info("USDT-TRC20 订单支付成功", zap.String("order_id", order.TradeId))
 				return true
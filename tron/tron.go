@@ -13,12 +13,17 @@ import (
 	"net/url"  // 导入 url 包用于构建请求的 URL
 	"strconv"
 	"upay_pro/db/sdb"
+	"upay_pro/events"
+	"upay_pro/metrics"
 	"upay_pro/mylog"
 
 	"go.uber.org/zap"
 	// 用于处理时间和日期的 Go 语言库
 )
 
+// USDTContract 主网的 USDT TRC20 合约地址
+const USDTContract = "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t"
+
 // 定义 TokenTransfer 结构体用于解析每个转账记录
 type TokenTransfer struct {
 	TransactionID   string                 `json:"transaction_id"`   // 交易 ID
@@ -70,8 +75,23 @@ type TransferDetails struct {
 	FinalResult   string
 }
 
-// 传入钱包地址
-func GetTransactions(order sdb.Orders) bool {
+// Tronscan 通过 Tronscan 查询 TRC20 USDT 转账
+type Tronscan struct {
+	store  *sdb.Store
+	apiKey func() string
+	// BaseURL 接口地址，默认为 Tronscan，测试时可以替换
+	BaseURL string
+	// Contract USDT 合约地址，默认为主网，查询测试网时替换
+	Contract string
+}
+
+// NewTronscan 创建监听器，apiKey 在每次查询时调用，后台修改的 API 密钥立即生效
+func NewTronscan(store *sdb.Store, apiKey func() string) *Tronscan {
+	return &Tronscan{store: store, apiKey: apiKey, BaseURL: "https://apilist.tronscan.org", Contract: USDTContract}
+}
+
+// Check 查询订单的转账，找到符合订单的转账时把订单设置为已支付并返回 true
+func (w *Tronscan) Check(order sdb.Orders) bool {
 
 	/* 	// 获取当前时间戳（毫秒）
 	   	endTime := carbon.Now().TimestampMilli()
@@ -81,26 +101,27 @@ func GetTransactions(order sdb.Orders) bool {
 
 	// 构建请求的 URL 参数
 	// API地址【trc20链的API地址】
-	baseURL := "https://apilist.tronscan.org/api/token_trc20/transfers"
+	baseURL := w.BaseURL + "/api/token_trc20/transfers"
 	params := url.Values{}
 	// 要查询的钱包地址
 	params.Add("toAddress", order.Token)
 	params.Add("limit", "1") // 修改 limit 参数为 1，获取两条转账记录
-	params.Add("confirm", "true")
+	// 同时返回还没有确认的转账，用于通知支付页面已经查到转账
 	params.Add("start_timestamp", fmt.Sprintf("%d", order.StartTime))
 	params.Add("end_timestamp", fmt.Sprintf("%d", order.ExpirationTime))
 	// 增加合约地址
-	params.Add("contract_address", "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t")
+	params.Add("contract_address", w.Contract)
 
 	// 使用 url 拼接完整的 URL
 	finalURL := fmt.Sprintf("%s?%s", baseURL, params.Encode())
 
 	// 发起 GET 请求
 	req, _ := http.NewRequest("GET", finalURL, nil)
-	req.Header.Set("TRON-PRO-API-KEY", sdb.GetApiKey().Tronscan)
+	req.Header.Set("TRON-PRO-API-KEY", w.apiKey())
 	req.Header.Set("Content-Type", "application/json")
 	client := http.Client{
-		Timeout: 30 * time.Second,
+		Timeout:   30 * time.Second,
+		Transport: metrics.WatcherTransport,
 	}
 
 	resp, err := client.Do(req)
@@ -128,6 +149,8 @@ func GetTransactions(order sdb.Orders) bool {
 		mylog.Logger.Error("Error unmarshalling JSON", zap.Any("error", err))
 		return false
 	}
+	// 返回结果有效，记录查询成功
+	metrics.RecordPoll(order.Type, order.Sandbox)
 
 	// 判断是否返回转账即可
 
@@ -138,10 +161,16 @@ func GetTransactions(order sdb.Orders) bool {
 		amount := formatAmount(response.TokenTransfers[0].Quant)
 
 		if amount == order.ActualAmount && strings.EqualFold(response.TokenTransfers[0].ToAddress, order.Token) && response.TokenTransfers[0].TokenInfo.TokenAbbr == "USDT" && response.TokenTransfers[0].TransactionID != "" {
+			// 还没有确认的转账只通知支付页面，确认后再入账
+			if !response.TokenTransfers[0].Confirmed {
+				events.Pending(order.TradeId, response.TokenTransfers[0].TransactionID)
+				mylog.Logger.Info("USDT-TRC20 转账等待确认", zap.String("order_id", order.TradeId), zap.String("tx", response.TokenTransfers[0].TransactionID))
+				return false
+			}
 			// 如果满足条件，则说明已经查到转账记录，并且金额和数据库转换后的金额，则就可以更新数据库中
 			order.BlockTransactionId = response.TokenTransfers[0].TransactionID
 			order.Status = sdb.StatusPaySuccess
-			re := sdb.DB.Save(&order)
+			re := w.store.DB.Save(&order)
 			if re.Error == nil {
 				mylog.Logger.Info("USDT-TRC20 更新数据库订单记录成功", zap.String("order_id", order.TradeId))
 				return true
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"time"
 	"upay_pro/db/sdb"
+	"upay_pro/metrics"
 	"upay_pro/mylog"
 
 	"go.uber.org/zap"
@@ -95,13 +96,27 @@ type QueryConfig struct {
 }
 
 // 构建API URL
-func buildAPIURL(config QueryConfig) string {
-	baseURL := fmt.Sprintf("%s/accounts/%s/transactions?limit=%d&only_confirmed=%t&only_to=%t&min_timestamp=%d&max_timestamp=%d", TronGridBaseURL, config.Account, config.Limit, config.OnlyConfirmed, config.OnlyTo, config.MinTimestamp, config.MaxTimestamp)
+func buildAPIURL(apiURL string, config QueryConfig) string {
+	baseURL := fmt.Sprintf("%s/accounts/%s/transactions?limit=%d&only_confirmed=%t&only_to=%t&min_timestamp=%d&max_timestamp=%d", apiURL, config.Account, config.Limit, config.OnlyConfirmed, config.OnlyTo, config.MinTimestamp, config.MaxTimestamp)
 
 	return baseURL
 }
 
-func Start2(order sdb.Orders) bool {
+// TronGrid 通过 TronGrid 查询 TRX 转账，Tronscan 没有查到时使用
+type TronGrid struct {
+	store  *sdb.Store
+	apiKey func() string
+	// BaseURL 接口地址，默认为 TronGrid，测试时可以替换
+	BaseURL string
+}
+
+// NewTronGrid 创建监听器，apiKey 在每次查询时调用，后台修改的 API 密钥立即生效
+func NewTronGrid(store *sdb.Store, apiKey func() string) *TronGrid {
+	return &TronGrid{store: store, apiKey: apiKey, BaseURL: TronGridBaseURL}
+}
+
+// Check 查询订单的转账，找到符合订单的转账时把订单设置为已支付并返回 true
+func (w *TronGrid) Check(order sdb.Orders) bool {
 
 	mylog.Logger.Info("第二个TRX_TronGrid开始查询", zap.String("order_id", order.TradeId))
 
@@ -117,12 +132,13 @@ func Start2(order sdb.Orders) bool {
 	}
 
 	// 构建API URL
-	apiURL := buildAPIURL(config)
+	apiURL := buildAPIURL(w.BaseURL, config)
 	fmt.Printf("请求URL: %s\n\n", apiURL)
 
 	// 创建HTTP客户端
 	client := &http.Client{
-		Timeout: DefaultTimeout,
+		Timeout:   DefaultTimeout,
+		Transport: metrics.WatcherTransport,
 	}
 
 	// 创建请求并设置请求头
@@ -132,7 +148,7 @@ func Start2(order sdb.Orders) bool {
 		return false
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("TRON-PRO-API-KEY", sdb.GetApiKey().Trongrid)
+	req.Header.Set("TRON-PRO-API-KEY", w.apiKey())
 
 	// 发送请求
 	resp, err := client.Do(req)
@@ -168,6 +184,12 @@ func Start2(order sdb.Orders) bool {
 	}
 
 	// 检查 API 响应的 Success 字段
+	if !txResponse.Success {
+		mylog.Logger.Error("TRX_TronGrid 返回 success=false")
+		return false
+	}
+	// 返回结果有效，记录查询成功
+	metrics.RecordPoll(order.Type, order.Sandbox)
 
 	if len(txResponse.Data) > 0 {
 
@@ -189,7 +211,7 @@ func Start2(order sdb.Orders) bool {
 				order.BlockTransactionId = tx.TxID
 				order.Status = sdb.StatusPaySuccess
 				// 更新数据库订单记录
-				re := sdb.DB.Save(&order)
+				re := w.store.DB.Save(&order)
 				if re.Error == nil {
 					mylog.Logger.Info("TRX_TronGrid更新数据库订单记录成功", zap.String("order_id", order.TradeId))
 					return true
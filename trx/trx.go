@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"time"
 	"upay_pro/db/sdb"
+	"upay_pro/events"
+	"upay_pro/metrics"
 	"upay_pro/mylog"
 
 	"go.uber.org/zap"
@@ -20,13 +22,17 @@ type TronClient struct {
 	httpClient *http.Client
 }
 
+// TronscanBaseURL Tronscan 接口地址
+const TronscanBaseURL = "https://apilist.tronscanapi.com/api"
+
 // NewTronClient 创建新的TRON客户端
 func NewTronClient(apiKey string) *TronClient {
 	return &TronClient{
 		apiKey:  apiKey,
-		baseURL: "https://apilist.tronscanapi.com/api",
+		baseURL: TronscanBaseURL,
 		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: metrics.WatcherTransport,
 		},
 	}
 }
@@ -67,13 +73,28 @@ func (c *TronClient) GetTransfers(address, toAddress string, limit, start int) (
 	return &result, nil
 }
 
-func Start(order sdb.Orders) bool {
+// Tronscan 通过 Tronscan 查询 TRX 转账
+type Tronscan struct {
+	store  *sdb.Store
+	apiKey func() string
+	// BaseURL 接口地址，默认为 Tronscan，测试时可以替换
+	BaseURL string
+}
+
+// NewTronscan 创建监听器，apiKey 在每次查询时调用，后台修改的 API 密钥立即生效
+func NewTronscan(store *sdb.Store, apiKey func() string) *Tronscan {
+	return &Tronscan{store: store, apiKey: apiKey, BaseURL: TronscanBaseURL}
+}
+
+// Check 查询订单的转账，找到符合订单的转账时把订单设置为已支付并返回 true
+func (w *Tronscan) Check(order sdb.Orders) bool {
 	mylog.Logger.Info("第一个API开始查询TRX转账记录", zap.String("order_id", order.TradeId))
 
-	// 从环境变量获取API密钥，如果没有则使用默认值
-	apiKey := sdb.GetApiKey().Tronscan
+	// API 密钥在后台设置
+	apiKey := w.apiKey()
 
 	client := NewTronClient(apiKey)
+	client.baseURL = w.BaseURL
 	address := order.Token
 	toAddress := address
 
@@ -84,6 +105,8 @@ func Start(order sdb.Orders) bool {
 		mylog.Logger.Error("获取TRX转账记录失败", zap.Error(err))
 		return false
 	}
+	// 返回结果有效，记录查询成功
+	metrics.RecordPoll(order.Type, order.Sandbox)
 
 	if len(result.Data) == 0 {
 		mylog.Logger.Info("TRX请求API查询返回0条,转账记录不存在", zap.String("order_id", order.TradeId))
@@ -93,11 +116,16 @@ func Start(order sdb.Orders) bool {
 
 	if result.Data[0].TokenInfo.TokenAbbr == "trx" && order.StartTime < result.Data[0].Timestamp && result.Data[0].Timestamp < order.ExpirationTime && formatAmount(result.Data[0].Amount) == order.ActualAmount && result.Data[0].TransactionHash != "" {
 		// 如果在指定时间内，并且金额正确，并且交易Hash不为空，则说明已经入账成功，可以更新数据库
-
+		// 还没有确认的转账只通知支付页面，确认后再入账
+		if !result.Data[0].Confirmed {
+			events.Pending(order.TradeId, result.Data[0].TransactionHash)
+			mylog.Logger.Info("TRX 转账等待确认", zap.String("order_id", order.TradeId), zap.String("tx", result.Data[0].TransactionHash))
+			return false
+		}
 		order.BlockTransactionId = result.Data[0].TransactionHash
 		order.Status = sdb.StatusPaySuccess
 		// 更新数据库订单记录
-		re := sdb.DB.Save(&order)
+		re := w.store.DB.Save(&order)
 		if re.Error == nil {
 			mylog.Logger.Info("TRX更新数据库订单记录成功", zap.String("order_id", order.TradeId))
 			return true
@@ -0,0 +1,138 @@
+package watcher
+
+// 沙盒订单的监听器
+// 沙盒商户的订单查询测试网上的转账，也可以通过模拟支付接口加入模拟的转账，模拟的转账和链上的转账一样按收款地址、金额和时间匹配订单
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"upay_pro/chains"
+	"upay_pro/config"
+	"upay_pro/db/sdb"
+	"upay_pro/mylog"
+	"upay_pro/testnet"
+	"upay_pro/tron"
+	"upay_pro/trx"
+
+	"go.uber.org/zap"
+)
+
+// 波场测试网的接口地址
+var tronTestnets = map[string]struct{ tronscan, trongrid string }{
+	config.TronNile:   {"https://nileapi.tronscan.org", "https://nile.trongrid.io"},
+	config.TronShasta: {"https://shastapi.tronscan.org", "https://api.shasta.trongrid.io"},
+}
+
+// Testnets 创建各币种测试网的监听器，没有测试网或者测试网没有代币合约地址的币种不查询
+func Testnets(store *sdb.Store, cfg config.Sandbox) Set {
+	set := Set{}
+	// 波场测试网不需要 API 密钥，主网的密钥在测试网不能使用
+	noKey := func() string { return "" }
+	if api, ok := tronTestnets[cfg.TronNetwork]; ok {
+		if chain, ok := chains.Testnet("USDT-TRC20", cfg); ok {
+			tronscan := tron.NewTronscan(store, noKey)
+			tronscan.BaseURL, tronscan.Contract = api.tronscan, chain.Contract
+			trongrid := tron.NewTronGrid(store, noKey)
+			trongrid.BaseURL, trongrid.Contract = api.trongrid, chain.Contract
+			set["USDT-TRC20"] = []Watcher{tronscan, trongrid}
+		}
+		trxscan := trx.NewTronscan(store, noKey)
+		trxscan.BaseURL = api.tronscan + "/api"
+		trxgrid := trx.NewTronGrid(store, noKey)
+		trxgrid.BaseURL = api.trongrid + "/v1"
+		set["TRX"] = []Watcher{trxscan, trxgrid}
+	}
+
+	etherscan := func() string { return store.GetApiKey().Etherscan }
+	for _, currency := range []string{"USDT-ERC20", "USDC-ERC20", "USDT-Polygon", "USDC-Polygon", "USDT-BSC", "USDC-BSC"} {
+		if chain, ok := chains.Testnet(currency, cfg); ok {
+			set[currency] = []Watcher{testnet.NewEtherscan(store, etherscan, chain)}
+		}
+	}
+	return set
+}
+
+// Sandbox 沙盒订单的监听器，先检查模拟的转账，再查询测试网
+type Sandbox struct {
+	Simulator *Simulator
+	testnets  Set
+}
+
+// NewSandbox 创建沙盒订单的监听器，testnets 为各币种测试网的监听器
+func NewSandbox(store *sdb.Store, testnets Set) *Sandbox {
+	return &Sandbox{Simulator: &Simulator{store: store}, testnets: testnets}
+}
+
+// Check 和 Set.Check 一样查询订单的转账，所有币种都可以模拟支付，ok 总是 true
+func (s *Sandbox) Check(order sdb.Orders) (paid bool, ok bool) {
+	if s.Simulator.Check(order) {
+		return true, true
+	}
+	paid, _ = s.testnets.Check(order)
+	return paid, true
+}
+
+// Transfer 模拟的转账
+type Transfer struct {
+	To     string
+	Amount float64
+	TxID   string
+	Time   time.Time
+}
+
+// 没有匹配到订单的模拟转账保留的时间
+const simulatedTransferTTL = time.Hour
+
+// Simulator 模拟的转账，没有匹配到订单的转账保留一段时间，之后创建的订单仍可能匹配到
+// 转账只保存在当前进程的内存中，部署多个实例时其他实例检查订单看不到这些转账
+type Simulator struct {
+	store     *sdb.Store
+	mu        sync.Mutex
+	transfers []Transfer
+}
+
+// Add 加入一笔模拟的转账
+func (s *Simulator) Add(tr Transfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 清理过期的转账
+	kept := s.transfers[:0]
+	for _, t := range s.transfers {
+		if time.Since(t.Time) < simulatedTransferTTL {
+			kept = append(kept, t)
+		}
+	}
+	s.transfers = append(kept, tr)
+}
+
+// Check 找到符合订单的模拟转账时把订单设置为已支付并返回 true，匹配到的转账只使用一次
+func (s *Simulator) Check(order sdb.Orders) bool {
+	tr, ok := s.take(order)
+	if !ok {
+		return false
+	}
+	order.BlockTransactionId = tr.TxID
+	order.Status = sdb.StatusPaySuccess
+	re := s.store.DB.Save(&order)
+	if re.Error != nil {
+		mylog.Logger.Error("沙盒订单模拟支付保存失败", zap.String("order_id", order.TradeId), zap.Error(re.Error))
+		return false
+	}
+	mylog.Logger.Info("沙盒订单模拟支付成功", zap.String("order_id", order.TradeId), zap.String("tx", tr.TxID))
+	return true
+}
+
+// take 取出符合订单收款地址、金额和有效期的模拟转账
+func (s *Simulator) take(order sdb.Orders) (Transfer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, tr := range s.transfers {
+		ms := tr.Time.UnixMilli()
+		if strings.EqualFold(tr.To, order.Token) && tr.Amount == order.ActualAmount && ms >= order.StartTime && ms < order.ExpirationTime {
+			s.transfers = append(s.transfers[:i], s.transfers[i+1:]...)
+			return tr, true
+		}
+	}
+	return Transfer{}, false
+}
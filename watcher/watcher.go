@@ -0,0 +1,63 @@
+package watcher
+
+// 各币种的链上监听器
+// 定时任务按订单的币种找到监听器查询链上转账，同一个币种有多个区块链浏览器时按顺序查询，前一个没有查到时使用下一个
+
+import (
+	"upay_pro/BSC_USD"
+	"upay_pro/ERC20_USDT"
+	"upay_pro/USDC_ArbitrumOne"
+	"upay_pro/USDC_BSC"
+	"upay_pro/USDC_ERC20"
+	"upay_pro/USDC_Polygon"
+	"upay_pro/USDT_ArbitrumOne"
+	"upay_pro/USDT_Polygon"
+	"upay_pro/db/sdb"
+	"upay_pro/metrics"
+	"upay_pro/tron"
+	"upay_pro/trx"
+)
+
+// Watcher 查询订单的链上转账
+type Watcher interface {
+	// Check 找到符合订单的转账时把订单设置为已支付并返回 true
+	Check(order sdb.Orders) bool
+}
+
+// Set 每个币种的监听器，key 和订单的 Type 一致
+type Set map[string][]Watcher
+
+// New 创建所有币种的监听器，API 密钥在每次查询时从数据库读取
+func New(store *sdb.Store) Set {
+	tronscan := func() string { return store.GetApiKey().Tronscan }
+	trongrid := func() string { return store.GetApiKey().Trongrid }
+	etherscan := func() string { return store.GetApiKey().Etherscan }
+
+	return Set{
+		"USDT-TRC20":       {tron.NewTronscan(store, tronscan), tron.NewTronGrid(store, trongrid)},
+		"TRX":              {trx.NewTronscan(store, tronscan), trx.NewTronGrid(store, trongrid)},
+		"USDT-Polygon":     {USDT_Polygon.New(store, etherscan)},
+		"USDT-BSC":         {BSC_USD.New(store, etherscan)},
+		"USDT-ERC20":       {ERC20_USDT.New(store, etherscan)},
+		"USDT-ArbitrumOne": {USDT_ArbitrumOne.New(store, etherscan)},
+		"USDC-ERC20":       {USDC_ERC20.New(store, etherscan)},
+		"USDC-Polygon":     {USDC_Polygon.New(store, etherscan)},
+		"USDC-BSC":         {USDC_BSC.New(store, etherscan)},
+		"USDC-ArbitrumOne": {USDC_ArbitrumOne.New(store, etherscan)},
+	}
+}
+
+// Check 按顺序使用币种的监听器查询订单的转账，有一个查到时返回 true；币种没有监听器时 ok 为 false
+func (s Set) Check(order sdb.Orders) (paid bool, ok bool) {
+	watchers, ok := s[order.Type]
+	if !ok {
+		return false, false
+	}
+	metrics.RecordCheck(order.Type, order.Sandbox)
+	for _, w := range watchers {
+		if w.Check(order) {
+			return true, true
+		}
+	}
+	return false, true
+}
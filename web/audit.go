@@ -0,0 +1,93 @@
+package web
+
+// 后台操作的审计日志
+// 修改数据的后台接口在操作成功后记录操作的用户、操作、对象和修改的内容，所有者可以在后台查看
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"upay_pro/db/sdb"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 审计日志中代替密钥明文的内容
+const maskedSecret = "******"
+
+// audit 记录当前登录用户的一次操作，detail 为修改的内容，保存为 JSON
+func (s *Server) audit(c *gin.Context, action, target string, detail any) {
+	s.auditAs(c, currentUser(c), action, target, detail)
+}
+
+// auditAs 记录 user 的一次操作，用于登录这类还没有登录用户的请求
+func (s *Server) auditAs(c *gin.Context, user sdb.User, action, target string, detail any) {
+	log := sdb.AuditLog{
+		UserID:    user.ID,
+		UserName:  user.UserName,
+		Action:    action,
+		Target:    target,
+		IP:        c.ClientIP(),
+		RequestID: c.GetString(requestIDKey),
+	}
+	if detail != nil {
+		if b, err := json.Marshal(detail); err == nil {
+			log.Detail = string(b)
+		}
+	}
+	s.store.RecordAudit(log)
+}
+
+// maskSecrets 复制修改的字段，密钥类字段有值时替换为 ******，只记录修改了哪些密钥
+func maskSecrets(updates map[string]interface{}, keys ...string) map[string]interface{} {
+	masked := make(map[string]interface{}, len(updates))
+	for k, v := range updates {
+		masked[k] = v
+	}
+	for _, k := range keys {
+		if v, ok := masked[k]; ok && v != "" {
+			masked[k] = maskedSecret
+		}
+	}
+	return masked
+}
+
+// AuditLogs 分页查询审计日志，可以按用户名和操作筛选
+func (s *Server) AuditLogs(c *gin.Context) {
+	page := 1
+	limit := 20
+	if p, err := strconv.Atoi(c.Query("page")); err == nil && p > 0 {
+		page = p
+	}
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+
+	query := s.store.DB.Model(&sdb.AuditLog{})
+	if user := c.Query("user"); user != "" {
+		query = query.Where("user_name = ?", user)
+	}
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var logs []sdb.AuditLog
+	result := query.Order("id DESC").Offset((page - 1) * limit).Limit(limit).Find(&logs)
+	if result.Error != nil {
+		fail(c, http.StatusInternalServerError, CodeInternal, "获取审计日志失败")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"msg":  "success",
+		"data": gin.H{
+			"logs":  logs,
+			"total": total,
+			"page":  page,
+			"limit": limit,
+		},
+	})
+}
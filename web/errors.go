@@ -0,0 +1,142 @@
+package web
+
+// 统一的接口错误格式，所有接口出错时返回：
+//
+//	{"code": 1, "message": "签名验证失败", "error": {"code": "SIGNATURE_INVALID"}, "request_id": "..."}
+//
+// code 和后台接口成功时的 code=0 一样是整数，出错时固定为 1；error.code 为稳定的机器可读错误码，
+// message 按请求的语言翻译，request_id 和响应头 X-Request-Id 一致，方便对照日志排查问题
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"upay_pro/i18n"
+	"upay_pro/mylog"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 错误码
+const (
+	CodeBadRequest             = "BAD_REQUEST"              // 请求格式错误
+	CodeValidationFailed       = "VALIDATION_FAILED"        // 参数校验失败
+	CodeSignatureInvalid       = "SIGNATURE_INVALID"        // 签名验证失败
+	CodeMerchantInvalid        = "MERCHANT_INVALID"         // 商户不存在或已禁用
+	CodeUnauthorized           = "UNAUTHORIZED"             // 未登录或登录失败
+	CodeForbidden              = "FORBIDDEN"                // 后台用户的角色没有权限
+	CodeNotFound               = "NOT_FOUND"                // 资源不存在
+	CodeConflict               = "CONFLICT"                 // 资源已存在
+	CodeOrderNotFound          = "ORDER_NOT_FOUND"          // 订单不存在
+	CodeOrderClosed            = "ORDER_CLOSED"             // 订单已支付或已过期
+	CodeOrderExpired           = "ORDER_EXPIRED"            // 订单已过期
+	CodeNetworkAlreadySelected = "NETWORK_ALREADY_SELECTED" // 订单已经选择了网络
+	CodeNetworkNotAllowed      = "NETWORK_NOT_ALLOWED"      // 订单不支持该网络
+	CodeNoWallet               = "NO_WALLET"                // 没有可用的钱包地址
+	CodeRateInvalid            = "RATE_INVALID"             // 币种汇率配置错误
+	CodeAmountTooSmall         = "AMOUNT_TOO_SMALL"         // 换算后的金额低于最小支付金额
+	CodeAmountExhausted        = "AMOUNT_EXHAUSTED"         // 没有可以分配的支付金额
+	CodeNotSandbox             = "NOT_SANDBOX"              // 订单不是沙盒订单
+	CodeInternal               = "INTERNAL_ERROR"           // 服务器内部错误
+	CodeUnavailable            = "SERVICE_UNAVAILABLE"      // 服务正在停止
+)
+
+// APIError 带 HTTP 状态码和错误码的接口错误，信息为中文原文，返回时按语言翻译
+type APIError struct {
+	Status int
+	Code   string
+	Msg    *i18n.Error
+}
+
+func (e *APIError) Error() string {
+	return e.Msg.Error()
+}
+
+// Unwrap 让 i18n.Localize 可以翻译错误信息
+func (e *APIError) Unwrap() error {
+	return e.Msg
+}
+
+// NewError 创建接口错误，format 为中文原文
+func NewError(status int, code, format string, args ...any) *APIError {
+	return &APIError{Status: status, Code: code, Msg: &i18n.Error{Format: format, Args: args}}
+}
+
+// 出错时响应中的 code，成功时为 0
+const errorCode = 1
+
+// gin 上下文中保存请求ID、兼容模式和默认语言的键
+const (
+	requestIDKey    = "request_id"
+	legacyErrorsKey = "legacy_errors"
+	defaultLangKey  = "default_lang"
+)
+
+// 请求方传入的请求ID只接受字母、数字、下划线、中划线和点，避免写入日志和响应头时被注入
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID 为每个请求分配请求ID，请求头带有 X-Request-Id 时沿用，并在响应头中返回
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-Id")
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		c.Set(requestIDKey, id)
+		c.Header("X-Request-Id", id)
+		c.Next()
+	}
+}
+
+// DefaultLang 读取系统设置的默认语言，浏览器语言都不支持时使用
+func (s *Server) DefaultLang() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if lang := i18n.Normalize(s.store.GetSetting().Language); lang != "" {
+			c.Set(defaultLangKey, lang)
+		}
+		c.Next()
+	}
+}
+
+// LegacyErrors 下单接口的兼容模式，系统设置开启后下单接口按旧版格式返回错误
+func (s *Server) LegacyErrors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.store.GetSetting().LegacyApiErrors {
+			c.Set(legacyErrorsKey, true)
+		}
+		c.Next()
+	}
+}
+
+// respondError 按统一格式返回错误，不是 APIError 的错误作为服务器内部错误返回
+func respondError(c *gin.Context, lang string, err error) {
+	var e *APIError
+	if !errors.As(err, &e) {
+		e = NewError(http.StatusInternalServerError, CodeInternal, "服务器内部错误")
+	}
+	message := i18n.Localize(lang, e)
+	requestID := c.GetString(requestIDKey)
+
+	if e.Status >= http.StatusInternalServerError {
+		mylog.Logger.Error("接口错误", zap.String("request_id", requestID), zap.String("path", c.Request.URL.Path), zap.String("code", e.Code), zap.Error(err))
+	}
+
+	// 兼容旧版下单接口：签名中间件返回 error 字段，下单失败返回 code=1 和 message 字段
+	if c.GetBool(legacyErrorsKey) {
+		c.AbortWithStatusJSON(e.Status, gin.H{"code": errorCode, "message": message, "error": message, "request_id": requestID})
+		return
+	}
+	c.AbortWithStatusJSON(e.Status, gin.H{"code": errorCode, "message": message, "error": gin.H{"code": e.Code}, "request_id": requestID})
+}
+
+// fail 返回错误，message 为中文原文，按请求的语言翻译
+func fail(c *gin.Context, status int, code, message string) {
+	lang := requestLang(c)
+	// 先翻译再作为参数传入，message 中的 % 不会被当成格式化符号
+	respondError(c, lang, NewError(status, code, "%s", i18n.T(lang, message)))
+}
@@ -10,14 +10,18 @@ import (
 	"math/rand"
 	"net/http"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
-	"upay_pro/db/rdb"
+	Autoprice "upay_pro/AutoPrice"
+	"upay_pro/chains"
+	"upay_pro/cron"
 	"upay_pro/db/sdb"
 	"upay_pro/dto"
-	"upay_pro/mq"
+	"upay_pro/events"
+	"upay_pro/i18n"
+	"upay_pro/lock"
+	"upay_pro/metrics"
 	"upay_pro/mylog"
 
 	"github.com/gin-gonic/gin"
@@ -26,12 +30,14 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/hedzr/lb"
 	"github.com/hedzr/lb/lbapi"
+	"github.com/skip2/go-qrcode"
 	"go.uber.org/zap"
 )
 
-// 自定义Claims结构
+// 自定义Claims结构，只保存用户名和登录版本，角色每次请求时从数据库读取
 type MyClaims struct {
 	UserName             string `json:"user_id"` // 自定义字段
+	TokenVersion         int    `json:"ver"`     // 签发时用户的登录版本，修改密码或角色后不再一致
 	jwt.RegisteredClaims        // 内嵌标准字段（如过期时间、签发者等）
 }
 
@@ -40,14 +46,16 @@ var (
 	sync_mu sync.Mutex
 )
 
-func GenerateToken() string {
+// GenerateToken 为登录的用户生成 token
+func (s *Server) GenerateToken(user sdb.User) string {
 
 	// 1. 准备密钥（重要！实际使用要保密）
 	secretKey := []byte(secret)
 
 	// 2. 创建Claims（数据载体）
 	claims := MyClaims{
-		UserName: sdb.GetUserByUsername(), // 自定义数据，让这个字段变得有意义，方便后续验证
+		UserName:     user.UserName, // 自定义数据，让这个字段变得有意义，方便后续验证
+		TokenVersion: user.TokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)), // 1小时后过期
 			Issuer:    "my-server",                                        // 签发者标识
@@ -98,51 +106,71 @@ func ParseToken(tokenString string) (*MyClaims, error) {
 
 // gin中间件验证cookie是否有效
 
-func JWTAuthMiddleware() gin.HandlerFunc {
+func (s *Server) JWTAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// 后台接口未登录时返回错误，页面未登录时跳转到登录页
+		unauthorized := func() {
+			if strings.HasPrefix(c.Request.URL.Path, "/admin/api/") {
+				fail(c, http.StatusUnauthorized, CodeUnauthorized, "未登录")
+				return
+			}
+			c.Redirect(302, "/login")
+			c.Abort()
+		}
 		// 1. 获取cookie
 		cookie, err := c.Cookie("token")
 		if err != nil || cookie == "" {
-			c.Redirect(302, "/login")
+			unauthorized()
 			/* c.JSON(http.StatusOK, gin.H{
 				"code": -1,
 				"msg":  "未登录",
 			}) */
 
-			c.Abort()
 			return
 
 		}
 		// 验证cookie
 		claims, err := ParseToken(cookie)
 		if err != nil {
-			c.Redirect(302, "/login")
+			unauthorized()
 			/* 	c.JSON(http.StatusOK, gin.H{
 				"code": -1,
 				"msg":  "未登录",
 			}) */
 
-			c.Abort()
 			return
 
 		}
-		// 2. 验证用户，是否和数据库里一致
-		if claims.UserName != sdb.GetUserByUsername() {
-			c.Redirect(302, "/login")
+		// 2. 验证用户，是否和数据库里一致，用户被删除、修改密码或角色后 token 立即失效
+		user, ok := s.tokenUser(claims)
+		if !ok {
+			unauthorized()
 			/* 	c.JSON(http.StatusOK, gin.H{
 				"code": -1,
 				"msg":  "未登录",
 			}) */
 
-			c.Abort()
 			return
 		}
-		// 3. 身份验证通过
+		// 3. 身份验证通过，后续按用户的角色检查权限
+		c.Set(adminUserKey, user)
 		c.Next()
 
 	}
 }
 
+// tokenUser token 对应的用户，用户不存在或登录版本不一致时返回 false
+func (s *Server) tokenUser(claims *MyClaims) (sdb.User, bool) {
+	user, ok := s.store.GetUser(claims.UserName)
+	if !ok || user.TokenVersion != claims.TokenVersion {
+		return sdb.User{}, false
+	}
+	return user, true
+}
+
+// TypeAuto 下单时 type 传 auto，表示由买家在支付页面选择网络
+const TypeAuto = "auto"
+
 const ( // 定义常量
 	CnyMinimumPaymentAmount  = 0.01 // cny最低支付金额
 	UsdtMinimumPaymentAmount = 0.01 // usdt最低支付金额
@@ -150,16 +178,15 @@ const ( // 定义常量
 	IncrementalMaximumNumber = 100  // 最大递增次数
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+func (s *Server) AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		mylog.Logger.Info("进入中间件")
 
 		// 读取原始请求体内容
 		body, err := io.ReadAll(c.Request.Body)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "读取请求体失败"})
+			fail(c, http.StatusBadRequest, CodeBadRequest, "读取请求体失败")
 			mylog.Logger.Error("读取请求体失败", zap.Error(err))
-			c.Abort()
 			return
 		}
 		// 打印原始请求体
@@ -173,9 +200,8 @@ func AuthMiddleware() gin.HandlerFunc {
 
 		if err := c.ShouldBindBodyWith(&requestParams, binding.JSON); err != nil {
 
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, requestLang(c), NewError(http.StatusBadRequest, CodeBadRequest, "请求参数格式错误：%s", err.Error()))
 			mylog.Logger.Info("请求体参数绑定失败")
-			c.Abort()
 			return
 
 		}
@@ -185,9 +211,8 @@ func AuthMiddleware() gin.HandlerFunc {
 		if err := validate.Struct(requestParams); err != nil {
 			//如果验证错误，则返回错误信息，并终止请求
 
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, paramsLang(c, requestParams), NewError(http.StatusBadRequest, CodeValidationFailed, "请求参数校验失败：%s", err.Error()))
 			mylog.Logger.Info("请求体参数验证失败", zap.String("error", err.Error()))
-			c.Abort()
 			return
 
 		}
@@ -233,7 +258,18 @@ func AuthMiddleware() gin.HandlerFunc {
 		sort.Strings(params)
 
 		// 使用 strings.Join 连接排序后的参数
-		signatureString := strings.Join(params, "&") + sdb.GetSetting().SecretKey
+		// 商户使用自己的密钥签名，未传入商户时使用系统设置的密钥
+		secretKey := s.store.GetSetting().SecretKey
+		if requestParams.MerchantID != 0 {
+			merchant, ok := s.store.GetMerchant(requestParams.MerchantID)
+			if !ok || merchant.Status != sdb.MerchantStatusEnable {
+				respondError(c, paramsLang(c, requestParams), NewError(http.StatusUnauthorized, CodeMerchantInvalid, "商户不存在或已禁用"))
+				mylog.Logger.Info("商户不存在或已禁用", zap.Uint("merchant_id", requestParams.MerchantID))
+				return
+			}
+			secretKey = merchant.SecretKey
+		}
+		signatureString := strings.Join(params, "&") + secretKey
 		/* var queryString string
 		for _, key := range keys {
 			value := params[key]
@@ -256,9 +292,8 @@ func AuthMiddleware() gin.HandlerFunc {
 		mylog.Logger.Info("计算的签名", zap.String("Signature", Signature))
 		// 验证传入的签名和计算的签名是否一致
 		if requestParams.Signature != Signature {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "签名验证失败"})
+			respondError(c, paramsLang(c, requestParams), NewError(http.StatusUnauthorized, CodeSignatureInvalid, "签名验证失败"))
 			mylog.Logger.Info("签名验证失败")
-			c.Abort()
 			return
 
 		}
@@ -268,7 +303,7 @@ func AuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
-func CreateTransaction(c *gin.Context) {
+func (s *Server) CreateTransaction(c *gin.Context) {
 	// 创建锁
 	sync_mu.Lock()
 	// 本函数最后释放锁
@@ -276,64 +311,37 @@ func CreateTransaction(c *gin.Context) {
 
 	var requestParams dto.RequestParams
 	if err := c.ShouldBindBodyWith(&requestParams, binding.JSON); err != nil {
-		c.JSON(400, gin.H{"code": 1, "message": "参数错误"})
+		fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
 		return
 	}
+	lang := paramsLang(c, requestParams)
 
 	// 根据传入的商店订单号查询到对应记录
-	order1 := sdb.GetOrderByOrderId(requestParams.OrderID)
+	order1 := s.store.GetOrderByOrderId(requestParams.MerchantID, requestParams.OrderID)
 
 	// 检查传入的商城交易订单号是否存在且状态为未支付，说明用户可能是重复下单
 	if order1.Status == sdb.StatusWaitPay {
 		mylog.Logger.Info("订单已存在，该订单为重复请求，不在创建订单，重置过期时间，重定向到支付页面", zap.Any("order", order1.OrderId))
 		// 重新计算过期时间
-		order1.ExpirationTime = time.Now().Add(sdb.GetSetting().ExpirationDate).UnixMilli()
-
-		sdb.DB.Save(&order1)
-
-		ActualAmount_Token := fmt.Sprintf("%s_%f", order1.Token, order1.ActualAmount)
-
-		// 更新Redis中的钱包过期时间
-		err := rdb.RDB.Set(context.Background(), ActualAmount_Token, order1.ActualAmount, sdb.GetSetting().ExpirationDate).Err()
-		if err != nil {
-			mylog.Logger.Error("更新Redis中的钱包过期时间失败", zap.Error(err))
-			return
-		}
-		//先获取一下之前这个订单的任务ID
-
-		var task sdb.TradeIdTaskID
-
-		re := sdb.DB.Where("TradeId = ?", order1.TradeId).Last(&task)
-		if re.Error != nil {
-			mylog.Logger.Info("获取任务ID记录失败:", zap.Any("error", re.Error))
-			return
-		}
-		if re.RowsAffected == 0 {
-			mylog.Logger.Info("获取任务ID记录失败，订单不存在", zap.Any("error", re.Error))
-			return
+		order1.ExpirationTime = time.Now().Add(s.store.GetSetting().ExpirationDate).UnixMilli()
+		// 重复下单时指定了新的语言，以新的语言为准
+		if requestParams.Lang != "" {
+			order1.Lang = i18n.Normalize(requestParams.Lang)
 		}
 
-		//使用队列管理器删除任务
-
-		err = mq.StopTask(task.TaskID)
-		if err != nil {
-			mylog.Logger.Error("删除队列任务失败", zap.Error(err))
-			return
-		}
-		// 删除这条数据库库记录
+		s.store.DB.Save(&order1)
 
-		re = sdb.DB.Delete(&task, task.ID)
-		if re.Error != nil {
-			mylog.Logger.Error("删除数据库任务记录失败", zap.Error(err))
-			return
-		}
-		if re.RowsAffected == 0 {
-			mylog.Logger.Error("删除数据库任务记录失败", zap.Error(err))
-			return
+		// 买家还没有选择网络时没有锁定钱包地址和金额
+		if order1.Token != "" {
+			// 更新钱包地址和金额的锁定时间
+			err := s.locker.Refresh(context.Background(), lock.Key(order1.Token, order1.ActualAmount), s.store.GetSetting().ExpirationDate)
+			if err != nil {
+				mylog.Logger.Error("更新钱包地址和金额的锁定时间失败", zap.Error(err))
+			}
 		}
 
-		// 重新加入新的任务
-		mq.TaskOrderExpiration(order1.TradeId, sdb.GetSetting().ExpirationDate)
+		// 重新加入新的任务，会替换之前的过期任务
+		s.scheduleExpiration(order1.TradeId, s.store.GetSetting().ExpirationDate)
 
 		// 将网页重定向到订单支付页面
 		// PaymentURL := fmt.Sprintf("%s%s%s", sdb.GetSetting().AppUrl, "/pay/checkout-counter/", order1.TradeId)
@@ -351,7 +359,8 @@ func CreateTransaction(c *gin.Context) {
 				ActualAmount:   order1.ActualAmount,
 				Token:          order1.Token,
 				ExpirationTime: order1.ExpirationTime,
-				PaymentURL:     fmt.Sprintf("%s%s%s", sdb.GetSetting().AppUrl, "/pay/checkout-counter/", order1.TradeId),
+				PaymentURL:     fmt.Sprintf("%s%s%s", s.store.GetSetting().AppUrl, "/pay/checkout-counter/", order1.TradeId),
+				Sandbox:        order1.Sandbox,
 			},
 		}
 		c.JSON(http.StatusOK, orderInfo)
@@ -359,18 +368,140 @@ func CreateTransaction(c *gin.Context) {
 
 	}
 	// 添加调试日志
-	mylog.Logger.Info("CreateTransaction - 接收到的Type参数", zap.String("type", requestParams.Type))
+	mylog.Logger.Info("s.CreateTransaction - 接收到的Type参数", zap.String("type", requestParams.Type))
 
-	// 通过Type参数获取钱包地址的切片
-	walletAddrs := sdb.GetWalletAddress(requestParams.Type)
-	if len(walletAddrs) == 0 {
-		c.JSON(400, gin.H{"code": 1, "message": "请先添加钱包地址"})
-		return
+	// type 为 auto 或者多个钱包类型时，由买家在支付页面选择网络后再分配钱包地址和金额
+	var allowedTypes []string
+	if isMultiType(requestParams.Type) {
+		var err error
+		allowedTypes, err = s.parseAllowedTypes(requestParams.Type)
+		if err != nil {
+			respondError(c, lang, err)
+			return
+		}
 	}
+
 	var Token string
 	var ActualAmount float64
-	// 默认值为false
-	var found = false
+	var Rate float64
+	var Type string
+	if len(allowedTypes) == 0 {
+		var err error
+		Token, ActualAmount, Rate, err = s.allocateWallet(requestParams.Type, requestParams.Amount, s.store.GetSetting().ExpirationDate)
+		if err != nil {
+			respondError(c, lang, err)
+			return
+		}
+		Type = requestParams.Type
+	}
+
+	// 沙盒商户的订单查询测试网，可以模拟支付
+	var sandbox bool
+	if requestParams.MerchantID != 0 {
+		merchant, _ := s.store.GetMerchant(requestParams.MerchantID)
+		sandbox = merchant.Sandbox
+	}
+
+	order := &sdb.Orders{
+		TradeId: generateOrderID(),
+		OrderId: requestParams.OrderID,
+
+		Amount:       requestParams.Amount,
+		ActualAmount: ActualAmount,
+		Rate:         Rate,
+		Type:         Type,
+		AllowedTypes: strings.Join(allowedTypes, ","),
+		Token:        Token,
+		Lang:         i18n.Normalize(requestParams.Lang),
+		MerchantID:   requestParams.MerchantID,
+		Sandbox:      sandbox,
+		Status:       sdb.StatusWaitPay,
+
+		NotifyUrl:      requestParams.NotifyURL,
+		RedirectUrl:    requestParams.RedirectURL,
+		StartTime:      time.Now().UnixMilli(),
+		ExpirationTime: time.Now().Add(s.store.GetSetting().ExpirationDate).UnixMilli(),
+	}
+
+	result := s.store.DB.Create(&order)
+	if result.Error != nil {
+		respondError(c, lang, NewError(http.StatusInternalServerError, CodeInternal, "创建订单失败1"))
+		mylog.Logger.Error("创建订单失败", zap.Any("err", result.Error))
+		return
+	}
+	mylog.Logger.Info("创建订单成功", zap.Any("订单号", order.TradeId))
+	metrics.OrdersCreated.WithLabelValues(metrics.CurrencyLabel(order.Type)).Inc()
+	// 在队列中加入任务，延期执行函数，更新数据库中当前的订单的支付状态为已过期
+	s.scheduleExpiration(order.TradeId, s.store.GetSetting().ExpirationDate)
+	// 返回响应的参数，格式为JSON
+	// 准备返回订单信息的数据
+	orderInfo := dto.Response{
+		StatusCode: http.StatusOK,
+		Message:    "success",
+		Data: dto.Data{
+			TradeID:        order.TradeId,
+			OrderID:        order.OrderId,
+			Amount:         order.Amount,
+			ActualAmount:   order.ActualAmount,
+			Token:          order.Token,
+			ExpirationTime: order.ExpirationTime,
+			PaymentURL:     fmt.Sprintf("%s%s%s", s.store.GetSetting().AppUrl, "/pay/checkout-counter/", order.TradeId),
+			Sandbox:        order.Sandbox,
+		},
+	}
+	c.JSON(http.StatusOK, orderInfo)
+
+}
+
+// isMultiType type 是否为 auto 或者逗号分隔的多个钱包类型
+func isMultiType(t string) bool {
+	return strings.EqualFold(strings.TrimSpace(t), TypeAuto) || strings.Contains(t, ",")
+}
+
+// parseAllowedTypes 解析买家可以选择的钱包类型，auto 表示所有有可用钱包地址的类型
+func (s *Server) parseAllowedTypes(t string) ([]string, error) {
+	if strings.EqualFold(strings.TrimSpace(t), TypeAuto) {
+		types := s.store.GetEnabledCurrencies()
+		if len(types) == 0 {
+			return nil, NewError(http.StatusBadRequest, CodeNoWallet, "请先添加钱包地址")
+		}
+		return types, nil
+	}
+
+	var types []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(t, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if len(s.store.GetWalletAddress(name)) == 0 {
+			return nil, NewError(http.StatusBadRequest, CodeNoWallet, "钱包类型%s没有可用的钱包地址", name)
+		}
+		seen[name] = true
+		types = append(types, name)
+	}
+	if len(types) == 0 {
+		return nil, NewError(http.StatusBadRequest, CodeValidationFailed, "钱包类型不能为空")
+	}
+	return types, nil
+}
+
+// allocateWallet 按钱包类型轮询分配钱包地址，并计算不重复的支付金额
+// 金额被占用时按 0.01 递增，分配成功后锁定钱包地址和金额，锁定时间为 ttl
+// 调用方需要持有 sync_mu
+func (s *Server) allocateWallet(walletType string, amount float64, ttl time.Duration) (string, float64, float64, error) {
+	// 通过Type参数获取钱包地址的切片
+	walletAddrs := s.store.GetWalletAddress(walletType)
+	if len(walletAddrs) == 0 {
+		return "", 0, 0, NewError(http.StatusBadRequest, CodeNoWallet, "请先添加钱包地址")
+	}
+	// 同一币种的所有钱包共用币种表中的汇率
+	Rate := s.store.GetCurrency(walletType).OrderRate()
+	if Rate <= 0 {
+		mylog.Logger.Info("s.allocateWallet - 汇率检查失败", zap.Float64("rate", Rate))
+		return "", 0, 0, NewError(http.StatusBadRequest, CodeRateInvalid, "币种汇率配置错误,小于等于0")
+	}
 	// 创建 RoundRobin 负载均衡器
 	b := lb.New(lb.RoundRobin)
 	for _, node := range walletAddrs {
@@ -380,115 +511,171 @@ func CreateTransaction(c *gin.Context) {
 	// 记录每个钱包的尝试次数
 	walletAttempts := make(map[string]int)
 
-	for i := 0; i < IncrementalMaximumNumber && !found; i++ {
+	for i := 0; i < IncrementalMaximumNumber; i++ {
 		address_rate, err := b.Next(lbapi.DummyFactor)
 		if err != nil {
 			mylog.Logger.Error("获取钱包地址失败", zap.Any("err", err))
 			continue
 		}
 
-		s := strings.Split(address_rate.String(), ":")
-		if len(s) != 2 {
+		wallet, ok := address_rate.(sdb.WalletAddress)
+		if !ok {
 			mylog.Logger.Error("钱包地址格式错误", zap.String("address_rate", address_rate.String()))
 			continue
 		}
 
-		Token = s[0]
-		rate, parseErr := strconv.ParseFloat(s[1], 64)
-		if parseErr != nil {
-			mylog.Logger.Error("汇率解析失败", zap.String("rate_str", s[1]), zap.Any("err", parseErr))
-			continue
-		}
+		Token := wallet.Token
 
 		mylog.Logger.Info("获取钱包地址成功", zap.Any("address", Token))
-		if rate <= 0 {
-			mylog.Logger.Info("CreateTransaction - 汇率检查失败", zap.Float64("rate", rate))
-			c.JSON(400, gin.H{"code": 1, "message": "钱包汇率配置错误,小于等于0"})
-			return
-		}
 
 		// 计算基础金额
-		baseAmount := math.Round((requestParams.Amount/rate)*100) / 100
+		baseAmount := math.Round((amount/Rate)*100) / 100
 
 		// 根据当前钱包的尝试次数计算递增金额
 		attempts := walletAttempts[Token]
-		ActualAmount = math.Round((baseAmount+float64(attempts)*UsdtAmountPerIncrement)*100) / 100
+		ActualAmount := math.Round((baseAmount+float64(attempts)*UsdtAmountPerIncrement)*100) / 100
 
 		// 检查换算后的金额是否符合最小支付金额
 		if ActualAmount < UsdtMinimumPaymentAmount {
-			c.JSON(400, gin.H{"code": 1, "message": "换算后的支付金额低于最小支付金额0.01"})
-			return
+			return "", 0, 0, NewError(http.StatusBadRequest, CodeAmountTooSmall, "换算后的支付金额低于最小支付金额0.01")
 		}
 
-		ActualAmount_Token := fmt.Sprintf("%s_%f", Token, ActualAmount)
+		// 锁定钱包地址和金额，已被其他订单占用时返回 false
+		locked, lockErr := s.locker.Lock(context.Background(), lock.Key(Token, ActualAmount), ttl)
+		if lockErr != nil {
+			mylog.Logger.Error("锁定钱包地址和金额时，操作过程发生错误", zap.Any("err", lockErr))
+			continue
+		}
+		if !locked {
+			metrics.AmountLockCollisions.WithLabelValues(walletType).Inc()
+			// 如果占用，增加该钱包的尝试次数
+			walletAttempts[Token]++
+			continue
+		}
+		return Token, ActualAmount, Rate, nil
+	}
 
-		// 检查Redis中是否有该金额
-		currentAmount := getRedisAmount(ActualAmount_Token)
+	return "", 0, 0, NewError(http.StatusBadRequest, CodeAmountExhausted, "递增金额次数超过最大次数,请稍后再创建订单")
+}
 
-		// 如果钱包地址没有被占用，getRedisAmount 返回 false
-		if currentAmount == false {
-			err := rdb.RDB.Set(context.Background(), ActualAmount_Token, ActualAmount, sdb.GetSetting().ExpirationDate).Err()
-			if err != nil {
-				mylog.Logger.Error("设置 Redis 中金额时，操作过程发生错误", zap.Any("err", err))
-				continue
-			}
-			found = true
+// scheduleExpiration 在 delay 之后把订单设置为过期，加入失败时只记录日志
+func (s *Server) scheduleExpiration(tradeId string, delay time.Duration) {
+	if err := s.queue.Schedule(tradeId, delay); err != nil {
+		mylog.Logger.Error("订单过期任务加入失败", zap.String("trade_id", tradeId), zap.Error(err))
+	}
+}
+
+// SelectNetwork 买家在支付页面选择网络后，为订单分配钱包地址和支付金额
+func (s *Server) SelectNetwork(c *gin.Context) {
+	sync_mu.Lock()
+	defer sync_mu.Unlock()
+
+	trade_id := c.Param("trade_id")
+	var req struct {
+		Type string `json:"type" form:"type"`
+	}
+	if err := c.ShouldBind(&req); err != nil || req.Type == "" {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, "请选择网络")
+		return
+	}
+
+	var order sdb.Orders
+	re := s.store.DB.Where("trade_id = ?", trade_id).Limit(1).Find(&order)
+	if re.Error != nil || order.ID == 0 {
+		fail(c, http.StatusNotFound, CodeOrderNotFound, "订单不存在")
+		return
+	}
+	lang := orderLang(c, order)
+	if order.Status != sdb.StatusWaitPay {
+		respondError(c, lang, NewError(http.StatusBadRequest, CodeOrderClosed, "订单已支付或已过期"))
+		return
+	}
+	if order.Type != "" {
+		respondError(c, lang, NewError(http.StatusBadRequest, CodeNetworkAlreadySelected, "订单已经选择了网络"))
+		return
+	}
+	allowed := false
+	for _, t := range strings.Split(order.AllowedTypes, ",") {
+		if t == req.Type {
+			allowed = true
 			break
-		} else {
-			// 如果占用，增加该钱包的尝试次数
-			walletAttempts[Token]++
 		}
 	}
+	if !allowed {
+		respondError(c, lang, NewError(http.StatusBadRequest, CodeNetworkNotAllowed, "订单不支持该网络"))
+		return
+	}
 
-	// 检查是否找到合适的配置
-	if found == false {
-		c.JSON(400, gin.H{"code": 1, "message": "递增金额次数超过最大次数,请稍后再创建订单"})
+	// 钱包地址和金额锁定到订单过期为止
+	ttl := time.Until(time.UnixMilli(order.ExpirationTime))
+	if ttl <= 0 {
+		respondError(c, lang, NewError(http.StatusBadRequest, CodeOrderExpired, "订单已过期"))
+		return
+	}
+	Token, ActualAmount, Rate, err := s.allocateWallet(req.Type, order.Amount, ttl)
+	if err != nil {
+		respondError(c, lang, err)
 		return
 	}
 
-	order := &sdb.Orders{
-		TradeId: generateOrderID(),
-		OrderId: requestParams.OrderID,
+	order.Type = req.Type
+	order.Token = Token
+	order.ActualAmount = ActualAmount
+	order.Rate = Rate
+	// 链上监听只匹配开始时间之后的转账，从分配钱包地址的时间开始计算
+	order.StartTime = time.Now().UnixMilli()
+	if err := s.store.DB.Save(&order).Error; err != nil {
+		mylog.Logger.Error("保存订单网络失败", zap.String("trade_id", trade_id), zap.Error(err))
+		respondError(c, lang, NewError(http.StatusInternalServerError, CodeInternal, "保存订单失败"))
+		return
+	}
+	mylog.Logger.Info("买家已选择网络", zap.String("trade_id", trade_id), zap.String("type", req.Type))
 
-		Amount:       requestParams.Amount,
-		ActualAmount: ActualAmount,
-		Type:         requestParams.Type,
-		Token:        Token,
-		Status:       sdb.StatusWaitPay,
+	c.JSON(200, gin.H{"code": 0, "message": "success", "data": gin.H{
+		"type":          order.Type,
+		"token":         order.Token,
+		"actual_amount": order.ActualAmount,
+	}})
+}
 
-		NotifyUrl:      requestParams.NotifyURL,
-		RedirectUrl:    requestParams.RedirectURL,
-		StartTime:      time.Now().UnixMilli(),
-		ExpirationTime: time.Now().Add(sdb.GetSetting().ExpirationDate).UnixMilli(),
+// requestLang 获取请求的语言，优先使用 lang 参数，其次使用浏览器的 Accept-Language
+func requestLang(c *gin.Context) string {
+	if lang := i18n.Normalize(c.Query("lang")); lang != "" {
+		return lang
 	}
+	return browserLang(c)
+}
 
-	result := sdb.DB.Create(&order)
-	if result.Error != nil {
-		c.JSON(500, gin.H{"code": 1, "message": "创建订单失败1"})
-		mylog.Logger.Error("创建订单失败", zap.Any("err", result.Error))
-		return
+// paramsLang 获取下单接口的语言，优先使用请求体中的 lang 参数
+func paramsLang(c *gin.Context, requestParams dto.RequestParams) string {
+	if lang := i18n.Normalize(requestParams.Lang); lang != "" {
+		return lang
 	}
-	mylog.Logger.Info("创建订单成功", zap.Any("订单号", order.TradeId))
-	// 在队列中加入任务，延期执行函数，更新数据库中当前的订单的支付状态为已过期
-	mq.TaskOrderExpiration(order.TradeId, sdb.GetSetting().ExpirationDate)
-	// 返回响应的参数，格式为JSON
-	// 准备返回订单信息的数据
-	orderInfo := dto.Response{
-		StatusCode: http.StatusOK,
-		Message:    "success",
-		Data: dto.Data{
-			TradeID:        order.TradeId,
-			OrderID:        order.OrderId,
-			Amount:         order.Amount,
-			ActualAmount:   order.ActualAmount,
-			Token:          order.Token,
-			ExpirationTime: order.ExpirationTime,
-			PaymentURL:     fmt.Sprintf("%s%s%s", sdb.GetSetting().AppUrl, "/pay/checkout-counter/", order.TradeId),
-		},
+	return requestLang(c)
+}
+
+// browserLang 按浏览器的 Accept-Language 选择语言，浏览器语言都不支持时使用系统设置的默认语言
+func browserLang(c *gin.Context) string {
+	if lang := i18n.FromAcceptLanguage(c.GetHeader("Accept-Language")); lang != "" {
+		return lang
 	}
-	c.JSON(http.StatusOK, orderInfo)
+	if lang := c.GetString(defaultLangKey); lang != "" {
+		return lang
+	}
+	return i18n.Default
+}
 
+// orderLang 获取订单的语言，lang 参数 > 下单时指定的语言 > 浏览器的语言
+func orderLang(c *gin.Context, order sdb.Orders) string {
+	if lang := i18n.Normalize(c.Query("lang")); lang != "" {
+		return lang
+	}
+	if order.Lang != "" {
+		return order.Lang
+	}
+	return browserLang(c)
 }
+
 func generateOrderID() string {
 	// 获取当前时间，格式化为年月日时分秒
 	timestamp := time.Now().Format("20060102150405") // 格式化为类似 20231010123456 的形式
@@ -502,79 +689,168 @@ func generateOrderID() string {
 }
 
 // 返回支付页面【支付页面是静态页面，所以需要返回html文件，组装一下模版参数】
-func CheckoutCounter(c *gin.Context) {
+func (s *Server) CheckoutCounter(c *gin.Context) {
 
 	// 获取请求参数
 	trade_id := c.Param("trade_id")
 
 	// 获取订单信息
 	order := sdb.Orders{}
-	err := sdb.DB.Find(&order, "trade_id=? and status=?", trade_id, sdb.StatusWaitPay).Error
+	err := s.store.DB.Find(&order, "trade_id=? and status=?", trade_id, sdb.StatusWaitPay).Error
 	if err != nil {
-		c.JSON(500, gin.H{"error": "获取订单信息失败"})
+		fail(c, http.StatusInternalServerError, CodeInternal, "获取订单信息失败")
 		return
 	}
 
 	// expirationMinutes := viper.GetInt("order_expiration_time")
 	// 组装一下模版所需的参数
 	viewModel := dto.PaymentViewModel{
-		Currency:               order.Type,
-		TradeId:                order.TradeId,
-		ActualAmount:           order.ActualAmount,
-		Token:                  order.Token,
-		ExpirationTime:         order.ExpirationTime,
-		RedirectUrl:            order.RedirectUrl,
-		AppName:                sdb.GetSetting().AppName,
-		CustomerServiceContact: sdb.GetSetting().CustomerServiceContact,
-	}
-
-	switch viewModel.Currency {
-	case "TRX":
-		viewModel.Logo = "https://static.tronscan.org/production/logo/trx.png"
-	case "USDT-TRC20":
-		viewModel.Logo = "https://static.tronscan.org/production/logo/usdtlogo.png"
-	case "USDT-Polygon":
-		viewModel.Logo = "https://st.softgamings.com/uploads/USDT-Polygon.png"
-	case "USDT-BSC":
-		viewModel.Logo = "https://bscscan.com/token/images/busdt_32.png"
-	case "USDT-ERC20":
-		viewModel.Logo = "https://static.tronscan.org/production/logo/usdtlogo.png"
-	case "USDT-ArbitrumOne":
-		viewModel.Logo = "https://static.tronscan.org/production/logo/usdtlogo.png"
-	case "USDC-ERC20":
-		viewModel.Logo = "https://bscscan.com/token/images/centre-usdc_28.png"
-	case "USDC-Polygon":
-		viewModel.Logo = "https://bscscan.com/token/images/centre-usdc_28.png"
-	case "USDC-BSC":
-		viewModel.Logo = "https://bscscan.com/token/images/centre-usdc_28.png"
-	case "USDC-ArbitrumOne":
-		viewModel.Logo = "https://bscscan.com/token/images/centre-usdc_28.png"
-	default:
-		viewModel.Logo = "https://static.tronscan.org/production/logo/usdtlogo.png"
+		Currency:       order.Type,
+		TradeId:        order.TradeId,
+		ActualAmount:   order.ActualAmount,
+		Token:          order.Token,
+		ExpirationTime: order.ExpirationTime,
+		RedirectUrl:    order.RedirectUrl,
+		Lang:           orderLang(c, order),
+		Sandbox:        order.Sandbox,
+	}
+
+	// 商户订单使用商户的品牌设置和模版
+	var merchant sdb.Merchant
+	if order.MerchantID != 0 {
+		merchant, _ = s.store.GetMerchant(order.MerchantID)
+	}
+	applyBranding(&viewModel, s.store.GetSetting(), merchant)
+
+	// 使用本地打包的币种图标
+	viewModel.Logo = chains.LogoOf(viewModel.Currency)
+	viewModel.Amount = order.Amount
+
+	// 买家还没有选择网络时，支付页面显示可选的网络
+	if order.Type == "" && order.AllowedTypes != "" {
+		for _, t := range strings.Split(order.AllowedTypes, ",") {
+			network := dto.Network{Currency: t, Network: t, Logo: chains.LogoOf(t)}
+			if chain, ok := s.chainOf(order, t); ok {
+				network.Network = chain.Network
+			}
+			viewModel.Networks = append(viewModel.Networks, network)
+		}
 	}
 
 	// 返回支付页面
-	c.HTML(http.StatusOK, "pay.html", viewModel)
+	renderPage(c, "pay.html", merchant.Name, viewModel)
 
 }
 
-func CheckOrderStatus(c *gin.Context) {
+// PaymentQRCode 返回订单的支付二维码，内容为钱包支付链接，扫码后自动填写收款地址和金额
+// 路由为 /pay/qr/:trade_id，支持带 .png 后缀
+func (s *Server) PaymentQRCode(c *gin.Context) {
+	trade_id := strings.TrimSuffix(c.Param("trade_id"), ".png")
+
+	order := sdb.Orders{}
+	re := s.store.DB.Where("trade_id = ?", trade_id).Limit(1).Find(&order)
+	if re.Error != nil || order.ID == 0 {
+		fail(c, http.StatusNotFound, CodeOrderNotFound, "订单不存在")
+		return
+	}
+	// 多网络订单选择网络后才有收款地址
+	if order.Token == "" {
+		respondError(c, orderLang(c, order), NewError(http.StatusBadRequest, CodeValidationFailed, "订单还没有选择网络"))
+		return
+	}
+
+	// 没有链上信息的币种只编码收款地址
+	content := order.Token
+	if chain, ok := s.chainOf(order, order.Type); ok {
+		content = chain.PaymentURI(order.Token, order.ActualAmount)
+	}
+
+	png, err := qrcode.Encode(content, qrcode.Medium, 256)
+	if err != nil {
+		mylog.Logger.Error("生成支付二维码失败", zap.String("trade_id", trade_id), zap.Error(err))
+		respondError(c, orderLang(c, order), NewError(http.StatusInternalServerError, CodeInternal, "生成二维码失败"))
+		return
+	}
+	// 订单的收款地址和金额不会变化，可以让浏览器缓存
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+// chainOf 获取订单使用的链上信息，沙盒订单使用测试网
+func (s *Server) chainOf(order sdb.Orders, currency string) (chains.Chain, bool) {
+	if order.Sandbox {
+		return chains.Testnet(currency, s.cfg.Sandbox)
+	}
+	return chains.Get(currency)
+}
+
+func (s *Server) CheckOrderStatus(c *gin.Context) {
 
 	// 依据传入的路径参数【交易ID】，查询订单状态
 	trade_id := c.Param("trade_id")
 
 	// 查询订单状态
 	order := sdb.Orders{}
-	err := sdb.DB.Find(&order, "trade_id=?", trade_id).Error
+	err := s.store.DB.Find(&order, "trade_id=?", trade_id).Error
 	if err != nil {
-		c.JSON(500, gin.H{"message": "获取订单信息失败"})
+		fail(c, http.StatusInternalServerError, CodeInternal, "获取订单信息失败")
 		return
 	}
 
 	// 返回订单状态
 	c.JSON(200, gin.H{"data": gin.H{"status": order.Status},
-		"message": "1-待支付，2-支付成功，3-支付过期"})
+		"message": i18n.T(orderLang(c, order), "1-待支付，2-支付成功，3-支付过期")})
+
+}
+
+// 支付页面 SSE 连接的心跳间隔，防止代理服务器断开空闲连接
+const eventsHeartbeat = 15 * time.Second
+
+// PaymentEvents 通过 SSE 向支付页面推送订单状态变化：detected、confirming、paid、expired
+func (s *Server) PaymentEvents(c *gin.Context) {
+	trade_id := c.Param("trade_id")
+
+	// 先订阅再查询订单，避免查询和订阅之间的事件丢失
+	ch, cancel := events.Subscribe(trade_id)
+	defer cancel()
+
+	order := sdb.Orders{}
+	re := s.store.DB.Where("trade_id = ?", trade_id).Limit(1).Find(&order)
+	if re.Error != nil || order.ID == 0 {
+		fail(c, http.StatusNotFound, CodeOrderNotFound, "订单不存在")
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// 关闭 nginx 的响应缓冲
+	c.Header("X-Accel-Buffering", "no")
+
+	// 订单已经是最终状态时直接推送并结束
+	switch order.Status {
+	case sdb.StatusPaySuccess:
+		c.SSEvent(events.Paid, events.Event{TradeId: order.TradeId, Type: events.Paid, TxHash: order.BlockTransactionId, Time: time.Now().UnixMilli()})
+		return
+	case sdb.StatusExpired:
+		c.SSEvent(events.Expired, events.Event{TradeId: order.TradeId, Type: events.Expired, Time: time.Now().UnixMilli()})
+		return
+	}
 
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			c.SSEvent("ping", time.Now().UnixMilli())
+			return true
+		case e := <-ch:
+			c.SSEvent(e.Type, e)
+			return !events.Terminal(e.Type)
+		}
+	})
 }
 
 /* type Node struct {
@@ -585,28 +861,30 @@ func (n Node) String() string {
 	return n.Address
 } */
 
-// 获取 Redis 中金额
-func getRedisAmount(token string) bool {
-	// 通过 Exists 方法检查键是否存在
-	// result := rdb.RDB.Get(context.Background(), token).Val() 该方法不适合生成环境使用
-	exists, err := rdb.RDB.Exists(context.Background(), token).Result()
-
+// currentAutoRate 查询币种当前的自动汇率并按币种的汇率策略调整，同时返回数据源的原始汇率
+// 所有数据源都不可用时返回 fallback，原始汇率为0
+func (s *Server) currentAutoRate(currency sdb.Currency, fallback float64) (float64, float64) {
+	C := Autoprice.CryptoOf(currency.Name)
+	if C == "" {
+		mylog.Logger.Error("当前币种不支持自动汇率，保留输入的汇率，请检查是否错误", zap.String("币种", currency.Name))
+		return fallback, 0
+	}
+	last := s.store.LastMarketRate(currency.Name)
+	if last <= 0 {
+		last = fallback
+	}
+	price, _, err := cron.NewRateAggregator(s.store.GetSetting()).Rate(C, last)
 	if err != nil {
-		mylog.Logger.Error("获取 Redis 中钱包地址的键值是否存时，操作过程发生错误", zap.Any("err", err))
-		return false
+		mylog.Logger.Error("获取自动汇率失败，保留输入的汇率", zap.String("币种", currency.Name), zap.Float64("汇率", fallback), zap.Error(err))
+		return fallback, 0
 	}
-	if exists == 1 {
-		// 键存在
-		return true
+	return currency.ApplyPolicy(price), price
+}
 
+// rateSource 根据是否自动汇率返回汇率历史的来源
+func rateSource(autoRate bool) string {
+	if autoRate {
+		return sdb.RateSourceAuto
 	}
-	// 键不存在
-	return false
-
-	/* 返回值具体情况
-	   情况 exists 值 err 值 说明
-	   key 存在 1 nil 表示 key 存在
-	   key 不存在 0 nil 表示 key 不存在
-	   发生错误 0 非nil 如连接问题、命令错误等 */
-
+	return sdb.RateSourceManual
 }
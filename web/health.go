@@ -0,0 +1,196 @@
+package web
+
+// 健康检查
+// /healthz 存活检查，进程能处理请求就返回 200
+// /readyz 就绪检查，数据库、金额锁或订单过期任务不可用，或者程序正在停止时返回 503；链上监听的状态只作参考，
+// 某个币种的链上监听一直查询失败时返回 degraded，但仍然返回 200，避免外部接口故障导致服务被摘除
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+	"upay_pro/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 健康检查的状态
+const (
+	HealthOK          = "ok"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+// 就绪检查的超时时间
+const readyTimeout = 3 * time.Second
+
+// 订单检查任务每 2 秒运行一次，超过这个时间没有运行说明定时任务卡住了
+const orderCheckStaleAfter = time.Minute
+
+// 币种的链上监听超过这个时间一直没有查询成功，认为监听不可用；区块链浏览器接口同样处理
+const watcherStaleAfter = 5 * time.Minute
+
+// 程序启动时间
+var startedAt = time.Now()
+
+// checkResult 单项检查的结果
+type checkResult struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// runCheck 执行检查，超过 ctx 的截止时间时返回超时
+func runCheck(ctx context.Context, check func(ctx context.Context) error) checkResult {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errors.New("检查超时")
+	}
+	result := checkResult{Status: HealthOK, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Status = HealthUnavailable
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Healthz 存活检查
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":         HealthOK,
+		"time":           time.Now().UnixMilli(),
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+	})
+}
+
+// Readyz 就绪检查，同时检查数据库、金额锁和订单过期任务，并返回链上监听的状态
+// local 模式不使用 Redis，金额锁保存在数据库中
+func (s *Server) Readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readyTimeout)
+	defer cancel()
+
+	checks := map[string]func(ctx context.Context) error{
+		"database": func(ctx context.Context) error {
+			db, err := s.store.DB.DB()
+			if err != nil {
+				return err
+			}
+			return db.PingContext(ctx)
+		},
+		"queue": func(ctx context.Context) error {
+			return s.queue.Ping()
+		},
+	}
+	if s.cfg.UseRedis() {
+		checks["redis"] = func(ctx context.Context) error {
+			return s.locker.Ping(ctx)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]checkResult, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			result := runCheck(ctx, check)
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := HealthOK
+	for _, r := range results {
+		if r.Status != HealthOK {
+			status = HealthUnavailable
+		}
+	}
+	// 程序正在停止，不再接收新的订单
+	if s.draining.Load() {
+		status = HealthUnavailable
+	}
+
+	watchers, healthy := s.watcherHealth()
+	if status == HealthOK && !healthy {
+		status = HealthDegraded
+	}
+
+	code := http.StatusOK
+	if status == HealthUnavailable {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{
+		"status":   status,
+		"time":     time.Now().UnixMilli(),
+		"checks":   results,
+		"watchers": watchers,
+	})
+}
+
+// providerHealth 区块链浏览器接口的状态
+type providerHealth struct {
+	metrics.ProviderStatus
+	Status string `json:"status"`
+}
+
+// currencyHealth 币种链上监听的状态
+type currencyHealth struct {
+	metrics.WatcherStatus
+	Status string `json:"status"`
+}
+
+// watcherHealth 返回订单检查任务、各币种链上监听和各个区块链浏览器接口的状态
+// 订单检查任务或者某个币种的监听有异常时 healthy 为 false；区块链浏览器接口按域名统计，多个币种共用同一个域名，只作参考
+func (s *Server) watcherHealth() (gin.H, bool) {
+	healthy := true
+	now := time.Now()
+
+	orderCheck := gin.H{"status": HealthOK, "last_run": int64(0)}
+	if last := s.jobs.LastOrderCheck(); last.IsZero() {
+		// 程序刚启动时任务还没有运行
+		if now.Sub(startedAt) > orderCheckStaleAfter {
+			orderCheck["status"] = HealthDegraded
+			healthy = false
+		}
+	} else {
+		orderCheck["last_run"] = last.UnixMilli()
+		if now.Sub(last) > orderCheckStaleAfter {
+			orderCheck["status"] = HealthDegraded
+			healthy = false
+		}
+	}
+
+	// 只有等待支付的订单才会查询，没有订单的币种不会出现在这里
+	currencies := make([]currencyHealth, 0)
+	for _, w := range metrics.Watchers() {
+		h := currencyHealth{WatcherStatus: w, Status: HealthOK}
+		if w.FailingSince != 0 && now.Sub(time.UnixMilli(w.FailingSince)) > watcherStaleAfter {
+			h.Status = HealthDegraded
+			healthy = false
+		}
+		currencies = append(currencies, h)
+	}
+
+	providers := make([]providerHealth, 0)
+	for _, p := range metrics.Providers() {
+		h := providerHealth{ProviderStatus: p, Status: HealthOK}
+		lastSuccess := time.UnixMilli(p.LastSuccess)
+		if p.LastError > p.LastSuccess && (p.LastSuccess == 0 || now.Sub(lastSuccess) > watcherStaleAfter) {
+			h.Status = HealthDegraded
+		}
+		providers = append(providers, h)
+	}
+
+	return gin.H{"order_check": orderCheck, "currencies": currencies, "providers": providers}, healthy
+}
@@ -0,0 +1,106 @@
+package web
+
+// /metrics 中需要在采集时查询的指标：异步队列积压和各币种的当前汇率
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"upay_pro/db/sdb"
+	"upay_pro/metrics"
+	"upay_pro/mq"
+	"upay_pro/mylog"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	queueTasksDesc = prometheus.NewDesc("upay_queue_tasks", "异步队列中的任务数，按队列和状态统计", []string{"queue", "state"}, nil)
+	rateDesc       = prometheus.NewDesc("upay_rate", "各币种下单使用的汇率（已应用汇率策略）", []string{"currency"}, nil)
+)
+
+// queueCollector 采集时读取订单过期任务的积压，local 模式下只有 scheduled 状态
+type queueCollector struct {
+	queue mq.Scheduler
+}
+
+func (queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueTasksDesc
+}
+
+func (q queueCollector) Collect(ch chan<- prometheus.Metric) {
+	queues, err := q.queue.Tasks()
+	if err != nil {
+		mylog.Logger.Error("读取异步队列失败", zap.Error(err))
+		return
+	}
+	for queue, states := range queues {
+		for state, n := range states {
+			ch <- prometheus.MustNewConstMetric(queueTasksDesc, prometheus.GaugeValue, float64(n), queue, state)
+		}
+	}
+}
+
+// rateCollector 采集时读取币种表中的汇率
+type rateCollector struct {
+	store *sdb.Store
+}
+
+func (rateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rateDesc
+}
+
+func (r rateCollector) Collect(ch chan<- prometheus.Metric) {
+	var currencies []sdb.Currency
+	if err := r.store.DB.Find(&currencies).Error; err != nil {
+		mylog.Logger.Error("读取币种汇率失败", zap.Error(err))
+		return
+	}
+	for _, c := range currencies {
+		ch <- prometheus.MustNewConstMetric(rateDesc, prometheus.GaugeValue, c.OrderRate(), c.Name)
+	}
+}
+
+// metricsHandler 返回 /metrics 的处理函数，包含采集时查询的指标
+func (s *Server) metricsHandler() http.Handler {
+	return metrics.Handler(queueCollector{queue: s.queue}, rateCollector{store: s.store})
+}
+
+// MetricsAuth /metrics 默认需要认证：请求头 Authorization: Bearer <监控令牌>，或者已登录后台；
+// 系统设置中开启公开访问后不需要认证
+func (s *Server) MetricsAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		setting := s.store.GetSetting()
+		if setting.MetricsPublic {
+			c.Next()
+			return
+		}
+		if token := setting.MetricsToken; token != "" {
+			got := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+				c.Next()
+				return
+			}
+		}
+		if user, ok := s.loggedInUser(c); ok && can(user.Role, PermView) {
+			c.Next()
+			return
+		}
+		fail(c, http.StatusUnauthorized, CodeUnauthorized, "未登录或监控令牌错误")
+	}
+}
+
+// loggedInUser 读取后台登录 cookie 对应的用户，不要求登录时使用
+func (s *Server) loggedInUser(c *gin.Context) (sdb.User, bool) {
+	cookie, err := c.Cookie("token")
+	if err != nil || cookie == "" {
+		return sdb.User{}, false
+	}
+	claims, err := ParseToken(cookie)
+	if err != nil {
+		return sdb.User{}, false
+	}
+	return s.tokenUser(claims)
+}
@@ -0,0 +1,277 @@
+package web
+
+// OpenAPI 文档
+// 接口路径、参数和说明写在 openapi.json 中，components.schemas 中的数据结构在启动时按 dto 和数据表结构生成，
+// 结构体增减字段后文档自动同步；openapi.json 中为同名结构体填写的说明会合并进生成的结构。
+// 启动时会对比已注册的路由和文档中的路径，不一致时打印警告
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"upay_pro/db/sdb"
+	"upay_pro/dto"
+	"upay_pro/events"
+	"upay_pro/mylog"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+//go:embed openapi.html
+var openAPIViewer []byte
+
+// 文档中的结构名和对应的结构体
+var openAPISchemas = []struct {
+	name string
+	typ  reflect.Type
+}{
+	{"RequestParams", reflect.TypeOf(dto.RequestParams{})},
+	{"SimulateParams", reflect.TypeOf(dto.SimulateParams{})},
+	{"Response", reflect.TypeOf(dto.Response{})},
+	{"OrderData", reflect.TypeOf(dto.Data{})},
+	{"PaymentNotification", reflect.TypeOf(dto.PaymentNotification_request{})},
+	{"OrderEvent", reflect.TypeOf(events.Event{})},
+	{"Error", reflect.TypeOf(errorBody{})},
+	{"Order", reflect.TypeOf(sdb.Orders{})},
+	{"User", reflect.TypeOf(sdb.User{})},
+	{"AuditLog", reflect.TypeOf(sdb.AuditLog{})},
+	{"WalletAddress", reflect.TypeOf(sdb.WalletAddress{})},
+	{"Currency", reflect.TypeOf(sdb.Currency{})},
+	{"Merchant", reflect.TypeOf(sdb.Merchant{})},
+	{"Setting", reflect.TypeOf(sdb.Setting{})},
+	{"ApiKey", reflect.TypeOf(sdb.ApiKey{})},
+}
+
+// errorBody 统一错误响应的结构，只用于生成文档，实际由 respondError 返回
+type errorBody struct {
+	Code    int    `json:"code" validate:"required"`
+	Message string `json:"message" validate:"required"`
+	Error   struct {
+		Code string `json:"code" validate:"required"`
+	} `json:"error" validate:"required"`
+	RequestID string `json:"request_id" validate:"required"`
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]any
+)
+
+// buildOpenAPI 解析 openapi.json 并生成 components.schemas，只执行一次
+func buildOpenAPI() map[string]any {
+	openAPIOnce.Do(func() {
+		if err := json.Unmarshal(openAPISpec, &openAPIDoc); err != nil {
+			// openapi.json 随程序编译，解析失败说明文件本身有错误
+			panic("openapi.json 格式错误：" + err.Error())
+		}
+		components, _ := openAPIDoc["components"].(map[string]any)
+		schemas, _ := components["schemas"].(map[string]any)
+		if schemas == nil {
+			schemas = make(map[string]any)
+			components["schemas"] = schemas
+		}
+
+		names := make(map[reflect.Type]string)
+		for _, s := range openAPISchemas {
+			names[s.typ] = s.name
+		}
+		for _, s := range openAPISchemas {
+			schema := structSchema(s.typ, names)
+			if extra, ok := schemas[s.name].(map[string]any); ok {
+				mergeSchema(schema, extra)
+			}
+			schemas[s.name] = schema
+		}
+	})
+	return openAPIDoc
+}
+
+// structSchema 按 json 标签生成结构体的 schema，validate 标签中带 required 的字段为必填
+func structSchema(t reflect.Type, names map[reflect.Type]string) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			// 没有 json 标签的嵌入结构体（gorm.Model、Branding）字段直接展开
+			if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			if !f.IsExported() || tag == "-" {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = f.Name
+			}
+
+			schema := typeSchema(f.Type, names)
+			validate := f.Tag.Get("validate")
+			for _, rule := range strings.Split(validate, ",") {
+				switch {
+				case rule == "required":
+					required = append(required, name)
+				case rule == "url":
+					schema["format"] = "uri"
+				case strings.HasPrefix(rule, "gte="):
+					if v, err := strconv.ParseFloat(strings.TrimPrefix(rule, "gte="), 64); err == nil {
+						schema["minimum"] = v
+					}
+				}
+			}
+			properties[name] = schema
+		}
+	}
+	walk(t)
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// typeSchema 把 Go 类型转换为 schema，已经在 openAPISchemas 中登记的结构体使用引用
+func typeSchema(t reflect.Type, names map[reflect.Type]string) map[string]any {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(gorm.DeletedAt{}):
+		return map[string]any{"type": "string", "format": "date-time", "nullable": true}
+	case reflect.TypeOf(time.Duration(0)):
+		return map[string]any{"type": "integer", "format": "int64", "description": "纳秒"}
+	}
+	if name, ok := names[t]; ok {
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := typeSchema(t.Elem(), names)
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem(), names)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem(), names)}
+	case reflect.Struct:
+		return structSchema(t, names)
+	}
+	return map[string]any{}
+}
+
+// mergeSchema 把 openapi.json 中手写的说明合并到生成的 schema，只合并生成结果中没有的键
+func mergeSchema(dst, src map[string]any) {
+	for k, v := range src {
+		if k == "properties" {
+			props, _ := dst["properties"].(map[string]any)
+			extra, _ := v.(map[string]any)
+			for name, p := range extra {
+				// 结构体中已经删除的字段不再保留说明
+				prop, ok := props[name].(map[string]any)
+				if !ok {
+					continue
+				}
+				if pm, ok := p.(map[string]any); ok {
+					mergeSchema(prop, pm)
+				}
+			}
+			continue
+		}
+		if _, ok := dst[k]; !ok {
+			dst[k] = v
+		}
+	}
+}
+
+// OpenAPI 返回 OpenAPI 文档，servers 使用系统设置中的网站地址
+func (s *Server) OpenAPI(c *gin.Context) {
+	doc := make(map[string]any)
+	for k, v := range buildOpenAPI() {
+		doc[k] = v
+	}
+	if appUrl := strings.TrimRight(s.store.GetSetting().AppUrl, "/"); appUrl != "" {
+		doc["servers"] = []map[string]string{{"url": appUrl}}
+	}
+	c.JSON(http.StatusOK, doc)
+}
+
+// OpenAPIViewer 文档查看页面
+func OpenAPIViewer(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", openAPIViewer)
+}
+
+// checkOpenAPIRoutes 对比已注册的路由和文档中的路径，静态文件路由不检查
+func checkOpenAPIRoutes(routes gin.RoutesInfo) {
+	paths, _ := buildOpenAPI()["paths"].(map[string]any)
+
+	documented := make(map[string]bool)
+	for path, item := range paths {
+		ops, _ := item.(map[string]any)
+		for method := range ops {
+			documented[strings.ToUpper(method)+" "+path] = false
+		}
+	}
+
+	var missing []string
+	for _, route := range routes {
+		if route.Method == http.MethodHead || strings.Contains(route.Path, "*") {
+			continue
+		}
+		// gin 的 :param 对应 OpenAPI 的 {param}
+		segments := strings.Split(route.Path, "/")
+		for i, s := range segments {
+			if strings.HasPrefix(s, ":") {
+				segments[i] = "{" + s[1:] + "}"
+			}
+		}
+		key := route.Method + " " + strings.Join(segments, "/")
+		if _, ok := documented[key]; !ok {
+			missing = append(missing, key)
+			continue
+		}
+		documented[key] = true
+	}
+
+	var stale []string
+	for key, found := range documented {
+		if !found {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(stale)
+
+	if len(missing) > 0 {
+		mylog.Logger.Warn("以下路由没有写入 openapi.json", zap.Strings("routes", missing))
+	}
+	if len(stale) > 0 {
+		mylog.Logger.Warn("openapi.json 中的以下接口没有对应的路由", zap.Strings("routes", stale))
+	}
+}
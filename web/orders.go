@@ -0,0 +1,236 @@
+package web
+
+// 后台订单列表的筛选、排序和导出
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"upay_pro/db/sdb"
+	"upay_pro/mylog"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 可以排序的字段，键为请求参数，值为数据库字段
+var orderSortColumns = map[string]string{
+	"id":              "id",
+	"created_at":      "created_at",
+	"amount":          "amount",
+	"actual_amount":   "actual_amount",
+	"status":          "status",
+	"callback_num":    "callback_num",
+	"expiration_time": "expiration_time",
+}
+
+// orderQuery 按请求参数构建订单查询，返回查询、排序语句和错误信息，没有错误时错误信息为空
+//
+// 筛选参数：search 订单号模糊搜索，status 订单状态（可以逗号分隔多个），currency 钱包类型，wallet 钱包地址，
+// merchant_id 商户ID，start/end 创建时间范围（毫秒时间戳），min_amount/max_amount 订单金额范围，
+// callback 回调是否已确认（1是 2否）；排序参数：sort 排序字段，order 为 asc 或 desc
+func (s *Server) orderQuery(c *gin.Context) (*gorm.DB, string, string) {
+	query := s.store.DB.Model(&sdb.Orders{})
+
+	if search := c.Query("search"); search != "" {
+		// 搜索订单号(TradeId)或商城订单号(OrderId)
+		query = query.Where("trade_id LIKE ? OR order_id LIKE ?", "%"+search+"%", "%"+search+"%")
+	}
+
+	if q := c.Query("status"); q != "" {
+		var statuses []int
+		for _, v := range strings.Split(q, ",") {
+			status, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || status < sdb.StatusWaitPay || status > sdb.StatusExpired {
+				return nil, "", "订单状态不正确"
+			}
+			statuses = append(statuses, status)
+		}
+		query = query.Where("status IN ?", statuses)
+	}
+
+	if currency := c.Query("currency"); currency != "" {
+		query = query.Where("type = ?", currency)
+	}
+	if wallet := c.Query("wallet"); wallet != "" {
+		query = query.Where("token = ?", wallet)
+	}
+	if m := c.Query("merchant_id"); m != "" {
+		merchantID, err := strconv.ParseUint(m, 10, 64)
+		if err != nil {
+			return nil, "", "商户ID不正确"
+		}
+		query = query.Where("merchant_id = ?", merchantID)
+	}
+
+	if q := c.Query("start"); q != "" {
+		start, err := strconv.ParseInt(q, 10, 64)
+		if err != nil {
+			return nil, "", "时间格式不正确，应为毫秒时间戳"
+		}
+		query = query.Where("created_at >= ?", time.UnixMilli(start))
+	}
+	if q := c.Query("end"); q != "" {
+		end, err := strconv.ParseInt(q, 10, 64)
+		if err != nil {
+			return nil, "", "时间格式不正确，应为毫秒时间戳"
+		}
+		query = query.Where("created_at <= ?", time.UnixMilli(end))
+	}
+
+	if q := c.Query("min_amount"); q != "" {
+		amount, err := strconv.ParseFloat(q, 64)
+		if err != nil {
+			return nil, "", "金额格式不正确"
+		}
+		query = query.Where("amount >= ?", amount)
+	}
+	if q := c.Query("max_amount"); q != "" {
+		amount, err := strconv.ParseFloat(q, 64)
+		if err != nil {
+			return nil, "", "金额格式不正确"
+		}
+		query = query.Where("amount <= ?", amount)
+	}
+
+	switch c.Query("callback") {
+	case "":
+	case strconv.Itoa(sdb.CallBackConfirmOk):
+		query = query.Where("call_back_confirm = ?", sdb.CallBackConfirmOk)
+	case strconv.Itoa(sdb.CallBackConfirmNo):
+		// 新订单的回调状态为 0，只有回调成功后才写入 1，没有写入 2 的地方
+		query = query.Where("call_back_confirm <> ?", sdb.CallBackConfirmOk)
+	default:
+		return nil, "", "回调状态不正确"
+	}
+
+	// 排序字段只能从白名单中选择，防止注入
+	column := "id"
+	if q := c.Query("sort"); q != "" {
+		var ok bool
+		if column, ok = orderSortColumns[q]; !ok {
+			return nil, "", "排序字段不正确"
+		}
+	}
+	direction := "DESC"
+	switch strings.ToLower(c.Query("order")) {
+	case "", "desc":
+	case "asc":
+		direction = "ASC"
+	default:
+		return nil, "", "排序方向不正确"
+	}
+	// 排序字段相同时按ID排序，分页结果稳定
+	orderBy := column + " " + direction
+	if column != "id" {
+		orderBy += ", id " + direction
+	}
+
+	return query, orderBy, ""
+}
+
+// 导出文件的表头
+var orderExportHeader = []string{
+	"ID", "订单号", "商城订单号", "商户ID", "钱包类型", "原始金额(CNY)", "实际支付金额", "下单汇率",
+	"钱包地址", "区块ID", "订单状态", "回调确认", "回调次数", "创建时间", "过期时间",
+}
+
+// ExportOrders 按筛选条件导出订单，逐行写入响应，不会一次把所有订单读入内存
+func (s *Server) ExportOrders(c *gin.Context) {
+	query, orderBy, msg := s.orderQuery(c)
+	if msg != "" {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, msg)
+		return
+	}
+	if format := c.DefaultQuery("format", "csv"); format != "csv" {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, "导出格式不正确，目前只支持 csv")
+		return
+	}
+
+	rows, err := query.Order(orderBy).Rows()
+	if err != nil {
+		mylog.Logger.Error("导出订单失败", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternal, "导出订单失败")
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("orders-%s.csv", time.Now().Format("20060102-150405"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+	// 写入 UTF-8 BOM，Excel 打开时中文不会乱码
+	c.Writer.WriteString("\xEF\xBB\xBF")
+
+	w := csv.NewWriter(c.Writer)
+	w.Write(orderExportHeader)
+
+	count := 0
+	for rows.Next() {
+		var order sdb.Orders
+		if err := s.store.DB.ScanRows(rows, &order); err != nil {
+			// 响应头已经发出，只能记录日志并结束导出
+			mylog.Logger.Error("导出订单失败", zap.Error(err))
+			break
+		}
+		w.Write(orderRecord(order))
+
+		// 每 500 行推送一次，浏览器可以及时看到下载进度
+		count++
+		if count%500 == 0 {
+			w.Flush()
+			c.Writer.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		mylog.Logger.Error("导出订单失败", zap.Error(err))
+	}
+	w.Flush()
+}
+
+// orderRecord 把订单转换为导出文件的一行
+func orderRecord(o sdb.Orders) []string {
+	status := "未知状态"
+	switch o.Status {
+	case sdb.StatusWaitPay:
+		status = "待支付"
+	case sdb.StatusPaySuccess:
+		status = "支付成功"
+	case sdb.StatusExpired:
+		status = "已过期"
+	}
+	callback := "否"
+	if o.CallBackConfirm == sdb.CallBackConfirmOk {
+		callback = "是"
+	}
+
+	return []string{
+		strconv.FormatUint(uint64(o.ID), 10),
+		csvText(o.TradeId),
+		csvText(o.OrderId),
+		strconv.FormatUint(uint64(o.MerchantID), 10),
+		csvText(o.Type),
+		strconv.FormatFloat(o.Amount, 'f', 2, 64),
+		strconv.FormatFloat(o.ActualAmount, 'f', -1, 64),
+		strconv.FormatFloat(o.Rate, 'f', -1, 64),
+		csvText(o.Token),
+		csvText(o.BlockTransactionId),
+		status,
+		callback,
+		strconv.Itoa(o.CallbackNum),
+		o.CreatedAt.Format("2006-01-02 15:04:05"),
+		time.UnixMilli(o.ExpirationTime).Format("2006-01-02 15:04:05"),
+	}
+}
+
+// csvText 商城订单号等由商户传入的文本以 = + - @ 开头时，Excel 会当作公式执行，前面加单引号按文本处理
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
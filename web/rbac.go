@@ -0,0 +1,65 @@
+package web
+
+// 后台用户的角色和权限
+// 每个后台接口需要一个权限，角色拥有的权限见 rolePermissions；
+// 登录状态中只保存用户名和登录版本，角色每次请求时从数据库读取；
+// 修改密码或角色时登录版本加1，之前签发的 token 都会失效，删除用户后同样立即生效
+
+import (
+	"net/http"
+	"upay_pro/db/sdb"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Permission 后台接口的权限
+type Permission string
+
+const (
+	PermView      Permission = "view"      // 查看订单、统计、钱包地址和汇率
+	PermOrders    Permission = "orders"    // 手动补单和模拟支付
+	PermRates     Permission = "rates"     // 修改币种汇率
+	PermWallets   Permission = "wallets"   // 添加、修改和删除钱包地址
+	PermMerchants Permission = "merchants" // 管理商户，商户信息中有签名密钥
+	PermSettings  Permission = "settings"  // 查看和修改系统设置，重新加载启动配置
+	PermAPIKeys   Permission = "apikeys"   // 查看和修改区块链浏览器的 API 密钥
+	PermUsers     Permission = "users"     // 管理后台用户，查看审计日志
+)
+
+// 各角色拥有的权限
+var rolePermissions = map[string][]Permission{
+	sdb.RoleOwner:    {PermView, PermOrders, PermRates, PermWallets, PermMerchants, PermSettings, PermAPIKeys, PermUsers},
+	sdb.RoleOperator: {PermView, PermOrders, PermRates},
+	sdb.RoleViewer:   {PermView},
+}
+
+// 登录的用户在 gin.Context 中的键
+const adminUserKey = "admin_user"
+
+// can 角色是否拥有权限
+func can(role string, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// currentUser 当前登录的后台用户，由 JWTAuthMiddleware 设置
+func currentUser(c *gin.Context) sdb.User {
+	user, _ := c.Get(adminUserKey)
+	u, _ := user.(sdb.User)
+	return u
+}
+
+// Require 登录的用户没有权限时返回 403
+func (s *Server) Require(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !can(currentUser(c).Role, perm) {
+			fail(c, http.StatusForbidden, CodeForbidden, "没有权限执行该操作")
+			return
+		}
+		c.Next()
+	}
+}
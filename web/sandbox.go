@@ -0,0 +1,131 @@
+package web
+
+// 沙盒订单的模拟支付
+// 模拟支付加入一笔模拟的转账后立即检查订单，和链上查到的转账一样按收款地址、金额和时间匹配，入账后正常发送回调和通知
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"upay_pro/db/sdb"
+	"upay_pro/dto"
+	"upay_pro/i18n"
+	"upay_pro/mylog"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+)
+
+// simulate 为沙盒订单模拟一笔转账，amount 为 0 时使用订单的支付金额，返回订单是否入账和模拟后的订单
+func (s *Server) simulate(order sdb.Orders, amount float64) (bool, gin.H, error) {
+	if !order.Sandbox {
+		return false, nil, NewError(http.StatusForbidden, CodeNotSandbox, "只能模拟沙盒订单的支付")
+	}
+	if order.Status != sdb.StatusWaitPay {
+		return false, nil, NewError(http.StatusBadRequest, CodeOrderClosed, "订单已支付或已过期")
+	}
+	if order.Token == "" {
+		return false, nil, NewError(http.StatusBadRequest, CodeValidationFailed, "订单还没有选择网络")
+	}
+	if amount == 0 {
+		amount = order.ActualAmount
+	}
+
+	paid := s.jobs.SimulatePayment(order, amount)
+	mylog.Logger.Info("沙盒订单模拟支付", zap.String("trade_id", order.TradeId), zap.Float64("amount", amount), zap.Bool("paid", paid))
+
+	s.store.DB.Where("id = ?", order.ID).Limit(1).Find(&order)
+	return paid, gin.H{
+		"trade_id":             order.TradeId,
+		"paid":                 paid,
+		"status":               order.Status,
+		"amount":               amount,
+		"block_transaction_id": order.BlockTransactionId,
+	}, nil
+}
+
+// SimulatePayment 商户通过接口模拟沙盒订单的支付，使用商户的密钥签名
+func (s *Server) SimulatePayment(c *gin.Context) {
+	var params dto.SimulateParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondError(c, requestLang(c), NewError(http.StatusBadRequest, CodeBadRequest, "请求参数格式错误：%s", err.Error()))
+		return
+	}
+	lang := requestLang(c)
+	if l := i18n.Normalize(params.Lang); l != "" {
+		lang = l
+	}
+	if err := validator.New().Struct(params); err != nil {
+		respondError(c, lang, NewError(http.StatusBadRequest, CodeValidationFailed, "请求参数校验失败：%s", err.Error()))
+		return
+	}
+
+	merchant, ok := s.store.GetMerchant(params.MerchantID)
+	if !ok || merchant.Status != sdb.MerchantStatusEnable {
+		respondError(c, lang, NewError(http.StatusUnauthorized, CodeMerchantInvalid, "商户不存在或已禁用"))
+		return
+	}
+	signParams := []string{
+		fmt.Sprintf("trade_id=%s", params.TradeID),
+		fmt.Sprintf("amount=%g", params.Amount),
+	}
+	sort.Strings(signParams)
+	signature := fmt.Sprintf("%x", md5.Sum([]byte(strings.Join(signParams, "&")+merchant.SecretKey)))
+	if params.Signature != signature {
+		respondError(c, lang, NewError(http.StatusUnauthorized, CodeSignatureInvalid, "签名验证失败"))
+		return
+	}
+
+	// 商户只能模拟自己的订单
+	var order sdb.Orders
+	re := s.store.DB.Where("trade_id = ? AND merchant_id = ?", params.TradeID, merchant.ID).Limit(1).Find(&order)
+	if re.Error != nil || order.ID == 0 {
+		respondError(c, lang, NewError(http.StatusNotFound, CodeOrderNotFound, "订单不存在"))
+		return
+	}
+
+	_, data, err := s.simulate(order, params.Amount)
+	if err != nil {
+		respondError(c, lang, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status_code": http.StatusOK, "message": "success", "data": data})
+}
+
+// AdminSimulatePayment 管理员在后台模拟沙盒订单的支付，可以使用订单号或者商城订单号
+func (s *Server) AdminSimulatePayment(c *gin.Context) {
+	var req struct {
+		OrderID string  `json:"order_id" validate:"required"`
+		Amount  float64 `json:"amount" validate:"gte=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, CodeBadRequest, "参数绑定错误")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, "参数验证错误")
+		return
+	}
+
+	var order sdb.Orders
+	s.store.DB.Where("order_id = ?", req.OrderID).Or("trade_id = ?", req.OrderID).Order("id DESC").Limit(1).Find(&order)
+	if order.ID == 0 {
+		fail(c, http.StatusNotFound, CodeOrderNotFound, "订单不存在")
+		return
+	}
+
+	paid, data, err := s.simulate(order, req.Amount)
+	if err != nil {
+		respondError(c, requestLang(c), err)
+		return
+	}
+	s.audit(c, "order.simulate_payment", order.TradeId, data)
+	message := "模拟支付成功"
+	if !paid {
+		message = "模拟转账已加入，但是和订单的金额不一致，订单没有入账"
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": message, "data": data})
+}
@@ -0,0 +1,136 @@
+package web
+
+// HTTP 服务，使用 endless 监听端口
+// 重新加载配置后 HTTP 端口有变化时，先在新端口启动服务，再平滑关闭旧端口的服务；
+// 程序停止时先拒绝新的订单，再等待正在处理的请求完成
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+	"upay_pro/config"
+	"upay_pro/mylog"
+
+	"github.com/fvbock/endless"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 关闭旧端口的服务时等待请求完成的时间，超过后强制关闭连接，例如支付页面的 SSE 长连接
+const shutdownTimeout = 30 * time.Second
+
+// httpServer endless 创建的服务
+type httpServer interface {
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// listen 在启动配置的端口上启动服务，端口不能监听时返回错误
+// 收到 SIGHUP 后 endless 启动的新进程继承旧进程的监听，端口仍被旧进程占用，这时不检查端口
+func (s *Server) listen(handler http.Handler) error {
+	if !isEndlessChild() {
+		if err := checkPort(s.cfg.HTTP.Port); err != nil {
+			return err
+		}
+	}
+	s.listener.mu.Lock()
+	s.listener.handler = handler
+	s.listener.mu.Unlock()
+
+	s.startServer(s.cfg.HTTP.Port)
+	return nil
+}
+
+// Reload 重新加载启动配置后调用，HTTP 端口有变化时切换端口
+func (s *Server) Reload(old, new config.Config) error {
+	if old.HTTP.Port == new.HTTP.Port {
+		return nil
+	}
+	// 失败时继续使用原来的端口，由 config.Reload 恢复原来的配置
+	if err := s.rotatePort(new.HTTP.Port); err != nil {
+		return fmt.Errorf("切换 HTTP 端口失败: %w", err)
+	}
+	return nil
+}
+
+// Stop 停止接收新的订单，等待正在处理的请求完成后关闭 HTTP 服务，超时后强制关闭连接
+func (s *Server) Stop(ctx context.Context) error {
+	s.draining.Store(true)
+	s.listener.mu.Lock()
+	srv := s.listener.server
+	s.listener.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
+}
+
+// RejectWhenDraining 程序正在停止时拒绝下单和选择网络，避免分配了金额的订单没有人处理
+func (s *Server) RejectWhenDraining() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.draining.Load() {
+			fail(c, http.StatusServiceUnavailable, CodeUnavailable, "服务正在停止，请稍后重试")
+			return
+		}
+		c.Next()
+	}
+}
+
+// isEndlessChild 是否是 endless 平滑重启时启动的新进程
+func isEndlessChild() bool {
+	return os.Getenv("ENDLESS_CONTINUE") != ""
+}
+
+// checkPort 确认端口可以监听
+func checkPort(port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// startServer 在 port 上启动服务，替换当前的服务
+func (s *Server) startServer(port int) {
+	s.listener.mu.Lock()
+	srv := endless.NewServer(fmt.Sprintf(":%d", port), s.listener.handler)
+	s.listener.server = srv
+	s.listener.mu.Unlock()
+
+	go func() {
+		err := srv.ListenAndServe()
+		mylog.Logger.Info("HTTP 服务已停止", zap.Int("port", port), zap.Error(err))
+	}()
+}
+
+// rotatePort 切换到新的端口，旧端口上的请求处理完成后关闭
+func (s *Server) rotatePort(port int) error {
+	// 先确认新端口可以监听，失败时不切换
+	if err := checkPort(port); err != nil {
+		return err
+	}
+
+	s.listener.mu.Lock()
+	old := s.listener.server
+	s.listener.mu.Unlock()
+
+	s.startServer(port)
+	mylog.Logger.Info("HTTP 端口已切换", zap.Int("port", port))
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := old.Shutdown(ctx); err != nil {
+			old.Close()
+		}
+	}()
+	return nil
+}
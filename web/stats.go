@@ -0,0 +1,306 @@
+package web
+
+// 后台收入统计，按小时、天或月汇总订单数据
+// 统计在程序中完成而不是用 SQL 分组，不依赖具体数据库的日期函数
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	"upay_pro/db/sdb"
+	"upay_pro/mylog"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 统计周期
+const (
+	IntervalHour  = "hour"
+	IntervalDay   = "day"
+	IntervalMonth = "month"
+)
+
+// 一次统计最多返回的时间段数量，防止时间范围过大时返回过多数据
+const maxStatsBuckets = 1000
+
+// statsBucket 一个时间段的统计数据
+// 创建、过期、等待支付和转化率按订单创建时间统计，支付数量、金额和支付用时按支付时间统计
+type statsBucket struct {
+	Time           int64              `json:"time"`           // 时间段开始时间，毫秒时间戳
+	Created        int                `json:"created"`        // 创建的订单数
+	CreatedPaid    int                `json:"createdPaid"`    // 创建的订单中已支付的订单数
+	Expired        int                `json:"expired"`        // 创建的订单中已过期的订单数
+	Waiting        int                `json:"waiting"`        // 创建的订单中仍在等待支付的订单数
+	Paid           int                `json:"paid"`           // 支付成功的订单数
+	PaidFiat       float64            `json:"paidFiat"`       // 支付成功的订单金额（人民币）
+	PaidCrypto     map[string]float64 `json:"paidCrypto"`     // 按钱包类型统计的实际到账金额
+	ConversionRate float64            `json:"conversionRate"` // 转化率，创建的订单中已支付的比例
+	AvgTimeToPay   float64            `json:"avgTimeToPay"`   // 平均支付用时，秒，旧版本的订单没有支付时间，不参与计算
+
+	payMillis int64 // 支付用时之和
+	payCount  int   // 有支付时间的订单数
+}
+
+// statsSeries 一组统计数据，包括整个时间范围的合计和每个时间段的数据
+type statsSeries struct {
+	Key     string         `json:"key,omitempty"` // 分组的值：钱包类型、钱包地址或商户ID
+	Totals  *statsBucket   `json:"totals"`
+	Buckets []*statsBucket `json:"buckets"`
+}
+
+// truncateTime 把时间截断到所在时间段的开始时间，按服务器时区计算
+func truncateTime(t time.Time, interval string) time.Time {
+	t = t.Local()
+	switch interval {
+	case IntervalHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case IntervalMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// nextBucket 下一个时间段的开始时间
+func nextBucket(t time.Time, interval string) time.Time {
+	switch interval {
+	case IntervalHour:
+		return t.Add(time.Hour)
+	case IntervalMonth:
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// newSeries 创建从 start 到 end 的所有时间段，没有订单的时间段也会返回，方便绘图
+func newSeries(key string, start, end time.Time, interval string) *statsSeries {
+	s := &statsSeries{Key: key, Totals: &statsBucket{Time: start.UnixMilli(), PaidCrypto: map[string]float64{}}}
+	for t := truncateTime(start, interval); !t.After(end); t = nextBucket(t, interval) {
+		s.Buckets = append(s.Buckets, &statsBucket{Time: t.UnixMilli(), PaidCrypto: map[string]float64{}})
+	}
+	return s
+}
+
+// bucket 查找时间所在的时间段，不在范围内时返回 nil
+func (s *statsSeries) bucket(t time.Time, interval string) *statsBucket {
+	ms := truncateTime(t, interval).UnixMilli()
+	i := sort.Search(len(s.Buckets), func(i int) bool { return s.Buckets[i].Time >= ms })
+	if i < len(s.Buckets) && s.Buckets[i].Time == ms {
+		return s.Buckets[i]
+	}
+	return nil
+}
+
+// addCreated 按创建时间统计订单
+func (s *statsSeries) addCreated(o sdb.Orders, interval string) {
+	for _, b := range []*statsBucket{s.Totals, s.bucket(o.CreatedAt, interval)} {
+		if b == nil {
+			continue
+		}
+		b.Created++
+		switch o.Status {
+		case sdb.StatusPaySuccess:
+			b.CreatedPaid++
+		case sdb.StatusExpired:
+			b.Expired++
+		case sdb.StatusWaitPay:
+			b.Waiting++
+		}
+	}
+}
+
+// addPaid 按支付时间统计订单
+func (s *statsSeries) addPaid(o sdb.Orders, paidAt time.Time, interval string) {
+	for _, b := range []*statsBucket{s.Totals, s.bucket(paidAt, interval)} {
+		if b == nil {
+			continue
+		}
+		b.Paid++
+		b.PaidFiat += o.Amount
+		b.PaidCrypto[o.Type] += o.ActualAmount
+		if o.PaidAt > 0 && o.StartTime > 0 && o.PaidAt >= o.StartTime {
+			b.payMillis += o.PaidAt - o.StartTime
+			b.payCount++
+		}
+	}
+}
+
+// finish 计算转化率和平均支付用时，金额保留合理的小数位数
+func (s *statsSeries) finish() {
+	for _, b := range append([]*statsBucket{s.Totals}, s.Buckets...) {
+		if b.Created > 0 {
+			b.ConversionRate = roundTo(float64(b.CreatedPaid)/float64(b.Created), 4)
+		}
+		if b.payCount > 0 {
+			b.AvgTimeToPay = roundTo(float64(b.payMillis)/float64(b.payCount)/1000, 1)
+		}
+		b.PaidFiat = roundTo(b.PaidFiat, 2)
+		for k, v := range b.PaidCrypto {
+			b.PaidCrypto[k] = roundTo(v, 6)
+		}
+	}
+}
+
+// roundTo 保留指定的小数位数
+func roundTo(v float64, decimals int) float64 {
+	pow := math.Pow(10, float64(decimals))
+	return math.Round(v*pow) / pow
+}
+
+// orderPaidAt 订单的支付时间，旧版本的订单没有记录支付时间，使用最后更新时间
+func orderPaidAt(o sdb.Orders) time.Time {
+	if o.PaidAt > 0 {
+		return time.UnixMilli(o.PaidAt)
+	}
+	return o.UpdatedAt
+}
+
+// StatsSeries 按时间段统计订单
+//
+// 参数：interval 统计周期 hour/day/month，默认 day；start/end 时间范围（毫秒时间戳），默认最近 30 天；
+// group 分组方式 currency/wallet/merchant，不传时不分组；currency、wallet、merchant_id 只统计指定的钱包类型、钱包地址或商户
+func (s *Server) StatsSeries(c *gin.Context) {
+	interval := c.DefaultQuery("interval", IntervalDay)
+	if interval != IntervalHour && interval != IntervalDay && interval != IntervalMonth {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, "统计周期不正确，可选 hour、day、month")
+		return
+	}
+
+	end := time.Now()
+	start := end.AddDate(0, 0, -30)
+	if q := c.Query("start"); q != "" {
+		v, err := strconv.ParseInt(q, 10, 64)
+		if err != nil {
+			fail(c, http.StatusBadRequest, CodeValidationFailed, "时间格式不正确，应为毫秒时间戳")
+			return
+		}
+		start = time.UnixMilli(v)
+	}
+	if q := c.Query("end"); q != "" {
+		v, err := strconv.ParseInt(q, 10, 64)
+		if err != nil {
+			fail(c, http.StatusBadRequest, CodeValidationFailed, "时间格式不正确，应为毫秒时间戳")
+			return
+		}
+		end = time.UnixMilli(v)
+	}
+	if !start.Before(end) {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, "开始时间必须早于结束时间")
+		return
+	}
+
+	group := c.Query("group")
+	var groupKey func(o sdb.Orders) string
+	switch group {
+	case "":
+	case "currency":
+		groupKey = func(o sdb.Orders) string { return o.Type }
+	case "wallet":
+		groupKey = func(o sdb.Orders) string { return o.Token }
+	case "merchant":
+		groupKey = func(o sdb.Orders) string { return strconv.FormatUint(uint64(o.MerchantID), 10) }
+	default:
+		fail(c, http.StatusBadRequest, CodeValidationFailed, "分组方式不正确，可选 currency、wallet、merchant")
+		return
+	}
+
+	total := newSeries("", start, end, interval)
+	if len(total.Buckets) > maxStatsBuckets {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, "时间段太多，请缩小时间范围或使用更大的统计周期")
+		return
+	}
+
+	// 查询时间范围内创建或支付的订单，旧版本的订单没有支付时间，按最后更新时间查询
+	query := s.store.DB.Model(&sdb.Orders{}).Where(
+		"(created_at BETWEEN ? AND ?) OR (paid_at BETWEEN ? AND ?) OR (paid_at = 0 AND status = ? AND updated_at BETWEEN ? AND ?)",
+		start, end, start.UnixMilli(), end.UnixMilli(), sdb.StatusPaySuccess, start, end,
+	)
+	if currency := c.Query("currency"); currency != "" {
+		query = query.Where("type = ?", currency)
+	}
+	if wallet := c.Query("wallet"); wallet != "" {
+		query = query.Where("token = ?", wallet)
+	}
+	if m := c.Query("merchant_id"); m != "" {
+		merchantID, err := strconv.ParseUint(m, 10, 64)
+		if err != nil {
+			fail(c, http.StatusBadRequest, CodeValidationFailed, "商户ID不正确")
+			return
+		}
+		query = query.Where("merchant_id = ?", merchantID)
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		mylog.Logger.Error("统计订单失败", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternal, "统计订单失败")
+		return
+	}
+	defer rows.Close()
+
+	groups := make(map[string]*statsSeries)
+	for rows.Next() {
+		var order sdb.Orders
+		if err := s.store.DB.ScanRows(rows, &order); err != nil {
+			mylog.Logger.Error("统计订单失败", zap.Error(err))
+			fail(c, http.StatusInternalServerError, CodeInternal, "统计订单失败")
+			return
+		}
+
+		series := []*statsSeries{total}
+		if groupKey != nil {
+			key := groupKey(order)
+			if groups[key] == nil {
+				groups[key] = newSeries(key, start, end, interval)
+			}
+			series = append(series, groups[key])
+		}
+
+		inRange := func(t time.Time) bool { return !t.Before(start) && !t.After(end) }
+		for _, g := range series {
+			if inRange(order.CreatedAt) {
+				g.addCreated(order, interval)
+			}
+			if order.Status == sdb.StatusPaySuccess {
+				if paidAt := orderPaidAt(order); inRange(paidAt) {
+					g.addPaid(order, paidAt, interval)
+				}
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		mylog.Logger.Error("统计订单失败", zap.Error(err))
+		fail(c, http.StatusInternalServerError, CodeInternal, "统计订单失败")
+		return
+	}
+
+	total.finish()
+	// 分组按支付金额从高到低排序
+	groupList := make([]*statsSeries, 0, len(groups))
+	for _, g := range groups {
+		g.finish()
+		groupList = append(groupList, g)
+	}
+	sort.Slice(groupList, func(i, j int) bool {
+		if groupList[i].Totals.PaidFiat != groupList[j].Totals.PaidFiat {
+			return groupList[i].Totals.PaidFiat > groupList[j].Totals.PaidFiat
+		}
+		return groupList[i].Key < groupList[j].Key
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"msg":  "success",
+		"data": gin.H{
+			"interval": interval,
+			"start":    start.UnixMilli(),
+			"end":      end.UnixMilli(),
+			"group":    group,
+			"totals":   total.Totals,
+			"buckets":  total.Buckets,
+			"groups":   groupList,
+		},
+	})
+}
@@ -0,0 +1,158 @@
+package web
+
+// 支付页面模版和品牌设置
+// 模版按以下顺序查找，找到即使用（data 目录在数据目录下）：
+//  1. data/templates/merchants/<商户标识>/<模版名>，只对该商户的订单生效
+//  2. data/templates/<模版名>，对所有订单生效
+//  3. static/<模版名>，程序自带的模版
+
+import (
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"upay_pro/config"
+	"upay_pro/db/sdb"
+	"upay_pro/dto"
+	"upay_pro/i18n"
+	"upay_pro/mylog"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+	"go.uber.org/zap"
+)
+
+// templateDir 模版覆盖目录，在数据目录下
+func templateDir() string {
+	return config.Get().Path("data", "templates")
+}
+
+// 模版中可以使用的函数
+var templateFuncs = template.FuncMap{"t": i18n.T}
+
+// 商户标识只允许字母、数字、下划线和中划线，同时作为模版目录名，防止目录穿越
+var merchantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// 主题色只允许 #RGB、#RRGGBB 和 #RRGGBBAA
+var colorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+
+// 覆盖模版缓存，文件修改后自动重新加载，不需要重启
+type cachedTemplate struct {
+	modTime time.Time
+	tpl     *template.Template
+}
+
+var (
+	templateMu    sync.Mutex
+	templateCache = make(map[string]cachedTemplate)
+)
+
+// overrideTemplate 查找并加载覆盖模版，没有覆盖模版时返回 nil
+func overrideTemplate(name, merchant string) *template.Template {
+	var paths []string
+	if merchant != "" {
+		paths = append(paths, filepath.Join(templateDir(), "merchants", merchant, name))
+	}
+	paths = append(paths, filepath.Join(templateDir(), name))
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		templateMu.Lock()
+		cached, ok := templateCache[path]
+		if !ok || !cached.modTime.Equal(info.ModTime()) {
+			tpl, err := template.New(name).Funcs(templateFuncs).ParseFiles(path)
+			if err != nil {
+				templateMu.Unlock()
+				// 模版有语法错误时继续使用下一级模版，不影响买家支付
+				mylog.Logger.Error("加载覆盖模版失败", zap.String("path", path), zap.Error(err))
+				continue
+			}
+			cached = cachedTemplate{modTime: info.ModTime(), tpl: tpl}
+			templateCache[path] = cached
+		}
+		templateMu.Unlock()
+		return cached.tpl
+	}
+	return nil
+}
+
+// renderPage 渲染页面，优先使用覆盖模版
+func renderPage(c *gin.Context, name, merchant string, data any) {
+	tpl := overrideTemplate(name, merchant)
+	if tpl == nil {
+		c.HTML(http.StatusOK, name, data)
+		return
+	}
+	c.Render(http.StatusOK, render.HTML{Template: tpl, Name: name, Data: data})
+}
+
+// applyBranding 把系统设置和商户的品牌设置填入支付页面，商户填写的字段优先
+func applyBranding(viewModel *dto.PaymentViewModel, setting sdb.Setting, merchant sdb.Merchant) {
+	pick := func(merchantValue, settingValue string) string {
+		if merchantValue != "" {
+			return merchantValue
+		}
+		return settingValue
+	}
+
+	viewModel.AppName = pick(merchant.AppName, setting.AppName)
+	viewModel.CustomerServiceContact = pick(merchant.CustomerServiceContact, setting.CustomerServiceContact)
+	viewModel.BrandLogo = pick(merchant.BrandLogo, setting.BrandLogo)
+	viewModel.FooterHtml = template.HTML(pick(merchant.FooterHtml, setting.FooterHtml))
+	viewModel.SupportLinks = parseSupportLinks(pick(merchant.SupportLinks, setting.SupportLinks))
+	// 主题色写入 CSS，不合法的颜色直接忽略
+	if color := pick(merchant.PrimaryColor, setting.PrimaryColor); colorPattern.MatchString(color) {
+		viewModel.PrimaryColor = color
+	}
+}
+
+// parseSupportLinks 解析帮助链接，每行一个，格式：名称|链接，格式不正确的行忽略
+func parseSupportLinks(s string) []dto.SupportLink {
+	var links []dto.SupportLink
+	for _, line := range strings.Split(s, "\n") {
+		name, url, ok := strings.Cut(strings.TrimSpace(line), "|")
+		name, url = strings.TrimSpace(name), strings.TrimSpace(url)
+		if !ok || name == "" || url == "" {
+			continue
+		}
+		links = append(links, dto.SupportLink{Name: name, Url: url})
+	}
+	return links
+}
+
+// validateBranding 检查品牌设置，返回错误信息，没有错误时返回空字符串
+func validateBranding(b sdb.Branding) string {
+	if b.PrimaryColor != "" && !colorPattern.MatchString(b.PrimaryColor) {
+		return "主题色格式不正确，例如 #28a745"
+	}
+	for _, line := range strings.Split(b.SupportLinks, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, url, ok := strings.Cut(line, "|")
+		if !ok || strings.TrimSpace(name) == "" || strings.TrimSpace(url) == "" {
+			return "帮助链接格式不正确，每行一个，格式：名称|链接"
+		}
+	}
+	return ""
+}
+
+// validateMerchant 检查商户信息，返回错误信息，没有错误时返回空字符串
+func validateMerchant(m sdb.Merchant) string {
+	if !merchantNamePattern.MatchString(m.Name) {
+		return "商户标识只能包含字母、数字、下划线和中划线"
+	}
+	if m.Status != 0 && m.Status != sdb.MerchantStatusEnable && m.Status != sdb.MerchantStatusDisable {
+		return "商户状态不正确"
+	}
+	return validateBranding(m.Branding)
+}
@@ -0,0 +1,207 @@
+package web
+
+// 后台用户管理
+// 所有者可以添加用户、修改角色和删除用户；其他用户只能查看自己和修改自己的密码。至少需要保留一个所有者
+
+import (
+	"net/http"
+	"upay_pro/db/sdb"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+// Me 当前登录的用户和拥有的权限，后台页面按权限显示功能
+func (s *Server) Me(c *gin.Context) {
+	user := currentUser(c)
+	permissions := rolePermissions[user.Role]
+	if permissions == nil {
+		permissions = []Permission{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"msg":  "success",
+		"data": gin.H{
+			"id":          user.ID,
+			"username":    user.UserName,
+			"role":        user.Role,
+			"permissions": permissions,
+		},
+	})
+}
+
+// ListUsers 用户列表，没有用户管理权限时只返回自己
+func (s *Server) ListUsers(c *gin.Context) {
+	var users []sdb.User
+	query := s.store.DB
+	if user := currentUser(c); !can(user.Role, PermUsers) {
+		query = query.Where("id = ?", user.ID)
+	}
+	result := query.Find(&users)
+	if result.Error != nil {
+		fail(c, http.StatusInternalServerError, CodeInternal, "获取用户列表失败")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"msg":  "success",
+		"data": users,
+	})
+}
+
+// CreateUser 添加后台用户，用户名和密码的规则和登录相同
+func (s *Server) CreateUser(c *gin.Context) {
+	var req struct {
+		User
+		Role string `json:"role" validate:"required,oneof=owner operator viewer"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, err.Error())
+		return
+	}
+	if _, ok := s.store.GetUser(req.UserName); ok {
+		fail(c, http.StatusConflict, CodeConflict, "用户名已存在")
+		return
+	}
+
+	hash, err := sdb.HashPassword(req.PassWord)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, CodeInternal, "创建失败")
+		return
+	}
+	user := sdb.User{UserName: req.UserName, PassWord: hash, Role: req.Role}
+	if err := s.store.DB.Create(&user).Error; err != nil {
+		fail(c, http.StatusInternalServerError, CodeInternal, "创建失败")
+		return
+	}
+	s.audit(c, "user.create", user.UserName, gin.H{"id": user.ID, "role": user.Role})
+
+	c.JSON(200, gin.H{"code": 0, "message": "添加成功", "data": user})
+}
+
+// UpdateUser 修改用户的角色，不能把最后一个所有者改为其他角色
+func (s *Server) UpdateUser(c *gin.Context) {
+	var req struct {
+		Role string `json:"role" validate:"required,oneof=owner operator viewer"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, err.Error())
+		return
+	}
+
+	var user sdb.User
+	s.store.DB.Where("id = ?", c.Param("id")).Limit(1).Find(&user)
+	if user.ID == 0 {
+		fail(c, http.StatusNotFound, CodeNotFound, "用户不存在")
+		return
+	}
+	if user.Role == sdb.RoleOwner && req.Role != sdb.RoleOwner && s.store.CountOwners() <= 1 {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, "至少需要保留一个所有者")
+		return
+	}
+
+	if req.Role == user.Role {
+		c.JSON(200, gin.H{"code": 0, "message": "更新成功"})
+		return
+	}
+	// 角色变化后之前的登录失效
+	if err := s.store.DB.Model(&user).Updates(map[string]interface{}{"role": req.Role, "token_version": gorm.Expr("token_version + 1")}).Error; err != nil {
+		fail(c, http.StatusInternalServerError, CodeInternal, "更新失败")
+		return
+	}
+	s.renewToken(c, user.ID)
+	s.audit(c, "user.update", user.UserName, gin.H{"role": gin.H{"from": user.Role, "to": req.Role}})
+
+	c.JSON(200, gin.H{"code": 0, "message": "更新成功"})
+}
+
+// DeleteUser 删除用户，不能删除自己和最后一个所有者
+func (s *Server) DeleteUser(c *gin.Context) {
+	var user sdb.User
+	s.store.DB.Where("id = ?", c.Param("id")).Limit(1).Find(&user)
+	if user.ID == 0 {
+		fail(c, http.StatusNotFound, CodeNotFound, "用户不存在")
+		return
+	}
+	if user.ID == currentUser(c).ID {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, "不能删除当前登录的用户")
+		return
+	}
+	if user.Role == sdb.RoleOwner && s.store.CountOwners() <= 1 {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, "至少需要保留一个所有者")
+		return
+	}
+
+	if err := s.store.DB.Delete(&user).Error; err != nil {
+		fail(c, http.StatusInternalServerError, CodeInternal, "删除失败")
+		return
+	}
+	s.audit(c, "user.delete", user.UserName, gin.H{"id": user.ID, "role": user.Role})
+
+	c.JSON(200, gin.H{"code": 0, "message": "删除成功"})
+}
+
+// ChangePassword 修改用户密码，没有用户管理权限时只能修改自己的密码
+func (s *Server) ChangePassword(c *gin.Context) {
+	var req struct {
+		UserId      int    `json:"userId"`
+		NewPassword string `json:"newPassword" validate:"required,min=6,max=18,alphanum"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
+		return
+	}
+
+	/* 	if req.NewPassword == "" {
+		c.JSON(400, gin.H{"code": 1, "message": "新密码不能为空"})
+		return
+	} */
+	//  验证参数是否符合要求
+	if err := validator.New().Struct(req); err != nil {
+		fail(c, http.StatusBadRequest, CodeValidationFailed, err.Error())
+		return
+	}
+	if me := currentUser(c); uint(req.UserId) != me.ID && !can(me.Role, PermUsers) {
+		fail(c, http.StatusForbidden, CodeForbidden, "没有权限执行该操作")
+		return
+	}
+
+	var user sdb.User
+	s.store.DB.Where("id = ?", req.UserId).Limit(1).Find(&user)
+	if user.ID == 0 {
+		fail(c, http.StatusNotFound, CodeNotFound, "用户不存在")
+		return
+	}
+
+	// 对密码加密
+	hash, _ := sdb.HashPassword(req.NewPassword)
+	// 更新用户密码，之前的登录失效
+	result := s.store.DB.Model(&user).Updates(map[string]interface{}{"PassWord": hash, "token_version": gorm.Expr("token_version + 1")})
+	if result.Error != nil {
+		fail(c, http.StatusInternalServerError, CodeInternal, "更新失败")
+		return
+	}
+	s.renewToken(c, user.ID)
+	s.audit(c, "user.password", user.UserName, gin.H{"id": user.ID})
+
+	c.JSON(200, gin.H{"code": 0, "message": "密码修改成功"})
+}
+
+// renewToken 修改的是当前登录的用户时按新的登录版本重新签发 token，当前会话不需要重新登录
+func (s *Server) renewToken(c *gin.Context, userID uint) {
+	if userID != currentUser(c).ID {
+		return
+	}
+	var user sdb.User
+	s.store.DB.Where("id = ?", userID).Limit(1).Find(&user)
+	c.SetCookie("token", s.GenerateToken(user), 3600*24, "/", "", false, true)
+}
@@ -5,14 +5,20 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	Autoprice "upay_pro/AutoPrice"
+	"upay_pro/config"
 	"upay_pro/db/sdb"
+	"upay_pro/i18n"
+	"upay_pro/lock"
+	"upay_pro/metrics"
+	"upay_pro/mq"
 	"upay_pro/mylog"
 
 	"upay_pro/cron"
 
-	"github.com/fvbock/endless"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"go.uber.org/zap"
@@ -23,10 +29,48 @@ type User struct {
 	PassWord string `json:"password" form:"password" validate:"required,min=6,max=18,alphanum"`
 }
 
-func Start() {
+// Server HTTP 服务，处理下单、支付页面和后台管理接口
+type Server struct {
+	cfg    config.Config
+	store  *sdb.Store
+	locker lock.Locker
+	queue  mq.Scheduler
+	jobs   *cron.Service
+
+	// 当前监听端口的服务，切换端口时替换
+	listener struct {
+		mu      sync.Mutex
+		handler http.Handler
+		server  httpServer
+	}
+	// 程序正在停止时为 true，不再接收新的订单
+	draining atomic.Bool
+}
+
+// New 创建 HTTP 服务，Start 后开始监听端口
+func New(cfg config.Config, store *sdb.Store, locker lock.Locker, queue mq.Scheduler, jobs *cron.Service) *Server {
+	return &Server{cfg: cfg, store: store, locker: locker, queue: queue, jobs: jobs}
+}
+
+// Start 在后台启动 HTTP 服务，端口不能监听时返回错误
+func (s *Server) Start() error {
+	return s.listen(s.Handler())
+}
+
+// Handler 创建路由
+func (s *Server) Handler() http.Handler {
 	// 创建一个新的验证器实例
 	validate := validator.New()
 	r := gin.Default()
+	// 为每个请求分配请求ID，接口出错时返回给调用方
+	r.Use(RequestID())
+	// 系统设置的默认语言，错误信息和支付页面按请求的语言翻译
+	r.Use(s.DefaultLang())
+	// 处理函数 panic 时也按统一格式返回错误
+	r.Use(gin.CustomRecovery(func(c *gin.Context, recovered any) {
+		mylog.Logger.Error("处理请求时发生 panic", zap.String("request_id", c.GetString(requestIDKey)), zap.Any("panic", recovered))
+		fail(c, http.StatusInternalServerError, CodeInternal, "服务器内部错误")
+	}))
 	/* 	// 配置 CORS 中间件
 	   	r.Use(cors.New(cors.Config{
 	   		AllowOrigins:     []string{"*"},                            // 允许的源
@@ -36,12 +80,23 @@ func Start() {
 	   		AllowCredentials: true,                                     // 允许携带凭据
 	   		MaxAge:           10 * time.Minute,                         // 缓存时间
 	   	})) */
+	// 模版中使用 t 函数翻译文本
+	r.SetFuncMap(templateFuncs)
 	// 加载模版
 	r.LoadHTMLGlob("static/*.html")
 	// 加载静态资源并把原始目录重定向
 
 	r.Static("/css", "./static/css")
 	r.Static("/js", "./static/js")
+	r.Static("/img", "./static/img")
+	// 健康检查
+	r.GET("/healthz", Healthz)
+	r.GET("/readyz", s.Readyz)
+	// Prometheus 监控指标
+	r.GET("/metrics", s.MetricsAuth(), gin.WrapH(s.metricsHandler()))
+	// OpenAPI 文档和查看页面
+	r.GET("/openapi.json", s.OpenAPI)
+	r.GET("/docs", OpenAPIViewer)
 	// 首页路由
 	r.GET("/", func(c *gin.Context) {
 		c.HTML(200, "index.html", gin.H{})
@@ -60,26 +115,22 @@ func Start() {
 			// 绑定请求体
 			err := c.ShouldBind(&user)
 			if err != nil {
-				c.JSON(400, gin.H{
-					"message": "参数错误",
-				})
+				fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
 				return
 			}
 			// 验证用户结构体是否符合要求
 			err = validate.Struct(user)
 			if err != nil {
-				c.JSON(400, gin.H{
-					"message": err.Error(),
-				})
+				fail(c, http.StatusBadRequest, CodeValidationFailed, err.Error())
 				return
 			}
 			// 验证用户名密码和数据库是否一致
 			var userDB sdb.User
-			err = sdb.DB.Where("UserName = ?", user.UserName).First(&userDB).Error
+			// 字段名有大写字母，使用 map 条件由 gorm 给字段名加引号，兼容 PostgreSQL 和 MySQL
+			err = s.store.DB.Where(map[string]interface{}{"UserName": user.UserName}).First(&userDB).Error
 			if err != nil {
-				c.JSON(400, gin.H{
-					"message": "用户名或密码错误",
-				})
+				s.auditAs(c, sdb.User{UserName: user.UserName}, "user.login_failed", user.UserName, nil)
+				fail(c, http.StatusUnauthorized, CodeUnauthorized, "用户名或密码错误")
 				return
 			}
 			if sdb.VerifyPassword(user.PassWord, userDB.PassWord) {
@@ -87,14 +138,14 @@ func Start() {
 				// c.Redirect(302, "/admin/")
 				c.Header("HX-Redirect", "/admin/")
 				// 生成token，并设置到cookie中
-				token := GenerateToken()
+				token := s.GenerateToken(userDB)
 				// cookie 设置选项 - 使用空字符串让浏览器自动处理域名
 				c.SetCookie("token", token, 3600*24, "/", "", false, true)
+				s.auditAs(c, userDB, "user.login", userDB.UserName, nil)
 
 			} else {
-				c.JSON(400, gin.H{
-					"message": "用户名或密码错误",
-				})
+				s.auditAs(c, userDB, "user.login_failed", userDB.UserName, nil)
+				fail(c, http.StatusUnauthorized, CodeUnauthorized, "用户名或密码错误")
 			}
 
 		})
@@ -102,32 +153,27 @@ func Start() {
 	// 后台路由组
 	{
 		admin := r.Group("/admin")
-		admin.Use(JWTAuthMiddleware())
+		admin.Use(s.JWTAuthMiddleware())
 
 		admin.GET("/", func(c *gin.Context) {
 			c.HTML(200, "admin.html", gin.H{})
 		})
 
-		// 用户管理API
-		admin.GET("/api/users", func(c *gin.Context) {
-			var users []sdb.User
-			result := sdb.DB.Find(&users)
-			if result.Error != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"code": -1,
-					"msg":  "获取用户列表失败",
-				})
-				return
-			}
-			c.JSON(http.StatusOK, gin.H{
-				"code": 0,
-				"msg":  "success",
-				"data": users,
-			})
-		})
+		// 当前登录的用户和权限
+		admin.GET("/api/me", s.Me)
+
+		// 用户管理API，没有用户管理权限时只能查看自己和修改自己的密码
+		admin.GET("/api/users", s.ListUsers)
+		admin.POST("/api/users", s.Require(PermUsers), s.CreateUser)
+		admin.PUT("/api/users/:id", s.Require(PermUsers), s.UpdateUser)
+		admin.DELETE("/api/users/:id", s.Require(PermUsers), s.DeleteUser)
+		admin.POST("/api/users/password", s.ChangePassword)
+
+		// 审计日志
+		admin.GET("/api/audit-logs", s.Require(PermUsers), s.AuditLogs)
 
 		// 订单管理API
-		admin.GET("/api/orders", func(c *gin.Context) {
+		admin.GET("/api/orders", s.Require(PermView), func(c *gin.Context) {
 			// 获取分页参数
 			page := 1
 			limit := 10
@@ -142,31 +188,25 @@ func Start() {
 				}
 			}
 
-			// 获取搜索参数
-			search := c.Query("search")
-
 			// 计算偏移量
 			offset := (page - 1) * limit
 
 			// 构建查询条件
-			query := sdb.DB.Model(&sdb.Orders{})
-			if search != "" {
-				// 搜索订单号(TradeId)或商城订单号(OrderId)
-				query = query.Where("trade_id LIKE ? OR order_id LIKE ?", "%"+search+"%", "%"+search+"%")
+			query, orderBy, msg := s.orderQuery(c)
+			if msg != "" {
+				fail(c, http.StatusBadRequest, CodeValidationFailed, msg)
+				return
 			}
 
 			// 获取总数
 			var total int64
 			query.Count(&total)
 
-			// 获取订单列表（按ID倒序）
+			// 获取订单列表
 			var orders []sdb.Orders
-			result := query.Order("id DESC").Offset(offset).Limit(limit).Find(&orders)
+			result := query.Order(orderBy).Offset(offset).Limit(limit).Find(&orders)
 			if result.Error != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"code": -1,
-					"msg":  "获取订单列表失败",
-				})
+				fail(c, http.StatusInternalServerError, CodeInternal, "获取订单列表失败")
 				return
 			}
 			c.JSON(http.StatusOK, gin.H{
@@ -181,15 +221,15 @@ func Start() {
 			})
 		})
 
+		// 按筛选条件导出订单
+		admin.GET("/api/orders/export", s.Require(PermView), s.ExportOrders)
+
 		// 钱包地址管理API
-		admin.GET("/api/wallets", func(c *gin.Context) {
+		admin.GET("/api/wallets", s.Require(PermView), func(c *gin.Context) {
 			var wallets []sdb.WalletAddress
-			result := sdb.DB.Find(&wallets)
+			result := s.store.DB.Find(&wallets)
 			if result.Error != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"code": -1,
-					"msg":  "获取钱包地址列表失败",
-				})
+				fail(c, http.StatusInternalServerError, CodeInternal, "获取钱包地址列表失败")
 				return
 			}
 			c.JSON(http.StatusOK, gin.H{
@@ -199,15 +239,58 @@ func Start() {
 			})
 		})
 
+		// 汇率历史API，用于绘制每个币种的汇率走势
+		admin.GET("/api/rates/history", s.Require(PermView), func(c *gin.Context) {
+			currency := c.Query("currency")
+			if currency == "" {
+				fail(c, http.StatusBadRequest, CodeValidationFailed, "币种不能为空")
+				return
+			}
+
+			// 默认查询最近7天，start/end 为毫秒时间戳
+			end := time.Now()
+			start := end.Add(-7 * 24 * time.Hour)
+			if v, err := strconv.ParseInt(c.Query("start"), 10, 64); err == nil && v > 0 {
+				start = time.UnixMilli(v)
+			}
+			if v, err := strconv.ParseInt(c.Query("end"), 10, 64); err == nil && v > 0 {
+				end = time.UnixMilli(v)
+			}
+
+			var history []sdb.RateHistory
+			result := s.store.DB.Where("currency = ? AND created_at BETWEEN ? AND ?", currency, start, end).Order("created_at ASC").Find(&history)
+			if result.Error != nil {
+				fail(c, http.StatusInternalServerError, CodeInternal, "获取汇率历史失败")
+				return
+			}
+
+			points := make([]gin.H, 0, len(history))
+			for _, h := range history {
+				points = append(points, gin.H{
+					"time":   h.CreatedAt.UnixMilli(),
+					"rate":   h.Rate,
+					"source": h.Source,
+				})
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"code": 0,
+				"msg":  "success",
+				"data": gin.H{
+					"currency": currency,
+					"points":   points,
+				},
+			})
+		})
+
 		// 统计数据API
-		admin.GET("/api/stats", func(c *gin.Context) {
+		admin.GET("/api/stats", s.Require(PermView), func(c *gin.Context) {
 			var userCount int64
 			var successOrderCount int64
 			var walletCount int64
 
-			sdb.DB.Model(&sdb.User{}).Count(&userCount)
-			sdb.DB.Model(&sdb.Orders{}).Where("status = ?", sdb.StatusPaySuccess).Count(&successOrderCount)
-			sdb.DB.Model(&sdb.WalletAddress{}).Count(&walletCount)
+			s.store.DB.Model(&sdb.User{}).Count(&userCount)
+			s.store.DB.Model(&sdb.Orders{}).Where("status = ?", sdb.StatusPaySuccess).Count(&successOrderCount)
+			s.store.DB.Model(&sdb.WalletAddress{}).Count(&walletCount)
 
 			c.JSON(http.StatusOK, gin.H{
 				"code": 0,
@@ -220,272 +303,248 @@ func Start() {
 			})
 		})
 
-		// 修改用户密码
-		admin.POST("/api/users/password", func(c *gin.Context) {
-			var req struct {
-				UserId      int    `json:"userId"`
-				NewPassword string `json:"newPassword" validate:"required,min=6,max=18,alphanum"`
-			}
+		// 按时间段统计订单和收入
+		admin.GET("/api/stats/series", s.Require(PermView), s.StatsSeries)
 
-			if err := c.ShouldBindJSON(&req); err != nil {
-				c.JSON(400, gin.H{"code": 1, "message": "参数错误"})
+		// 添加钱包地址
+		admin.POST("/api/wallets", s.Require(PermWallets), func(c *gin.Context) {
+			// 传入的币种和钱包地址和状态，汇率在币种汇率中统一设置
+			var wallet sdb.WalletAddress
+
+			if err := c.ShouldBindJSON(&wallet); err != nil {
+				fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
 				return
 			}
 
-			/* 	if req.NewPassword == "" {
-				c.JSON(400, gin.H{"code": 1, "message": "新密码不能为空"})
-				return
-			} */
-			//  验证参数是否符合要求
-			err := validate.Struct(req)
-			if err != nil {
-				c.JSON(400, gin.H{"code": 1, "message": err.Error()})
+			if wallet.Currency == "" || wallet.Token == "" {
+				fail(c, http.StatusBadRequest, CodeValidationFailed, "币种和钱包地址不能为空")
 				return
 			}
 
-			// 对密码加密
-			hash, _ := sdb.HashPassword(req.NewPassword)
-
-			// 更新用户密码
-			result := sdb.DB.Model(&sdb.User{}).Where("id = ?", req.UserId).Update("PassWord", hash)
-			if result.Error != nil {
-				c.JSON(500, gin.H{"code": 1, "message": "更新失败"})
+			// 检查是否已经存在了该币种和地址都存在的记录，如果存在，返回错误，提示钱包地址在该币种下已经存在
+			var existingWallet sdb.WalletAddress
+			if err := s.store.DB.Where("currency = ? AND token = ?", wallet.Currency, wallet.Token).First(&existingWallet).Error; err == nil {
+				fail(c, http.StatusConflict, CodeConflict, "钱包地址在当前币种中已存在")
 				return
 			}
 
-			if result.RowsAffected == 0 {
-				c.JSON(404, gin.H{"code": 1, "message": "用户不存在"})
+			// 创建钱包地址
+			if err := s.store.DB.Create(&wallet).Error; err != nil {
+				fail(c, http.StatusInternalServerError, CodeInternal, "创建失败")
 				return
 			}
 
-			c.JSON(200, gin.H{"code": 0, "message": "密码修改成功"})
+			s.audit(c, "wallet.create", strconv.Itoa(int(wallet.ID)), gin.H{"currency": wallet.Currency, "token": wallet.Token, "status": wallet.Status})
+
+			c.JSON(200, gin.H{"code": 0, "message": "添加成功", "data": wallet})
+
 		})
 
-		// 添加钱包地址
-		admin.POST("/api/wallets", func(c *gin.Context) {
-			// 传入的币种和钱包地址和汇率和状态
+		// 编辑钱包地址
+		admin.PUT("/api/wallets/:id", s.Require(PermWallets), func(c *gin.Context) {
+			walletId := c.Param("id")
 			var wallet sdb.WalletAddress
 
 			if err := c.ShouldBindJSON(&wallet); err != nil {
-				c.JSON(400, gin.H{"code": 1, "message": "参数错误"})
+				fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
 				return
 			}
 
 			if wallet.Currency == "" || wallet.Token == "" {
-				c.JSON(400, gin.H{"code": 1, "message": "币种和钱包地址不能为空"})
+				fail(c, http.StatusBadRequest, CodeValidationFailed, "币种和钱包地址不能为空")
 				return
 			}
 
-			if wallet.Rate <= 0 {
-
-				c.JSON(400, gin.H{"code": 1, "message": "汇率必须大于0"})
+			/* 	// 检查钱包地址是否已存在（排除当前记录）
+			var existingWallet sdb.WalletAddress
+			if err := sdb.DB.Where("token = ? AND id != ?", wallet.Token, walletId).First(&existingWallet).Error; err == nil {
+				c.JSON(400, gin.H{"code": 1, "message": "钱包地址已存在"})
 				return
-			}
-
-			// // 创建汇率维护表
-			// var autoprice sdb.AutoRate
-
-			// autoprice.Currency = wallet.Currency
+			} */
 
-			if wallet.AutoRate == true {
-				mylog.Logger.Info("自动汇率已启用", zap.String("币种", wallet.Currency))
-				// 自动汇率是否启用
-				wallet.AutoRate = true
-				// 设置钱包地址表里面的汇率字段
-				// 币种
-				C := ""
-				// 如果order.Currency包含了"USDT"，那么C就等于"USDT"
-				switch {
-				case strings.Contains(wallet.Currency, "USDT"):
-					C = "USDT"
-				case strings.Contains(wallet.Currency, "USDC"):
-					C = "USDC"
-				case strings.Contains(wallet.Currency, "TRX"):
-					C = "TRX"
-				default:
-					mylog.Logger.Error("当前币种将自动设置默认汇率：10，请检查是否错误", zap.String("币种", wallet.Currency))
-				}
-				price, err := Autoprice.Start(C)
-				if err != nil {
-					mylog.Logger.Error("获取自动汇率失败，将设置默认汇率，USDT:7,USDC:7,TRX:2.5", zap.Error(err))
-					//将设置默认汇率
-					// 优化后的switch语句
-					switch C {
-					case "USDT", "USDC":
-						wallet.Rate = 7
-					case "TRX":
-						wallet.Rate = 2.5
-					default:
-						wallet.Rate = 10
-					}
-				} else {
-					wallet.Rate = price
-				}
+			// 更新钱包地址，审计日志记录修改前后的内容
+			var before sdb.WalletAddress
+			s.store.DB.Where("id = ?", walletId).Limit(1).Find(&before)
+			updates := map[string]interface{}{
+				"Currency": wallet.Currency,
+				"Token":    wallet.Token,
+				"Status":   wallet.Status,
+			}
+			result := s.store.DB.Model(&sdb.WalletAddress{}).Where("id = ?", walletId).Updates(updates)
 
-			} else {
-				wallet.AutoRate = false
+			if result.Error != nil {
+				fail(c, http.StatusInternalServerError, CodeInternal, "更新失败")
+				return
 			}
-			// 查询数据库中的钱包记录
-			var existingWallet sdb.WalletAddress
-			if wallet.AutoRate == false {
-				// 检查输入的币种的汇率是否存在，如果存在验证输入的汇率和数据库中的汇率是否一致，如果能找到，说明已经存在了，返回错误要求为汇率必须输入为一致；
-				// 这里使用Last是为了获取最新的一条记录，因为如果有两条记录，说明之前有过修改，所以需要验证最新的一条记录的汇率是否一致
-				if err := sdb.DB.Where("currency = ? ", wallet.Currency).Last(&existingWallet).Error; err == nil {
 
-					/* fmt.Println("existingWallet.Rate:", existingWallet.Rate)
-					fmt.Println("wallet.Rate:", wallet.Rate) */
+			if result.RowsAffected == 0 {
+				fail(c, http.StatusNotFound, CodeNotFound, "钱包地址更新失败")
+				return
+			}
+			s.audit(c, "wallet.update", walletId, gin.H{
+				"from": gin.H{"Currency": before.Currency, "Token": before.Token, "Status": before.Status},
+				"to":   updates,
+			})
 
-					if wallet.Rate != existingWallet.Rate {
-						c.JSON(400, gin.H{"code": 1, "message": fmt.Sprintf("每一个币种的汇率必须一致，你输入的钱包汇率配置错误，请把汇率设置为%v", existingWallet.Rate)})
-						return
+			c.JSON(200, gin.H{"code": 0, "message": "更新成功"})
 
-					}
+		})
 
-				}
-			}
+		// 删除钱包地址
+		admin.DELETE("/api/wallets/:id", s.Require(PermWallets), func(c *gin.Context) {
+			walletId := c.Param("id")
+			var wallet sdb.WalletAddress
+			s.store.DB.Where("id = ?", walletId).Limit(1).Find(&wallet)
 
-			// 检查是否已经存在了该币种和地址都存在的记录，如果存在，返回错误，提示钱包地址在该币种下已经存在
-			if err := sdb.DB.Where("currency = ? AND token = ?", wallet.Currency, wallet.Token).First(&existingWallet).Error; err == nil {
-				c.JSON(400, gin.H{"code": 1, "message": "钱包地址在当前币种中已存在"})
+			// 删除钱包地址
+			result := s.store.DB.Delete(&sdb.WalletAddress{}, walletId)
+			if result.Error != nil {
+				fail(c, http.StatusInternalServerError, CodeInternal, "删除失败")
 				return
 			}
 
-			// 创建钱包地址
-			if err := sdb.DB.Create(&wallet).Error; err != nil {
-				c.JSON(500, gin.H{"code": 1, "message": "创建失败"})
+			if result.RowsAffected == 0 {
+				fail(c, http.StatusNotFound, CodeNotFound, "钱包地址不存在")
 				return
 			}
+			s.audit(c, "wallet.delete", walletId, gin.H{"currency": wallet.Currency, "token": wallet.Token})
 
-			c.JSON(200, gin.H{"code": 0, "message": "添加成功", "data": wallet})
+			c.JSON(200, gin.H{"code": 0, "message": "删除成功"})
 
 		})
 
-		// 编辑钱包地址
-		admin.PUT("/api/wallets/:id", func(c *gin.Context) {
-			walletId := c.Param("id")
-			var wallet sdb.WalletAddress
+		// 商户管理API
+		admin.GET("/api/merchants", s.Require(PermMerchants), func(c *gin.Context) {
+			var merchants []sdb.Merchant
+			result := s.store.DB.Find(&merchants)
+			if result.Error != nil {
+				fail(c, http.StatusInternalServerError, CodeInternal, "获取商户列表失败")
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"code": 0,
+				"msg":  "success",
+				"data": merchants,
+			})
+		})
 
-			if err := c.ShouldBindJSON(&wallet); err != nil {
-				c.JSON(400, gin.H{"code": 1, "message": "参数错误"})
+		// 添加商户，没有填写密钥时自动生成
+		admin.POST("/api/merchants", s.Require(PermMerchants), func(c *gin.Context) {
+			var merchant sdb.Merchant
+			if err := c.ShouldBindJSON(&merchant); err != nil {
+				fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
+				return
+			}
+			if msg := validateMerchant(merchant); msg != "" {
+				fail(c, http.StatusBadRequest, CodeValidationFailed, msg)
 				return
 			}
 
-			if wallet.Currency == "" || wallet.Token == "" {
-				c.JSON(400, gin.H{"code": 1, "message": "币种和钱包地址不能为空"})
+			var count int64
+			s.store.DB.Model(&sdb.Merchant{}).Where("name = ?", merchant.Name).Count(&count)
+			if count > 0 {
+				fail(c, http.StatusConflict, CodeConflict, "商户标识已存在")
 				return
 			}
 
-			if wallet.Rate <= 0 {
-				c.JSON(400, gin.H{"code": 1, "message": "汇率必须大于0"})
+			if merchant.SecretKey == "" {
+				merchant.SecretKey = sdb.GenerateSecretKey(48)
+			}
+			if merchant.Status == 0 {
+				merchant.Status = sdb.MerchantStatusEnable
+			}
+			merchant.ID = 0
+			if err := s.store.DB.Create(&merchant).Error; err != nil {
+				fail(c, http.StatusInternalServerError, CodeInternal, "创建失败")
 				return
 			}
+			s.audit(c, "merchant.create", strconv.Itoa(int(merchant.ID)), gin.H{"name": merchant.Name, "status": merchant.Status, "sandbox": merchant.Sandbox})
 
-			if wallet.AutoRate == true {
-				mylog.Logger.Info("自动汇率已启用", zap.String("币种", wallet.Currency))
-				// 自动汇率是否启用
-				wallet.AutoRate = true
-				// 设置钱包地址表里面的汇率字段
-				// 币种
-				C := ""
-				// 如果order.Currency包含了"USDT"，那么C就等于"USDT"
-				switch {
-				case strings.Contains(wallet.Currency, "USDT"):
-					C = "USDT"
-				case strings.Contains(wallet.Currency, "USDC"):
-					C = "USDC"
-				case strings.Contains(wallet.Currency, "TRX"):
-					C = "TRX"
-				default:
-					mylog.Logger.Error("当前币种将自动设置默认汇率：10，请检查是否错误", zap.String("币种", wallet.Currency))
-				}
-				price, err := Autoprice.Start(C)
-				if err != nil {
-					mylog.Logger.Error("获取自动汇率失败，将设置默认汇率，USDT:7,USDC:7,TRX:2.5", zap.Error(err))
-					//将设置默认汇率
-					// 优化后的switch语句
-					switch C {
-					case "USDT", "USDC":
-						wallet.Rate = 7
-					case "TRX":
-						wallet.Rate = 2.5
-					default:
-						wallet.Rate = 10
-					}
-				} else {
-					wallet.Rate = price
-				}
+			c.JSON(200, gin.H{"code": 0, "message": "添加成功", "data": merchant})
+		})
 
-			} else {
-				wallet.AutoRate = false
+		// 编辑商户，密钥为空时保留原密钥
+		admin.PUT("/api/merchants/:id", s.Require(PermMerchants), func(c *gin.Context) {
+			merchantId := c.Param("id")
+			var merchant sdb.Merchant
+			if err := c.ShouldBindJSON(&merchant); err != nil {
+				fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
+				return
 			}
-
-			/* 	// 检查钱包地址是否已存在（排除当前记录）
-			var existingWallet sdb.WalletAddress
-			if err := sdb.DB.Where("token = ? AND id != ?", wallet.Token, walletId).First(&existingWallet).Error; err == nil {
-				c.JSON(400, gin.H{"code": 1, "message": "钱包地址已存在"})
+			if msg := validateMerchant(merchant); msg != "" {
+				fail(c, http.StatusBadRequest, CodeValidationFailed, msg)
 				return
-			} */
+			}
 
-			// 更新钱包地址
-			result := sdb.DB.Model(&sdb.WalletAddress{}).Where("id = ?", walletId).Updates(map[string]interface{}{
-				"Currency": wallet.Currency,
-				"Token":    wallet.Token,
-				"Rate":     wallet.Rate,
-				"Status":   wallet.Status,
-				"AutoRate": wallet.AutoRate,
-			})
+			var count int64
+			s.store.DB.Model(&sdb.Merchant{}).Where("name = ? AND id != ?", merchant.Name, merchantId).Count(&count)
+			if count > 0 {
+				fail(c, http.StatusConflict, CodeConflict, "商户标识已存在")
+				return
+			}
 
+			if merchant.Status == 0 {
+				merchant.Status = sdb.MerchantStatusEnable
+			}
+			updates := map[string]interface{}{
+				"Name":                   merchant.Name,
+				"Status":                 merchant.Status,
+				"AppName":                merchant.AppName,
+				"CustomerServiceContact": merchant.CustomerServiceContact,
+				"Sandbox":                merchant.Sandbox,
+				"BrandLogo":              merchant.BrandLogo,
+				"PrimaryColor":           merchant.PrimaryColor,
+				"FooterHtml":             merchant.FooterHtml,
+				"SupportLinks":           merchant.SupportLinks,
+			}
+			if merchant.SecretKey != "" {
+				updates["SecretKey"] = merchant.SecretKey
+			}
+			result := s.store.DB.Model(&sdb.Merchant{}).Where("id = ?", merchantId).Updates(updates)
 			if result.Error != nil {
-				c.JSON(500, gin.H{"code": 1, "message": "更新失败"})
+				fail(c, http.StatusInternalServerError, CodeInternal, "更新失败")
 				return
 			}
-
 			if result.RowsAffected == 0 {
-				c.JSON(404, gin.H{"code": 1, "message": "钱包地址更新失败"})
+				fail(c, http.StatusNotFound, CodeNotFound, "商户不存在")
 				return
 			}
+			s.audit(c, "merchant.update", merchantId, maskSecrets(updates, "SecretKey"))
 
 			c.JSON(200, gin.H{"code": 0, "message": "更新成功"})
-
 		})
 
-		// 删除钱包地址
-		admin.DELETE("/api/wallets/:id", func(c *gin.Context) {
-			walletId := c.Param("id")
+		// 删除商户，已经创建的订单回调改用系统设置的密钥签名
+		admin.DELETE("/api/merchants/:id", s.Require(PermMerchants), func(c *gin.Context) {
+			merchantId := c.Param("id")
+			var merchant sdb.Merchant
+			s.store.DB.Where("id = ?", merchantId).Limit(1).Find(&merchant)
 
-			// 删除钱包地址
-			result := sdb.DB.Delete(&sdb.WalletAddress{}, walletId)
+			result := s.store.DB.Delete(&sdb.Merchant{}, merchantId)
 			if result.Error != nil {
-				c.JSON(500, gin.H{"code": 1, "message": "删除失败"})
+				fail(c, http.StatusInternalServerError, CodeInternal, "删除失败")
 				return
 			}
-
 			if result.RowsAffected == 0 {
-				c.JSON(404, gin.H{"code": 1, "message": "钱包地址不存在"})
+				fail(c, http.StatusNotFound, CodeNotFound, "商户不存在")
 				return
 			}
+			s.audit(c, "merchant.delete", merchantId, gin.H{"name": merchant.Name})
 
 			c.JSON(200, gin.H{"code": 0, "message": "删除成功"})
-
 		})
 
 		// 系统设置管理API
 		// 获取系统设置
-		admin.GET("/api/settings", func(c *gin.Context) {
+		admin.GET("/api/settings", s.Require(PermSettings), func(c *gin.Context) {
 			var setting sdb.Setting
-			result := sdb.DB.First(&setting)
+			result := s.store.DB.First(&setting)
 			if result.Error != nil {
-				c.JSON(500, gin.H{
-					"code": -1,
-					"msg":  "获取系统设置失败",
-				})
+				fail(c, http.StatusInternalServerError, CodeInternal, "获取系统设置失败")
 				return
 			}
 			if result.RowsAffected == 0 {
-				c.JSON(500, gin.H{
-					"code": -1,
-					"msg":  "系统设置不存在",
-				})
+				fail(c, http.StatusInternalServerError, CodeInternal, "系统设置不存在")
 				return
 			}
 			c.JSON(http.StatusOK, gin.H{
@@ -496,18 +555,18 @@ func Start() {
 		})
 
 		// 保存系统设置
-		admin.POST("/api/settings", func(c *gin.Context) {
+		admin.POST("/api/settings", s.Require(PermSettings), func(c *gin.Context) {
 			var req map[string]interface{}
 			if err := c.ShouldBindJSON(&req); err != nil {
-				c.JSON(400, gin.H{"code": 1, "message": "参数错误"})
+				fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
 				return
 			}
 
 			// 获取当前设置
 			var setting sdb.Setting
-			result := sdb.DB.First(&setting)
+			result := s.store.DB.First(&setting)
 			if result.Error != nil {
-				c.JSON(500, gin.H{"code": 1, "message": "获取当前设置失败"})
+				fail(c, http.StatusInternalServerError, CodeInternal, "获取当前设置失败")
 				return
 			}
 
@@ -519,66 +578,61 @@ func Start() {
 				if name, ok := appname.(string); ok && name != "" {
 					updates["AppName"] = name
 				} else {
-					c.JSON(400, gin.H{"code": 1, "message": "应用名称不能为空"})
+					fail(c, http.StatusBadRequest, CodeValidationFailed, "应用名称不能为空")
 					return
 				}
 			}
 			if customerservicecontact, ok := req["customerservicecontact"]; ok {
 				updates["CustomerServiceContact"] = customerservicecontact
 			}
-			if appurl, ok := req["appurl"]; ok {
-				if url, ok := appurl.(string); ok && url != "" {
-					updates["AppUrl"] = url
-				} else {
-					c.JSON(400, gin.H{"code": 1, "message": "应用地址不能为空"})
+			if language, ok := req["language"]; ok {
+				lang, _ := language.(string)
+				if i18n.Normalize(lang) == "" {
+					fail(c, http.StatusBadRequest, CodeValidationFailed, "不支持的语言")
 					return
 				}
+				updates["Language"] = i18n.Normalize(lang)
 			}
-			if httpport, ok := req["httpport"]; ok {
-				if port, ok := httpport.(float64); ok && port >= 1 && port <= 65535 {
-					updates["Httpport"] = int(port)
-				} else {
-					c.JSON(400, gin.H{"code": 1, "message": "HTTP端口必须在1-65535之间"})
+			if legacyapierrors, ok := req["legacyapierrors"]; ok {
+				legacy, ok := legacyapierrors.(bool)
+				if !ok {
+					fail(c, http.StatusBadRequest, CodeValidationFailed, "下单接口错误格式参数错误")
 					return
 				}
+				updates["LegacyApiErrors"] = legacy
 			}
-			if secretkey, ok := req["secretkey"]; ok {
-				updates["SecretKey"] = secretkey
-			}
-			if expirationdate, ok := req["expirationdate"]; ok {
-				if expiration, ok := expirationdate.(float64); ok && expiration > 0 {
-					updates["ExpirationDate"] = time.Duration(int64(expiration))
-				} else {
-					c.JSON(400, gin.H{"code": 1, "message": "过期时间必须大于0"})
+			if metricstoken, ok := req["metricstoken"]; ok {
+				token, ok := metricstoken.(string)
+				if !ok {
+					fail(c, http.StatusBadRequest, CodeValidationFailed, "监控令牌参数错误")
 					return
 				}
+				updates["MetricsToken"] = strings.TrimSpace(token)
 			}
-
-			// Redis设置
-			if redishost, ok := req["redishost"]; ok {
-				if host, ok := redishost.(string); ok && host != "" {
-					updates["Redishost"] = host
-				} else {
-					c.JSON(400, gin.H{"code": 1, "message": "Redis主机不能为空"})
+			if metricspublic, ok := req["metricspublic"]; ok {
+				public, ok := metricspublic.(bool)
+				if !ok {
+					fail(c, http.StatusBadRequest, CodeValidationFailed, "监控接口访问方式参数错误")
 					return
 				}
+				updates["MetricsPublic"] = public
 			}
-			if redisport, ok := req["redisport"]; ok {
-				if port, ok := redisport.(float64); ok && port >= 1 && port <= 65535 {
-					updates["Redisport"] = int(port)
+			if appurl, ok := req["appurl"]; ok {
+				if url, ok := appurl.(string); ok && url != "" {
+					updates["AppUrl"] = url
 				} else {
-					c.JSON(400, gin.H{"code": 1, "message": "Redis端口必须在1-65535之间"})
+					fail(c, http.StatusBadRequest, CodeValidationFailed, "应用地址不能为空")
 					return
 				}
 			}
-			if redispasswd, ok := req["redispasswd"]; ok {
-				updates["Redispasswd"] = redispasswd
+			if secretkey, ok := req["secretkey"]; ok {
+				updates["SecretKey"] = secretkey
 			}
-			if redisdb, ok := req["redisdb"]; ok {
-				if db, ok := redisdb.(float64); ok && db >= 0 && db <= 15 {
-					updates["Redisdb"] = int(db)
+			if expirationdate, ok := req["expirationdate"]; ok {
+				if expiration, ok := expirationdate.(float64); ok && expiration > 0 {
+					updates["ExpirationDate"] = time.Duration(int64(expiration))
 				} else {
-					c.JSON(400, gin.H{"code": 1, "message": "Redis数据库编号必须在0-15之间"})
+					fail(c, http.StatusBadRequest, CodeValidationFailed, "过期时间必须大于0")
 					return
 				}
 			}
@@ -594,70 +648,253 @@ func Start() {
 				updates["Barkkey"] = barkkey
 			}
 
-			// 执行更新
+			// 汇率设置
+			if rateproviders, ok := req["rateproviders"]; ok {
+				providers, ok := rateproviders.(string)
+				if !ok || strings.TrimSpace(providers) == "" {
+					fail(c, http.StatusBadRequest, CodeValidationFailed, "汇率数据源不能为空")
+					return
+				}
+				for _, name := range strings.Split(providers, ",") {
+					switch strings.TrimSpace(name) {
+					case "okx", "binance", "htx", "static":
+					default:
+						fail(c, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("未知的汇率数据源：%s", name))
+						return
+					}
+				}
+				updates["RateProviders"] = providers
+			}
+			if ratemaxdeviation, ok := req["ratemaxdeviation"]; ok {
+				if deviation, ok := ratemaxdeviation.(float64); ok && deviation > 0 && deviation <= 100 {
+					updates["RateMaxDeviation"] = deviation
+				} else {
+					fail(c, http.StatusBadRequest, CodeValidationFailed, "数据源最大偏差必须在0-100之间")
+					return
+				}
+			}
+			if ratemaxchange, ok := req["ratemaxchange"]; ok {
+				if change, ok := ratemaxchange.(float64); ok && change > 0 && change <= 100 {
+					updates["RateMaxChange"] = change
+				} else {
+					fail(c, http.StatusBadRequest, CodeValidationFailed, "汇率最大变化必须在0-100之间")
+					return
+				}
+			}
+			if staticrates, ok := req["staticrates"]; ok {
+				rates, _ := staticrates.(string)
+				if _, err := Autoprice.ParseStaticRates(rates); err != nil {
+					fail(c, http.StatusBadRequest, CodeValidationFailed, err.Error())
+					return
+				}
+				updates["StaticRates"] = rates
+			}
+
+			// 支付页面品牌设置
+			branding := setting.Branding
+			brandingFields := map[string]*string{
+				"brandlogo":    &branding.BrandLogo,
+				"primarycolor": &branding.PrimaryColor,
+				"footerhtml":   &branding.FooterHtml,
+				"supportlinks": &branding.SupportLinks,
+			}
+			brandingChanged := false
+			for key, field := range brandingFields {
+				if value, ok := req[key]; ok {
+					*field, _ = value.(string)
+					brandingChanged = true
+				}
+			}
+			if brandingChanged {
+				if msg := validateBranding(branding); msg != "" {
+					fail(c, http.StatusBadRequest, CodeValidationFailed, msg)
+					return
+				}
+				updates["BrandLogo"] = branding.BrandLogo
+				updates["PrimaryColor"] = branding.PrimaryColor
+				updates["FooterHtml"] = branding.FooterHtml
+				updates["SupportLinks"] = branding.SupportLinks
+			}
+
+			// 执行更新，保存后立即刷新设置缓存，不需要重启
 			if len(updates) > 0 {
-				result := sdb.DB.Model(&setting).Where("id = ?", setting.ID).Updates(updates)
-				if result.Error != nil {
-					c.JSON(500, gin.H{"code": 1, "message": "保存失败"})
+				if _, err := s.store.UpdateSetting(setting.ID, updates); err != nil {
+					mylog.Logger.Error("保存系统设置失败", zap.Error(err))
+					fail(c, http.StatusInternalServerError, CodeInternal, "保存失败")
 					return
 				}
+				s.audit(c, "setting.update", "", maskSecrets(updates, "SecretKey", "Tgbotkey", "Barkkey", "MetricsToken"))
 			}
 
 			c.JSON(200, gin.H{"code": 0, "message": "保存成功"})
 		})
 
+		// 重新加载启动配置，HTTP 端口和 Redis 连接立即生效，不需要重启
+		admin.POST("/api/config/reload", s.Require(PermSettings), func(c *gin.Context) {
+			restart, err := config.Reload()
+			if err != nil {
+				mylog.Logger.Error("重新加载启动配置失败", zap.Error(err))
+				fail(c, http.StatusInternalServerError, CodeInternal, "重新加载启动配置失败："+err.Error())
+				return
+			}
+			if restart == nil {
+				restart = []string{}
+			}
+			cfg, file := config.Get(), config.File()
+			mylog.Logger.Info("启动配置已重新加载", zap.String("file", file), zap.Strings("restart_required", restart))
+			s.audit(c, "config.reload", file, gin.H{"restart_required": restart})
+			c.JSON(http.StatusOK, gin.H{
+				"code":    0,
+				"message": "重新加载成功",
+				"data": gin.H{
+					"file":             file,
+					"http_port":        cfg.HTTP.Port,
+					"redis":            cfg.RedisAddr(),
+					"restart_required": restart,
+				},
+			})
+		})
+
 		// 手动补单
-		admin.POST("/api/manual-complete-order", func(c *gin.Context) {
+		admin.POST("/api/manual-complete-order", s.Require(PermOrders), func(c *gin.Context) {
 			var req struct {
 				OrderID string `json:"order_id" validate:"required"`
 			}
 			if err := c.ShouldBindJSON(&req); err != nil {
-				c.JSON(400, gin.H{"code": 1, "message": "参数绑定错误"})
+				fail(c, http.StatusBadRequest, CodeBadRequest, "参数绑定错误")
 				return
 			}
 			// validate := validator.New()
 			// 验证参数是否符合要求
 			err := validate.Struct(req)
 			if err != nil {
-				c.JSON(400, gin.H{"code": 1, "message": "参数验证错误"})
+				fail(c, http.StatusBadRequest, CodeValidationFailed, "参数验证错误")
 				return
 			}
 			var order sdb.Orders
 			// 通过订单号或者商城订单号查询最新的那条记录
-			sdb.DB.Where("order_id = ?", req.OrderID).Or("trade_id = ?", req.OrderID).Order("id DESC").First(&order)
+			s.store.DB.Where("order_id = ?", req.OrderID).Or("trade_id = ?", req.OrderID).Order("id DESC").First(&order)
 			if order.ID == 0 {
-				c.JSON(400, gin.H{"code": 1, "message": "订单不存在"})
+				fail(c, http.StatusBadRequest, CodeValidationFailed, "订单不存在")
 				return
 			}
+			// 已支付的订单可以再次补单重新发送回调，只统计第一次支付成功
+			paidBefore := order.Status == sdb.StatusPaySuccess
 			order.Status = sdb.StatusPaySuccess
-			result := sdb.DB.Save(&order)
+			result := s.store.DB.Save(&order)
 			if result.Error != nil {
-				c.JSON(500, gin.H{"code": 1, "message": "保存失败"})
+				fail(c, http.StatusInternalServerError, CodeInternal, "保存失败")
 				return
 			}
+			if !paidBefore {
+				metrics.OrdersPaid.WithLabelValues(metrics.CurrencyLabel(order.Type)).Inc()
+			}
 			mylog.Logger.Info("订单已手动完成", zap.Any("order_id", order.OrderId))
-			// 异步回调
-			go cron.ProcessCallback(order)
+			s.audit(c, "order.manual_complete", order.TradeId, gin.H{"order_id": order.OrderId, "amount": order.Amount})
+			// 通知支付页面并异步回调
+			s.jobs.Paid(order.TradeId)
 			c.JSON(200, gin.H{"code": 0, "message": "订单已手动完成"})
 		})
 
+		// 沙盒订单模拟支付
+		admin.POST("/api/simulate-payment", s.Require(PermOrders), s.AdminSimulatePayment)
+
+		// 币种汇率策略API
+		admin.GET("/api/currencies", s.Require(PermView), func(c *gin.Context) {
+			var currencies []sdb.Currency
+			result := s.store.DB.Order("name ASC").Find(&currencies)
+			if result.Error != nil {
+				fail(c, http.StatusInternalServerError, CodeInternal, "获取币种列表失败")
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"code": 0,
+				"msg":  "success",
+				"data": currencies,
+			})
+		})
+
+		// 保存币种汇率和汇率策略，不存在则创建
+		admin.PUT("/api/currencies/:name", s.Require(PermRates), func(c *gin.Context) {
+			name := c.Param("name")
+			var req sdb.Currency
+			if err := c.ShouldBindJSON(&req); err != nil {
+				fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
+				return
+			}
+
+			if req.Rate <= 0 && !req.AutoRate {
+				fail(c, http.StatusBadRequest, CodeValidationFailed, "汇率必须大于0")
+				return
+			}
+
+			switch req.Rounding {
+			case sdb.RoundingNone, sdb.RoundingNearest, sdb.RoundingUp, sdb.RoundingDown:
+			default:
+				fail(c, http.StatusBadRequest, CodeValidationFailed, "取整方向只能是 nearest、up、down 或留空")
+				return
+			}
+			if req.RoundingDecimals < 0 || req.RoundingDecimals > 8 {
+				fail(c, http.StatusBadRequest, CodeValidationFailed, "取整小数位数必须在0-8之间")
+				return
+			}
+			if req.MarkupPercent <= -100 {
+				fail(c, http.StatusBadRequest, CodeValidationFailed, "加价百分比必须大于-100")
+				return
+			}
+			if req.MinRate < 0 || req.MaxRate < 0 {
+				fail(c, http.StatusBadRequest, CodeValidationFailed, "最低和最高汇率不能小于0")
+				return
+			}
+			if req.MinRate > 0 && req.MaxRate > 0 && req.MinRate > req.MaxRate {
+				fail(c, http.StatusBadRequest, CodeValidationFailed, "最低汇率不能大于最高汇率")
+				return
+			}
+
+			currency := s.store.GetCurrency(name)
+			currency.MarkupPercent = req.MarkupPercent
+			currency.FixedOffset = req.FixedOffset
+			currency.MinRate = req.MinRate
+			currency.MaxRate = req.MaxRate
+			currency.Rounding = req.Rounding
+			currency.RoundingDecimals = req.RoundingDecimals
+			currency.AutoRate = req.AutoRate
+			currency.Rate = req.Rate
+
+			// 自动汇率时数据源的原始汇率，用于记录汇率历史
+			var marketRate float64
+			if currency.AutoRate {
+				mylog.Logger.Info("自动汇率已启用", zap.String("币种", name))
+				// 获取失败时保留输入的汇率
+				currency.Rate, marketRate = s.currentAutoRate(currency, req.Rate)
+				if currency.Rate <= 0 {
+					fail(c, http.StatusBadRequest, CodeValidationFailed, "获取自动汇率失败，请先手动输入汇率")
+					return
+				}
+			}
+
+			// Save 在 ID 为 0 时创建记录
+			if err := s.store.DB.Save(&currency).Error; err != nil {
+				fail(c, http.StatusInternalServerError, CodeInternal, "保存失败")
+				return
+			}
+			s.store.RecordRate(currency.Name, currency.Rate, marketRate, rateSource(currency.AutoRate))
+			s.audit(c, "currency.update", currency.Name, currency)
+
+			c.JSON(200, gin.H{"code": 0, "message": "保存成功", "data": currency})
+		})
+
 		// API密钥管理API
 		// 获取波场和以太坊API密钥
-		admin.GET("/api/apikeys", func(c *gin.Context) {
+		admin.GET("/api/apikeys", s.Require(PermAPIKeys), func(c *gin.Context) {
 			var apiKey sdb.ApiKey
-			result := sdb.DB.First(&apiKey)
+			result := s.store.DB.First(&apiKey)
 			if result.Error != nil {
-				c.JSON(500, gin.H{
-					"code": -1,
-					"msg":  "获取API密钥失败",
-				})
+				fail(c, http.StatusInternalServerError, CodeInternal, "获取API密钥失败")
 				return
 			}
 			if result.RowsAffected == 0 {
-				c.JSON(500, gin.H{
-					"code": -1,
-					"msg":  "API密钥不存在",
-				})
+				fail(c, http.StatusInternalServerError, CodeInternal, "API密钥不存在")
 				return
 			}
 			c.JSON(http.StatusOK, gin.H{
@@ -668,18 +905,18 @@ func Start() {
 		})
 
 		// 保存API密钥
-		admin.POST("/api/apikeys", func(c *gin.Context) {
+		admin.POST("/api/apikeys", s.Require(PermAPIKeys), func(c *gin.Context) {
 			var req map[string]interface{}
 			if err := c.ShouldBindJSON(&req); err != nil {
-				c.JSON(400, gin.H{"code": 1, "message": "参数错误"})
+				fail(c, http.StatusBadRequest, CodeBadRequest, "参数错误")
 				return
 			}
 
 			// 获取当前API密钥
 			var apiKey sdb.ApiKey
-			result := sdb.DB.First(&apiKey)
+			result := s.store.DB.First(&apiKey)
 			if result.Error != nil {
-				c.JSON(500, gin.H{"code": 1, "message": "获取当前API密钥失败"})
+				fail(c, http.StatusInternalServerError, CodeInternal, "获取当前API密钥失败")
 				return
 			}
 
@@ -700,16 +937,17 @@ func Start() {
 			// 执行更新（更新获取到的apiKey记录）
 			if len(updates) > 0 {
 				// 更新获取到的apiKey变量对应的记录
-				result := sdb.DB.Model(&apiKey).Updates(updates)
+				result := s.store.DB.Model(&apiKey).Updates(updates)
 				if result.Error != nil {
-					c.JSON(500, gin.H{"code": 1, "message": "保存失败"})
+					fail(c, http.StatusInternalServerError, CodeInternal, "保存失败")
 					return
 				}
 				// 检查是否有记录被更新
 				if result.RowsAffected == 0 {
-					c.JSON(500, gin.H{"code": 1, "message": "没有找到要更新的记录"})
+					fail(c, http.StatusInternalServerError, CodeInternal, "没有找到要更新的记录")
 					return
 				}
+				s.audit(c, "apikey.update", "", maskSecrets(updates, "Tronscan", "Trongrid", "Etherscan"))
 			}
 
 			c.JSON(200, gin.H{"code": 0, "message": "保存成功"})
@@ -726,20 +964,34 @@ func Start() {
 	}
 
 	// 定义订单路由组
-	api := r.Group("/api", AuthMiddleware())
+	api := r.Group("/api", s.LegacyErrors(), s.RejectWhenDraining(), s.AuthMiddleware())
+
+	api.POST("/create_order", s.CreateTransaction)
 
-	api.POST("/create_order", CreateTransaction)
+	// 沙盒订单模拟支付，使用商户的密钥签名，参数和下单接口不同，不经过下单接口的签名中间件
+	r.POST("/api/simulate_payment", s.RejectWhenDraining(), s.SimulatePayment)
 
 	// 定义支付路由组
 	pay := r.Group("/pay")
 	// 返回支付页面【支付页面是静态页面，所以需要返回html文件】
-	pay.GET("/checkout-counter/:trade_id", CheckoutCounter)
+	pay.GET("/checkout-counter/:trade_id", s.CheckoutCounter)
 
 	// 检查订单状态
-	pay.GET("/check-status/:trade_id", CheckOrderStatus)
+	pay.GET("/check-status/:trade_id", s.CheckOrderStatus)
+
+	// 买家选择网络，分配钱包地址和支付金额
+	pay.POST("/select-network/:trade_id", s.RejectWhenDraining(), s.SelectNetwork)
+
+	// 支付二维码，内容为钱包支付链接
+	pay.GET("/qr/:trade_id", s.PaymentQRCode)
+
+	// 订单状态事件推送（SSE）
+	pay.GET("/events/:trade_id", s.PaymentEvents)
+
+	// 检查路由是否都写入了 OpenAPI 文档
+	checkOpenAPIRoutes(r.Routes())
 
-	// 读取系统设置
-	port := sdb.GetSetting().Httpport
+	// 监听端口在启动配置中设置，重新加载配置后端口有变化时切换
 	// endless.ListenAndServe(":8080", r)
-	endless.ListenAndServe(fmt.Sprintf(":%d", port), r)
+	return r
 }